@@ -0,0 +1,310 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/netguard"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Headers of the webhook requests.
+const (
+	HeaderDelivery  = "X-Alert-Delivery"
+	HeaderTimestamp = "X-Alert-Timestamp"
+	HeaderSignature = "X-Alert-Signature"
+)
+
+//dispatchBatch is the number of due deliveries read from the storage at once.
+const dispatchBatch = 50
+
+//maxResponseSize limits the part of the webhook response that is read before the connection is reused.
+const maxResponseSize = 64 << 10
+
+type storage interface {
+	GetAlertRule(id int) (*database.AlertRule, error)
+	GetAlertRules(userID int) ([]*database.AlertRule, error)
+	CreateDeliveries(deliveries []*database.AlertDelivery) error
+	UpdateDelivery(delivery *database.AlertDelivery) error
+	DueDeliveries(now int64, n int) ([]*database.AlertDelivery, error)
+	DeleteDeliveries(before int64) error
+}
+
+//Alerter matches the new posts against the alert rules of the users and delivers the matches to the webhooks.
+type Alerter struct {
+	db           storage
+	client       *http.Client
+	allowPrivate bool
+	maxAttempts  int
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	period       time.Duration
+	logTTL       time.Duration
+	wake         chan struct{}
+}
+
+//New creates a new instance Alerter. Unless cfg.AllowPrivate is set, the webhooks are sent only
+//to public addresses, see netguard.Control, and not through the proxy of the environment.
+func New(cfg config.Alerts, db storage) *Alerter {
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !cfg.AllowPrivate {
+		dialer.Control = netguard.Control
+		transport.Proxy = nil
+	}
+	transport.DialContext = dialer.DialContext
+
+	return &Alerter{
+		db:           db,
+		allowPrivate: cfg.AllowPrivate,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			//a redirected POST turns into GET, so the redirect is a failed attempt
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		maxAttempts: maxAttempts,
+		backoff:     cfg.Backoff,
+		maxBackoff:  cfg.MaxBackoff,
+		period:      cfg.Period,
+		logTTL:      cfg.LogTTL,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+//Evaluate matches the just written posts against all alert rules and queues the deliveries of the matches.
+//The posts without ids were not inserted and are skipped. The deliveries are sent by Start.
+func (a *Alerter) Evaluate(posts []*database.Post) {
+	rules, err := a.db.GetAlertRules(0)
+	if err != nil {
+		log.WithError(err).Error("failed to get alert rules")
+		return
+	}
+
+	now := time.Now().Unix()
+	deliveries := []*database.AlertDelivery{}
+
+	for _, rule := range rules {
+		m, err := newMatcher(rule)
+		if err != nil {
+			log.WithError(err).WithField("rule", rule.ID).Warn("invalid alert rule")
+			continue
+		}
+
+		for _, post := range posts {
+			if post.ID == 0 {
+				continue
+			}
+
+			matches, ok := m.match(post)
+			if !ok {
+				continue
+			}
+
+			payload, err := json.Marshal(Payload{Rule: rule.ID, Name: rule.Name, Matches: matches, Post: post})
+			if err != nil {
+				log.WithError(err).WithField("rule", rule.ID).Error("failed to encode alert")
+				continue
+			}
+
+			deliveries = append(deliveries, &database.AlertDelivery{
+				RuleID:        rule.ID,
+				PostID:        post.ID,
+				Payload:       payload,
+				Status:        database.DeliveryPending,
+				CreatedAt:     now,
+				UpdatedAt:     now,
+				NextAttemptAt: now,
+			})
+		}
+	}
+
+	if len(deliveries) == 0 {
+		return
+	}
+
+	if err = a.db.CreateDeliveries(deliveries); err != nil {
+		log.WithError(err).Error("failed to queue alert deliveries")
+		return
+	}
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Start starts a process that sends the queued deliveries as soon as Evaluate adds them
+//and every "period" retries the failed ones, whose backoff has passed.
+func (a *Alerter) Start(ctx context.Context) error {
+	for {
+		a.dispatch(ctx)
+		a.cleanup()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.wake:
+		case <-time.After(a.period):
+		}
+	}
+}
+
+//dispatch sends all deliveries that are due.
+func (a *Alerter) dispatch(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := a.db.DueDeliveries(time.Now().Unix(), dispatchBatch)
+		if err != nil {
+			log.WithError(err).Error("failed to get alert deliveries")
+			return
+		}
+
+		for _, delivery := range deliveries {
+			if err = a.deliver(ctx, delivery); err != nil {
+				log.WithError(err).WithField("delivery", delivery.ID).Error("failed to save alert delivery")
+				return
+			}
+		}
+
+		if len(deliveries) < dispatchBatch {
+			return
+		}
+	}
+}
+
+//deliver makes one attempt to send the delivery and saves its result to the delivery log.
+//After the last allowed attempt the failed delivery is not retried.
+func (a *Alerter) deliver(ctx context.Context, delivery *database.AlertDelivery) error {
+	rule, err := a.db.GetAlertRule(delivery.RuleID)
+	if errors.Is(err, database.ErrNotFound) {
+		//the rule was deleted together with its deliveries
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	code, err := a.send(ctx, rule, delivery)
+	if ctx.Err() != nil {
+		//the attempt was aborted by the shutdown, it is repeated after the restart
+		return nil
+	}
+
+	now := time.Now()
+	delivery.Attempts++
+	delivery.ResponseCode = code
+	delivery.UpdatedAt = now.Unix()
+
+	fields := log.Fields{
+		"rule":     rule.ID,
+		"delivery": delivery.ID,
+		"attempt":  delivery.Attempts,
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status = database.DeliveryDelivered
+		delivery.Error = ""
+		log.WithFields(fields).Debug("alert delivered")
+	case delivery.Attempts >= a.maxAttempts:
+		delivery.Status = database.DeliveryFailed
+		delivery.Error = err.Error()
+		log.WithError(err).WithFields(fields).Warn("alert delivery failed")
+	default:
+		delivery.Error = err.Error()
+		delivery.NextAttemptAt = now.Add(a.delay(delivery.Attempts)).Unix()
+		log.WithError(err).WithFields(fields).Info("alert delivery will be retried")
+	}
+
+	return a.db.UpdateDelivery(delivery)
+}
+
+//send posts the payload to the webhook of the rule and returns the response status.
+func (a *Alerter) send(ctx context.Context, rule *database.AlertRule, delivery *database.AlertDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rule.WebhookURL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, strconv.Itoa(delivery.ID))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(rule.Secret, timestamp, delivery.Payload))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+//delay returns the pause after the given number of failed attempts: the backoff doubled after every attempt, up to maxBackoff.
+func (a *Alerter) delay(attempts int) time.Duration {
+	delay := a.backoff
+	for i := 1; i < attempts && delay < a.maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if a.maxBackoff > 0 && delay > a.maxBackoff {
+		delay = a.maxBackoff
+	}
+
+	return delay
+}
+
+//cleanup removes the finished deliveries older than logTTL from the delivery log.
+func (a *Alerter) cleanup() {
+	if a.logTTL <= 0 {
+		return
+	}
+
+	if err := a.db.DeleteDeliveries(time.Now().Add(-a.logTTL).Unix()); err != nil {
+		log.WithError(err).Error("failed to clean alert delivery log")
+	}
+}
+
+//Sign returns the signature of the webhook request: "sha256=" and the hex encoded HMAC-SHA256
+//of the timestamp, a dot and the body, the key is the secret of the rule.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
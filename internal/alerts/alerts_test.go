@@ -0,0 +1,327 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/netguard"
+)
+
+//receiver is a local webhook that records the requests and answers with the given statuses, the last one repeats.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+
+	status := r.statuses[0]
+	if len(r.statuses) > 1 {
+		r.statuses = r.statuses[1:]
+	}
+
+	w.WriteHeader(status)
+}
+
+func testAlerter(t *testing.T, statuses ...int) (*Alerter, *database.Memdb, *receiver, *database.AlertRule) {
+	db := database.NewMemoryDB()
+	user := &database.User{Login: "reader", PasswordHash: "hash"}
+	assert.Nil(t, db.CreateUser(user, false))
+
+	r := &receiver{statuses: statuses}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	rule := &database.AlertRule{
+		UserID:     user.ID,
+		Name:       "Go",
+		Keywords:   []string{"Golang"},
+		Feeds:      []string{"https://go.dev/feed"},
+		WebhookURL: server.URL,
+		Secret:     "secret",
+	}
+	assert.Nil(t, db.CreateAlertRule(rule))
+
+	//the local receiver lives on the loopback
+	alerter := New(config.Alerts{MaxAttempts: 3, Timeout: time.Second, Period: time.Minute, AllowPrivate: true}, db)
+
+	return alerter, db, r, rule
+}
+
+func testPosts(t *testing.T, db *database.Memdb) []*database.Post {
+	posts := []*database.Post{
+		{Title: "Golang 1.18 is released", PubTime: 1650000000, Link: "1", Feed: "https://go.dev/feed"},
+		{Title: "Rust", PlainText: "Not about golang", PubTime: 1650000000, Link: "2", Feed: "https://go.dev/feed"},
+		{Title: "Golang elsewhere", PubTime: 1650000000, Link: "3", Feed: "https://example.com/feed"},
+		{Title: "Python", PubTime: 1650000000, Link: "4", Feed: "https://go.dev/feed"},
+	}
+	assert.Nil(t, db.WriteNews(posts))
+
+	return posts
+}
+
+func TestMatcher(t *testing.T) {
+	post := &database.Post{
+		Title:     "Go 1.18 brings generics",
+		PlainText: "The release of go1.18 is out.",
+		Feed:      "https://go.dev/feed",
+	}
+
+	tests := []struct {
+		name    string
+		rule    database.AlertRule
+		matches []string
+		ok      bool
+	}{
+		{"keyword", database.AlertRule{Keywords: []string{"GENERICS", "rust"}}, []string{"generics"}, true},
+		{"keyword in text", database.AlertRule{Keywords: []string{"release"}}, []string{"release"}, true},
+		{"no keyword", database.AlertRule{Keywords: []string{"rust"}}, nil, false},
+		{"regex", database.AlertRule{Regex: `go1\.\d+`}, []string{"go1.18"}, true},
+		{"regex is case-sensitive", database.AlertRule{Regex: `GO1`}, nil, false},
+		{"keyword and regex", database.AlertRule{Keywords: []string{"go"}, Regex: `Python`}, nil, false},
+		{"feed", database.AlertRule{Keywords: []string{"go"}, Feeds: []string{"https://go.dev/feed"}}, []string{"go"}, true},
+		{"other feed", database.AlertRule{Keywords: []string{"go"}, Feeds: []string{"https://example.com/feed"}}, nil, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		m, err := newMatcher(&tt.rule)
+		if !assert.Nil(t, err, tt.name) {
+			continue
+		}
+
+		matches, ok := m.match(post)
+		assert.Equal(t, tt.ok, ok, tt.name)
+		assert.Equal(t, tt.matches, matches, tt.name)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	rule := &database.AlertRule{
+		Keywords:   []string{" go ", "", "go"},
+		Feeds:      []string{""},
+		WebhookURL: "https://hooks.example.com/news",
+	}
+	assert.Nil(t, Validate(rule))
+	assert.Equal(t, []string{"go"}, rule.Keywords)
+	assert.Equal(t, []string{}, rule.Feeds)
+
+	tests := []struct {
+		name string
+		rule database.AlertRule
+	}{
+		{"empty", database.AlertRule{Keywords: []string{" "}, WebhookURL: "https://example.com"}},
+		{"regex", database.AlertRule{Regex: `go(`, WebhookURL: "https://example.com"}},
+		{"no url", database.AlertRule{Keywords: []string{"go"}}},
+		{"scheme", database.AlertRule{Keywords: []string{"go"}, WebhookURL: "ftp://example.com"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		assert.NotNil(t, Validate(&tt.rule), tt.name)
+	}
+}
+
+func TestAlerter_Validate(t *testing.T) {
+	guarded := New(config.Alerts{}, database.NewMemoryDB())
+
+	for _, link := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.1/hook",
+		"http://[::1]/hook",
+		"http://localhost/hook",
+	} {
+		rule := &database.AlertRule{Keywords: []string{"go"}, WebhookURL: link}
+		assert.ErrorIs(t, guarded.Validate(context.Background(), rule), netguard.ErrPrivateAddress, link)
+	}
+
+	rule := &database.AlertRule{Keywords: []string{"go"}, WebhookURL: "https://93.184.216.34/hook"}
+	assert.Nil(t, guarded.Validate(context.Background(), rule))
+
+	//the common checks still apply
+	rule = &database.AlertRule{WebhookURL: "https://93.184.216.34/hook"}
+	assert.ErrorIs(t, guarded.Validate(context.Background(), rule), ErrEmptyRule)
+
+	allowed := New(config.Alerts{AllowPrivate: true}, database.NewMemoryDB())
+	rule = &database.AlertRule{Keywords: []string{"go"}, WebhookURL: "http://127.0.0.1:8080/hook"}
+	assert.Nil(t, allowed.Validate(context.Background(), rule))
+}
+
+func TestAlerter_PrivateDelivery(t *testing.T) {
+	_, db, r, rule := testAlerter(t, http.StatusOK)
+
+	//a rule stored before the check or a name that resolves to the loopback later is refused by the dialer
+	alerter := New(config.Alerts{MaxAttempts: 1, Timeout: time.Second, Period: time.Minute}, db)
+	alerter.Evaluate(testPosts(t, db)[:1])
+	alerter.dispatch(context.Background())
+
+	deliveries, err := db.GetDeliveries(rule.ID, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(deliveries)) {
+		assert.Equal(t, database.DeliveryFailed, deliveries[0].Status)
+		assert.Contains(t, deliveries[0].Error, netguard.ErrPrivateAddress.Error())
+	}
+	assert.Empty(t, r.requests)
+}
+
+func TestAlerter_Evaluate(t *testing.T) {
+	alerter, db, r, rule := testAlerter(t, http.StatusOK)
+	posts := testPosts(t, db)
+
+	//the posts that were not inserted are skipped
+	posts = append(posts, &database.Post{Title: "Golang duplicate", Feed: "https://go.dev/feed"})
+
+	alerter.Evaluate(posts)
+	alerter.dispatch(context.Background())
+
+	deliveries, err := db.GetDeliveries(rule.ID, 10)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 2, len(deliveries)) {
+		return
+	}
+
+	for _, delivery := range deliveries {
+		assert.Equal(t, database.DeliveryDelivered, delivery.Status)
+		assert.Equal(t, 1, delivery.Attempts)
+		assert.Equal(t, http.StatusOK, delivery.ResponseCode)
+	}
+
+	if !assert.Equal(t, 2, len(r.requests)) {
+		return
+	}
+
+	req, body := r.requests[0], r.bodies[0]
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(deliveries[1].ID), req.Header.Get(HeaderDelivery))
+
+	//the receiver checks the signature with the shared secret
+	timestamp, err := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, Sign("secret", timestamp, body), req.Header.Get(HeaderSignature))
+	assert.NotEqual(t, Sign("other", timestamp, body), req.Header.Get(HeaderSignature))
+
+	var payload Payload
+	assert.Nil(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, rule.ID, payload.Rule)
+	assert.Equal(t, []string{"golang"}, payload.Matches)
+	assert.Equal(t, "Golang 1.18 is released", payload.Post.Title)
+	assert.Equal(t, posts[0].ID, payload.Post.ID)
+}
+
+func TestAlerter_Retry(t *testing.T) {
+	alerter, db, r, rule := testAlerter(t, http.StatusInternalServerError, http.StatusOK)
+	alerter.backoff = time.Hour
+	alerter.maxBackoff = time.Hour
+
+	alerter.Evaluate(testPosts(t, db)[:1])
+	alerter.dispatch(context.Background())
+
+	deliveries, err := db.GetDeliveries(rule.ID, 10)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 1, len(deliveries)) {
+		return
+	}
+
+	delivery := deliveries[0]
+	assert.Equal(t, database.DeliveryPending, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, delivery.ResponseCode)
+	assert.Equal(t, "unexpected status 500 Internal Server Error", delivery.Error)
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), delivery.NextAttemptAt, 5)
+
+	//the backoff has not passed yet
+	alerter.dispatch(context.Background())
+	assert.Equal(t, 1, len(r.requests))
+
+	delivery.NextAttemptAt = time.Now().Unix()
+	assert.Nil(t, db.UpdateDelivery(delivery))
+	alerter.dispatch(context.Background())
+
+	deliveries, err = db.GetDeliveries(rule.ID, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, database.DeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, 2, deliveries[0].Attempts)
+	assert.Equal(t, "", deliveries[0].Error)
+	assert.Equal(t, 2, len(r.requests))
+}
+
+func TestAlerter_Failed(t *testing.T) {
+	alerter, db, r, rule := testAlerter(t, http.StatusNotFound)
+
+	alerter.Evaluate(testPosts(t, db)[:1])
+
+	//without the backoff every dispatch makes the next attempt
+	for i := 0; i < 5; i++ {
+		alerter.dispatch(context.Background())
+	}
+
+	deliveries, err := db.GetDeliveries(rule.ID, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(deliveries)) {
+		assert.Equal(t, database.DeliveryFailed, deliveries[0].Status)
+		assert.Equal(t, 3, deliveries[0].Attempts)
+		assert.Equal(t, http.StatusNotFound, deliveries[0].ResponseCode)
+	}
+	assert.Equal(t, 3, len(r.requests))
+
+	due, err := db.DueDeliveries(time.Now().Add(time.Hour).Unix(), 10)
+	assert.Nil(t, err)
+	assert.Empty(t, due)
+}
+
+func TestAlerter_Start(t *testing.T) {
+	alerter, db, r, rule := testAlerter(t, http.StatusOK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- alerter.Start(ctx)
+	}()
+
+	//Evaluate wakes up the dispatcher without waiting for the period
+	alerter.Evaluate(testPosts(t, db))
+
+	assert.Eventually(t, func() bool {
+		deliveries, _ := db.GetDeliveries(rule.ID, 10)
+		return len(deliveries) == 2 && deliveries[0].Status == database.DeliveryDelivered &&
+			deliveries[1].Status == database.DeliveryDelivered
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.Equal(t, 2, len(r.requests))
+}
+
+func TestAlerter_Delay(t *testing.T) {
+	alerter := New(config.Alerts{Backoff: 30 * time.Second, MaxBackoff: 5 * time.Minute}, database.NewMemoryDB())
+
+	assert.Equal(t, 30*time.Second, alerter.delay(1))
+	assert.Equal(t, time.Minute, alerter.delay(2))
+	assert.Equal(t, 4*time.Minute, alerter.delay(4))
+	assert.Equal(t, 5*time.Minute, alerter.delay(5))
+	assert.Equal(t, 5*time.Minute, alerter.delay(100))
+}
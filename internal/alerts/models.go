@@ -0,0 +1,11 @@
+package alerts
+
+import "github.com/MarySmirnova/news_reader/internal/database"
+
+//Payload is the JSON body of the webhook request.
+type Payload struct {
+	Rule    int            // номер правила
+	Name    string         // название правила
+	Matches []string       // совпавшие ключевые слова и текст, найденный регулярным выражением
+	Post    *database.Post // новая запись
+}
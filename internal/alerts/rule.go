@@ -0,0 +1,138 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/netguard"
+)
+
+//ErrEmptyRule is returned by Validate for a rule without keywords and regex, such a rule would match every post.
+var ErrEmptyRule = errors.New("the rule needs keywords or a regex")
+
+//Validate checks the rule before it is stored, the keywords and the feeds are trimmed and the empty ones are removed.
+func Validate(rule *database.AlertRule) error {
+	rule.Keywords = trimList(rule.Keywords)
+	rule.Feeds = trimList(rule.Feeds)
+	rule.Regex = strings.TrimSpace(rule.Regex)
+
+	if len(rule.Keywords) == 0 && rule.Regex == "" {
+		return ErrEmptyRule
+	}
+
+	if _, err := newMatcher(rule); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(rule.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q", rule.WebhookURL)
+	}
+
+	return nil
+}
+
+//Validate checks the rule like the package Validate and, unless the private webhooks are allowed,
+//refuses the webhooks on loopback, private and link-local addresses. DNS may change after the rule
+//is saved, so the address is checked again by the client on every request.
+func (a *Alerter) Validate(ctx context.Context, rule *database.AlertRule) error {
+	if err := Validate(rule); err != nil {
+		return err
+	}
+
+	if a.allowPrivate {
+		return nil
+	}
+
+	u, _ := url.Parse(rule.WebhookURL)
+	return netguard.CheckHost(ctx, u.Hostname())
+}
+
+//matcher checks the posts against one rule.
+type matcher struct {
+	rule     *database.AlertRule
+	keywords []string
+	regex    *regexp.Regexp
+}
+
+func newMatcher(rule *database.AlertRule) (*matcher, error) {
+	m := &matcher{rule: rule}
+
+	for _, keyword := range rule.Keywords {
+		m.keywords = append(m.keywords, strings.ToLower(keyword))
+	}
+
+	if rule.Regex != "" {
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		m.regex = regex
+	}
+
+	return m, nil
+}
+
+//match returns the keywords and the text of the regex found in the title and the text of the post.
+//The post matches, if it comes from one of the rule feeds, contains any of the keywords and matches the regex.
+//The keywords are compared case-insensitively, the regex is applied as is.
+func (m *matcher) match(post *database.Post) ([]string, bool) {
+	if len(m.rule.Feeds) > 0 && !contains(m.rule.Feeds, post.Feed) {
+		return nil, false
+	}
+
+	text := post.Title + "\n" + post.PlainText
+	matches := []string{}
+
+	if len(m.keywords) > 0 {
+		lower := strings.ToLower(text)
+		for _, keyword := range m.keywords {
+			if strings.Contains(lower, keyword) {
+				matches = append(matches, keyword)
+			}
+		}
+
+		if len(matches) == 0 {
+			return nil, false
+		}
+	}
+
+	if m.regex != nil {
+		loc := m.regex.FindStringIndex(text)
+		if loc == nil {
+			return nil, false
+		}
+
+		matches = append(matches, text[loc[0]:loc[1]])
+	}
+
+	return matches, true
+}
+
+func trimList(list []string) []string {
+	trimmed := []string{}
+
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item != "" && !contains(trimmed, item) {
+			trimmed = append(trimmed, item)
+		}
+	}
+
+	return trimmed
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
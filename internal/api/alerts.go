@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+)
+
+//deliveryLogSize is the number of the latest deliveries returned by GET /me/alerts/{id}/deliveries.
+const deliveryLogSize = 100
+
+//AlertRulesHandler returns the alert rules of the current user.
+func (a *API) AlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := a.db.GetAlertRules(currentUser(r).ID)
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(rules)
+}
+
+//CreateAlertRuleHandler adds the alert rule from RequestAlertRule for the current user.
+//The response is the only place the secret of the webhook signature is returned, it is generated if not given.
+func (a *API) CreateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var req RequestAlertRule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rule := &database.AlertRule{
+		UserID:     currentUser(r).ID,
+		Name:       req.Name,
+		Keywords:   req.Keywords,
+		Regex:      req.Regex,
+		Feeds:      req.Feeds,
+		WebhookURL: req.WebhookURL,
+		Secret:     req.Secret,
+		CreatedAt:  time.Now().Unix(),
+	}
+
+	if err := a.alerts.Validate(r.Context(), rule); err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if rule.Secret == "" {
+		secret, err := newToken()
+		if err != nil {
+			a.writeResponseError(w, err, http.StatusInternalServerError)
+			return
+		}
+		rule.Secret = secret
+	}
+
+	if err := a.db.CreateAlertRule(rule); err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusCreated))
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(ResponseAlertRule{AlertRule: rule, Secret: rule.Secret})
+}
+
+//DeleteAlertRuleHandler removes the alert rule of the current user with its delivery log.
+func (a *API) DeleteAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err = a.db.DeleteAlertRule(currentUser(r).ID, id); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusNoContent))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//DeliveriesHandler returns the delivery log of the alert rule of the current user, the newest first.
+func (a *API) DeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	rule, err := a.db.GetAlertRule(id)
+	if err == nil && rule.UserID != currentUser(r).ID {
+		err = database.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := a.db.GetDeliveries(id, deliveryLogSize)
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(deliveries)
+}
@@ -0,0 +1,415 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+)
+
+const ContextUserKey ContextKey = "user"
+
+//sessionCookie is the name of the cookie with the session token, the same token is accepted in "Authorization: Bearer".
+const sessionCookie = "session"
+
+//Password limits, bcrypt ignores everything after 72 bytes.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+var (
+	errUnauthorized       = errors.New("authentication required")
+	errForbidden          = errors.New("access denied")
+	errInvalidCredentials = errors.New("invalid login or password")
+	errInvalidLogin       = errors.New("login must be 3-64 characters: latin letters, digits, '.', '_' or '-'")
+	errInvalidPassword    = fmt.Errorf("password must be %d-%d bytes long", minPasswordLength, maxPasswordLength)
+	errRegistrationClosed = errors.New("registration is closed")
+	errUnreadAnonymous    = errors.New("the unread filter requires a login")
+)
+
+//access is the level required to call the route.
+type access int
+
+const (
+	accessPublic access = iota // без входа
+	accessRead                 // без входа, если разрешено анонимное чтение
+	accessUser                 // любой вошедший пользователь
+	accessAdmin                // только администратор
+)
+
+//routeAccess maps the route names to the access levels, the routes missing here require a login.
+var routeAccess = map[string]access{
+	"webapp":               accessPublic,
+	"register":             accessPublic,
+	"login":                accessPublic,
+	"get_some_last_news":   accessRead,
+	"get_all_news":         accessRead,
+	"stream_news":          accessRead,
+	"socket_news":          accessRead,
+	"get_news_by_id":       accessRead,
+	"get_tags":             accessRead,
+	"get_feeds":            accessRead,
+	"get_feed_icon":        accessRead,
+	"get_retention_report": accessAdmin,
+	//the tags are shared by all users, so only the admin changes them
+	"add_news_tags":   accessAdmin,
+	"remove_news_tag": accessAdmin,
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+//authMiddleware checks the session of the request against the access level of the route
+//and puts the user into the request context.
+func (a *API) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level := accessUser
+		if route := mux.CurrentRoute(r); route != nil {
+			if l, ok := routeAccess[route.GetName()]; ok {
+				level = l
+			}
+		}
+
+		user, err := a.authenticate(r)
+		if err != nil {
+			a.writeResponseError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		switch {
+		case level == accessPublic:
+		case level == accessRead && a.cfg.AnonymousRead:
+		case user == nil:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="news_reader"`)
+			a.writeResponseError(w, errUnauthorized, http.StatusUnauthorized)
+			return
+		case level == accessAdmin && !user.Admin:
+			a.writeResponseError(w, errForbidden, http.StatusForbidden)
+			return
+		}
+
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), ContextUserKey, user))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//authenticate returns the owner of the session token sent with the request.
+//A missing, unknown or expired token gives no user and no error.
+func (a *API) authenticate(r *http.Request) (*database.User, error) {
+	token := requestToken(r)
+	if token == "" {
+		return nil, nil
+	}
+
+	session, err := a.db.GetSession(hashToken(token))
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if session.ExpiresAt <= time.Now().Unix() {
+		return nil, nil
+	}
+
+	user, err := a.db.GetUser(session.UserID)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil, nil
+	}
+
+	return user, err
+}
+
+//corsHandler allows the configured origins to call the API from a browser and answers the preflight requests.
+//It wraps the whole router, because the preflight OPTIONS requests match no route.
+func (a *API) corsHandler(next http.Handler) http.Handler {
+	origins := a.corsOrigins()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		switch {
+		case origins[origin]:
+			//the session cookie is sent only to the listed origins
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		case origins["*"]:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//corsOrigins returns the set of the configured origins, "*" stands for any origin.
+func (a *API) corsOrigins() map[string]bool {
+	origins := make(map[string]bool)
+	for _, origin := range a.cfg.CORSOrigins {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins[origin] = true
+		}
+	}
+
+	return origins
+}
+
+//RegisterHandler creates a user from RequestCredentials. Anyone may register when the registration is open,
+//otherwise only the administrator adds users. The first user may always register and becomes the administrator.
+func (a *API) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	var req RequestCredentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !a.cfg.Registration && !currentUser(r).Admin {
+		amount, err := a.db.UsersAmount()
+		if err != nil {
+			a.writeResponseError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if amount > 0 {
+			a.writeResponseError(w, errRegistrationClosed, http.StatusForbidden)
+			return
+		}
+	}
+
+	login, err := normalizeLogin(req.Login)
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength {
+		a.writeResponseError(w, errInvalidPassword, http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user := &database.User{
+		Login:        login,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now().Unix(),
+	}
+
+	//the check above is repeated by the storage, a concurrent request may have added the first user since
+	err = a.db.CreateUser(user, !a.cfg.Registration && !currentUser(r).Admin)
+	if errors.Is(err, database.ErrRegistrationClosed) {
+		a.writeResponseError(w, errRegistrationClosed, http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, database.ErrExists) {
+		a.writeResponseError(w, fmt.Errorf("login %q is taken", login), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusCreated))
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(user)
+}
+
+//LoginHandler checks RequestCredentials and opens a session. The token is returned in ResponseSession
+//for the "Authorization: Bearer" header and is set as an HttpOnly cookie for browsers.
+func (a *API) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req RequestCredentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := a.db.GetUserByLogin(strings.ToLower(strings.TrimSpace(req.Login)))
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	//an unknown login takes as long as a wrong password
+	hash := getDummyHash()
+	if user != nil {
+		hash = []byte(user.PasswordHash)
+	}
+	if err = bcrypt.CompareHashAndPassword(hash, []byte(req.Password)); err != nil || user == nil {
+		a.writeResponseError(w, errInvalidCredentials, http.StatusUnauthorized)
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	session := &database.Session{
+		TokenHash: hashToken(token),
+		UserID:    user.ID,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(a.cfg.SessionTTL).Unix(),
+	}
+	if err = a.db.CreateSession(session); err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err = a.db.DeleteExpiredSessions(now.Unix()); err != nil {
+		log.WithError(err).Warn("failed to delete expired sessions")
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Unix(session.ExpiresAt, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(ResponseSession{
+		Token:     token,
+		ExpiresAt: session.ExpiresAt,
+		User:      user,
+	})
+}
+
+//LogoutHandler closes the session of the request and removes the cookie.
+func (a *API) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.db.DeleteSession(hashToken(requestToken(r))); err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusNoContent))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//MeHandler returns the current user.
+func (a *API) MeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(currentUser(r))
+}
+
+//currentUser returns the user put into the context by authMiddleware, anonymous requests get an empty user.
+func currentUser(r *http.Request) *database.User {
+	if user, ok := r.Context().Value(ContextUserKey).(*database.User); ok {
+		return user
+	}
+
+	return &database.User{}
+}
+
+//requestToken returns the session token from the Authorization header or, if there is none, from the cookie.
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if scheme, token, ok := strings.Cut(header, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+//newToken returns a random session token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+//hashToken returns the hash the session is stored by, so the leaked table does not give the tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//normalizeLogin lowercases the login and checks its characters.
+func normalizeLogin(login string) (string, error) {
+	login = strings.ToLower(strings.TrimSpace(login))
+	if len(login) < 3 || len(login) > 64 {
+		return "", errInvalidLogin
+	}
+
+	for _, c := range login {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '.' && c != '_' && c != '-' {
+			return "", errInvalidLogin
+		}
+	}
+
+	return login, nil
+}
+
+//getDummyHash returns the hash compared with the password of an unknown login.
+func getDummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+
+	return dummyHash
+}
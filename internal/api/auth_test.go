@@ -0,0 +1,270 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+)
+
+//testRegister registers the user with the password "password" on behalf of the token owner, the token may be empty.
+func testRegister(api *API, login, token string) *http.Response {
+	body, _ := json.Marshal(RequestCredentials{Login: login, Password: "password"})
+	req, _ := http.NewRequest(http.MethodPost, "/auth/register", bytes.NewReader(body))
+
+	return execAuthRequest(req, api.httpServer, token).Result()
+}
+
+//testLogin registers the user, if it does not exist yet, and returns its session token.
+//The first registered user is the administrator.
+func testLogin(t *testing.T, api *API, login string) string {
+	if _, err := api.db.GetUserByLogin(login); err != nil {
+		admin := ""
+		if amount, _ := api.db.UsersAmount(); amount > 0 {
+			admin = testLogin(t, api, "admin")
+		}
+		assert.Equal(t, http.StatusCreated, testRegister(api, login, admin).StatusCode)
+	}
+
+	body, _ := json.Marshal(RequestCredentials{Login: login, Password: "password"})
+	req, _ := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+	resp := execRequest(req, api.httpServer)
+	if !assert.Equal(t, http.StatusOK, resp.Code) {
+		return ""
+	}
+
+	var session ResponseSession
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&session))
+
+	return session.Token
+}
+
+func TestAPI_Register(t *testing.T) {
+	api := testAPI(t)
+
+	//the first user registers freely and becomes the administrator
+	resp := testRegister(api, " Admin ", "")
+	if assert.Equal(t, http.StatusCreated, resp.StatusCode) {
+		var user database.User
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&user))
+		assert.Equal(t, "admin", user.Login)
+		assert.True(t, user.Admin)
+		assert.Empty(t, user.PasswordHash)
+	}
+
+	//the registration is closed for the others
+	assert.Equal(t, http.StatusForbidden, testRegister(api, "reader", "").StatusCode)
+
+	token := testLogin(t, api, "admin")
+	resp = testRegister(api, "reader", token)
+	if assert.Equal(t, http.StatusCreated, resp.StatusCode) {
+		var user database.User
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&user))
+		assert.False(t, user.Admin)
+	}
+
+	assert.Equal(t, http.StatusConflict, testRegister(api, "READER", token).StatusCode)
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"Login": "ab", "Password": "password"}`, http.StatusBadRequest},
+		{`{"Login": "user name", "Password": "password"}`, http.StatusBadRequest},
+		{`{"Login": "user", "Password": "short"}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "/auth/register", bytes.NewReader([]byte(tt.body)))
+		assert.Equal(t, tt.code, execAuthRequest(req, api.httpServer, token).Code, tt.body)
+	}
+
+	//an open registration
+	api.cfg.Registration = true
+	assert.Equal(t, http.StatusCreated, testRegister(api, "guest", "").StatusCode)
+}
+
+func TestAPI_RegisterAtOnce(t *testing.T) {
+	api := testAPI(t)
+
+	//the anonymous requests that all see no users yet, only the first of them is added
+	codes := make([]int, 8)
+
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = testRegister(api, "user"+strconv.Itoa(i), "").StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			created++
+			continue
+		}
+		assert.Equal(t, http.StatusForbidden, code)
+	}
+	assert.Equal(t, 1, created)
+
+	amount, err := api.db.UsersAmount()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, amount)
+}
+
+func TestAPI_LoginLogout(t *testing.T) {
+	api := testAPI(t)
+	testLogin(t, api, "admin")
+
+	for _, body := range []string{
+		`{"Login": "admin", "Password": "wrong password"}`,
+		`{"Login": "nobody", "Password": "password"}`,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader([]byte(body)))
+		assert.Equal(t, http.StatusUnauthorized, execRequest(req, api.httpServer).Code, body)
+	}
+
+	body, _ := json.Marshal(RequestCredentials{Login: "admin", Password: "password"})
+	req, _ := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+	resp := execRequest(req, api.httpServer)
+	if !assert.Equal(t, http.StatusOK, resp.Code) {
+		return
+	}
+
+	var session ResponseSession
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&session))
+	assert.NotEmpty(t, session.Token)
+	assert.Equal(t, "admin", session.User.Login)
+
+	//the token is stored only as a hash
+	_, err := api.db.GetSession(session.Token)
+	assert.ErrorIs(t, err, database.ErrNotFound)
+
+	//the browser gets the same token in the cookie
+	cookies := resp.Result().Cookies()
+	if assert.Equal(t, 1, len(cookies)) {
+		assert.Equal(t, session.Token, cookies[0].Value)
+		assert.True(t, cookies[0].HttpOnly)
+
+		req, _ = http.NewRequest(http.MethodGet, "/me", nil)
+		req.AddCookie(cookies[0])
+		resp = execRequest(req, api.httpServer)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/me", nil)
+	resp = execAuthRequest(req, api.httpServer, session.Token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		var user database.User
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&user))
+		assert.Equal(t, "admin", user.Login)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, "/auth/logout", nil)
+	assert.Equal(t, http.StatusNoContent, execAuthRequest(req, api.httpServer, session.Token).Code)
+
+	req, _ = http.NewRequest(http.MethodGet, "/me", nil)
+	assert.Equal(t, http.StatusUnauthorized, execAuthRequest(req, api.httpServer, session.Token).Code)
+}
+
+func TestAPI_Access(t *testing.T) {
+	api := testAPI(t)
+	admin := testLogin(t, api, "admin")
+	reader := testLogin(t, api, "reader")
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{http.MethodGet, "/news", "", http.StatusOK},
+		{http.MethodGet, "/news", "invalid", http.StatusOK},
+		{http.MethodGet, "/me", "", http.StatusUnauthorized},
+		{http.MethodGet, "/me", "invalid", http.StatusUnauthorized},
+		{http.MethodPost, "/news/1/tags", "", http.StatusUnauthorized},
+		{http.MethodPost, "/news/1/tags", reader, http.StatusForbidden},
+		{http.MethodPost, "/news/1/tags", admin, http.StatusOK},
+		{http.MethodDelete, "/news/1/tags/x", reader, http.StatusForbidden},
+		{http.MethodDelete, "/news/1/tags/x", admin, http.StatusOK},
+		{http.MethodGet, "/admin/retention", "", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/retention", reader, http.StatusForbidden},
+		{http.MethodGet, "/admin/retention", admin, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.path, bytes.NewReader([]byte(`{"Tags": ["x"]}`)))
+		resp := execAuthRequest(req, api.httpServer, tt.token)
+		assert.Equal(t, tt.code, resp.Code, tt.method+" "+tt.path)
+	}
+
+	//the anonymous read is an opt-in
+	api.cfg.AnonymousRead = false
+
+	req, _ := http.NewRequest(http.MethodGet, "/news", nil)
+	resp := execRequest(req, api.httpServer)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.NotEmpty(t, resp.Header().Get("WWW-Authenticate"))
+
+	req, _ = http.NewRequest(http.MethodGet, "/news", nil)
+	assert.Equal(t, http.StatusOK, execAuthRequest(req, api.httpServer, reader).Code)
+
+	//an expired session
+	assert.Nil(t, api.db.CreateSession(&database.Session{
+		TokenHash: hashToken("expired"),
+		UserID:    1,
+		CreatedAt: time.Now().Add(-2 * time.Hour).Unix(),
+		ExpiresAt: time.Now().Add(-time.Hour).Unix(),
+	}))
+	req, _ = http.NewRequest(http.MethodGet, "/news", nil)
+	assert.Equal(t, http.StatusUnauthorized, execAuthRequest(req, api.httpServer, "expired").Code)
+}
+
+func TestAPI_CORS(t *testing.T) {
+	db := database.NewMemoryDB()
+	api := New(config.API{
+		AnonymousRead: true,
+		CORSOrigins:   []string{"https://reader.example.com"},
+	}, db, nil, nil, nil, nil)
+
+	//the preflight request is answered before the routing
+	req, _ := http.NewRequest(http.MethodOptions, "/news/1/tags", nil)
+	req.Header.Set("Origin", "https://reader.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	resp := execRequest(req, api.httpServer)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "https://reader.example.com", resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, resp.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+	req, _ = http.NewRequest(http.MethodGet, "/news", nil)
+	req.Header.Set("Origin", "https://reader.example.com")
+	resp = execRequest(req, api.httpServer)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "https://reader.example.com", resp.Header().Get("Access-Control-Allow-Origin"))
+
+	//other origins get no CORS headers
+	req, _ = http.NewRequest(http.MethodGet, "/news", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	resp = execRequest(req, api.httpServer)
+	assert.Equal(t, "", resp.Header().Get("Access-Control-Allow-Origin"))
+
+	//no CORS at all by default
+	api = New(config.API{AnonymousRead: true}, db, nil, nil, nil, nil)
+	req, _ = http.NewRequest(http.MethodGet, "/news", nil)
+	req.Header.Set("Origin", "https://reader.example.com")
+	resp = execRequest(req, api.httpServer)
+	assert.Equal(t, "", resp.Header().Get("Access-Control-Allow-Origin"))
+}
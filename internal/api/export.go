@@ -0,0 +1,58 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+)
+
+//Export formats of GET /me/saved/export.
+const (
+	exportJSON     = "json"
+	exportMarkdown = "markdown"
+)
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "<", `\<`, "#", `\#`)
+
+//writeMarkdown writes the saved posts as a Markdown document: a section per post with the link, the feed,
+//the publication date, the tags and the note as a quote.
+func writeMarkdown(w io.Writer, saved []*database.SavedPost) error {
+	b := bufio.NewWriter(w)
+
+	fmt.Fprintf(b, "# Saved news\n")
+
+	for _, post := range saved {
+		title := strings.Join(strings.Fields(post.Title), " ")
+		if title == "" {
+			title = post.Link
+		}
+
+		if post.Link != "" {
+			fmt.Fprintf(b, "\n## [%s](<%s>)\n\n", markdownEscaper.Replace(title), strings.ReplaceAll(post.Link, ">", "%3E"))
+		} else {
+			fmt.Fprintf(b, "\n## %s\n\n", markdownEscaper.Replace(title))
+		}
+
+		meta := []string{time.Unix(post.PubTime, 0).UTC().Format("2006-01-02 15:04 UTC")}
+		if post.Feed != "" {
+			meta = append([]string{post.Feed}, meta...)
+		}
+		if len(post.Tags) > 0 {
+			meta = append(meta, "tags: "+strings.Join(post.Tags, ", "))
+		}
+		fmt.Fprintf(b, "%s\n", markdownEscaper.Replace(strings.Join(meta, " · ")))
+
+		if note := strings.TrimSpace(post.Note); note != "" {
+			b.WriteString("\n")
+			for _, line := range strings.Split(note, "\n") {
+				fmt.Fprintf(b, "> %s\n", strings.TrimRight(line, "\r"))
+			}
+		}
+	}
+
+	return b.Flush()
+}
@@ -1,13 +1,19 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/netguard"
+	"github.com/MarySmirnova/news_reader/internal/rss"
 	"github.com/gorilla/mux"
-	"github.com/jackc/pgx/v4"
 )
 
 //PostsHandler waits for parameter n in the request path, returns the latest n news.
@@ -31,12 +37,25 @@ func (a *API) SomePostsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 //AllPostsHandler returns a page with news found by filter.
-//Accepts "filter" and "page" parameters.
+//Accepts "filter", "page", "tag", "has_media", "media_type", "unread" and the publication period "from" and "to" parameters.
 func (a *API) AllPostsHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeNewsPage(w, r, false)
+}
+
+//MyPostsHandler returns a page with news of the feeds the current user is subscribed to.
+//Accepts the same parameters as AllPostsHandler.
+func (a *API) MyPostsHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeNewsPage(w, r, true)
+}
+
+//writeNewsPage writes the page with news found by the request parameters, optionally limited to the subscriptions.
+func (a *API) writeNewsPage(w http.ResponseWriter, r *http.Request, subscribed bool) {
 	page, filter, err := a.getPageAndFilterParams(w, r)
 	if err != nil {
 		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
 	}
+	filter.Subscribed = subscribed
 
 	itemsAmount, err := a.db.NewsAmount(filter)
 	if err != nil {
@@ -74,7 +93,7 @@ func (a *API) PostHandler(w http.ResponseWriter, r *http.Request) {
 
 	post, err := a.db.GetNewsByID(id)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
+		if errors.Is(err, database.ErrNotFound) {
 			a.writeResponseError(w, err, http.StatusBadRequest)
 			return
 		}
@@ -86,3 +105,420 @@ func (a *API) PostHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(post)
 }
+
+//AddTagsHandler attaches the tags from the request body to the news.
+func (a *API) AddTagsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var req RequestTags
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err = a.db.AddTags(id, req.Tags); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	a.writePost(w, id)
+}
+
+//RemoveTagHandler detaches the tag from the news.
+func (a *API) RemoveTagHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err = a.db.RemoveTag(id, mux.Vars(r)["tag"]); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	a.writePost(w, id)
+}
+
+//TagsHandler returns all tags with the number of news, the most popular first.
+func (a *API) TagsHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := a.db.GetTags()
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(tags)
+}
+
+//writePost responds with the current state of the news.
+func (a *API) writePost(w http.ResponseWriter, id int) {
+	post, err := a.db.GetNewsByID(id)
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(post)
+}
+
+//FeedsHandler returns the polled feeds with their channel metadata.
+func (a *API) FeedsHandler(w http.ResponseWriter, r *http.Request) {
+	feeds, err := a.db.GetFeeds()
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(feeds)
+}
+
+//FeedIconHandler returns the cached icon of the feed site as an image.
+func (a *API) FeedIconHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	icon, err := a.db.GetFeedIcon(id)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", icon.Type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(icon.Data)
+}
+
+//DiscoverHandler finds the feeds of the site from the request body.
+func (a *API) DiscoverHandler(w http.ResponseWriter, r *http.Request) {
+	var req RequestFeed
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := a.inspectContext(r)
+	defer cancel()
+
+	candidates, err := a.feeds.Discover(ctx, req.URL)
+	if err != nil {
+		a.writeResponseError(w, err, inspectErrorCode(err))
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(candidates)
+}
+
+//inspectContext limits DiscoverHandler and PreviewHandler to 4/5 of API_WRITE_TIMEOUT,
+//so the slow sites end with an answer instead of a connection closed by the server.
+func (a *API) inspectContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if a.cfg.WriteTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+
+	return context.WithTimeout(r.Context(), a.cfg.WriteTimeout*4/5)
+}
+
+//inspectErrorCode returns the status of the error of Discover and Preview.
+func inspectErrorCode(err error) int {
+	switch {
+	case errors.Is(err, rss.ErrInvalidLink), errors.Is(err, netguard.ErrPrivateAddress):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+//PreviewHandler shows what the parser makes of the feed from the request body, nothing is stored.
+func (a *API) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	var req RequestFeed
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := a.inspectContext(r)
+	defer cancel()
+
+	preview, err := a.feeds.Preview(ctx, req.URL)
+	if err != nil {
+		a.writeResponseError(w, err, inspectErrorCode(err))
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(preview)
+}
+
+//RetentionReportHandler returns the posts that would be pruned by the retention policy.
+func (a *API) RetentionReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := a.retention.Report()
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+//SubscriptionsHandler returns the feeds the current user is subscribed to.
+func (a *API) SubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeSubscriptions(w, currentUser(r).ID)
+}
+
+//SubscribeHandler subscribes the current user to the feed from GET /feeds, returns the subscriptions.
+func (a *API) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	if err = a.db.Subscribe(user.ID, id, time.Now().Unix()); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	a.writeSubscriptions(w, user.ID)
+}
+
+//UnsubscribeHandler removes the subscription of the current user to the feed, returns the subscriptions.
+func (a *API) UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	if err = a.db.Unsubscribe(user.ID, id); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	a.writeSubscriptions(w, user.ID)
+}
+
+func (a *API) writeSubscriptions(w http.ResponseWriter, userID int) {
+	feeds, err := a.db.GetSubscriptions(userID)
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(feeds)
+}
+
+//ReadHandler marks the news as read by the current user.
+func (a *API) ReadHandler(w http.ResponseWriter, r *http.Request) {
+	a.markRead(w, r, true)
+}
+
+//UnreadHandler marks the news as unread by the current user, even if it is older than a "read up to" mark.
+func (a *API) UnreadHandler(w http.ResponseWriter, r *http.Request) {
+	a.markRead(w, r, false)
+}
+
+func (a *API) markRead(w http.ResponseWriter, r *http.Request, read bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err = a.db.MarkRead(currentUser(r).ID, id, read, time.Now().Unix()); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusNoContent))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//ReadAllHandler marks as read the news published up to RequestReadAll.Before, of one feed or of all feeds.
+//Returns the unread counts.
+func (a *API) ReadAllHandler(w http.ResponseWriter, r *http.Request) {
+	var req RequestReadAll
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if req.Before == 0 {
+		req.Before = time.Now().Unix()
+	}
+
+	user := currentUser(r)
+	if err := a.db.MarkAllRead(user.ID, req.Feed, req.Before); err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	a.writeUnreadCounts(w, user.ID)
+}
+
+//UnreadCountsHandler returns the number of unread news of the current user by feed, feeds without them are omitted.
+func (a *API) UnreadCountsHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeUnreadCounts(w, currentUser(r).ID)
+}
+
+func (a *API) writeUnreadCounts(w http.ResponseWriter, userID int) {
+	counts, err := a.db.UnreadCounts(userID)
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(counts)
+}
+
+//SavedPostsHandler returns the news starred by the current user, the last saved first.
+//The "filter" parameter searches the title, the text and the note.
+func (a *API) SavedPostsHandler(w http.ResponseWriter, r *http.Request) {
+	saved, err := a.db.GetSavedPosts(currentUser(r).ID, r.FormValue("filter"))
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(saved)
+}
+
+//ExportSavedHandler returns the news starred by the current user as a file to download.
+//Accepts "format" (json or markdown, json by default) and "filter" parameters.
+func (a *API) ExportSavedHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = exportJSON
+	}
+	if format != exportJSON && format != exportMarkdown {
+		a.writeResponseError(w, fmt.Errorf("unsupported format %q, expected json or markdown", format), http.StatusBadRequest)
+		return
+	}
+
+	saved, err := a.db.GetSavedPosts(currentUser(r).ID, r.FormValue("filter"))
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if format == exportMarkdown {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="saved.md"`)
+		w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+		w.WriteHeader(http.StatusOK)
+		_ = writeMarkdown(w, saved)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="saved.json"`)
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(saved)
+}
+
+//SaveHandler stars the news for the current user with the optional note from RequestNote,
+//starring it again replaces the note.
+func (a *API) SaveHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var req RequestNote
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err = a.db.SavePost(currentUser(r).ID, id, req.Note, time.Now().Unix()); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusNoContent))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//UnsaveHandler removes the star of the current user from the news.
+func (a *API) UnsaveHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err = a.db.UnsavePost(currentUser(r).ID, id); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			a.writeResponseError(w, err, http.StatusNotFound)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Code", strconv.Itoa(http.StatusNoContent))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -12,3 +12,61 @@ type Page struct {
 	NumberOfPage int // номер страницы
 	ItemsPerPage int // количество новостей на одной странице
 }
+
+type RequestTags struct {
+	Tags []string // теги, добавляемые к новости
+}
+
+type RequestFeed struct {
+	URL string // ссылка на сайт или ленту
+}
+
+type RequestNote struct {
+	Note string // заметка к закладке
+}
+
+type RequestReadAll struct {
+	Feed   string // ссылка на ленту, пустая - все ленты
+	Before int64  // отметить прочитанными записи, опубликованные не позже этого времени, 0 - сейчас
+}
+
+type RequestAlertRule struct {
+	Name       string   // название правила
+	Keywords   []string // ключевые слова, достаточно одного без учета регистра
+	Regex      string   // регулярное выражение RE2 для заголовка и текста
+	Feeds      []string // ссылки на ленты, пустой список - все ленты
+	WebhookURL string   // http или https адрес, на который отправляются совпадения
+	Secret     string   // ключ подписи запросов, если не задан, генерируется
+}
+
+type ResponseAlertRule struct {
+	*database.AlertRule
+	Secret string // ключ подписи запросов, возвращается только при создании правила
+}
+
+type RequestCredentials struct {
+	Login    string // логин, регистр не учитывается
+	Password string // пароль
+}
+
+type ResponseSession struct {
+	Token     string         // токен сессии для заголовка "Authorization: Bearer"
+	ExpiresAt int64          // время окончания сессии
+	User      *database.User // вошедший пользователь
+}
+
+type SocketRequest struct {
+	Type  string   // subscribe или unsubscribe
+	ID    string   // название подписки, выбранное клиентом
+	Feeds []string // ссылки на ленты, пустой список - все ленты
+	Query string   // подстрока заголовка или текста
+	Tag   string   // тег записи
+	After int      // прислать сначала записи с номером больше этого, 0 - только новые
+}
+
+type SocketMessage struct {
+	Type  string         // subscribed, unsubscribed, post или error
+	ID    string         `json:",omitempty"` // название подписки
+	Post  *database.Post `json:",omitempty"` // запись для сообщения post
+	Error string         `json:",omitempty"` // причина ошибки
+}
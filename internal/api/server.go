@@ -2,16 +2,20 @@ package api
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/MarySmirnova/news_reader/internal/config"
 	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/hub"
+	"github.com/MarySmirnova/news_reader/internal/retention"
+	"github.com/MarySmirnova/news_reader/internal/rss"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -24,35 +28,121 @@ const itemsPerPage = 15
 
 type storage interface {
 	GetLastNews(n int) ([]*database.Post, error)
-	NewsAmount(filter string) (int, error)
-	GetNewsPage(filter string, page int, ipemsPerPage int) ([]*database.Post, error)
+	NewsAmount(filter database.Filter) (int, error)
+	GetNewsPage(filter database.Filter, page int, ipemsPerPage int) ([]*database.Post, error)
 	GetNewsByID(id int) (*database.Post, error)
+	GetNewsAfter(filter database.Filter, id int, n int) ([]*database.Post, error)
+	LastNewsID() (int, error)
+	AddTags(id int, tags []string) error
+	RemoveTag(id int, tag string) error
+	GetTags() ([]*database.Tag, error)
+	GetFeeds() ([]*database.Feed, error)
+	GetFeedIcon(id int) (*database.FeedIcon, error)
+	CreateUser(user *database.User, closed bool) error
+	GetUser(id int) (*database.User, error)
+	GetUserByLogin(login string) (*database.User, error)
+	UsersAmount() (int, error)
+	CreateSession(session *database.Session) error
+	GetSession(tokenHash string) (*database.Session, error)
+	DeleteSession(tokenHash string) error
+	DeleteExpiredSessions(before int64) error
+	Subscribe(userID, feedID int, createdAt int64) error
+	Unsubscribe(userID, feedID int) error
+	GetSubscriptions(userID int) ([]*database.Feed, error)
+	MarkRead(userID, postID int, read bool, at int64) error
+	MarkAllRead(userID int, feed string, before int64) error
+	UnreadCounts(userID int) ([]*database.UnreadCount, error)
+	SavePost(userID, postID int, note string, at int64) error
+	UnsavePost(userID, postID int) error
+	GetSavedPosts(userID int, query string) ([]*database.SavedPost, error)
+	CreateAlertRule(rule *database.AlertRule) error
+	GetAlertRule(id int) (*database.AlertRule, error)
+	GetAlertRules(userID int) ([]*database.AlertRule, error)
+	DeleteAlertRule(userID, id int) error
+	GetDeliveries(ruleID int, n int) ([]*database.AlertDelivery, error)
+}
+
+type retentionReporter interface {
+	Report() (*retention.Report, error)
+}
+
+type eventHub interface {
+	Subscribe() *hub.Subscription
+}
+
+type feedInspector interface {
+	Discover(ctx context.Context, link string) ([]*rss.Candidate, error)
+	Preview(ctx context.Context, link string) (*rss.Preview, error)
+}
+
+type ruleValidator interface {
+	Validate(ctx context.Context, rule *database.AlertRule) error
 }
 
 type API struct {
+	cfg        config.API
 	db         storage
+	retention  retentionReporter
+	feeds      feedInspector
+	alerts     ruleValidator
+	events     eventHub
 	httpServer *http.Server
 }
 
-//New creates a new instance API.
-func New(cfg config.API, db storage) *API {
+//New creates a new instance API, events may be nil, then the live updates are not available.
+func New(cfg config.API, db storage, pruner retentionReporter, parser feedInspector, alerter ruleValidator, events eventHub) *API {
 	a := &API{
-		db: db,
+		cfg:       cfg,
+		db:        db,
+		retention: pruner,
+		feeds:     parser,
+		alerts:    alerter,
+		events:    events,
 	}
 
 	handler := mux.NewRouter()
-	handler.Use(a.reqIDMiddleware, a.logMiddleware)
+	handler.Use(a.reqIDMiddleware, a.logMiddleware, a.authMiddleware)
+	handler.Name("register").Path("/auth/register").Methods(http.MethodPost).HandlerFunc(a.RegisterHandler)
+	handler.Name("login").Path("/auth/login").Methods(http.MethodPost).HandlerFunc(a.LoginHandler)
+	handler.Name("logout").Path("/auth/logout").Methods(http.MethodPost).HandlerFunc(a.LogoutHandler)
+	handler.Name("get_me").Path("/me").Methods(http.MethodGet).HandlerFunc(a.MeHandler)
+	handler.Name("get_my_news").Path("/me/news").Methods(http.MethodGet).HandlerFunc(a.MyPostsHandler)
+	handler.Name("get_unread_counts").Path("/me/unread").Methods(http.MethodGet).HandlerFunc(a.UnreadCountsHandler)
+	handler.Name("get_saved").Path("/me/saved").Methods(http.MethodGet).HandlerFunc(a.SavedPostsHandler)
+	handler.Name("export_saved").Path("/me/saved/export").Methods(http.MethodGet).HandlerFunc(a.ExportSavedHandler)
+	handler.Name("save_news").Path("/me/saved/{id}").Methods(http.MethodPost).HandlerFunc(a.SaveHandler)
+	handler.Name("unsave_news").Path("/me/saved/{id}").Methods(http.MethodDelete).HandlerFunc(a.UnsaveHandler)
+	handler.Name("get_alerts").Path("/me/alerts").Methods(http.MethodGet).HandlerFunc(a.AlertRulesHandler)
+	handler.Name("create_alert").Path("/me/alerts").Methods(http.MethodPost).HandlerFunc(a.CreateAlertRuleHandler)
+	handler.Name("delete_alert").Path("/me/alerts/{id}").Methods(http.MethodDelete).HandlerFunc(a.DeleteAlertRuleHandler)
+	handler.Name("get_alert_deliveries").Path("/me/alerts/{id}/deliveries").Methods(http.MethodGet).HandlerFunc(a.DeliveriesHandler)
+	handler.Name("get_subscriptions").Path("/me/feeds").Methods(http.MethodGet).HandlerFunc(a.SubscriptionsHandler)
+	handler.Name("subscribe").Path("/me/feeds/{id}").Methods(http.MethodPost).HandlerFunc(a.SubscribeHandler)
+	handler.Name("unsubscribe").Path("/me/feeds/{id}").Methods(http.MethodDelete).HandlerFunc(a.UnsubscribeHandler)
+	handler.Name("socket_news").Path("/news/socket").Methods(http.MethodGet).HandlerFunc(a.SocketHandler)
+	handler.Name("stream_news").Path("/news/stream").Methods(http.MethodGet).HandlerFunc(a.StreamHandler)
 	handler.Name("get_some_last_news").Path("/news/{n}").Methods(http.MethodGet).HandlerFunc(a.SomePostsHandler)
 	handler.Name("get_all_news").Path("/news").Methods(http.MethodGet).HandlerFunc(a.AllPostsHandler)
 	handler.Name("get_news_by_id").Path("/news/full/{id}").Methods(http.MethodGet).HandlerFunc(a.PostHandler)
+	handler.Name("add_news_tags").Path("/news/{id}/tags").Methods(http.MethodPost).HandlerFunc(a.AddTagsHandler)
+	handler.Name("remove_news_tag").Path("/news/{id}/tags/{tag}").Methods(http.MethodDelete).HandlerFunc(a.RemoveTagHandler)
+	handler.Name("read_all_news").Path("/news/read").Methods(http.MethodPost).HandlerFunc(a.ReadAllHandler)
+	handler.Name("read_news").Path("/news/{id}/read").Methods(http.MethodPost).HandlerFunc(a.ReadHandler)
+	handler.Name("unread_news").Path("/news/{id}/read").Methods(http.MethodDelete).HandlerFunc(a.UnreadHandler)
+	handler.Name("get_tags").Path("/tags").Methods(http.MethodGet).HandlerFunc(a.TagsHandler)
+	handler.Name("get_feeds").Path("/feeds").Methods(http.MethodGet).HandlerFunc(a.FeedsHandler)
+	handler.Name("get_feed_icon").Path("/feeds/{id}/icon").Methods(http.MethodGet).HandlerFunc(a.FeedIconHandler)
+	handler.Name("discover_feeds").Path("/feeds/discover").Methods(http.MethodPost).HandlerFunc(a.DiscoverHandler)
+	handler.Name("preview_feed").Path("/feeds/preview").Methods(http.MethodPost).HandlerFunc(a.PreviewHandler)
+	handler.Name("get_retention_report").Path("/admin/retention").Methods(http.MethodGet).HandlerFunc(a.RetentionReportHandler)
 
-	handler.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("./webapp"))))
+	handler.Name("webapp").PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("./webapp"))))
 
 	a.httpServer = &http.Server{
 		Addr:         cfg.Listen,
 		WriteTimeout: cfg.WriteTimeout,
 		ReadTimeout:  cfg.ReadTimeout,
-		Handler:      handler,
+		Handler:      a.corsHandler(handler),
 	}
 
 	return a
@@ -84,7 +174,6 @@ func (a *API) reqIDMiddleware(next http.Handler) http.Handler {
 		ctx := context.WithValue(r.Context(), ContextReqIDKey, reqID)
 
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -95,7 +184,7 @@ func (a *API) logMiddleware(next http.Handler) http.Handler {
 		defer func() {
 			log.WithFields(log.Fields{
 				"request_time": time.Now().Format("2006-01-02 15:04:05.000000"),
-				"request_ip":   strings.TrimPrefix(strings.Split(r.RemoteAddr, ":")[1], "["),
+				"request_ip":   a.requestIP(r),
 				"code":         w.Header().Get("Code"),
 				"request_id":   r.Context().Value(ContextReqIDKey),
 			}).Info("news reader response")
@@ -105,6 +194,15 @@ func (a *API) logMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+func (a *API) requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 func (a *API) generateReqID() int {
 	max := 999999999999
 	min := 100000
@@ -113,9 +211,18 @@ func (a *API) generateReqID() int {
 	return rand.Intn(max-min) + min
 }
 
-func (a *API) getPageAndFilterParams(w http.ResponseWriter, r *http.Request) (int, string, error) {
+func (a *API) getPageAndFilterParams(w http.ResponseWriter, r *http.Request) (int, database.Filter, error) {
 	var page int
-	filter := r.FormValue("filter")
+	filter := database.Filter{
+		Query: r.FormValue("filter"),
+		Tag:   r.FormValue("tag"),
+
+		MediaType: r.FormValue("media_type"),
+
+		UserID: currentUser(r).ID,
+	}
+	filter.Feeds = r.Form["feed"]
+
 	pageString := r.FormValue("page")
 	if pageString == "" {
 		page = 1
@@ -123,14 +230,59 @@ func (a *API) getPageAndFilterParams(w http.ResponseWriter, r *http.Request) (in
 	if pageString != "" {
 		p, err := strconv.Atoi(pageString)
 		if err != nil {
-			return 0, "", err
+			return 0, filter, err
 		}
 		page = p
 	}
 
+	if unread := r.FormValue("unread"); unread != "" {
+		u, err := strconv.ParseBool(unread)
+		if err != nil {
+			return 0, filter, err
+		}
+		if u && filter.UserID == 0 {
+			return 0, filter, errUnreadAnonymous
+		}
+		filter.Unread = u
+	}
+
+	if hasMedia := r.FormValue("has_media"); hasMedia != "" {
+		h, err := strconv.ParseBool(hasMedia)
+		if err != nil {
+			return 0, filter, err
+		}
+		filter.HasMedia = h
+	}
+
+	var err error
+	if filter.From, err = a.parseTimeParam(r.FormValue("from")); err != nil {
+		return 0, filter, err
+	}
+	if filter.To, err = a.parseTimeParam(r.FormValue("to")); err != nil {
+		return 0, filter, err
+	}
+
 	return page, filter, nil
 }
 
+//parseTimeParam accepts unix time or a date in the format YYYY-MM-DD, an empty value means no limit.
+func (a *API) parseTimeParam(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return unix, nil
+	}
+
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected unix time or YYYY-MM-DD", value)
+	}
+
+	return date.Unix(), nil
+}
+
 func (a *API) writeResponseError(w http.ResponseWriter, err error, code int) {
 	w.Header().Add("Code", strconv.Itoa(code))
 	log.WithError(err).Error("api error")
@@ -1,25 +1,62 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/MarySmirnova/news_reader/internal/alerts"
 	"github.com/MarySmirnova/news_reader/internal/config"
 	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/hub"
+	"github.com/MarySmirnova/news_reader/internal/retention"
+	"github.com/MarySmirnova/news_reader/internal/rss"
 	"github.com/stretchr/testify/assert"
 )
 
 func testAPI(t *testing.T) *API {
+	db := database.NewMemoryDB()
+
+	var posts []*database.Post
+	for i := 0; i < 20; i++ {
+		post := &database.Post{
+			Title:   "Title " + strconv.Itoa(i),
+			Content: "Content " + strconv.Itoa(i),
+			PubTime: time.Now().Unix(),
+			Link:    "Link " + strconv.Itoa(i),
+		}
+		if i%4 == 0 {
+			post.Categories = []string{"Even"}
+		}
+		if i%5 == 0 {
+			post.Media = []database.Media{{URL: "Image " + strconv.Itoa(i), Type: "image/jpeg", Medium: "image"}}
+		}
+		posts = append(posts, post)
+	}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	pruner, err := retention.New(config.Retention{
+		MaxPostsPerFeed: 15,
+		Mode:            retention.ModeArchive,
+		DryRun:          true,
+	}, db)
+	assert.Nil(t, err)
+
 	return New(config.API{
-		Listen:       ":8080",
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-	}, database.NewMemoryDB())
+		Listen:        ":8080",
+		ReadTimeout:   30 * time.Second,
+		WriteTimeout:  30 * time.Second,
+		AnonymousRead: true,
+		SessionTTL:    time.Hour,
+	}, db, pruner, rss.NewNewsParser(config.RSS{Fetcher: config.Fetcher{AllowPrivate: true}}, db), alerts.New(config.Alerts{}, db), hub.New())
 }
 
 func execRequest(req *http.Request, s *http.Server) *httptest.ResponseRecorder {
@@ -29,6 +66,12 @@ func execRequest(req *http.Request, s *http.Server) *httptest.ResponseRecorder {
 	return resp
 }
 
+//execAuthRequest sends the request with the session token.
+func execAuthRequest(req *http.Request, s *http.Server, token string) *httptest.ResponseRecorder {
+	req.Header.Set("Authorization", "Bearer "+token)
+	return execRequest(req, s)
+}
+
 func TestAPI_PostsHandler_InvalidParameter(t *testing.T) {
 	api := testAPI(t)
 
@@ -54,4 +97,564 @@ func TestAPI_PostsHandler_GoodWay(t *testing.T) {
 	assert.Nil(t, err)
 
 	assert.Equal(t, n, len(posts))
+
+	//the full text is returned only by GET /news/full/{id}
+	assert.NotContains(t, string(body), "FullText")
+}
+
+func TestAPI_RetentionReportHandler(t *testing.T) {
+	api := testAPI(t)
+	token := testLogin(t, api, "admin")
+
+	req, _ := http.NewRequest(http.MethodGet, "/admin/retention", nil)
+	resp := execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var report retention.Report
+	err := json.NewDecoder(resp.Body).Decode(&report)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 5, report.Total)
+	assert.Equal(t, 5, len(report.Posts))
+	assert.True(t, report.DryRun)
+}
+
+func TestAPI_AllPostsHandler_Period(t *testing.T) {
+	api := testAPI(t)
+
+	tests := []struct {
+		query string
+		code  int
+		posts int
+	}{
+		{"/news", http.StatusOK, 15},
+		{"/news?from=2000-01-01", http.StatusOK, 15},
+		{"/news?to=2000-01-01", http.StatusOK, 0},
+		{fmt.Sprintf("/news?from=%d", time.Now().Add(time.Hour).Unix()), http.StatusOK, 0},
+		{"/news?from=yesterday", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, tt.query, nil)
+		resp := execRequest(req, api.httpServer)
+		assert.Equal(t, tt.code, resp.Code, tt.query)
+
+		if tt.code != http.StatusOK {
+			continue
+		}
+
+		var news ResponseNews
+		err := json.NewDecoder(resp.Body).Decode(&news)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.posts, len(news.Posts), tt.query)
+	}
+}
+
+func TestAPI_Tags(t *testing.T) {
+	api := testAPI(t)
+	token := testLogin(t, api, "admin")
+
+	req, _ := http.NewRequest(http.MethodGet, "/news?tag=even", nil)
+	resp := execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var news ResponseNews
+	err := json.NewDecoder(resp.Body).Decode(&news)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 5, len(news.Posts)) {
+		return
+	}
+	id := news.Posts[0].ID
+
+	body, _ := json.Marshal(RequestTags{Tags: []string{"Later"}})
+	req, _ = http.NewRequest(http.MethodPost, fmt.Sprintf("/news/%d/tags", id), bytes.NewReader(body))
+	resp = execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var post database.Post
+	err = json.NewDecoder(resp.Body).Decode(&post)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"even", "later"}, post.Tags)
+
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("/news/%d/tags/even", id), nil)
+	resp = execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	req, _ = http.NewRequest(http.MethodGet, "/tags", nil)
+	resp = execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var tags []*database.Tag
+	err = json.NewDecoder(resp.Body).Decode(&tags)
+	assert.Nil(t, err)
+	assert.Equal(t, []*database.Tag{{Name: "even", Count: 4}, {Name: "later", Count: 1}}, tags)
+
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("/news/%d/tags/even", id), nil)
+	resp = execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestAPI_AllPostsHandler_Media(t *testing.T) {
+	api := testAPI(t)
+
+	tests := []struct {
+		query string
+		code  int
+		posts int
+	}{
+		{"/news?has_media=true", http.StatusOK, 4},
+		{"/news?has_media=false", http.StatusOK, 15},
+		{"/news?media_type=image", http.StatusOK, 4},
+		{"/news?media_type=image/jpeg", http.StatusOK, 4},
+		{"/news?media_type=audio", http.StatusOK, 0},
+		{"/news?has_media=maybe", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, tt.query, nil)
+		resp := execRequest(req, api.httpServer)
+		assert.Equal(t, tt.code, resp.Code, tt.query)
+
+		if tt.code != http.StatusOK {
+			continue
+		}
+
+		var news ResponseNews
+		err := json.NewDecoder(resp.Body).Decode(&news)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.posts, len(news.Posts), tt.query)
+	}
+}
+
+func TestAPI_DiscoverHandler(t *testing.T) {
+	api := testAPI(t)
+	token := testLogin(t, api, "admin")
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<html><head><link rel="alternate" type="application/rss+xml" href="/rss.xml"></head></html>`))
+		case "/rss.xml":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			_, _ = w.Write([]byte(`<rss version="2.0"><channel><title>Site news</title><item><title>Post</title></item></channel></rss>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	body, _ := json.Marshal(RequestFeed{URL: site.URL})
+	req, _ := http.NewRequest(http.MethodPost, "/feeds/discover", bytes.NewReader(body))
+	resp := execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		var candidates []*rss.Candidate
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&candidates))
+		if assert.Equal(t, 1, len(candidates)) {
+			assert.Equal(t, site.URL+"/rss.xml", candidates[0].URL)
+			assert.Equal(t, "Site news", candidates[0].Title)
+			assert.Equal(t, 1, candidates[0].Items)
+		}
+	}
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"URL": "ftp://example.com"}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+		{`{"URL": "` + site.URL + `/missing"}`, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		req, _ = http.NewRequest(http.MethodPost, "/feeds/discover", bytes.NewReader([]byte(tt.body)))
+		resp = execAuthRequest(req, api.httpServer, token)
+		assert.Equal(t, tt.code, resp.Code, tt.body)
+	}
+
+	//a site slower than the write timeout gets an answer before the connection is closed
+	api.cfg.WriteTimeout = 250 * time.Millisecond
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer hanging.Close()
+
+	req, _ = http.NewRequest(http.MethodPost, "/feeds/discover", bytes.NewReader([]byte(`{"URL": "`+hanging.URL+`"}`)))
+	resp = execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.Code)
+
+	//by default the server does not fetch the internal addresses for the users
+	api.feeds = rss.NewNewsParser(config.RSS{}, api.db.(*database.Memdb))
+	req, _ = http.NewRequest(http.MethodPost, "/feeds/discover", bytes.NewReader(body))
+	resp = execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestAPI_PreviewHandler(t *testing.T) {
+	api := testAPI(t)
+	token := testLogin(t, api, "admin")
+
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(`<rss version="2.0"><channel><title>Site news</title>
+			<item><title>Post</title><link>https://example.com/post</link><pubDate>Mon, 18 Apr 2022 10:00:00 GMT</pubDate></item>
+			<item><title>Broken</title><pubDate>yesterday</pubDate></item>
+		</channel></rss>`))
+	}))
+	defer feed.Close()
+
+	amount, err := api.db.NewsAmount(database.Filter{})
+	assert.Nil(t, err)
+
+	body, _ := json.Marshal(RequestFeed{URL: feed.URL})
+	req, _ := http.NewRequest(http.MethodPost, "/feeds/preview", bytes.NewReader(body))
+	resp := execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		var preview rss.Preview
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&preview))
+		assert.Equal(t, rss.FormatRSS, preview.Format)
+		assert.Equal(t, "Site news", preview.Channel.Title)
+		if assert.Equal(t, 2, len(preview.Items)) {
+			assert.Equal(t, "Post", preview.Items[0].Post.Title)
+			assert.Empty(t, preview.Items[0].Warnings)
+			assert.Contains(t, preview.Items[1].Warnings, `unparseable pubDate "yesterday"`)
+		}
+	}
+
+	//the preview does not store the posts
+	after, err := api.db.NewsAmount(database.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, amount, after)
+
+	req, _ = http.NewRequest(http.MethodPost, "/feeds/preview", bytes.NewReader([]byte(`{"URL": ""}`)))
+	resp = execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	//by default the server does not fetch the internal addresses for the users
+	api.feeds = rss.NewNewsParser(config.RSS{}, api.db.(*database.Memdb))
+	req, _ = http.NewRequest(http.MethodPost, "/feeds/preview", bytes.NewReader(body))
+	resp = execAuthRequest(req, api.httpServer, token)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestAPI_FeedsHandler(t *testing.T) {
+	api := testAPI(t)
+	db := api.db.(*database.Memdb)
+
+	png := []byte("\x89PNG\r\n\x1a\nicon")
+	assert.Nil(t, db.WriteFeed(&database.Feed{URL: "https://example.com/rss", Title: "Example", Link: "https://example.com/"}))
+	assert.Nil(t, db.WriteFeed(&database.Feed{URL: "https://example.org/rss", Title: "Other"}))
+	assert.Nil(t, db.WriteFeedIcon("https://example.com/rss", &database.FeedIcon{Type: "image/png", Data: png, FetchedAt: 1650000000}))
+
+	req, _ := http.NewRequest(http.MethodGet, "/feeds", nil)
+	resp := execRequest(req, api.httpServer)
+	if !assert.Equal(t, http.StatusOK, resp.Code) {
+		return
+	}
+
+	var feeds []*database.Feed
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&feeds))
+	if !assert.Equal(t, 2, len(feeds)) {
+		return
+	}
+	assert.Equal(t, "Example", feeds[0].Title)
+	assert.True(t, feeds[0].HasIcon)
+	assert.False(t, feeds[1].HasIcon)
+
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf("/feeds/%d/icon", feeds[0].ID), nil)
+	resp = execRequest(req, api.httpServer)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "image/png", resp.Header().Get("Content-Type"))
+	assert.Equal(t, png, resp.Body.Bytes())
+
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf("/feeds/%d/icon", feeds[1].ID), nil)
+	resp = execRequest(req, api.httpServer)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	req, _ = http.NewRequest(http.MethodGet, "/feeds/abc/icon", nil)
+	resp = execRequest(req, api.httpServer)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestAPI_Subscriptions(t *testing.T) {
+	api := testAPI(t)
+	db := api.db.(*database.Memdb)
+	token := testLogin(t, api, "admin")
+
+	var posts []*database.Post
+	for i := 0; i < 6; i++ {
+		posts = append(posts, &database.Post{
+			Title:   "Feed post " + strconv.Itoa(i),
+			PubTime: time.Now().Unix(),
+			Link:    "Feed link " + strconv.Itoa(i),
+			Feed:    "https://example.com/rss" + strconv.Itoa(i%2),
+		})
+	}
+	assert.Nil(t, db.WriteNews(posts))
+	assert.Nil(t, db.WriteFeed(&database.Feed{URL: "https://example.com/rss0"}))
+	assert.Nil(t, db.WriteFeed(&database.Feed{URL: "https://example.com/rss1"}))
+
+	req, _ := http.NewRequest(http.MethodPost, "/me/feeds/1", nil)
+	resp := execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		var feeds []*database.Feed
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&feeds))
+		if assert.Equal(t, 1, len(feeds)) {
+			assert.Equal(t, "https://example.com/rss0", feeds[0].URL)
+		}
+	}
+
+	//only the posts of the subscribed feed, with the usual filters
+	req, _ = http.NewRequest(http.MethodGet, "/me/news?filter=post", nil)
+	resp = execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		var news ResponseNews
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&news))
+		if assert.Equal(t, 3, len(news.Posts)) {
+			for _, post := range news.Posts {
+				assert.Equal(t, "https://example.com/rss0", post.Feed)
+			}
+		}
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/me/news?page=x", nil)
+	assert.Equal(t, http.StatusBadRequest, execAuthRequest(req, api.httpServer, token).Code)
+
+	//the personal timeline needs a login even with the anonymous read
+	req, _ = http.NewRequest(http.MethodGet, "/me/news", nil)
+	assert.Equal(t, http.StatusUnauthorized, execRequest(req, api.httpServer).Code)
+
+	req, _ = http.NewRequest(http.MethodPost, "/me/feeds/100", nil)
+	assert.Equal(t, http.StatusNotFound, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodDelete, "/me/feeds/1", nil)
+	assert.Equal(t, http.StatusOK, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodDelete, "/me/feeds/1", nil)
+	assert.Equal(t, http.StatusNotFound, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodGet, "/me/feeds", nil)
+	resp = execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		assert.Equal(t, "[]\n", resp.Body.String())
+	}
+}
+
+func TestAPI_ReadState(t *testing.T) {
+	api := testAPI(t)
+	db := api.db.(*database.Memdb)
+	token := testLogin(t, api, "admin")
+
+	unread := func() int {
+		req, _ := http.NewRequest(http.MethodGet, "/news?unread=true", nil)
+		resp := execAuthRequest(req, api.httpServer, token)
+		if !assert.Equal(t, http.StatusOK, resp.Code) {
+			return -1
+		}
+
+		var news ResponseNews
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&news))
+		return len(news.Posts)
+	}
+
+	posts, err := db.GetLastNews(20)
+	if !assert.Nil(t, err) || !assert.Equal(t, 20, len(posts)) {
+		return
+	}
+	assert.Equal(t, 15, unread())
+
+	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/news/%d/read", posts[0].ID), nil)
+	assert.Equal(t, http.StatusNoContent, execAuthRequest(req, api.httpServer, token).Code)
+
+	amount, err := db.NewsAmount(database.Filter{UserID: 1, Unread: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 19, amount)
+
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("/news/%d/read", posts[0].ID), nil)
+	assert.Equal(t, http.StatusNoContent, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodPost, "/news/100/read", nil)
+	assert.Equal(t, http.StatusNotFound, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodGet, "/me/unread", nil)
+	resp := execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		var counts []*database.UnreadCount
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&counts))
+		assert.Equal(t, []*database.UnreadCount{{Feed: "", Count: 20}}, counts)
+	}
+
+	//everything published up to now
+	req, _ = http.NewRequest(http.MethodPost, "/news/read", bytes.NewReader([]byte(`{}`)))
+	resp = execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		assert.Equal(t, "[]\n", resp.Body.String())
+	}
+	assert.Equal(t, 0, unread())
+
+	//the unread filter needs a login
+	req, _ = http.NewRequest(http.MethodGet, "/news?unread=true", nil)
+	assert.Equal(t, http.StatusBadRequest, execRequest(req, api.httpServer).Code)
+
+	req, _ = http.NewRequest(http.MethodPost, fmt.Sprintf("/news/%d/read", posts[0].ID), nil)
+	assert.Equal(t, http.StatusUnauthorized, execRequest(req, api.httpServer).Code)
+}
+
+func TestAPI_SavedPosts(t *testing.T) {
+	api := testAPI(t)
+	db := api.db.(*database.Memdb)
+	token := testLogin(t, api, "admin")
+
+	posts, err := db.GetLastNews(2)
+	if !assert.Nil(t, err) || !assert.Equal(t, 2, len(posts)) {
+		return
+	}
+
+	body, _ := json.Marshal(RequestNote{Note: "Check *this*\nlater"})
+	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/me/saved/%d", posts[0].ID), bytes.NewReader(body))
+	assert.Equal(t, http.StatusNoContent, execAuthRequest(req, api.httpServer, token).Code)
+
+	//the note is optional
+	req, _ = http.NewRequest(http.MethodPost, fmt.Sprintf("/me/saved/%d", posts[1].ID), http.NoBody)
+	assert.Equal(t, http.StatusNoContent, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodPost, "/me/saved/100", http.NoBody)
+	assert.Equal(t, http.StatusNotFound, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodGet, "/me/saved?filter=later", nil)
+	resp := execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		var saved []*database.SavedPost
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&saved))
+		if assert.Equal(t, 1, len(saved)) {
+			assert.Equal(t, posts[0].ID, saved[0].ID)
+			assert.Equal(t, posts[0].Title, saved[0].Title)
+			assert.Equal(t, "Check *this*\nlater", saved[0].Note)
+		}
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/me/saved/export?format=markdown&filter=later", nil)
+	resp = execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		assert.Equal(t, "text/markdown; charset=utf-8", resp.Header().Get("Content-Type"))
+		assert.Contains(t, resp.Header().Get("Content-Disposition"), "saved.md")
+		assert.Contains(t, resp.Body.String(), fmt.Sprintf("## [%s](<%s>)\n", posts[0].Title, posts[0].Link))
+		assert.Contains(t, resp.Body.String(), "> Check *this*\n> later\n")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/me/saved/export", nil)
+	resp = execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		assert.Contains(t, resp.Header().Get("Content-Disposition"), "saved.json")
+
+		var saved []*database.SavedPost
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&saved))
+		assert.Equal(t, 2, len(saved))
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/me/saved/export?format=pdf", nil)
+	assert.Equal(t, http.StatusBadRequest, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("/me/saved/%d", posts[1].ID), nil)
+	assert.Equal(t, http.StatusNoContent, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("/me/saved/%d", posts[1].ID), nil)
+	assert.Equal(t, http.StatusNotFound, execAuthRequest(req, api.httpServer, token).Code)
+
+	//the starred post is not offered to the retention policy
+	report, err := api.retention.Report()
+	if assert.Nil(t, err) {
+		for _, post := range report.Posts {
+			assert.NotEqual(t, posts[0].ID, post.ID)
+		}
+	}
+}
+
+func TestAPI_Alerts(t *testing.T) {
+	api := testAPI(t)
+	db := api.db.(*database.Memdb)
+	token := testLogin(t, api, "admin")
+	other := testLogin(t, api, "reader")
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"Keywords": [" "], "WebhookURL": "https://example.com"}`, http.StatusBadRequest},
+		{`{"Regex": "go(", "WebhookURL": "https://example.com"}`, http.StatusBadRequest},
+		{`{"Keywords": ["go"], "WebhookURL": "file:///etc/passwd"}`, http.StatusBadRequest},
+		{`{"Keywords": ["go"], "WebhookURL": "http://127.0.0.1:8080/hook"}`, http.StatusBadRequest},
+		{`{"Keywords": ["go"], "WebhookURL": "http://169.254.169.254/latest/meta-data"}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "/me/alerts", bytes.NewReader([]byte(tt.body)))
+		assert.Equal(t, tt.code, execAuthRequest(req, api.httpServer, token).Code, tt.body)
+	}
+
+	body, _ := json.Marshal(RequestAlertRule{Name: "Go", Keywords: []string{"go "}, WebhookURL: "https://hooks.example.com"})
+	req, _ := http.NewRequest(http.MethodPost, "/me/alerts", bytes.NewReader(body))
+	resp := execAuthRequest(req, api.httpServer, token)
+	if !assert.Equal(t, http.StatusCreated, resp.Code) {
+		return
+	}
+
+	//the generated secret is returned only once
+	var created ResponseAlertRule
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.NotEmpty(t, created.Secret)
+	assert.Equal(t, []string{"go"}, created.Keywords)
+
+	req, _ = http.NewRequest(http.MethodGet, "/me/alerts", nil)
+	resp = execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		assert.NotContains(t, resp.Body.String(), created.Secret)
+
+		var rules []*database.AlertRule
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&rules))
+		if assert.Equal(t, 1, len(rules)) {
+			assert.Equal(t, created.ID, rules[0].ID)
+			assert.Equal(t, "https://hooks.example.com", rules[0].WebhookURL)
+		}
+	}
+
+	assert.Nil(t, db.CreateDeliveries([]*database.AlertDelivery{{
+		RuleID:  created.ID,
+		PostID:  1,
+		Payload: []byte(`{"Rule":1}`),
+		Status:  database.DeliveryFailed,
+		Error:   "unexpected status 500 Internal Server Error",
+	}}))
+
+	path := fmt.Sprintf("/me/alerts/%d/deliveries", created.ID)
+	req, _ = http.NewRequest(http.MethodGet, path, nil)
+	resp = execAuthRequest(req, api.httpServer, token)
+	if assert.Equal(t, http.StatusOK, resp.Code) {
+		var deliveries []*database.AlertDelivery
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&deliveries))
+		if assert.Equal(t, 1, len(deliveries)) {
+			assert.Equal(t, database.DeliveryFailed, deliveries[0].Status)
+			assert.JSONEq(t, `{"Rule":1}`, string(deliveries[0].Payload))
+		}
+	}
+
+	//the rules of the other users are not visible
+	req, _ = http.NewRequest(http.MethodGet, path, nil)
+	assert.Equal(t, http.StatusNotFound, execAuthRequest(req, api.httpServer, other).Code)
+
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("/me/alerts/%d", created.ID), nil)
+	assert.Equal(t, http.StatusNotFound, execAuthRequest(req, api.httpServer, other).Code)
+
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("/me/alerts/%d", created.ID), nil)
+	assert.Equal(t, http.StatusNoContent, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodGet, path, nil)
+	assert.Equal(t, http.StatusNotFound, execAuthRequest(req, api.httpServer, token).Code)
+
+	req, _ = http.NewRequest(http.MethodGet, "/me/alerts", nil)
+	assert.Equal(t, http.StatusUnauthorized, execRequest(req, api.httpServer).Code)
 }
@@ -0,0 +1,312 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/hub"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Types of the WebSocket messages.
+const (
+	socketSubscribe    = "subscribe"
+	socketUnsubscribe  = "unsubscribe"
+	socketSubscribed   = "subscribed"
+	socketUnsubscribed = "unsubscribed"
+	socketPost         = "post"
+	socketError        = "error"
+)
+
+//maxSocketSubscriptions limits the number of subscriptions of one connection.
+const maxSocketSubscriptions = 32
+
+//maxSocketMessage limits the size of the client message.
+const maxSocketMessage = 64 << 10
+
+var (
+	errSocketType          = errors.New("unknown message type")
+	errSocketNoID          = errors.New("subscription id is required")
+	errSocketUnknownID     = errors.New("unknown subscription")
+	errSocketSubscriptions = errors.New("too many subscriptions")
+)
+
+//socketClient is one WebSocket connection with the subscriptions of the client.
+//The subscriptions are read and changed only by the goroutine of SocketHandler.
+type socketClient struct {
+	api  *API
+	conn *websocket.Conn
+	subs map[string]*socketSubscription
+	send chan *SocketMessage
+	done chan struct{}
+}
+
+//socketSubscription is a filter with the id of the last post sent by it.
+//The posts after the cursor are read from the storage, which makes them visible in the order of their ids.
+type socketSubscription struct {
+	filter database.Filter
+	cursor int
+}
+
+//SocketHandler upgrades the connection to WebSocket. The client sends SocketRequest messages to subscribe
+//to the news by feeds, search query or tag and to unsubscribe, the server answers with SocketMessage
+//and sends the new posts matching each subscription as "post" messages with the subscription id.
+//The messages wait in a queue of API_SOCKET_QUEUE messages, while it is full the new posts are not read
+//from the storage, and the client that does not accept a message for API_SOCKET_WRITE_TIMEOUT is disconnected.
+func (a *API) SocketHandler(w http.ResponseWriter, r *http.Request) {
+	if a.events == nil {
+		a.writeResponseError(w, errStreamUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: a.checkOrigin,
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			a.writeResponseError(w, reason, status)
+		},
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	//the subscription goes first, so the news written while the client subscribes are not missed
+	sub := a.events.Subscribe()
+	defer sub.Close()
+
+	queue := a.cfg.SocketQueue
+	if queue < 1 {
+		queue = 1
+	}
+
+	c := &socketClient{
+		api:  a,
+		conn: conn,
+		subs: make(map[string]*socketSubscription),
+		send: make(chan *SocketMessage, queue),
+		done: make(chan struct{}),
+	}
+
+	requests := make(chan []byte)
+	go c.writeLoop()
+	go c.readLoop(requests)
+
+	c.run(requests, sub)
+
+	close(c.send)
+	<-c.done
+}
+
+//checkOrigin allows the clients without Origin, the pages of the API host and the configured CORS origins.
+//Browsers do not apply CORS to WebSocket, so the check keeps other sites from using the session cookie.
+func (a *API) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	origins := a.corsOrigins()
+	return origins[strings.TrimRight(origin, "/")] || origins["*"]
+}
+
+//run handles the client messages and the new posts until the connection is closed.
+func (c *socketClient) run(requests <-chan []byte, sub *hub.Subscription) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case data, ok := <-requests:
+			if !ok || !c.handle(data) {
+				return
+			}
+		case id := <-sub.C():
+			for name, s := range c.subs {
+				if id > s.cursor && !c.deliver(name, s) {
+					return
+				}
+			}
+		}
+	}
+}
+
+//handle applies the client message, it returns false when the connection has to be closed.
+func (c *socketClient) handle(data []byte) bool {
+	var req SocketRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return c.fail("", err)
+	}
+
+	switch req.Type {
+	case socketSubscribe:
+		return c.subscribe(&req)
+	case socketUnsubscribe:
+		if _, ok := c.subs[req.ID]; !ok {
+			return c.fail(req.ID, errSocketUnknownID)
+		}
+		delete(c.subs, req.ID)
+		return c.enqueue(&SocketMessage{Type: socketUnsubscribed, ID: req.ID})
+	default:
+		return c.fail(req.ID, errSocketType)
+	}
+}
+
+//subscribe adds the subscription or replaces the filter of the subscription with the same id.
+//With After the posts written after it are sent at once, otherwise only the new posts are sent.
+func (c *socketClient) subscribe(req *SocketRequest) bool {
+	if req.ID == "" {
+		return c.fail("", errSocketNoID)
+	}
+	if _, ok := c.subs[req.ID]; !ok && len(c.subs) >= maxSocketSubscriptions {
+		return c.fail(req.ID, errSocketSubscriptions)
+	}
+
+	s := &socketSubscription{
+		filter: database.Filter{
+			Query: strings.TrimSpace(req.Query),
+			Tag:   req.Tag,
+			Feeds: req.Feeds,
+		},
+		cursor: req.After,
+	}
+
+	if s.cursor <= 0 {
+		cursor, err := c.api.db.LastNewsID()
+		if err != nil {
+			log.WithError(err).Error("failed to subscribe to news")
+			return false
+		}
+		s.cursor = cursor
+	}
+
+	c.subs[req.ID] = s
+	if !c.enqueue(&SocketMessage{Type: socketSubscribed, ID: req.ID}) {
+		return false
+	}
+
+	return c.deliver(req.ID, s)
+}
+
+//deliver queues the posts of the subscription written after its cursor.
+func (c *socketClient) deliver(id string, s *socketSubscription) bool {
+	for {
+		posts, err := c.api.db.GetNewsAfter(s.filter, s.cursor, streamBatch)
+		if err != nil {
+			log.WithError(err).Error("failed to send news to socket")
+			return false
+		}
+
+		for _, post := range posts {
+			if !c.enqueue(&SocketMessage{Type: socketPost, ID: id, Post: post}) {
+				return false
+			}
+			s.cursor = post.ID
+		}
+
+		if len(posts) < streamBatch {
+			return true
+		}
+	}
+}
+
+//fail sends the error to the client, the connection stays open.
+func (c *socketClient) fail(id string, err error) bool {
+	return c.enqueue(&SocketMessage{Type: socketError, ID: id, Error: err.Error()})
+}
+
+//enqueue waits for a place in the send queue, it returns false when the connection is closed.
+func (c *socketClient) enqueue(msg *SocketMessage) bool {
+	select {
+	case c.send <- msg:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+//readLoop passes the client messages to run. The pongs extend the read deadline, so the dead connections are closed.
+func (c *socketClient) readLoop(requests chan<- []byte) {
+	defer close(requests)
+
+	c.conn.SetReadLimit(maxSocketMessage)
+
+	if heartbeat := c.api.cfg.StreamHeartbeat; heartbeat > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+		c.conn.SetPongHandler(func(string) error {
+			return c.conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+		})
+	}
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.WithError(err).Debug("socket closed")
+			}
+			return
+		}
+
+		select {
+		case requests <- data:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+//writeLoop sends the queued messages and the pings, it closes the connection after a failed write.
+func (c *socketClient) writeLoop() {
+	defer close(c.done)
+
+	var ping <-chan time.Time
+	if c.api.cfg.StreamHeartbeat > 0 {
+		ticker := time.NewTicker(c.api.cfg.StreamHeartbeat)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				c.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), c.writeDeadline())
+				return
+			}
+
+			c.conn.SetWriteDeadline(c.writeDeadline())
+			if err := c.conn.WriteJSON(msg); err != nil {
+				log.WithError(err).Info("socket client is too slow or gone")
+				c.conn.Close()
+				return
+			}
+		case <-ping:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, c.writeDeadline()); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+//writeDeadline returns the deadline of the next write, the zero time means no deadline.
+func (c *socketClient) writeDeadline() time.Time {
+	if c.api.cfg.SocketWriteTimeout <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(c.api.cfg.SocketWriteTimeout)
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/hub"
+)
+
+//dialSocket connects a local WebSocket client to the test server.
+func dialSocket(t *testing.T, server *httptest.Server, header http.Header) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/news/socket", header)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+//readSocket returns the next message from the server.
+func readSocket(t *testing.T, conn *websocket.Conn) *SocketMessage {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var msg SocketMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+
+	return &msg
+}
+
+func writeSocket(t *testing.T, conn *websocket.Conn, req SocketRequest) {
+	assert.Nil(t, conn.WriteJSON(req))
+}
+
+func TestAPI_SocketHandler(t *testing.T) {
+	api := testAPI(t)
+	db := api.db.(*database.Memdb)
+	events := api.events.(*hub.Hub)
+
+	server := httptest.NewServer(api.httpServer.Handler)
+	defer server.Close()
+
+	conn := dialSocket(t, server, nil)
+
+	writeSocket(t, conn, SocketRequest{Type: socketSubscribe, ID: "go", Feeds: []string{"https://go.dev/feed"}})
+	assert.Equal(t, &SocketMessage{Type: socketSubscribed, ID: "go"}, readSocket(t, conn))
+	writeSocket(t, conn, SocketRequest{Type: socketSubscribe, ID: "rust", Query: "rust"})
+	assert.Equal(t, &SocketMessage{Type: socketSubscribed, ID: "rust"}, readSocket(t, conn))
+
+	posts := []*database.Post{
+		{Title: "Go 1.18", Link: "go", PubTime: time.Now().Unix(), Feed: "https://go.dev/feed"},
+		{Title: "Python", Link: "python", PubTime: time.Now().Unix(), Feed: "https://python.org/feed"},
+		{Title: "Rust 1.60", Link: "rust", PubTime: time.Now().Unix(), Feed: "https://rust-lang.org/feed"},
+	}
+	assert.Nil(t, db.WriteNews(posts))
+	events.Publish(posts)
+
+	got := map[string]int{}
+	for i := 0; i < 2; i++ {
+		msg := readSocket(t, conn)
+		if assert.Equal(t, socketPost, msg.Type) {
+			got[msg.ID] = msg.Post.ID
+		}
+	}
+	assert.Equal(t, map[string]int{"go": posts[0].ID, "rust": posts[2].ID}, got)
+
+	//the dashboard drops the query on the fly
+	writeSocket(t, conn, SocketRequest{Type: socketUnsubscribe, ID: "rust"})
+	assert.Equal(t, &SocketMessage{Type: socketUnsubscribed, ID: "rust"}, readSocket(t, conn))
+
+	more := []*database.Post{
+		{Title: "Rust 1.61", Link: "rust 2", PubTime: time.Now().Unix(), Feed: "https://rust-lang.org/feed"},
+		{Title: "Go 1.19", Link: "go 2", PubTime: time.Now().Unix(), Feed: "https://go.dev/feed"},
+	}
+	assert.Nil(t, db.WriteNews(more))
+	events.Publish(more)
+
+	msg := readSocket(t, conn)
+	assert.Equal(t, socketPost, msg.Type)
+	assert.Equal(t, "go", msg.ID)
+	assert.Equal(t, more[1].ID, msg.Post.ID)
+	assert.Equal(t, "Go 1.19", msg.Post.Title)
+}
+
+func TestAPI_SocketHandler_After(t *testing.T) {
+	api := testAPI(t)
+
+	server := httptest.NewServer(api.httpServer.Handler)
+	defer server.Close()
+
+	expected, err := api.db.GetNewsAfter(database.Filter{Tag: "even"}, 5, 100)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, expected)
+
+	conn := dialSocket(t, server, nil)
+
+	//the reconnected client gets the news it missed
+	writeSocket(t, conn, SocketRequest{Type: socketSubscribe, ID: "even", Tag: "Even", After: 5})
+	assert.Equal(t, socketSubscribed, readSocket(t, conn).Type)
+
+	for _, post := range expected {
+		msg := readSocket(t, conn)
+		assert.Equal(t, "even", msg.ID)
+		assert.Equal(t, post.ID, msg.Post.ID)
+	}
+}
+
+func TestAPI_SocketHandler_InvalidMessage(t *testing.T) {
+	api := testAPI(t)
+
+	server := httptest.NewServer(api.httpServer.Handler)
+	defer server.Close()
+
+	conn := dialSocket(t, server, nil)
+
+	assert.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte("{")))
+	msg := readSocket(t, conn)
+	assert.Equal(t, socketError, msg.Type)
+	assert.NotEmpty(t, msg.Error)
+
+	tests := []struct {
+		req SocketRequest
+		err error
+	}{
+		{SocketRequest{Type: "publish", ID: "go"}, errSocketType},
+		{SocketRequest{Type: socketSubscribe}, errSocketNoID},
+		{SocketRequest{Type: socketUnsubscribe, ID: "go"}, errSocketUnknownID},
+	}
+
+	for _, tt := range tests {
+		writeSocket(t, conn, tt.req)
+		assert.Equal(t, &SocketMessage{Type: socketError, ID: tt.req.ID, Error: tt.err.Error()}, readSocket(t, conn))
+	}
+
+	//the errors do not close the connection
+	writeSocket(t, conn, SocketRequest{Type: socketSubscribe, ID: "go"})
+	assert.Equal(t, &SocketMessage{Type: socketSubscribed, ID: "go"}, readSocket(t, conn))
+}
+
+func TestAPI_SocketHandler_Origin(t *testing.T) {
+	header := http.Header{"Origin": {"https://dashboard.example.com"}}
+
+	for _, origins := range [][]string{nil, {"https://dashboard.example.com"}} {
+		api := testAPI(t)
+		api.cfg.CORSOrigins = origins
+
+		server := httptest.NewServer(api.httpServer.Handler)
+		defer server.Close()
+
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/news/socket", header)
+		if origins == nil {
+			assert.NotNil(t, err)
+			if assert.NotNil(t, resp) {
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			}
+			continue
+		}
+
+		if assert.Nil(t, err) {
+			conn.Close()
+		}
+	}
+
+	api := testAPI(t)
+	api.events = nil
+	req, _ := http.NewRequest(http.MethodGet, "/news/socket", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, execRequest(req, api.httpServer).Code)
+}
+
+func TestAPI_SocketHandler_SlowClient(t *testing.T) {
+	api := testAPI(t)
+	api.cfg.SocketQueue = 1
+	api.cfg.SocketWriteTimeout = 100 * time.Millisecond
+	db := api.db.(*database.Memdb)
+	events := api.events.(*hub.Hub)
+
+	server := httptest.NewServer(api.httpServer.Handler)
+	defer server.Close()
+
+	conn := dialSocket(t, server, nil)
+	writeSocket(t, conn, SocketRequest{Type: socketSubscribe, ID: "all"})
+	assert.Equal(t, socketSubscribed, readSocket(t, conn).Type)
+
+	//much more than the socket buffers can hold
+	content := strings.Repeat("news ", 20000)
+	posts := make([]*database.Post, 300)
+	for i := range posts {
+		posts[i] = &database.Post{Title: "Post " + strconv.Itoa(i), Link: "slow " + strconv.Itoa(i), Content: content}
+	}
+	assert.Nil(t, db.WriteNews(posts))
+	events.Publish(posts)
+
+	//the client does not read, so the server gives up on it
+	time.Sleep(time.Second)
+
+	received := 0
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg SocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			assert.False(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+			break
+		}
+		received++
+	}
+
+	assert.Less(t, received, len(posts))
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//streamBatch is the number of posts read from the storage at once while the stream catches up.
+const streamBatch = 100
+
+//streamRetry is the pause before the browser reconnects to the closed stream.
+const streamRetry = 3 * time.Second
+
+var errStreamUnavailable = errors.New("live updates are not available")
+
+//StreamHandler sends the news written after the request as Server-Sent Events, one "post" event per news
+//with the news id as the event id. Accepts the same filters as GET /news. The stream resumes after
+//the id from the Last-Event-ID header or the "last_event_id" parameter, so the reconnected client
+//gets the news written while it was away.
+func (a *API) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	if a.events == nil {
+		a.writeResponseError(w, errStreamUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		a.writeResponseError(w, errStreamUnavailable, http.StatusInternalServerError)
+		return
+	}
+
+	_, filter, err := a.getPageAndFilterParams(w, r)
+	if err != nil {
+		a.writeResponseError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	//the subscription goes first, so the news written while the stream starts are not missed
+	sub := a.events.Subscribe()
+	defer sub.Close()
+
+	cursor, err := a.streamCursor(r)
+	if err != nil {
+		if errors.Is(err, strconv.ErrSyntax) || errors.Is(err, strconv.ErrRange) {
+			a.writeResponseError(w, err, http.StatusBadRequest)
+			return
+		}
+		a.writeResponseError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Add("Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+
+	var heartbeat <-chan time.Time
+	if a.cfg.StreamHeartbeat > 0 {
+		ticker := time.NewTicker(a.cfg.StreamHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	//the server closes the connection after WriteTimeout, so the stream ends a bit earlier and the client reconnects
+	var end <-chan time.Time
+	if a.cfg.WriteTimeout > 0 {
+		timer := time.NewTimer(a.cfg.WriteTimeout - a.cfg.WriteTimeout/10)
+		defer timer.Stop()
+		end = timer.C
+	}
+
+	if cursor, err = a.writePostEvents(w, filter, cursor); err != nil {
+		log.WithError(err).Error("failed to stream news")
+		return
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-end:
+			return
+		case id := <-sub.C():
+			if id <= cursor {
+				continue
+			}
+			if cursor, err = a.writePostEvents(w, filter, cursor); err != nil {
+				log.WithError(err).Error("failed to stream news")
+				return
+			}
+		case <-heartbeat:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+
+		flusher.Flush()
+	}
+}
+
+//streamCursor returns the id after which the stream starts: the last event id sent by the client
+//or, for a new client, the id of the newest written news.
+func (a *API) streamCursor(r *http.Request) (int, error) {
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.FormValue("last_event_id")
+	}
+
+	if lastID == "" {
+		return a.db.LastNewsID()
+	}
+
+	return strconv.Atoi(lastID)
+}
+
+//writePostEvents writes the news by filter written after the cursor and returns the id of the last written one.
+func (a *API) writePostEvents(w io.Writer, filter database.Filter, cursor int) (int, error) {
+	for {
+		posts, err := a.db.GetNewsAfter(filter, cursor, streamBatch)
+		if err != nil {
+			return cursor, err
+		}
+
+		for _, post := range posts {
+			data, err := json.Marshal(post)
+			if err != nil {
+				return cursor, err
+			}
+
+			fmt.Fprintf(w, "id: %d\nevent: post\ndata: %s\n\n", post.ID, data)
+			cursor = post.ID
+		}
+
+		if len(posts) < streamBatch {
+			return cursor, nil
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/hub"
+)
+
+//streamEvent is one Server-Sent Event, a comment has only the Comment.
+type streamEvent struct {
+	ID      string
+	Event   string
+	Data    string
+	Comment string
+}
+
+//openStream connects to the news stream of the test server and returns the channel of its events.
+func openStream(t *testing.T, ctx context.Context, url string, header http.Header) (<-chan streamEvent, *http.Response) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	events := make(chan streamEvent, 100)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		var event streamEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event != (streamEvent{}) {
+					events <- event
+				}
+				event = streamEvent{}
+			case strings.HasPrefix(line, ":"):
+				event.Comment = strings.TrimSpace(line[1:])
+			default:
+				field, value, _ := strings.Cut(line, ": ")
+				switch field {
+				case "id":
+					event.ID = value
+				case "event":
+					event.Event = value
+				case "data":
+					event.Data = value
+				}
+			}
+		}
+	}()
+
+	return events, resp
+}
+
+//nextPost returns the next post event of the stream, skipping the other events.
+func nextPost(t *testing.T, events <-chan streamEvent) *database.Post {
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("stream closed")
+			}
+			if event.Event != "post" {
+				continue
+			}
+
+			var post database.Post
+			assert.Nil(t, json.Unmarshal([]byte(event.Data), &post))
+			assert.Equal(t, strconv.Itoa(post.ID), event.ID)
+			return &post
+		case <-timeout:
+			t.Fatal("no post in the stream")
+		}
+	}
+}
+
+func TestAPI_StreamHandler(t *testing.T) {
+	api := testAPI(t)
+	db := api.db.(*database.Memdb)
+	events := api.events.(*hub.Hub)
+
+	server := httptest.NewServer(api.httpServer.Handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, resp := openStream(t, ctx, server.URL+"/news/stream?tag=go", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	//the stream starts with the news written after the request
+	posts := []*database.Post{
+		{Title: "Python", Link: "python", PubTime: time.Now().Unix()},
+		{Title: "Go", Link: "go", PubTime: time.Now().Unix(), Categories: []string{"Go"}},
+	}
+	assert.Nil(t, db.WriteNews(posts))
+	events.Publish(posts)
+
+	post := nextPost(t, stream)
+	assert.Equal(t, posts[1].ID, post.ID)
+	assert.Equal(t, "Go", post.Title)
+	assert.Equal(t, []string{"go"}, post.Tags)
+
+	cancel()
+
+	//the client reconnects with the id of the last event it got
+	more := []*database.Post{
+		{Title: "Go 2", Link: "go 2", PubTime: time.Now().Unix(), Categories: []string{"go"}},
+		{Title: "Go 3", Link: "go 3", PubTime: time.Now().Unix(), Categories: []string{"go"}},
+	}
+	assert.Nil(t, db.WriteNews(more))
+	events.Publish(more)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, _ = openStream(t, ctx, server.URL+"/news/stream?tag=go", http.Header{"Last-Event-ID": {strconv.Itoa(post.ID)}})
+	assert.Equal(t, more[0].ID, nextPost(t, stream).ID)
+	assert.Equal(t, more[1].ID, nextPost(t, stream).ID)
+}
+
+func TestAPI_StreamHandler_Heartbeat(t *testing.T) {
+	api := testAPI(t)
+	api.cfg.StreamHeartbeat = 10 * time.Millisecond
+	api.cfg.WriteTimeout = 500 * time.Millisecond
+
+	server := httptest.NewServer(api.httpServer.Handler)
+	defer server.Close()
+
+	stream, _ := openStream(t, context.Background(), server.URL+"/news/stream", nil)
+
+	heartbeats := 0
+	for event := range stream {
+		if event.Comment == "heartbeat" {
+			heartbeats++
+		}
+	}
+
+	//the stream ends before the write timeout
+	assert.Greater(t, heartbeats, 1)
+}
+
+func TestAPI_StreamHandler_BadRequest(t *testing.T) {
+	api := testAPI(t)
+
+	for _, path := range []string{"/news/stream?from=yesterday", "/news/stream?last_event_id=abc", "/news/stream?unread=true"} {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		assert.Equal(t, http.StatusBadRequest, execRequest(req, api.httpServer).Code, path)
+	}
+
+	api.events = nil
+	req, _ := http.NewRequest(http.MethodGet, "/news/stream", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, execRequest(req, api.httpServer).Code)
+}
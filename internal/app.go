@@ -1,22 +1,80 @@
 package internal
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/MarySmirnova/news_reader/internal/alerts"
 	"github.com/MarySmirnova/news_reader/internal/api"
 	"github.com/MarySmirnova/news_reader/internal/config"
 	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/hub"
+	"github.com/MarySmirnova/news_reader/internal/leader"
+	"github.com/MarySmirnova/news_reader/internal/maintenance"
+	"github.com/MarySmirnova/news_reader/internal/retention"
 	"github.com/MarySmirnova/news_reader/internal/rss"
 	"github.com/chatex-com/process-manager"
 	log "github.com/sirupsen/logrus"
 )
 
+type storage interface {
+	WriteNews([]*database.Post) error
+	GetLastNews(n int) ([]*database.Post, error)
+	NewsAmount(filter database.Filter) (int, error)
+	GetNewsPage(filter database.Filter, page int, ipemsPerPage int) ([]*database.Post, error)
+	GetNewsByID(id int) (*database.Post, error)
+	GetNewsAfter(filter database.Filter, id int, n int) ([]*database.Post, error)
+	LastNewsID() (int, error)
+	AddTags(id int, tags []string) error
+	RemoveTag(id int, tag string) error
+	GetTags() ([]*database.Tag, error)
+	PendingFullText(feed string, n int) ([]*database.Post, error)
+	WriteFullText(id int, text *database.FullText) error
+	WriteFeed(feed *database.Feed) error
+	GetFeed(url string) (*database.Feed, error)
+	GetFeeds() ([]*database.Feed, error)
+	WriteFeedIcon(feedURL string, icon *database.FeedIcon) error
+	GetFeedIcon(id int) (*database.FeedIcon, error)
+	GetHostPolicy(host string) (*database.HostPolicy, error)
+	WriteHostPolicy(policy *database.HostPolicy) error
+	CreateUser(user *database.User, closed bool) error
+	GetUser(id int) (*database.User, error)
+	GetUserByLogin(login string) (*database.User, error)
+	UsersAmount() (int, error)
+	CreateSession(session *database.Session) error
+	GetSession(tokenHash string) (*database.Session, error)
+	DeleteSession(tokenHash string) error
+	DeleteExpiredSessions(before int64) error
+	Subscribe(userID, feedID int, createdAt int64) error
+	Unsubscribe(userID, feedID int) error
+	GetSubscriptions(userID int) ([]*database.Feed, error)
+	MarkRead(userID, postID int, read bool, at int64) error
+	MarkAllRead(userID int, feed string, before int64) error
+	UnreadCounts(userID int) ([]*database.UnreadCount, error)
+	SavePost(userID, postID int, note string, at int64) error
+	UnsavePost(userID, postID int) error
+	GetSavedPosts(userID int, query string) ([]*database.SavedPost, error)
+	CreateAlertRule(rule *database.AlertRule) error
+	GetAlertRule(id int) (*database.AlertRule, error)
+	GetAlertRules(userID int) ([]*database.AlertRule, error)
+	DeleteAlertRule(userID, id int) error
+	CreateDeliveries(deliveries []*database.AlertDelivery) error
+	UpdateDelivery(delivery *database.AlertDelivery) error
+	DueDeliveries(now int64, n int) ([]*database.AlertDelivery, error)
+	GetDeliveries(ruleID int, n int) ([]*database.AlertDelivery, error)
+	DeleteDeliveries(before int64) error
+	ExpiredNews(before int64, keepPerFeed int) ([]*database.Post, error)
+	PruneNews(posts []*database.Post, archive bool) error
+	Close()
+}
+
 type Application struct {
 	sigChan <-chan os.Signal
 	cfg     config.Application
-	db      *database.Store
+	db      storage
+	pg      *database.Store
 	manager *process.Manager
 }
 
@@ -43,33 +101,113 @@ func (a *Application) bootstrap() error {
 		return err
 	}
 
+	pruner, err := retention.New(a.cfg.Retention, a.db)
+	if err != nil {
+		return err
+	}
+
+	parser := rss.NewNewsParser(a.cfg.RSS, a.db)
+
+	//with Postgres the hub gets the news written by every instance through the database notifications
+	events := hub.New()
+	if a.pg == nil {
+		parser.OnNewPosts(events.Publish)
+	}
+
+	alerter := alerts.New(a.cfg.Alerts, a.db)
+	parser.OnNewPosts(alerter.Evaluate)
+
 	// init workers
-	a.bootRSSWorker()
-	a.bootServerWorker()
+	if a.pg != nil {
+		a.bootMaintenanceWorker()
+		a.bootListenerWorker(events)
+		a.bootLeaderWorker(parser, alerter, pruner)
+	} else {
+		a.bootRSSWorker(parser)
+		a.bootAlertsWorker(alerter)
+		a.bootRetentionWorker(pruner)
+	}
+	a.bootServerWorker(pruner, parser, alerter, events)
 
 	return nil
 }
 
 func (a *Application) initDatabase() error {
-	db, err := database.NewPostgresDB(a.cfg.Postgres)
+	var (
+		db  storage
+		err error
+	)
+
+	switch a.cfg.DBDriver {
+	case "postgres":
+		a.pg, err = database.NewPostgresDB(a.cfg.Postgres)
+		if err == nil {
+			db = a.pg
+			//partitions should exist before the first posts are written, otherwise they go to the default one,
+			//the maintenance worker tries again, so a failure does not keep the service down
+			if err := maintenance.New(a.cfg.Postgres, a.pg).Run(); err != nil {
+				log.WithError(err).Error("fail to create partitions")
+			}
+		}
+	case "sqlite":
+		db, err = database.NewSQLiteDB(a.cfg.SQLite)
+	case "memory":
+		db = database.NewMemoryDB()
+	default:
+		err = fmt.Errorf("unknown database driver %q", a.cfg.DBDriver)
+	}
+
 	if err != nil {
 		log.WithError(err).Error("database connection error")
 		return err
 	}
 
-	log.Info("database connection established")
+	log.WithField("driver", a.cfg.DBDriver).Info("database connection established")
 	a.db = db
 	return nil
 }
 
-func (a *Application) bootRSSWorker() {
-	rssParser := rss.NewNewsParser(a.cfg.RSS, a.db)
-	rssWorker := process.NewCallbackWorker("rss", rssParser.Start)
+func (a *Application) bootMaintenanceWorker() {
+	maintainer := maintenance.New(a.cfg.Postgres, a.pg)
+	maintenanceWorker := process.NewCallbackWorker("maintenance", maintainer.Start)
+	a.manager.AddWorker(maintenanceWorker)
+}
+
+func (a *Application) bootListenerWorker(events *hub.Hub) {
+	listener := hub.NewListener(events, a.pg)
+	listenerWorker := process.NewCallbackWorker("listener", listener.Start)
+	a.manager.AddWorker(listenerWorker)
+}
+
+//bootLeaderWorker runs the feed polling, the alert deliveries and the retention only on the leader,
+//so the replicas sharing the database do not poll the same feeds and send the same alerts.
+func (a *Application) bootLeaderWorker(parser *rss.NewsParser, alerter *alerts.Alerter, pruner *retention.Pruner) {
+	elector := leader.New(a.cfg.Postgres, a.pg)
+	elector.Add("rss", parser.Start)
+	elector.Add("alerts", alerter.Start)
+	elector.Add("retention", pruner.Start)
+
+	leaderWorker := process.NewCallbackWorker("leader", elector.Start)
+	a.manager.AddWorker(leaderWorker)
+}
+
+func (a *Application) bootRSSWorker(parser *rss.NewsParser) {
+	rssWorker := process.NewCallbackWorker("rss", parser.Start)
 	a.manager.AddWorker(rssWorker)
 }
 
-func (a *Application) bootServerWorker() {
-	server := api.New(a.cfg.API, a.db)
+func (a *Application) bootAlertsWorker(alerter *alerts.Alerter) {
+	alertsWorker := process.NewCallbackWorker("alerts", alerter.Start)
+	a.manager.AddWorker(alertsWorker)
+}
+
+func (a *Application) bootRetentionWorker(pruner *retention.Pruner) {
+	retentionWorker := process.NewCallbackWorker("retention", pruner.Start)
+	a.manager.AddWorker(retentionWorker)
+}
+
+func (a *Application) bootServerWorker(pruner *retention.Pruner, parser *rss.NewsParser, alerter *alerts.Alerter, events *hub.Hub) {
+	server := api.New(a.cfg.API, a.db, pruner, parser, alerter, events)
 	serverWorker := process.NewServerWorker("api", server.GetHTTPServer())
 	a.manager.AddWorker(serverWorker)
 }
@@ -86,7 +224,7 @@ func (a *Application) registerShutdown() {
 		manager.StopAll()
 	}(a.manager)
 
-	defer a.db.GetPGXPool().Close()
+	defer a.db.Close()
 
 	a.manager.AwaitAll()
 }
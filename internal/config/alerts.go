@@ -0,0 +1,13 @@
+package config
+
+import "time"
+
+type Alerts struct {
+	MaxAttempts  int           `env:"ALERTS_MAX_ATTEMPTS" envDefault:"5"`      // сколько раз отправляется запрос к вебхуку, прежде чем доставка считается неудачной
+	Backoff      time.Duration `env:"ALERTS_BACKOFF" envDefault:"30s"`         // пауза перед второй попыткой, дальше она удваивается
+	MaxBackoff   time.Duration `env:"ALERTS_MAX_BACKOFF" envDefault:"1h"`      // наибольшая пауза между попытками
+	Timeout      time.Duration `env:"ALERTS_TIMEOUT" envDefault:"10s"`         // таймаут запроса к вебхуку
+	Period       time.Duration `env:"ALERTS_PERIOD" envDefault:"10s"`          // как часто проверяются доставки, ждущие повтора
+	LogTTL       time.Duration `env:"ALERTS_LOG_TTL" envDefault:"720h"`        // сколько хранится журнал завершенных доставок, 0 - всегда
+	AllowPrivate bool          `env:"ALERTS_ALLOW_PRIVATE" envDefault:"false"` // разрешает вебхуки на внутренних адресах: loopback, частных и link-local
+}
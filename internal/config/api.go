@@ -3,7 +3,14 @@ package config
 import "time"
 
 type API struct {
-	Listen       string        `env:"API_LISTEN" envDefault:":8080"`
-	ReadTimeout  time.Duration `env:"API_READ_TIMEOUT" envDefault:"30s"`
-	WriteTimeout time.Duration `env:"API_WRITE_TIMEOUT" envDefault:"30s"`
+	Listen             string        `env:"API_LISTEN" envDefault:":8080"`
+	ReadTimeout        time.Duration `env:"API_READ_TIMEOUT" envDefault:"30s"`
+	WriteTimeout       time.Duration `env:"API_WRITE_TIMEOUT" envDefault:"30s"`
+	AnonymousRead      bool          `env:"API_ANONYMOUS_READ" envDefault:"false"`     // разрешить чтение новостей, тегов и лент без входа
+	Registration       bool          `env:"API_REGISTRATION" envDefault:"false"`       // открытая регистрация, иначе пользователей добавляет администратор
+	SessionTTL         time.Duration `env:"API_SESSION_TTL" envDefault:"720h"`         // время жизни сессии после входа
+	CORSOrigins        []string      `env:"API_CORS_ORIGINS" envSeparator:","`         // источники, которым разрешены запросы из браузера, "*" - любые
+	StreamHeartbeat    time.Duration `env:"API_STREAM_HEARTBEAT" envDefault:"15s"`     // как часто в поток новостей отправляется комментарий, чтобы соединение не закрылось
+	SocketQueue        int           `env:"API_SOCKET_QUEUE" envDefault:"64"`          // сколько сообщений WebSocket клиента ждут отправки, пока он их не принял
+	SocketWriteTimeout time.Duration `env:"API_SOCKET_WRITE_TIMEOUT" envDefault:"10s"` // клиент, не принявший сообщение за это время, отключается
 }
@@ -2,7 +2,11 @@ package config
 
 type Application struct {
 	LogLevel string `env:"LOG_LEVEL" envDefault:"INFO"`
+	DBDriver string `env:"DB_DRIVER" envDefault:"postgres"`
 	RSS
 	API
 	Postgres
+	SQLite
+	Retention
+	Alerts
 }
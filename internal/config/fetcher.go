@@ -0,0 +1,17 @@
+package config
+
+import "time"
+
+//Fetcher configures the HTTP client of the RSS parser, zero values disable the corresponding limit.
+type Fetcher struct {
+	ConnectTimeout time.Duration `env:"FETCH_CONNECT_TIMEOUT" envDefault:"10s"`
+	ReadTimeout    time.Duration `env:"FETCH_READ_TIMEOUT" envDefault:"30s"`
+	MaxBodySize    int64         `env:"FETCH_MAX_BODY_SIZE" envDefault:"10485760"`
+	MaxRedirects   int           `env:"FETCH_MAX_REDIRECTS" envDefault:"5"`
+	MaxPerHost     int           `env:"FETCH_MAX_PER_HOST" envDefault:"2"`
+	UserAgent      string        `env:"FETCH_USER_AGENT" envDefault:"news_reader/1.0 (+https://github.com/MarySmirnova/news_reader)"`
+	HostDelay      time.Duration `env:"FETCH_HOST_DELAY" envDefault:"1s"`
+	Robots         bool          `env:"FETCH_ROBOTS" envDefault:"true"`
+	RobotsTTL      time.Duration `env:"FETCH_ROBOTS_TTL" envDefault:"24h"`
+	AllowPrivate   bool          `env:"FETCH_ALLOW_PRIVATE" envDefault:"false"` // разрешает ссылкам пользователей (поиск и предпросмотр лент) вести на внутренние адреса
+}
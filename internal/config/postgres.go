@@ -1,10 +1,16 @@
 package config
 
+import "time"
+
 type Postgres struct {
-	User         string `env:"PG_USER"`
-	Password     string `env:"PG_PASSWORD"`
-	Host         string `env:"PG_HOST"`
-	Port         int    `env:"PG_PORT"`
-	Database     string `env:"PG_DATABASE"`
-	TestDatabase string `env:"PG_TEST_DATABASE"`
+	User              string        `env:"PG_USER"`
+	Password          string        `env:"PG_PASSWORD"`
+	Host              string        `env:"PG_HOST"`
+	Port              int           `env:"PG_PORT"`
+	Database          string        `env:"PG_DATABASE"`
+	TestDatabase      string        `env:"PG_TEST_DATABASE"`
+	PartitionsAhead   int           `env:"PG_PARTITIONS_AHEAD" envDefault:"3"`
+	MaintenancePeriod time.Duration `env:"PG_MAINTENANCE_PERIOD" envDefault:"24h"`
+	LeaderLockKey     int64         `env:"PG_LEADER_LOCK_KEY" envDefault:"20220601"`
+	LeaderPeriod      time.Duration `env:"PG_LEADER_PERIOD" envDefault:"5s"`
 }
@@ -0,0 +1,11 @@
+package config
+
+import "time"
+
+type Retention struct {
+	MaxAge          time.Duration `env:"RETENTION_MAX_AGE" envDefault:"0"`
+	MaxPostsPerFeed int           `env:"RETENTION_MAX_POSTS_PER_FEED" envDefault:"0"`
+	Mode            string        `env:"RETENTION_MODE" envDefault:"delete"`
+	DryRun          bool          `env:"RETENTION_DRY_RUN" envDefault:"false"`
+	Period          time.Duration `env:"RETENTION_PERIOD" envDefault:"1h"`
+}
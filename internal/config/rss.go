@@ -1,6 +1,30 @@
 package config
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 type RSS struct {
-	Links         []string `json:"rss"`
-	RequestPeriod int      `json:"request_period"`
+	Feeds         []Feed `json:"rss"`
+	RequestPeriod int    `json:"request_period"`
+	Workers       int    `json:"workers" env:"RSS_WORKERS" envDefault:"4"` // сколько лент опрашиваются одновременно
+	Fetcher       `json:"-"`
+}
+
+//Feed is a feed from the config, it is written either as a link or as an object with options.
+type Feed struct {
+	URL      string `json:"url"`
+	FullText bool   `json:"full_text"` // загружать полный текст статей по ссылкам из ленты
+}
+
+//UnmarshalJSON accepts both "https://example.com/rss" and {"url": "https://example.com/rss", "full_text": true}.
+func (f *Feed) UnmarshalJSON(data []byte) error {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), `"`) {
+		*f = Feed{}
+		return json.Unmarshal(data, &f.URL)
+	}
+
+	type feed Feed
+	return json.Unmarshal(data, (*feed)(f))
 }
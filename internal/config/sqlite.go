@@ -0,0 +1,5 @@
+package config
+
+type SQLite struct {
+	Path string `env:"SQLITE_PATH" envDefault:"news.db"`
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+)
+
+//compressPost encodes the post as gzipped JSON for the archive.
+func compressPost(post *Post) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(post); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+//decompressPost decodes the post stored by compressPost.
+func decompressPost(data []byte) (*Post, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var post Post
+	if err = json.NewDecoder(zr).Decode(&post); err != nil {
+		return nil, err
+	}
+
+	return &post, nil
+}
@@ -0,0 +1,1022 @@
+package database
+
+import (
+	"sort"
+	"sync"
+)
+
+//Memdb is an in-memory storage, used in tests and for running without a database.
+type Memdb struct {
+	mu             sync.RWMutex
+	posts          []*Post
+	keys           map[string]struct{}
+	links          map[string]struct{}
+	archive        map[string][]byte
+	texts          map[int]*FullText
+	hosts          map[string]*HostPolicy
+	feeds          []*Feed
+	icons          map[int]*FeedIcon
+	users          []*User
+	sessions       map[string]*Session
+	subs           map[int]map[int]bool
+	reads          map[int]map[int]bool
+	marks          map[int]map[string]int64
+	saved          map[int]map[int]*SavedPost
+	rules          []*AlertRule
+	deliveries     []*AlertDelivery
+	lastID         int
+	lastRuleID     int
+	lastDeliveryID int
+}
+
+//NewMemoryDB creates a new empty instance Memdb.
+func NewMemoryDB() *Memdb {
+	return &Memdb{
+		keys:     make(map[string]struct{}),
+		links:    make(map[string]struct{}),
+		archive:  make(map[string][]byte),
+		texts:    make(map[int]*FullText),
+		hosts:    make(map[string]*HostPolicy),
+		icons:    make(map[int]*FeedIcon),
+		sessions: make(map[string]*Session),
+		subs:     make(map[int]map[int]bool),
+		reads:    make(map[int]map[int]bool),
+		marks:    make(map[int]map[string]int64),
+		saved:    make(map[int]map[int]*SavedPost),
+	}
+}
+
+//Close does nothing, it exists to satisfy the same interface as the other stores.
+func (m *Memdb) Close() {}
+
+//WriteNews adds posts to the memory, checking guids for uniqueness.
+//Posts that were already pruned by the retention policy are not added again.
+//The inserted posts get their ids, the skipped ones get zero ids.
+func (m *Memdb) WriteNews(posts []*Post) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, post := range posts {
+		post.ID = 0
+		key := post.key()
+
+		if _, ok := m.keys[key]; ok {
+			continue
+		}
+		if _, ok := m.links[post.Link]; ok {
+			continue
+		}
+		if _, ok := m.archive[key]; ok {
+			continue
+		}
+
+		m.lastID++
+		p := *post
+		p.ID = m.lastID
+		p.GUID = key
+		p.Categories = append([]string{}, post.Categories...)
+		if post.Enclosure != nil {
+			enclosure := *post.Enclosure
+			p.Enclosure = &enclosure
+		}
+		p.Media = append([]Media{}, post.Media...)
+		p.Tags = normalizeTags(post.Categories)
+		sort.Strings(p.Tags)
+
+		m.posts = append(m.posts, &p)
+		m.keys[key] = struct{}{}
+		m.links[post.Link] = struct{}{}
+		post.ID = p.ID
+	}
+
+	return nil
+}
+
+//GetLastNews returns the latest n news, sorted by publication date.
+func (m *Memdb) GetLastNews(n int) ([]*Post, error) {
+	posts := m.find(Filter{})
+	if len(posts) > n {
+		posts = posts[:n]
+	}
+
+	return posts, nil
+}
+
+//NewsAmount returns the number of news by filter.
+func (m *Memdb) NewsAmount(filter Filter) (int, error) {
+	return len(m.find(filter)), nil
+}
+
+//GetNewsPage returns the specified page with news by filter.
+func (m *Memdb) GetNewsPage(filter Filter, page int, ipemsPerPage int) ([]*Post, error) {
+	posts := m.find(filter)
+
+	offset := (page - 1) * ipemsPerPage
+	if page < 1 || offset >= len(posts) {
+		return nil, nil
+	}
+
+	end := offset + ipemsPerPage
+	if end > len(posts) {
+		end = len(posts)
+	}
+
+	return posts[offset:end], nil
+}
+
+//GetNewsAfter returns up to n news by filter with ids greater than id, in the order they were written.
+func (m *Memdb) GetNewsAfter(filter Filter, id int, n int) ([]*Post, error) {
+	var posts []*Post
+	for _, post := range m.find(filter) {
+		if post.ID > id {
+			posts = append(posts, post)
+		}
+	}
+
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].ID < posts[j].ID
+	})
+
+	if len(posts) > n {
+		posts = posts[:n]
+	}
+
+	return posts, nil
+}
+
+//LastNewsID returns the greatest id of the stored news, 0 if there are none.
+func (m *Memdb) LastNewsID() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id := 0
+	for _, post := range m.posts {
+		if post.ID > id {
+			id = post.ID
+		}
+	}
+
+	return id, nil
+}
+
+//GetNewsByID returns one post by its id.
+func (m *Memdb) GetNewsByID(id int) (*Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	post := m.post(id)
+	if post == nil {
+		return nil, ErrNotFound
+	}
+
+	p := *post
+	if text, ok := m.texts[id]; ok && text.Error == "" {
+		p.FullText = text.Content
+	}
+
+	return &p, nil
+}
+
+//PendingFullText returns the latest n posts of the feed, for which the full text was not fetched yet.
+func (m *Memdb) PendingFullText(feed string, n int) ([]*Post, error) {
+	var pending []*Post
+	for _, post := range m.find(Filter{}) {
+		if len(pending) == n {
+			break
+		}
+
+		m.mu.RLock()
+		_, ok := m.texts[post.ID]
+		m.mu.RUnlock()
+
+		if post.Feed == feed && !ok {
+			pending = append(pending, post)
+		}
+	}
+
+	return pending, nil
+}
+
+//WriteFullText saves the full text of the post, an existing one is replaced.
+func (m *Memdb) WriteFullText(id int, text *FullText) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.post(id) == nil {
+		return ErrNotFound
+	}
+
+	t := *text
+	m.texts[id] = &t
+
+	return nil
+}
+
+//AddTags attaches user tags to the post.
+func (m *Memdb) AddTags(id int, tags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	post := m.post(id)
+	if post == nil {
+		return ErrNotFound
+	}
+
+	//the tags slice is replaced, not modified, because copies of the post share it
+	post.Tags = normalizeTags(append(append([]string{}, post.Tags...), tags...))
+	sort.Strings(post.Tags)
+
+	return nil
+}
+
+//RemoveTag detaches the tag from the post.
+func (m *Memdb) RemoveTag(id int, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	post := m.post(id)
+	tag = NormalizeTag(tag)
+	if post == nil || !containsString(post.Tags, tag) {
+		return ErrNotFound
+	}
+
+	tags := make([]string, 0, len(post.Tags))
+	for _, t := range post.Tags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	post.Tags = tags
+
+	return nil
+}
+
+//GetTags returns all tags that have posts with the number of their posts, the most popular first.
+func (m *Memdb) GetTags() ([]*Tag, error) {
+	counts := make(map[string]int)
+	for _, post := range m.find(Filter{}) {
+		for _, tag := range post.Tags {
+			counts[tag]++
+		}
+	}
+
+	tags := []*Tag{}
+	for name, count := range counts {
+		tags = append(tags, &Tag{Name: name, Count: count})
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Name < tags[j].Name
+	})
+
+	return tags, nil
+}
+
+//WriteFeed saves the channel metadata of the feed, the feed is created on first write.
+func (m *Memdb) WriteFeed(feed *Feed) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f := *feed
+	if stored := m.feed(feed.URL); stored != nil {
+		f.ID, f.IconFetchedAt, f.HasIcon = stored.ID, stored.IconFetchedAt, stored.HasIcon
+		*stored = f
+		return nil
+	}
+
+	f.ID = len(m.feeds) + 1
+	f.IconFetchedAt, f.HasIcon = 0, false
+	m.feeds = append(m.feeds, &f)
+
+	return nil
+}
+
+//GetFeed returns the feed by its link.
+func (m *Memdb) GetFeed(url string) (*Feed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	feed := m.feed(url)
+	if feed == nil {
+		return nil, ErrNotFound
+	}
+
+	f := *feed
+	return &f, nil
+}
+
+//GetFeeds returns all feeds in the order they were first fetched.
+func (m *Memdb) GetFeeds() ([]*Feed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	feeds := make([]*Feed, 0, len(m.feeds))
+	for _, feed := range m.feeds {
+		f := *feed
+		feeds = append(feeds, &f)
+	}
+
+	return feeds, nil
+}
+
+//SavePost stars the post for the user, starring it again replaces the note.
+//ErrNotFound is returned if the post does not exist.
+func (m *Memdb) SavePost(userID, postID int, note string, at int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.post(postID) == nil {
+		return ErrNotFound
+	}
+
+	if m.saved[userID] == nil {
+		m.saved[userID] = make(map[int]*SavedPost)
+	}
+	if saved, ok := m.saved[userID][postID]; ok {
+		saved.Note = note
+		return nil
+	}
+	m.saved[userID][postID] = &SavedPost{Note: note, SavedAt: at}
+
+	return nil
+}
+
+//UnsavePost removes the star of the user from the post.
+//ErrNotFound is returned if the post is not starred.
+func (m *Memdb) UnsavePost(userID, postID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.saved[userID][postID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.saved[userID], postID)
+
+	return nil
+}
+
+//GetSavedPosts returns the posts starred by the user, the last saved first.
+//A non-empty query is searched in the title, the text and the note.
+func (m *Memdb) GetSavedPosts(userID int, query string) ([]*SavedPost, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	saved := []*SavedPost{}
+	for postID, s := range m.saved[userID] {
+		post := m.post(postID)
+		if post == nil {
+			continue
+		}
+		if query != "" && !(Filter{Query: query}).match(post) && !containsFold(s.Note, query) {
+			continue
+		}
+
+		p := *post
+		saved = append(saved, &SavedPost{Post: &p, Note: s.Note, SavedAt: s.SavedAt})
+	}
+
+	sort.Slice(saved, func(i, j int) bool {
+		if saved[i].SavedAt != saved[j].SavedAt {
+			return saved[i].SavedAt > saved[j].SavedAt
+		}
+		return saved[i].ID > saved[j].ID
+	})
+
+	return saved, nil
+}
+
+//isSaved reports whether any user has starred the post, the caller must hold the lock.
+func (m *Memdb) isSaved(postID int) bool {
+	for _, saved := range m.saved {
+		if _, ok := saved[postID]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+//MarkRead sets the read state of the post for the user.
+//ErrNotFound is returned if the post does not exist.
+func (m *Memdb) MarkRead(userID, postID int, read bool, at int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.post(postID) == nil {
+		return ErrNotFound
+	}
+
+	if m.reads[userID] == nil {
+		m.reads[userID] = make(map[int]bool)
+	}
+	m.reads[userID][postID] = read
+
+	return nil
+}
+
+//MarkAllRead marks as read the posts of the feed published up to the unix time before, an empty feed means all feeds.
+func (m *Memdb) MarkAllRead(userID int, feed string, before int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.marks[userID] == nil {
+		m.marks[userID] = make(map[string]int64)
+	}
+	if before > m.marks[userID][feed] {
+		m.marks[userID][feed] = before
+	}
+
+	for _, post := range m.posts {
+		if post.PubTime <= before && (feed == "" || post.Feed == feed) {
+			delete(m.reads[userID], post.ID)
+		}
+	}
+
+	return nil
+}
+
+//UnreadCounts returns the number of unread posts of the user for each feed that has them.
+func (m *Memdb) UnreadCounts(userID int) ([]*UnreadCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	amounts := make(map[string]int)
+	for _, post := range m.posts {
+		if !m.isRead(userID, post) {
+			amounts[post.Feed]++
+		}
+	}
+
+	counts := []*UnreadCount{}
+	for feed, count := range amounts {
+		counts = append(counts, &UnreadCount{Feed: feed, Count: count})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Feed < counts[j].Feed
+	})
+
+	return counts, nil
+}
+
+//isRead reports whether the user has read the post, the state of the post wins over the marks.
+func (m *Memdb) isRead(userID int, post *Post) bool {
+	if read, ok := m.reads[userID][post.ID]; ok {
+		return read
+	}
+
+	mark := m.marks[userID][""]
+	if feedMark := m.marks[userID][post.Feed]; feedMark > mark {
+		mark = feedMark
+	}
+
+	return post.PubTime <= mark
+}
+
+//Subscribe subscribes the user to the feed, the repeated subscription is not an error.
+//ErrNotFound is returned if the feed does not exist.
+func (m *Memdb) Subscribe(userID, feedID int, createdAt int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if feedID < 1 || feedID > len(m.feeds) {
+		return ErrNotFound
+	}
+
+	if m.subs[userID] == nil {
+		m.subs[userID] = make(map[int]bool)
+	}
+	m.subs[userID][feedID] = true
+
+	return nil
+}
+
+//Unsubscribe removes the subscription of the user to the feed.
+//ErrNotFound is returned if the user is not subscribed to the feed.
+func (m *Memdb) Unsubscribe(userID, feedID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.subs[userID][feedID] {
+		return ErrNotFound
+	}
+	delete(m.subs[userID], feedID)
+
+	return nil
+}
+
+//GetSubscriptions returns the feeds the user is subscribed to.
+func (m *Memdb) GetSubscriptions(userID int) ([]*Feed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	feeds := []*Feed{}
+	for _, feed := range m.feeds {
+		if m.subs[userID][feed.ID] {
+			f := *feed
+			feeds = append(feeds, &f)
+		}
+	}
+
+	return feeds, nil
+}
+
+//WriteFeedIcon saves the result of the icon download, a failed download keeps the previous icon.
+func (m *Memdb) WriteFeedIcon(feedURL string, icon *FeedIcon) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	feed := m.feed(feedURL)
+	if feed == nil {
+		return ErrNotFound
+	}
+
+	feed.IconFetchedAt = icon.FetchedAt
+	if len(icon.Data) > 0 {
+		i := *icon
+		i.Data = append([]byte{}, icon.Data...)
+		m.icons[feed.ID] = &i
+		feed.HasIcon = true
+	}
+
+	return nil
+}
+
+//GetFeedIcon returns the icon of the feed site.
+func (m *Memdb) GetFeedIcon(id int) (*FeedIcon, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	icon, ok := m.icons[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	for _, feed := range m.feeds {
+		if feed.ID == id {
+			i := *icon
+			i.FetchedAt = feed.IconFetchedAt
+			return &i, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+//CreateUser adds the user and sets its ID, the first user becomes an admin.
+//ErrExists is returned if the login is taken. With closed registration only the first user is added,
+//ErrRegistrationClosed is returned if there are users already.
+func (m *Memdb) CreateUser(user *User, closed bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if closed && len(m.users) > 0 {
+		return ErrRegistrationClosed
+	}
+
+	for _, u := range m.users {
+		if u.Login == user.Login {
+			return ErrExists
+		}
+	}
+
+	user.ID = len(m.users) + 1
+	user.Admin = len(m.users) == 0
+
+	u := *user
+	m.users = append(m.users, &u)
+
+	return nil
+}
+
+//GetUser returns the user by its id.
+func (m *Memdb) GetUser(id int) (*User, error) {
+	return m.getUser(func(u *User) bool { return u.ID == id })
+}
+
+//GetUserByLogin returns the user by its login.
+func (m *Memdb) GetUserByLogin(login string) (*User, error) {
+	return m.getUser(func(u *User) bool { return u.Login == login })
+}
+
+//UsersAmount returns the number of registered users.
+func (m *Memdb) UsersAmount() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.users), nil
+}
+
+//CreateSession saves the session of the user.
+func (m *Memdb) CreateSession(session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[session.TokenHash]; ok {
+		return ErrExists
+	}
+
+	s := *session
+	m.sessions[session.TokenHash] = &s
+
+	return nil
+}
+
+//GetSession returns the session by the hash of its token, expired sessions are returned too.
+func (m *Memdb) GetSession(tokenHash string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	s := *session
+	return &s, nil
+}
+
+//DeleteSession removes the session, a missing session is not an error.
+func (m *Memdb) DeleteSession(tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, tokenHash)
+
+	return nil
+}
+
+//DeleteExpiredSessions removes the sessions that expired before the unix time.
+func (m *Memdb) DeleteExpiredSessions(before int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, session := range m.sessions {
+		if session.ExpiresAt < before {
+			delete(m.sessions, hash)
+		}
+	}
+
+	return nil
+}
+
+//getUser returns a copy of the first user matching the condition.
+func (m *Memdb) getUser(match func(*User) bool) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		if match(user) {
+			u := *user
+			return &u, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+//CreateAlertRule adds the alert rule and sets its id.
+func (m *Memdb) CreateAlertRule(rule *AlertRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastRuleID++
+	rule.ID = m.lastRuleID
+	m.rules = append(m.rules, copyAlertRule(rule))
+
+	return nil
+}
+
+//GetAlertRule returns the alert rule by id.
+func (m *Memdb) GetAlertRule(id int) (*AlertRule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, rule := range m.rules {
+		if rule.ID == id {
+			return copyAlertRule(rule), nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+//GetAlertRules returns the alert rules of the user in the order they were created, zero userID returns the rules of all users.
+func (m *Memdb) GetAlertRules(userID int) ([]*AlertRule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rules := []*AlertRule{}
+	for _, rule := range m.rules {
+		if userID == 0 || rule.UserID == userID {
+			rules = append(rules, copyAlertRule(rule))
+		}
+	}
+
+	return rules, nil
+}
+
+//DeleteAlertRule removes the alert rule of the user together with its deliveries.
+func (m *Memdb) DeleteAlertRule(userID, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, rule := range m.rules {
+		if rule.ID != id || rule.UserID != userID {
+			continue
+		}
+
+		m.rules = append(m.rules[:i], m.rules[i+1:]...)
+
+		deliveries := m.deliveries[:0]
+		for _, delivery := range m.deliveries {
+			if delivery.RuleID != id {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		m.deliveries = deliveries
+
+		return nil
+	}
+
+	return ErrNotFound
+}
+
+//CreateDeliveries adds the deliveries and sets their ids.
+func (m *Memdb) CreateDeliveries(deliveries []*AlertDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, delivery := range deliveries {
+		m.lastDeliveryID++
+		delivery.ID = m.lastDeliveryID
+
+		d := *delivery
+		m.deliveries = append(m.deliveries, &d)
+	}
+
+	return nil
+}
+
+//UpdateDelivery saves the result of the delivery attempt.
+func (m *Memdb) UpdateDelivery(delivery *AlertDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range m.deliveries {
+		if d.ID != delivery.ID {
+			continue
+		}
+
+		d.Status = delivery.Status
+		d.Attempts = delivery.Attempts
+		d.ResponseCode = delivery.ResponseCode
+		d.Error = delivery.Error
+		d.UpdatedAt = delivery.UpdatedAt
+		d.NextAttemptAt = delivery.NextAttemptAt
+
+		return nil
+	}
+
+	return ErrNotFound
+}
+
+//DueDeliveries returns up to n pending deliveries whose next attempt is due at the time now.
+func (m *Memdb) DueDeliveries(now int64, n int) ([]*AlertDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	deliveries := []*AlertDelivery{}
+	for _, delivery := range m.deliveries {
+		if delivery.Status == DeliveryPending && delivery.NextAttemptAt <= now {
+			d := *delivery
+			deliveries = append(deliveries, &d)
+		}
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].NextAttemptAt < deliveries[j].NextAttemptAt
+	})
+
+	if len(deliveries) > n {
+		deliveries = deliveries[:n]
+	}
+
+	return deliveries, nil
+}
+
+//GetDeliveries returns the latest n deliveries of the alert rule, the newest first.
+func (m *Memdb) GetDeliveries(ruleID int, n int) ([]*AlertDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	deliveries := []*AlertDelivery{}
+	for i := len(m.deliveries) - 1; i >= 0 && len(deliveries) < n; i-- {
+		if m.deliveries[i].RuleID == ruleID {
+			d := *m.deliveries[i]
+			deliveries = append(deliveries, &d)
+		}
+	}
+
+	return deliveries, nil
+}
+
+//DeleteDeliveries removes the delivered and failed deliveries last attempted before the given time.
+func (m *Memdb) DeleteDeliveries(before int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries := m.deliveries[:0]
+	for _, delivery := range m.deliveries {
+		if delivery.Status == DeliveryPending || delivery.UpdatedAt >= before {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	m.deliveries = deliveries
+
+	return nil
+}
+
+func copyAlertRule(rule *AlertRule) *AlertRule {
+	r := *rule
+	r.Keywords = append([]string{}, rule.Keywords...)
+	r.Feeds = append([]string{}, rule.Feeds...)
+
+	return &r
+}
+
+//GetHostPolicy returns the saved state of the host for the fetcher.
+func (m *Memdb) GetHostPolicy(host string) (*HostPolicy, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	policy, ok := m.hosts[host]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	p := *policy
+	return &p, nil
+}
+
+//WriteHostPolicy saves the state of the host, an existing one is replaced.
+func (m *Memdb) WriteHostPolicy(policy *HostPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := *policy
+	m.hosts[policy.Host] = &p
+
+	return nil
+}
+
+//ExpiredNews returns posts published before the "before" unix time
+//or not among the latest keepPerFeed posts of their feed, the oldest first.
+//Zero values disable the corresponding limit.
+func (m *Memdb) ExpiredNews(before int64, keepPerFeed int) ([]*Post, error) {
+	rank := make(map[string]int)
+	posts := m.find(Filter{})
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var expired []*Post
+	for _, post := range posts {
+		rank[post.Feed]++
+
+		if m.isSaved(post.ID) {
+			continue
+		}
+		if (before > 0 && post.PubTime < before) || (keepPerFeed > 0 && rank[post.Feed] > keepPerFeed) {
+			expired = append(expired, post)
+		}
+	}
+
+	for i, j := 0, len(expired)-1; i < j; i, j = i+1, j-1 {
+		expired[i], expired[j] = expired[j], expired[i]
+	}
+
+	return expired, nil
+}
+
+//PruneNews removes posts from the memory and remembers their guids, so they are not fetched again.
+//If archive is true, the compressed posts are kept in the archive.
+func (m *Memdb) PruneNews(posts []*Post, archive bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pruned := make(map[int]struct{}, len(posts))
+
+	for _, post := range posts {
+		//the post starred after it was selected for pruning is kept
+		if m.isSaved(post.ID) {
+			continue
+		}
+
+		var data []byte
+		if archive {
+			var err error
+			if data, err = compressPost(post); err != nil {
+				return err
+			}
+		}
+
+		if _, ok := m.archive[post.key()]; !ok {
+			m.archive[post.key()] = data
+		}
+		pruned[post.ID] = struct{}{}
+	}
+
+	kept := m.posts[:0]
+	for _, post := range m.posts {
+		if _, ok := pruned[post.ID]; ok {
+			delete(m.keys, post.key())
+			delete(m.links, post.Link)
+			delete(m.texts, post.ID)
+			for _, reads := range m.reads {
+				delete(reads, post.ID)
+			}
+			continue
+		}
+		kept = append(kept, post)
+	}
+	m.posts = kept
+
+	return nil
+}
+
+//GetArchivedNews returns the archived post by its guid.
+func (m *Memdb) GetArchivedNews(guid string) (*Post, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data := m.archive[guid]
+	if data == nil {
+		return nil, ErrNotFound
+	}
+
+	return decompressPost(data)
+}
+
+//post returns the stored post by its id, the caller must hold the lock.
+func (m *Memdb) post(id int) *Post {
+	for _, post := range m.posts {
+		if post.ID == id {
+			return post
+		}
+	}
+
+	return nil
+}
+
+//feed returns the stored feed by its link, the caller must hold the lock.
+func (m *Memdb) feed(url string) *Feed {
+	for _, feed := range m.feeds {
+		if feed.URL == url {
+			return feed
+		}
+	}
+
+	return nil
+}
+
+//find returns copies of the posts matching the filter, sorted by publication date.
+func (m *Memdb) find(filter Filter) []*Post {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var feeds map[string]bool
+	if filter.UserID != 0 && filter.Subscribed {
+		feeds = make(map[string]bool)
+		for _, feed := range m.feeds {
+			if m.subs[filter.UserID][feed.ID] {
+				feeds[feed.URL] = true
+			}
+		}
+	}
+
+	var posts []*Post
+	for _, post := range m.posts {
+		if !filter.match(post) || (feeds != nil && !feeds[post.Feed]) {
+			continue
+		}
+		if filter.UserID != 0 && filter.Unread && m.isRead(filter.UserID, post) {
+			continue
+		}
+
+		p := *post
+		posts = append(posts, &p)
+	}
+
+	sort.Slice(posts, func(i, j int) bool {
+		if posts[i].PubTime != posts[j].PubTime {
+			return posts[i].PubTime > posts[j].PubTime
+		}
+		return posts[i].ID > posts[j].ID
+	})
+
+	return posts
+}
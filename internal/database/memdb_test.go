@@ -0,0 +1,9 @@
+package database
+
+import "testing"
+
+func TestMemdb(t *testing.T) {
+	runStorageSuite(t, func(t *testing.T) (testStorage, func()) {
+		return NewMemoryDB(), func() {}
+	})
+}
@@ -1,9 +1,279 @@
 package database
 
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+//ErrNotFound is returned by all stores when the requested record does not exist.
+var ErrNotFound = errors.New("not found")
+
+//ErrExists is returned when a record with the same unique key already exists.
+var ErrExists = errors.New("already exists")
+
+//ErrRegistrationClosed is returned by CreateUser when only the first user may register and there are users already.
+var ErrRegistrationClosed = errors.New("registration is closed")
+
 type Post struct {
-	ID      int    // номер записи
-	Title   string // заголовок публикации
-	Content string // содержание публикации
-	PubTime int64  // время публикации
-	Link    string // ссылка на источник
+	ID         int        // номер записи
+	Title      string     // заголовок публикации
+	Content    string     // содержание публикации, очищенный HTML
+	PlainText  string     // текст публикации без разметки для поиска и превью
+	PubTime    int64      // время публикации
+	Link       string     // ссылка на источник
+	Feed       string     // ссылка на RSS ленту, из которой получена запись
+	GUID       string     // уникальный идентификатор записи в ленте, по нему отсеиваются повторы
+	Author     string     // автор публикации
+	Categories []string   // категории публикации из ленты
+	Comments   string     // ссылка на комментарии
+	Enclosure  *Enclosure // вложение, если есть
+	FetchedAt  int64      // время получения записи из ленты
+	Tags       []string   // теги: нормализованные категории из ленты и теги пользователей
+	Media      []Media    // медиа вложения: enclosure, media:content и media:thumbnail
+	FullText   string     `json:",omitempty"` // полный текст статьи для лент с full_text, только в GET /news/full/{id}
+}
+
+type Enclosure struct {
+	URL    string // ссылка на файл
+	Type   string // MIME тип
+	Length int64  // размер в байтах
+}
+
+type Media struct {
+	URL    string // ссылка на файл
+	Type   string // MIME тип
+	Medium string // вид вложения: image, audio, video или document
+	Source string // элемент ленты, из которого получено вложение
+	Length int64  // размер в байтах
+	Width  int    // ширина в пикселях
+	Height int    // высота в пикселях
+}
+
+//Feed elements the media attachments come from.
+const (
+	MediaSourceEnclosure = "enclosure"
+	MediaSourceContent   = "media:content"
+	MediaSourceThumbnail = "media:thumbnail"
+)
+
+type FullText struct {
+	Content   string // очищенный HTML статьи
+	PlainText string // текст статьи без разметки
+	FetchedAt int64  // время загрузки статьи
+	Error     string // ошибка загрузки или извлечения, такие статьи не загружаются повторно
+}
+
+type Tag struct {
+	Name  string // нормализованное название тега
+	Count int    // количество записей с тегом
+}
+
+type Feed struct {
+	ID            int    // номер ленты
+	URL           string // ссылка на RSS ленту, совпадает с Post.Feed
+	Title         string // название канала
+	Link          string // ссылка на сайт
+	Description   string // описание канала
+	Language      string // язык канала
+	Image         string // ссылка на логотип из ленты
+	LastBuildDate int64  // время последнего изменения ленты по её данным
+	FetchedAt     int64  // время последнего успешного опроса ленты
+	IconFetchedAt int64  // время последней попытки загрузить иконку сайта
+	HasIcon       bool   // иконка сайта загружена и отдается по GET /feeds/{id}/icon
+}
+
+type FeedIcon struct {
+	Type      string // MIME тип изображения
+	Data      []byte // изображение, пустое, если иконку не удалось загрузить
+	FetchedAt int64  // время загрузки
+}
+
+type User struct {
+	ID           int    // номер пользователя
+	Login        string // логин в нижнем регистре
+	PasswordHash string `json:"-"` // bcrypt хеш пароля
+	Admin        bool   // администратор, им становится первый зарегистрированный пользователь
+	CreatedAt    int64  // время регистрации
+}
+
+type Session struct {
+	TokenHash string // sha256 токена сессии, сам токен не хранится
+	UserID    int    // владелец сессии
+	CreatedAt int64  // время входа
+	ExpiresAt int64  // время, после которого сессия недействительна
+}
+
+//SavedPost is the post starred by the user, starred posts are never pruned.
+type SavedPost struct {
+	*Post
+	Note    string // заметка пользователя
+	SavedAt int64  // время добавления в закладки
+}
+
+//UnreadCount is the number of posts of the feed the user has not read.
+type UnreadCount struct {
+	Feed  string // ссылка на ленту
+	Count int    // количество непрочитанных записей
+}
+
+//AlertRule is the rule of the user, the new posts matching it are sent to the webhook.
+type AlertRule struct {
+	ID         int      // номер правила
+	UserID     int      // владелец правила
+	Name       string   // название правила
+	Keywords   []string // ключевые слова, достаточно совпадения одного из них без учета регистра
+	Regex      string   // регулярное выражение для заголовка и текста записи
+	Feeds      []string // ленты, записи которых проверяются, пустой список - все ленты
+	WebhookURL string   // адрес, на который отправляются совпадения
+	Secret     string   `json:"-"` // ключ HMAC подписи запросов к вебхуку
+	CreatedAt  int64    // время создания
+}
+
+//AlertDelivery is a webhook request sent for the post matching the alert rule, the deliveries are the delivery log.
+type AlertDelivery struct {
+	ID            int             // номер доставки
+	RuleID        int             // правило, по которому найдено совпадение
+	PostID        int             // совпавшая запись
+	Payload       json.RawMessage // тело запроса к вебхуку
+	Status        string          // pending, delivered или failed
+	Attempts      int             // количество сделанных попыток
+	ResponseCode  int             // HTTP статус ответа на последнюю попытку
+	Error         string          // ошибка последней попытки
+	CreatedAt     int64           // время совпадения
+	UpdatedAt     int64           // время последней попытки
+	NextAttemptAt int64           // время следующей попытки, пока доставка в статусе pending
+}
+
+//Statuses of the alert deliveries.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+type HostPolicy struct {
+	Host            string // хост с портом, как в URL
+	Robots          string // содержимое robots.txt
+	RobotsStatus    int    // HTTP статус ответа на запрос robots.txt
+	RobotsFetchedAt int64  // время загрузки robots.txt, 0 если он ещё не загружался
+	RetryAfter      int64  // время, до которого хост просил не отправлять запросы (Retry-After)
+	LastRequestAt   int64  // время последнего запроса к хосту
+}
+
+//Tag sources in post_tags.
+const (
+	tagSourceFeed = "feed"
+	tagSourceUser = "user"
+)
+
+//key returns the deduplication key of the post: its GUID or the link, if the feed has no usable GUID.
+func (p *Post) key() string {
+	if p.GUID != "" {
+		return p.GUID
+	}
+
+	return p.Link
+}
+
+//Filter selects news for the listings, zero fields are not applied.
+type Filter struct {
+	Query string // подстрока заголовка или текста
+	From  int64  // опубликованы не раньше этого времени
+	To    int64  // опубликованы раньше этого времени
+	Tag   string // тег записи
+
+	Feeds []string // только записи этих лент, пустой список - любые
+
+	HasMedia  bool   // есть медиа вложения
+	MediaType string // вид (image, audio, video) или MIME тип вложения
+
+	UserID     int  // пользователь, к которому относятся Subscribed и Unread
+	Subscribed bool // только ленты, на которые подписан пользователь
+	Unread     bool // только непрочитанные пользователем
+}
+
+//match reports whether the post satisfies the filter.
+func (f Filter) match(post *Post) bool {
+	if f.Query != "" && !containsFold(post.Title, f.Query) && !containsFold(post.PlainText, f.Query) {
+		return false
+	}
+	if f.From > 0 && post.PubTime < f.From {
+		return false
+	}
+	if f.To > 0 && post.PubTime >= f.To {
+		return false
+	}
+	if f.Tag != "" && !containsString(post.Tags, NormalizeTag(f.Tag)) {
+		return false
+	}
+	if len(f.Feeds) > 0 && !containsString(f.Feeds, post.Feed) {
+		return false
+	}
+	if f.HasMedia && len(post.Media) == 0 {
+		return false
+	}
+	if f.MediaType != "" && !f.matchMediaType(post.Media) {
+		return false
+	}
+
+	return true
+}
+
+func (f Filter) matchMediaType(media []Media) bool {
+	column, value := f.mediaTypeColumn()
+
+	for _, m := range media {
+		if (column == "type" && m.Type == value) || (column == "medium" && m.Medium == value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//mediaTypeColumn returns the media column compared with MediaType:
+//a value with a slash is a MIME type, otherwise it is a medium.
+func (f Filter) mediaTypeColumn() (string, string) {
+	value := strings.ToLower(strings.TrimSpace(f.MediaType))
+	if strings.Contains(value, "/") {
+		return "type", value
+	}
+
+	return "medium", value
+}
+
+//NormalizeTag brings a tag or a feed category to the stored form: lower case with single spaces.
+func NormalizeTag(tag string) string {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+//normalizeTags normalizes the tags and removes empty ones and duplicates.
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" || containsString(normalized, tag) {
+			continue
+		}
+		normalized = append(normalized, tag)
+	}
+
+	return normalized
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsFold(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/MarySmirnova/news_reader/internal/config"
 	"github.com/jackc/pgx/v4"
@@ -12,26 +14,67 @@ import (
 
 var ctx context.Context = context.Background()
 
+//postgresSchema is the schema that holds all tables, queries use unqualified names and rely on search_path.
+const postgresSchema = "news"
+
+//pgPostSelect is postColumns of the posts table aliased as p, followed by the post tags and media.
+const pgPostSelect = postColumns + `,
+		(SELECT coalesce(json_agg(t.name), '[]')
+		FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.post_id = p.id) AS tags,
+		(SELECT coalesce(json_agg(json_build_object(` + mediaObject + `)), '[]')
+		FROM media m
+		WHERE m.post_id = p.id) AS media`
+
+//Keys of the transaction level advisory locks. The locks with two keys never conflict
+//with the single key lock of the leader election.
+const (
+	advisoryLockClass = 20220602
+	partitionsLock    = 1
+	writeNewsLock     = 2
+)
+
+//NewsChannel is the notification channel, on which WriteNews announces the id of the newest inserted post.
+//Only the last id is sent: WriteNews commits in the order of the ids, so the posts before it are already visible.
+const NewsChannel = "news_posts"
+
 type Store struct {
 	db *pgxpool.Pool
 }
 
 //NewPostgresDB creates a new instance Store for PostgresDB.
 func NewPostgresDB(cfg config.Postgres) (*Store, error) {
-	connString := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
+	db, err := connectPostgres(cfg, cfg.Database, postgresSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		db: db,
+	}, nil
+}
+
+//connectPostgres opens a pool to the database with search_path set to the schema.
+func connectPostgres(cfg config.Postgres, database string, schema string) (*pgxpool.Pool, error) {
+	connString := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", cfg.User, cfg.Password, cfg.Host, cfg.Port, database)
+
+	poolCfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	poolCfg.ConnConfig.RuntimeParams["search_path"] = schema
 
-	db, err := pgxpool.Connect(ctx, connString)
+	db, err := pgxpool.ConnectConfig(ctx, poolCfg)
 	if err != nil {
 		return nil, err
 	}
 
 	if err = db.Ping(ctx); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return &Store{
-		db: db,
-	}, nil
+	return db, nil
 }
 
 //GetPGXPool returns the pgxpool.Pool.
@@ -39,85 +82,162 @@ func (s *Store) GetPGXPool() *pgxpool.Pool {
 	return s.db
 }
 
-//WriteNews adds posts to the database, checking links for uniqueness.
-func (s *Store) WriteNews(posts []*Post) error {
-	query := `
-	INSERT INTO news.posts (
-		title,
-		content,
-		pubTime,
-		link)
-	VALUES ($1, $2, $3, $4)
-	ON CONFLICT (link) DO NOTHING;`
+//Close closes all connections of the pool.
+func (s *Store) Close() {
+	s.db.Close()
+}
 
+//WriteNews adds posts to the database, checking guids and links for uniqueness.
+//Posts that were already pruned by the retention policy are not added again.
+//The inserted posts get their ids, the skipped ones get zero ids.
+//The id of the newest inserted post is sent to NewsChannel, the listeners get it after the commit.
+//Concurrent calls, also of the other instances, take the ids and commit one after another.
+func (s *Store) WriteNews(posts []*Post) error {
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
+
+	if err = s.insertNews(tx, posts); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+//insertNews inserts the posts of WriteNews in tx. The lock it takes is held until tx ends.
+func (s *Store) insertNews(tx pgx.Tx, posts []*Post) error {
+	query := `
+	WITH key AS (
+		INSERT INTO post_keys (
+			guid,
+			link,
+			pubTime)
+		SELECT $6::text, $4::text, $3::bigint
+		WHERE NOT EXISTS (SELECT 1 FROM posts_archive WHERE guid = $6)
+		ON CONFLICT DO NOTHING
+		RETURNING id
+	)
+	INSERT INTO posts (` + postColumns + `)
+	SELECT id, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14
+	FROM key
+	RETURNING id;`
+
+	//the ids are taken from the sequence at insert, but become visible at commit. Without the lock
+	//a writer with a smaller id could commit after a reader has passed over its ids, see GetNewsAfter,
+	//so the writers of all instances take the ids and commit one after another
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1, $2);", advisoryLockClass, writeNewsLock); err != nil {
+		return err
+	}
 
+	last := 0
 	for _, post := range posts {
-		_, err = tx.Exec(ctx, query, post.Title, post.Content, post.PubTime, post.Link)
+		post.ID = 0
+
+		var id int
+		err := tx.QueryRow(ctx, query, postValues(post)...).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
 		if err != nil {
 			return err
 		}
+		post.ID = id
+		if id > last {
+			last = id
+		}
+
+		if err = s.addTags(tx, id, normalizeTags(post.Categories), tagSourceFeed); err != nil {
+			return err
+		}
+
+		for i, media := range post.Media {
+			if _, err = tx.Exec(ctx, rebind(insertMedia), mediaValues(int64(id), i, media)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	if last > 0 {
+		if _, err := tx.Exec(ctx, "SELECT pg_notify($1, $2)", NewsChannel, strconv.Itoa(last)); err != nil {
+			return err
+		}
 	}
 
-	tx.Commit(ctx)
 	return nil
 }
 
-//GetLastNews returns the latest n news, sorted by publication date.
-func (s *Store) GetLastNews(n int) ([]*Post, error) {
-	query := `
-	SELECT 
-		id,
-		title,
-		content,
-		pubTime,
-		link
-	FROM news.posts
-	ORDER BY pubTime DESC
-	LIMIT $1;`
+//ListenNews calls notify with the id of the newest post every time any instance sharing the database writes news,
+//and once right after it starts listening, so the news written while nobody listened are not missed.
+//The notifications of the concurrent writers come in the order of the ids, the receiver reads the posts up to the id.
+//It holds a connection of the pool until ctx is done or the connection fails.
+func (s *Store) ListenNews(ctx context.Context, notify func(id int)) error {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		//the listening connection is not returned to the pool, otherwise it would keep collecting notifications
+		conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
 
-	var posts []*Post
+	if _, err = conn.Exec(ctx, "LISTEN "+NewsChannel); err != nil {
+		return err
+	}
 
-	rows, err := s.db.Query(ctx, query, n)
-	if err != nil {
-		return nil, err
+	var last int
+	if err = conn.QueryRow(ctx, "SELECT COALESCE(max(id), 0) FROM posts;").Scan(&last); err != nil {
+		return err
+	}
+	if last > 0 {
+		notify(last)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var post Post
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
 
-		err = rows.Scan(&post.ID, &post.Title, &post.Content, &post.PubTime, &post.Link)
+		id, err := strconv.Atoi(notification.Payload)
 		if err != nil {
-			return nil, err
+			continue
 		}
 
-		posts = append(posts, &post)
+		notify(id)
 	}
+}
 
-	if err = rows.Err(); err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, nil
-		}
+//GetLastNews returns the latest n news, sorted by publication date.
+func (s *Store) GetLastNews(n int) ([]*Post, error) {
+	query := `
+	SELECT ` + pgPostSelect + `
+	FROM posts p
+	ORDER BY pubTime DESC, id DESC
+	LIMIT $1;`
+
+	rows, err := s.db.Query(ctx, query, n)
+	if err != nil {
 		return nil, err
 	}
 
-	return posts, nil
+	return s.scanPosts(rows)
 }
 
 //NewsAmount returns the number of news by filter.
-func (s *Store) NewsAmount(filter string) (int, error) {
+func (s *Store) NewsAmount(filter Filter) (int, error) {
+	cond := s.filterConditions(filter)
+
 	query := `
 	SELECT count(*)
-	FROM news.posts
-	WHERE title ILIKE '%` + filter + `%';`
+	FROM posts p
+	WHERE ` + cond.where() + `;`
 
 	var amount int
 
-	row := s.db.QueryRow(ctx, query)
+	row := s.db.QueryRow(ctx, rebind(query), cond.args...)
 	err := row.Scan(&amount)
 	if err != nil {
 		return 0, err
@@ -126,71 +246,1060 @@ func (s *Store) NewsAmount(filter string) (int, error) {
 	return amount, nil
 }
 
-//GetNews returns the specified page with news by filter
-func (s *Store) GetNewsPage(filter string, page int, ipemsPerPage int) ([]*Post, error) {
+//GetNewsPage returns the specified page with news by filter.
+func (s *Store) GetNewsPage(filter Filter, page int, ipemsPerPage int) ([]*Post, error) {
+	if page < 1 {
+		return nil, nil
+	}
+
+	cond := s.filterConditions(filter)
+
 	query := `
-	SELECT 
-		id,
-		title,
-		content,
-		pubTime,
-		link
-	FROM news.posts
-	WHERE title ILIKE '%` + filter + `%'
-	ORDER BY pubTime DESC
-	LIMIT $1
-	OFFSET $2;`
+	SELECT ` + pgPostSelect + `
+	FROM posts p
+	WHERE ` + cond.where() + `
+	ORDER BY pubTime DESC, id DESC
+	LIMIT ?
+	OFFSET ?;`
 
 	offset := (page - 1) * ipemsPerPage
 
-	var posts []*Post
+	rows, err := s.db.Query(ctx, rebind(query), append(cond.args, ipemsPerPage, offset)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scanPosts(rows)
+}
+
+//GetNewsAfter returns up to n news by filter with ids greater than id, in the order they were written.
+func (s *Store) GetNewsAfter(filter Filter, id int, n int) ([]*Post, error) {
+	cond := s.filterConditions(filter)
+	cond.add("p.id > ?", id)
+
+	query := `
+	SELECT ` + pgPostSelect + `
+	FROM posts p
+	WHERE ` + cond.where() + `
+	ORDER BY id
+	LIMIT ?;`
+
+	rows, err := s.db.Query(ctx, rebind(query), append(cond.args, n)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scanPosts(rows)
+}
+
+//LastNewsID returns the greatest id of the stored news, 0 if there are none.
+func (s *Store) LastNewsID() (int, error) {
+	var id int
+	err := s.db.QueryRow(ctx, `SELECT COALESCE(max(id), 0) FROM posts;`).Scan(&id)
+	return id, err
+}
+
+//GetNewsByID returns one post by its id.
+func (s *Store) GetNewsByID(id int) (*Post, error) {
+	//the publication time from post_keys lets the planner skip the other partitions
+	query := `
+	SELECT ` + pgPostSelect + `
+	FROM posts p
+	WHERE id = $1 AND pubTime = (SELECT pubTime FROM post_keys WHERE id = $1);`
+
+	post, err := scanPost(s.db.QueryRow(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	query = `
+	SELECT content
+	FROM full_texts
+	WHERE post_id = $1 AND error = '';`
+
+	err = s.db.QueryRow(ctx, query, id).Scan(&post.FullText)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	return post, nil
+}
+
+//PendingFullText returns the latest n posts of the feed, for which the full text was not fetched yet.
+func (s *Store) PendingFullText(feed string, n int) ([]*Post, error) {
+	query := `
+	SELECT ` + pgPostSelect + `
+	FROM posts p
+	WHERE feed = $1 AND NOT EXISTS (SELECT 1 FROM full_texts f WHERE f.post_id = p.id)
+	ORDER BY pubTime DESC, id DESC
+	LIMIT $2;`
+
+	rows, err := s.db.Query(ctx, query, feed, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scanPosts(rows)
+}
+
+//WriteFullText saves the full text of the post, an existing one is replaced.
+func (s *Store) WriteFullText(id int, text *FullText) error {
+	query := `
+	INSERT INTO full_texts (
+		post_id,
+		content,
+		plainText,
+		fetchedAt,
+		error)
+	SELECT id, $2, $3, $4, $5
+	FROM post_keys
+	WHERE id = $1
+	ON CONFLICT (post_id) DO UPDATE SET
+		content = EXCLUDED.content,
+		plainText = EXCLUDED.plainText,
+		fetchedAt = EXCLUDED.fetchedAt,
+		error = EXCLUDED.error;`
+
+	result, err := s.db.Exec(ctx, query, id, text.Content, text.PlainText, text.FetchedAt, text.Error)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//AddTags attaches user tags to the post.
+func (s *Store) AddTags(id int, tags []string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM post_keys WHERE id = $1);`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	if err = s.addTags(tx, id, normalizeTags(tags), tagSourceUser); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+//RemoveTag detaches the tag from the post.
+func (s *Store) RemoveTag(id int, tag string) error {
+	query := `
+	DELETE FROM post_tags
+	WHERE post_id = $1 AND tag_id = (SELECT id FROM tags WHERE name = $2);`
+
+	result, err := s.db.Exec(ctx, query, id, NormalizeTag(tag))
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetTags returns all tags that have posts with the number of their posts, the most popular first.
+func (s *Store) GetTags() ([]*Tag, error) {
+	query := `
+	SELECT t.name, count(*)
+	FROM tags t
+	JOIN post_tags pt ON pt.tag_id = t.id
+	GROUP BY t.name
+	ORDER BY count(*) DESC, t.name;`
 
-	rows, err := s.db.Query(ctx, query, ipemsPerPage, offset)
+	rows, err := s.db.Query(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	tags := []*Tag{}
+
 	for rows.Next() {
-		var post Post
+		var tag Tag
 
-		err = rows.Scan(&post.ID, &post.Title, &post.Content, &post.PubTime, &post.Link)
-		if err != nil {
+		if err = rows.Scan(&tag.Name, &tag.Count); err != nil {
 			return nil, err
 		}
 
-		posts = append(posts, &post)
+		tags = append(tags, &tag)
 	}
 
 	if err = rows.Err(); err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, nil
-		}
 		return nil, err
 	}
 
-	return posts, nil
+	return tags, nil
 }
 
-//GetNewsByID returns one post by its id
-func (s *Store) GetNewsByID(id int) (*Post, error) {
+//WriteFeed saves the channel metadata of the feed, the feed is created on first write.
+func (s *Store) WriteFeed(feed *Feed) error {
+	_, err := s.db.Exec(ctx, rebind(upsertFeed), feedValues(feed)...)
+	return err
+}
+
+//GetFeed returns the feed by its link.
+func (s *Store) GetFeed(url string) (*Feed, error) {
 	query := `
-	SELECT 
-		id,
-		title,
-		content,
-		pubTime,
-		link
-	FROM news.posts
-	WHERE id = $1;`
+	SELECT ` + feedColumns + `
+	FROM feeds
+	WHERE url = $1;`
+
+	feed, err := scanFeed(s.db.QueryRow(ctx, query, url))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return feed, nil
+}
+
+//GetFeeds returns all feeds in the order they were first fetched.
+func (s *Store) GetFeeds() ([]*Feed, error) {
+	query := `
+	SELECT ` + feedColumns + `
+	FROM feeds
+	ORDER BY id;`
 
-	var post Post
+	return s.queryFeeds(query)
+}
+
+//MarkRead sets the read state of the post for the user.
+//ErrNotFound is returned if the post does not exist.
+func (s *Store) MarkRead(userID, postID int, read bool, at int64) error {
+	result, err := s.db.Exec(ctx, rebind(upsertPostRead), userID, read, at, postID)
+	if err != nil {
+		return err
+	}
+
+	n := result.RowsAffected()
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//MarkAllRead marks as read the posts of the feed published up to the unix time before, an empty feed means all feeds.
+func (s *Store) MarkAllRead(userID int, feed string, before int64) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, rebind(upsertReadMark), userID, feed, before); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, rebind(deleteCoveredReads), userID, before, feed, feed); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+//UnreadCounts returns the number of unread posts of the user for each feed that has them.
+func (s *Store) UnreadCounts(userID int) ([]*UnreadCount, error) {
+	rows, err := s.db.Query(ctx, rebind(selectUnreadCounts), userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []*UnreadCount{}
+
+	for rows.Next() {
+		var count UnreadCount
+		if err = rows.Scan(&count.Feed, &count.Count); err != nil {
+			return nil, err
+		}
 
-	row := s.db.QueryRow(ctx, query, id)
-	err := row.Scan(&post.ID, &post.Title, &post.Content, &post.PubTime, &post.Link)
+		counts = append(counts, &count)
+	}
+
+	return counts, rows.Err()
+}
+
+//SavePost stars the post for the user, starring it again replaces the note.
+//ErrNotFound is returned if the post does not exist.
+func (s *Store) SavePost(userID, postID int, note string, at int64) error {
+	result, err := s.db.Exec(ctx, rebind(upsertSavedPost), userID, note, at, postID)
+	if err != nil {
+		return err
+	}
+
+	n := result.RowsAffected()
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//UnsavePost removes the star of the user from the post.
+//ErrNotFound is returned if the post is not starred.
+func (s *Store) UnsavePost(userID, postID int) error {
+	result, err := s.db.Exec(ctx, `DELETE FROM saved_posts WHERE user_id = $1 AND post_id = $2;`, userID, postID)
+	if err != nil {
+		return err
+	}
+
+	n := result.RowsAffected()
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetSavedPosts returns the posts starred by the user, the last saved first.
+//A non-empty query is searched in the title, the text and the note.
+func (s *Store) GetSavedPosts(userID int, query string) ([]*SavedPost, error) {
+	cond := &conditions{}
+	cond.add("s.user_id = ?", userID)
+	if query != "" {
+		query = escapeLike(query)
+		cond.add("(p.title ILIKE '%' || ? || '%' OR p.plainText ILIKE '%' || ? || '%' OR s.note ILIKE '%' || ? || '%')", query, query, query)
+	}
+
+	q := `
+	SELECT ` + pgPostSelect + `, s.note, s.savedAt
+	FROM saved_posts s JOIN posts p ON p.id = s.post_id
+	WHERE ` + cond.where() + `
+	ORDER BY s.savedAt DESC, p.id DESC;`
+
+	rows, err := s.db.Query(ctx, rebind(q), cond.args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	saved := []*SavedPost{}
+
+	for rows.Next() {
+		post, err := scanSavedPost(rows)
+		if err != nil {
+			return nil, err
+		}
 
-	return &post, nil
+		saved = append(saved, post)
+	}
+
+	return saved, rows.Err()
+}
+
+//Subscribe subscribes the user to the feed, the repeated subscription is not an error.
+//ErrNotFound is returned if the feed does not exist.
+func (s *Store) Subscribe(userID, feedID int, createdAt int64) error {
+	result, err := s.db.Exec(ctx, rebind(insertSubscription), userID, createdAt, feedID)
+	if err != nil {
+		return err
+	}
+
+	n := result.RowsAffected()
+	if n > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = s.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM feeds WHERE id = $1);`, feedID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//Unsubscribe removes the subscription of the user to the feed.
+//ErrNotFound is returned if the user is not subscribed to the feed.
+func (s *Store) Unsubscribe(userID, feedID int) error {
+	result, err := s.db.Exec(ctx, `DELETE FROM subscriptions WHERE user_id = $1 AND feed_id = $2;`, userID, feedID)
+	if err != nil {
+		return err
+	}
+
+	n := result.RowsAffected()
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetSubscriptions returns the feeds the user is subscribed to.
+func (s *Store) GetSubscriptions(userID int) ([]*Feed, error) {
+	return s.queryFeeds(rebind(selectSubscriptions), userID)
+}
+
+//queryFeeds returns the feeds selected by the query of feedColumns.
+func (s *Store) queryFeeds(query string, args ...interface{}) ([]*Feed, error) {
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := []*Feed{}
+
+	for rows.Next() {
+		feed, err := scanFeed(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
+}
+
+//WriteFeedIcon saves the result of the icon download, a failed download keeps the previous icon.
+func (s *Store) WriteFeedIcon(feedURL string, icon *FeedIcon) error {
+	result, err := s.db.Exec(ctx, rebind(updateFeedIcon), feedIconValues(feedURL, icon)...)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetFeedIcon returns the icon of the feed site.
+func (s *Store) GetFeedIcon(id int) (*FeedIcon, error) {
+	query := `
+	SELECT iconType, icon, iconFetchedAt
+	FROM feeds
+	WHERE id = $1 AND iconType <> '';`
+
+	var icon FeedIcon
+	err := s.db.QueryRow(ctx, query, id).Scan(&icon.Type, &icon.Data, &icon.FetchedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &icon, nil
+}
+
+//CreateUser adds the user and sets its ID, the first user becomes an admin.
+//ErrExists is returned if the login is taken. With closed registration only the first user is added,
+//ErrRegistrationClosed is returned if there are users already.
+func (s *Store) CreateUser(user *User, closed bool) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	//the lock conflicts with itself, so two first users registering at once do not both see no users
+	if _, err = tx.Exec(ctx, "LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE;"); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(ctx, rebind(insertUser), user.Login, user.PasswordHash, user.CreatedAt, !closed).Scan(&user.ID, &user.Admin)
+	if errors.Is(err, pgx.ErrNoRows) && closed {
+		return ErrRegistrationClosed
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrExists
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+//GetUser returns the user by its id.
+func (s *Store) GetUser(id int) (*User, error) {
+	return s.getUser("id = $1", id)
+}
+
+//GetUserByLogin returns the user by its login.
+func (s *Store) GetUserByLogin(login string) (*User, error) {
+	return s.getUser("login = $1", login)
+}
+
+//UsersAmount returns the number of registered users.
+func (s *Store) UsersAmount() (int, error) {
+	var amount int
+	err := s.db.QueryRow(ctx, `SELECT count(*) FROM users;`).Scan(&amount)
+
+	return amount, err
+}
+
+//CreateSession saves the session of the user.
+func (s *Store) CreateSession(session *Session) error {
+	query := `
+	INSERT INTO sessions (
+		tokenHash,
+		user_id,
+		createdAt,
+		expiresAt)
+	VALUES ($1, $2, $3, $4);`
+
+	_, err := s.db.Exec(ctx, query, session.TokenHash, session.UserID, session.CreatedAt, session.ExpiresAt)
+	return err
+}
+
+//GetSession returns the session by the hash of its token, expired sessions are returned too.
+func (s *Store) GetSession(tokenHash string) (*Session, error) {
+	query := `
+	SELECT tokenHash, user_id, createdAt, expiresAt
+	FROM sessions
+	WHERE tokenHash = $1;`
+
+	var session Session
+	err := s.db.QueryRow(ctx, query, tokenHash).Scan(&session.TokenHash, &session.UserID, &session.CreatedAt, &session.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+//DeleteSession removes the session, a missing session is not an error.
+func (s *Store) DeleteSession(tokenHash string) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM sessions WHERE tokenHash = $1;`, tokenHash)
+	return err
+}
+
+//DeleteExpiredSessions removes the sessions that expired before the unix time.
+func (s *Store) DeleteExpiredSessions(before int64) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM sessions WHERE expiresAt < $1;`, before)
+	return err
+}
+
+//getUser returns the user matching the condition.
+func (s *Store) getUser(condition string, arg interface{}) (*User, error) {
+	query := `
+	SELECT id, login, passwordHash, admin, createdAt
+	FROM users
+	WHERE ` + condition + `;`
+
+	var user User
+	err := s.db.QueryRow(ctx, query, arg).Scan(&user.ID, &user.Login, &user.PasswordHash, &user.Admin, &user.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+//CreateAlertRule adds the alert rule and sets its id.
+func (s *Store) CreateAlertRule(rule *AlertRule) error {
+	return s.db.QueryRow(ctx, rebind(insertAlertRule), alertRuleValues(rule)...).Scan(&rule.ID)
+}
+
+//GetAlertRule returns the alert rule by id.
+func (s *Store) GetAlertRule(id int) (*AlertRule, error) {
+	query := `
+	SELECT ` + alertRuleColumns + `
+	FROM alert_rules
+	WHERE id = $1;`
+
+	rule, err := scanAlertRule(s.db.QueryRow(ctx, query, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return rule, err
+}
+
+//GetAlertRules returns the alert rules of the user in the order they were created, zero userID returns the rules of all users.
+func (s *Store) GetAlertRules(userID int) ([]*AlertRule, error) {
+	query := `
+	SELECT ` + alertRuleColumns + `
+	FROM alert_rules
+	WHERE $1 = 0 OR user_id = $1
+	ORDER BY id;`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*AlertRule{}
+
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+//DeleteAlertRule removes the alert rule of the user together with its deliveries.
+func (s *Store) DeleteAlertRule(userID, id int) error {
+	result, err := s.db.Exec(ctx, `DELETE FROM alert_rules WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//CreateDeliveries adds the deliveries and sets their ids.
+func (s *Store) CreateDeliveries(deliveries []*AlertDelivery) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, delivery := range deliveries {
+		if err = tx.QueryRow(ctx, rebind(insertDelivery), deliveryValues(delivery)...).Scan(&delivery.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+//UpdateDelivery saves the result of the delivery attempt.
+func (s *Store) UpdateDelivery(delivery *AlertDelivery) error {
+	result, err := s.db.Exec(ctx, rebind(updateDelivery), updateDeliveryValues(delivery)...)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//DueDeliveries returns up to n pending deliveries whose next attempt is due at the time now.
+func (s *Store) DueDeliveries(now int64, n int) ([]*AlertDelivery, error) {
+	return s.queryDeliveries(rebind(selectDueDeliveries), now, n)
+}
+
+//GetDeliveries returns the latest n deliveries of the alert rule, the newest first.
+func (s *Store) GetDeliveries(ruleID int, n int) ([]*AlertDelivery, error) {
+	query := `
+	SELECT ` + deliveryColumns + `
+	FROM alert_deliveries
+	WHERE rule_id = $1
+	ORDER BY id DESC
+	LIMIT $2;`
+
+	return s.queryDeliveries(query, ruleID, n)
+}
+
+//DeleteDeliveries removes the delivered and failed deliveries last attempted before the given time.
+func (s *Store) DeleteDeliveries(before int64) error {
+	_, err := s.db.Exec(ctx, rebind(deleteFinishedDeliveries), before)
+	return err
+}
+
+func (s *Store) queryDeliveries(query string, args ...interface{}) ([]*AlertDelivery, error) {
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*AlertDelivery{}
+
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+//GetHostPolicy returns the saved state of the host for the fetcher.
+func (s *Store) GetHostPolicy(host string) (*HostPolicy, error) {
+	query := `
+	SELECT host, robots, robotsStatus, robotsFetchedAt, retryAfter, lastRequestAt
+	FROM host_policies
+	WHERE host = $1;`
+
+	var policy HostPolicy
+	err := s.db.QueryRow(ctx, query, host).Scan(
+		&policy.Host,
+		&policy.Robots,
+		&policy.RobotsStatus,
+		&policy.RobotsFetchedAt,
+		&policy.RetryAfter,
+		&policy.LastRequestAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+//WriteHostPolicy saves the state of the host, an existing one is replaced.
+func (s *Store) WriteHostPolicy(policy *HostPolicy) error {
+	query := `
+	INSERT INTO host_policies (
+		host,
+		robots,
+		robotsStatus,
+		robotsFetchedAt,
+		retryAfter,
+		lastRequestAt)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (host) DO UPDATE SET
+		robots = EXCLUDED.robots,
+		robotsStatus = EXCLUDED.robotsStatus,
+		robotsFetchedAt = EXCLUDED.robotsFetchedAt,
+		retryAfter = EXCLUDED.retryAfter,
+		lastRequestAt = EXCLUDED.lastRequestAt;`
+
+	_, err := s.db.Exec(ctx, query, policy.Host, policy.Robots, policy.RobotsStatus,
+		policy.RobotsFetchedAt, policy.RetryAfter, policy.LastRequestAt)
+
+	return err
+}
+
+//ExpiredNews returns posts published before the "before" unix time
+//or not among the latest keepPerFeed posts of their feed, the oldest first.
+//Zero values disable the corresponding limit.
+func (s *Store) ExpiredNews(before int64, keepPerFeed int) ([]*Post, error) {
+	query := `
+	SELECT ` + pgPostSelect + `
+	FROM (
+		SELECT *, row_number() OVER (PARTITION BY feed ORDER BY pubTime DESC, id DESC) AS rank
+		FROM posts
+	) p
+	WHERE (($1::bigint > 0 AND pubTime < $1::bigint) OR ($2::bigint > 0 AND rank > $2::bigint)) AND ` + notSavedCondition + `
+	ORDER BY pubTime, id;`
+
+	rows, err := s.db.Query(ctx, query, before, keepPerFeed)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scanPosts(rows)
+}
+
+//PruneNews removes posts from the database and remembers their guids, so they are not fetched again.
+//If archive is true, the compressed posts are kept in the archive table.
+func (s *Store) PruneNews(posts []*Post, archive bool) error {
+	query := `
+	INSERT INTO posts_archive (
+		guid,
+		link,
+		feed,
+		pubTime,
+		prunedAt,
+		data)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (guid) DO NOTHING;`
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	prunedAt := time.Now().Unix()
+
+	for _, post := range posts {
+		var data []byte
+		if archive {
+			if data, err = compressPost(post); err != nil {
+				return err
+			}
+		}
+
+		//the post is deleted from its partition by the foreign key cascade,
+		//the post starred after it was selected for pruning is kept
+		result, err := tx.Exec(ctx, `DELETE FROM post_keys AS p WHERE id = $1 AND `+notSavedCondition+`;`, post.ID)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			continue
+		}
+
+		_, err = tx.Exec(ctx, query, post.key(), post.Link, post.Feed, post.PubTime, prunedAt, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+//GetArchivedNews returns the archived post by its guid.
+func (s *Store) GetArchivedNews(guid string) (*Post, error) {
+	query := `
+	SELECT data
+	FROM posts_archive
+	WHERE guid = $1 AND data IS NOT NULL;`
+
+	var data []byte
+
+	err := s.db.QueryRow(ctx, query, guid).Scan(&data)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return decompressPost(data)
+}
+
+//CreatePartitions creates the monthly partitions of the posts table
+//for the month of "from" and the following monthsAhead months, existing partitions are skipped.
+//The earlier months that have posts in the default partition, e.g. the posts of the upgraded flat table
+//or the old posts of a new feed, get their partitions too, so the queries over the history are pruned.
+func (s *Store) CreatePartitions(from time.Time, monthsAhead int) error {
+	from = from.UTC()
+	month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	earlier, err := s.defaultMonths(month)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range earlier {
+		if err = s.createPartition(m, m.AddDate(0, 1, 0)); err != nil {
+			return fmt.Errorf("create partition for %s: %w", m.Format("2006-01"), err)
+		}
+	}
+
+	for i := 0; i <= monthsAhead; i++ {
+		next := month.AddDate(0, 1, 0)
+
+		if err := s.createPartition(month, next); err != nil {
+			return fmt.Errorf("create partition for %s: %w", month.Format("2006-01"), err)
+		}
+
+		month = next
+	}
+
+	return nil
+}
+
+//defaultMonths returns the months before "before" that have posts in the default partition, the oldest first.
+func (s *Store) defaultMonths(before time.Time) ([]time.Time, error) {
+	query := `
+	SELECT DISTINCT date_trunc('month', to_timestamp(pubTime) AT TIME ZONE 'UTC')
+	FROM posts_default
+	WHERE pubTime < $1
+	ORDER BY 1;`
+
+	rows, err := s.db.Query(ctx, query, before.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var months []time.Time
+	for rows.Next() {
+		var month time.Time
+		if err = rows.Scan(&month); err != nil {
+			return nil, err
+		}
+		months = append(months, month.UTC())
+	}
+
+	return months, rows.Err()
+}
+
+//createPartition creates the partition for the posts published from "from" up to "to".
+//The posts of that time that were written to the default partition before, e.g. the posts dated ahead
+//of the created partitions, are moved to the new partition, otherwise Postgres refuses to attach it.
+func (s *Store) createPartition(from, to time.Time) error {
+	name := fmt.Sprintf("posts_y%04dm%02d", from.Year(), from.Month())
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	//the instances sharing the database do not create the same partition at once
+	if _, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1, $2);", advisoryLockClass, partitionsLock); err != nil {
+		return err
+	}
+
+	var exists bool
+	if err = tx.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL;", name).Scan(&exists); err != nil || exists {
+		return err
+	}
+
+	//the writes to the default partition wait until the rows are moved and the partition is attached
+	query := fmt.Sprintf(`
+	LOCK TABLE posts_default IN ACCESS EXCLUSIVE MODE;
+
+	CREATE TABLE %[1]s (LIKE posts INCLUDING DEFAULTS INCLUDING CONSTRAINTS);
+
+	WITH moved AS (
+		DELETE FROM posts_default
+		WHERE pubTime >= %[2]d AND pubTime < %[3]d
+		RETURNING *
+	)
+	INSERT INTO %[1]s
+	SELECT * FROM moved;
+
+	ALTER TABLE posts ATTACH PARTITION %[1]s FOR VALUES FROM (%[2]d) TO (%[3]d);`, name, from.Unix(), to.Unix())
+
+	if _, err = tx.Exec(ctx, query); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+//AdvisoryLock is a session level advisory lock held by a connection taken from the pool for it.
+type AdvisoryLock struct {
+	conn *pgxpool.Conn
+}
+
+//TryAdvisoryLock takes the advisory lock with the key without waiting, it returns no lock and no error
+//if another session holds it. The lock is held until Unlock or until its connection is lost.
+func (s *Store) TryAdvisoryLock(ctx context.Context, key int64) (*AdvisoryLock, error) {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	if err = conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1);", key).Scan(&locked); err != nil || !locked {
+		conn.Release()
+		return nil, err
+	}
+
+	return &AdvisoryLock{conn: conn}, nil
+}
+
+//Check makes sure the connection that holds the lock is alive, so the lock is still held.
+func (l *AdvisoryLock) Check(ctx context.Context) error {
+	return l.conn.Ping(ctx)
+}
+
+//Unlock releases the lock by closing its connection, the connection is not returned to the pool.
+func (l *AdvisoryLock) Unlock() {
+	l.conn.Conn().Close(context.Background())
+	l.conn.Release()
+}
+
+func (s *Store) addTags(tx pgx.Tx, id int, tags []string, source string) error {
+	query := `
+	WITH tag AS (
+		INSERT INTO tags (name)
+		VALUES ($2)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id
+	)
+	INSERT INTO post_tags (
+		post_id,
+		tag_id,
+		source)
+	SELECT $1, id, $3
+	FROM tag
+	ON CONFLICT DO NOTHING;`
+
+	for _, tag := range tags {
+		if _, err := tx.Exec(ctx, query, id, tag, source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//filterConditions builds the WHERE conditions for the filter.
+//Publication time is compared directly with the partition key, so the partitions outside the range are pruned.
+func (s *Store) filterConditions(filter Filter) *conditions {
+	cond := &conditions{}
+
+	if filter.Query != "" {
+		query := escapeLike(filter.Query)
+		cond.add("(title ILIKE '%' || ? || '%' OR plainText ILIKE '%' || ? || '%')", query, query)
+	}
+	if filter.From > 0 {
+		cond.add("pubTime >= ?", filter.From)
+	}
+	if filter.To > 0 {
+		cond.add("pubTime < ?", filter.To)
+	}
+	if filter.Tag != "" {
+		cond.add(tagCondition, NormalizeTag(filter.Tag))
+	}
+	addFeedConditions(cond, filter)
+	addMediaConditions(cond, filter)
+	addUserConditions(cond, filter)
+
+	return cond
+}
+
+func (s *Store) scanPosts(rows pgx.Rows) ([]*Post, error) {
+	defer rows.Close()
+
+	var posts []*Post
+
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		posts = append(posts, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return posts, nil
 }
@@ -1,89 +1,438 @@
 package database
 
 import (
+	"context"
 	"fmt"
-	"strconv"
+	"io/ioutil"
+	"regexp"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/MarySmirnova/news_reader/internal/config"
 	"github.com/caarlos0/env/v6"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
 )
 
 var cfg config.Postgres
 
+var schemaNameRe = regexp.MustCompile(`\b` + postgresSchema + `\b`)
+
+//testPGDB creates a disposable schema from schema.sql, so every test starts with empty tables.
 func testPGDB(t *testing.T) (*Store, func()) {
+	return testPGDBFrom(t, "")
+}
+
+//testPGDBFrom runs the statements of the earlier version before schema.sql, so the schema is upgraded.
+func testPGDBFrom(t *testing.T, earlier string) (*Store, func()) {
 	godotenv.Load("../../.env")
 	err := env.Parse(&cfg)
 	assert.Nil(t, err)
 
-	connString := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.TestDatabase)
+	if cfg.TestDatabase == "" {
+		t.Skip("PG_TEST_DATABASE is not set")
+	}
+
+	schemaName := fmt.Sprintf("news_test_%d", time.Now().UnixNano())
+
+	schema, err := ioutil.ReadFile("../../schema.sql")
+	assert.Nil(t, err)
+
+	db, err := connectPostgres(cfg, cfg.TestDatabase, schemaName)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	if earlier != "" {
+		_, err = db.Exec(ctx, schemaNameRe.ReplaceAllString(earlier, schemaName))
+		assert.Nil(t, err)
+	}
+
+	_, err = db.Exec(ctx, schemaNameRe.ReplaceAllString(string(schema), schemaName))
+	assert.Nil(t, err)
+
+	store := &Store{db: db}
+
+	err = store.CreatePartitions(time.Now().AddDate(0, -2, 0), 3)
+	assert.Nil(t, err)
+
+	return store, func() {
+		_, err := db.Exec(ctx, "DROP SCHEMA "+schemaName+" CASCADE")
+		assert.Nil(t, err)
+		db.Close()
+	}
+}
+
+func TestStore(t *testing.T) {
+	runStorageSuite(t, func(t *testing.T) (testStorage, func()) {
+		return testPGDB(t)
+	})
+}
+
+func TestStore_CreatePartitions(t *testing.T) {
+	db, cleanup := testPGDB(t)
+	defer cleanup()
+
+	countPartitions := func() int {
+		query := `
+		SELECT count(*)
+		FROM pg_inherits
+		WHERE inhparent = 'posts'::regclass;`
+
+		var n int
+		err := db.db.QueryRow(ctx, query).Scan(&n)
+		assert.Nil(t, err)
+		return n
+	}
+
+	//two months back, the current one, the next one and the default partition
+	assert.Equal(t, 5, countPartitions())
+
+	//existing partitions are skipped
+	err := db.CreatePartitions(time.Now(), 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, countPartitions())
+
+	posts := generateDatedPosts(3)
+	err = db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	now := time.Now().UTC()
+	partition := fmt.Sprintf("posts_y%04dm%02d", now.Year(), now.Month())
+
+	var n int
+	err = db.db.QueryRow(ctx, "SELECT count(*) FROM "+partition).Scan(&n)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	//a date filtered query reads only the matching partition
+	rows, err := db.db.Query(ctx, "EXPLAIN SELECT count(*) FROM posts WHERE pubTime >= $1 AND pubTime < $2",
+		posts[0].PubTime, posts[2].PubTime+1)
+	assert.Nil(t, err)
+	defer rows.Close()
+
+	var plan string
+	for rows.Next() {
+		var line string
+		err = rows.Scan(&line)
+		assert.Nil(t, err)
+		plan += line + "\n"
+	}
+
+	assert.Contains(t, plan, partition)
+	assert.NotContains(t, plan, "posts_default")
+}
+
+func TestStore_CreatePartitions_Default(t *testing.T) {
+	db, cleanup := testPGDB(t)
+	defer cleanup()
+
+	//a post dated ahead of the created partitions goes to the default partition
+	ahead := time.Now().UTC().AddDate(0, 6, 0)
+	post := &Post{Title: "From the future", Content: "Content", PubTime: ahead.Unix(), Link: "Link ahead"}
+	assert.Nil(t, db.WriteNews([]*Post{post}))
+
+	count := func(table string) int {
+		var n int
+		err := db.db.QueryRow(ctx, "SELECT count(*) FROM "+table).Scan(&n)
+		assert.Nil(t, err)
+		return n
+	}
+	assert.Equal(t, 1, count("posts_default"))
+
+	//when its month comes the post is moved to the new partition
+	err := db.CreatePartitions(time.Now(), 7)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 0, count("posts_default"))
+	assert.Equal(t, 1, count(fmt.Sprintf("posts_y%04dm%02d", ahead.Year(), ahead.Month())))
+
+	got, err := db.GetNewsByID(post.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "From the future", got.Title)
+}
+
+func TestStore_CreatePartitions_Earlier(t *testing.T) {
+	db, cleanup := testPGDB(t)
+	defer cleanup()
+
+	//the posts older than the created partitions go to the default partition
+	old := time.Date(2019, time.March, 15, 12, 0, 0, 0, time.UTC)
+	older := time.Date(2017, time.November, 2, 8, 0, 0, 0, time.UTC)
+	posts := []*Post{
+		{Title: "Old", Content: "Content", PubTime: old.Unix(), Link: "Link old"},
+		{Title: "Older", Content: "Content", PubTime: older.Unix(), Link: "Link older"},
+	}
+	assert.Nil(t, db.WriteNews(posts))
+
+	count := func(table string) int {
+		var n int
+		err := db.db.QueryRow(ctx, "SELECT count(*) FROM "+table).Scan(&n)
+		assert.Nil(t, err)
+		return n
+	}
+	assert.Equal(t, 2, count("posts_default"))
 
-	db, err := pgxpool.Connect(ctx, connString)
+	//their months get partitions, the months between them do not
+	err := db.CreatePartitions(time.Now(), 1)
 	assert.Nil(t, err)
 
-	schemaName := "news"
+	assert.Equal(t, 0, count("posts_default"))
+	assert.Equal(t, 1, count("posts_y2019m03"))
+	assert.Equal(t, 1, count("posts_y2017m11"))
 
-	_, err = db.Exec(ctx, "CREATE SCHEMA "+schemaName)
+	var exists bool
+	err = db.db.QueryRow(ctx, "SELECT to_regclass('posts_y2018m01') IS NOT NULL;").Scan(&exists)
 	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	//a date filtered query over the history reads only the matching partition
+	rows, err := db.db.Query(ctx, "EXPLAIN SELECT count(*) FROM posts WHERE pubTime >= $1 AND pubTime < $2",
+		old.AddDate(0, 0, -1).Unix(), old.AddDate(0, 0, 1).Unix())
+	assert.Nil(t, err)
+	defer rows.Close()
+
+	var plan string
+	for rows.Next() {
+		var line string
+		err = rows.Scan(&line)
+		assert.Nil(t, err)
+		plan += line + "\n"
+	}
+
+	assert.Contains(t, plan, "posts_y2019m03")
+	assert.NotContains(t, plan, "posts_default")
+}
+
+func TestStore_UpgradeFlatPosts(t *testing.T) {
+	//the schema of the first version
+	earlier := `
+	CREATE SCHEMA news;
 
-	createTableQuery := fmt.Sprintf(
-		`CREATE TABLE IF NOT EXISTS %s.posts (
+	CREATE TABLE news.posts (
 		id SERIAL PRIMARY KEY,
 		title TEXT NOT NULL,
 		content TEXT NOT NULL,
 		pubTime BIGINT NOT NULL CHECK (pubTime > 0),
-		link TEXT NOT NULL UNIQUE);`, schemaName)
+		link TEXT NOT NULL UNIQUE
+	);
+
+	INSERT INTO news.posts (title, content, pubTime, link) VALUES
+		('Title 1', '<p>Content 1</p>', 1650000000, 'Link 1'),
+		('Title 2', '<p>Content 2</p>', 1650000100, 'Link 2');`
+
+	db, cleanup := testPGDBFrom(t, earlier)
+	defer cleanup()
+
+	page, err := db.GetNewsPage(Filter{}, 1, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(page)) {
+		assert.Equal(t, "Title 2", page[0].Title)
+		assert.Equal(t, "Link 2", page[0].GUID)
+		assert.Equal(t, "Content 2", page[0].PlainText)
+	}
 
-	_, err = db.Exec(ctx, createTableQuery)
+	amount, err := db.NewsAmount(Filter{Query: "content 1"})
 	assert.Nil(t, err)
+	assert.Equal(t, 1, amount)
 
-	return &Store{db: db}, func() {
-		_, err := db.Exec(ctx, "DROP SCHEMA "+schemaName+" CASCADE")
-		assert.Nil(t, err)
+	//the copied posts are moved from the default partition to the partition of their month
+	var n int
+	assert.Nil(t, db.db.QueryRow(ctx, "SELECT count(*) FROM posts_default").Scan(&n))
+	assert.Equal(t, 0, n)
+	assert.Nil(t, db.db.QueryRow(ctx, "SELECT count(*) FROM posts_y2022m04").Scan(&n))
+	assert.Equal(t, 2, n)
+
+	//the copied posts stay unique and the new ones get the next ids
+	posts := []*Post{
+		{Title: "Title 1", Content: "Content", PubTime: time.Now().Unix(), Link: "Link 1"},
+		{Title: "Title 3", Content: "Content", PubTime: time.Now().Unix(), Link: "Link 3"},
 	}
+	assert.Nil(t, db.WriteNews(posts))
+	assert.Equal(t, 0, posts[0].ID)
+	assert.Greater(t, posts[1].ID, page[0].ID)
+
+	//the upgraded schema is applied again without changes
+	schema, err := ioutil.ReadFile("../../schema.sql")
+	assert.Nil(t, err)
+	var schemaName string
+	assert.Nil(t, db.db.QueryRow(ctx, "SELECT current_schema();").Scan(&schemaName))
+	_, err = db.db.Exec(ctx, schemaNameRe.ReplaceAllString(string(schema), schemaName))
+	assert.Nil(t, err)
+
+	amount, err = db.NewsAmount(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, amount)
 }
 
-func generateSomePosts(n int) []*Post {
-	var posts []*Post
-	for i := 0; i < n; i++ {
-		post := Post{
-			Title:   "Title " + strconv.Itoa(i),
-			Content: "Content " + strconv.Itoa(i),
-			PubTime: time.Now().Unix(),
-			Link:    "Link " + strconv.Itoa(i),
+func TestStore_ListenNews(t *testing.T) {
+	db, cleanup := testPGDB(t)
+	defer cleanup()
+
+	posts := generateDatedPosts(2)
+	assert.Nil(t, db.WriteNews(posts))
+
+	listenCtx, cancel := context.WithCancel(context.Background())
+	ids := make(chan int, 10)
+	done := make(chan error)
+	go func() {
+		done <- db.ListenNews(listenCtx, func(id int) { ids <- id })
+	}()
+
+	next := func() int {
+		select {
+		case id := <-ids:
+			return id
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification")
+			return 0
 		}
-		posts = append(posts, &post)
 	}
 
-	return posts
+	//the listener starts with the newest post
+	assert.Equal(t, posts[1].ID, next())
+
+	more := generateDatedPosts(3)
+	for _, post := range more {
+		post.Link = "more " + post.Link
+	}
+	assert.Nil(t, db.WriteNews(more))
+	assert.Equal(t, more[2].ID, next())
+
+	//nothing is inserted, nothing is sent
+	assert.Nil(t, db.WriteNews(more))
+	select {
+	case id := <-ids:
+		t.Fatalf("unexpected notification %d", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	assert.NotNil(t, <-done)
 }
 
-func TestStore_WriteNews(t *testing.T) {
+func TestStore_WriteNewsOrder(t *testing.T) {
 	db, cleanup := testPGDB(t)
 	defer cleanup()
 
-	var n = 10
-	posts := generateSomePosts(n)
+	slow := generateDatedPosts(2)
+	fast := generateDatedPosts(2)
+	for _, post := range fast {
+		post.Link = "fast " + post.Link
+	}
+
+	//the first writer has taken its ids and has not committed yet
+	tx, err := db.db.Begin(ctx)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer tx.Rollback(ctx)
+	assert.Nil(t, db.insertNews(tx, slow))
+
+	done := make(chan error)
+	go func() {
+		done <- db.WriteNews(fast)
+	}()
 
-	err := db.WriteNews(posts)
+	//the second writer waits, so it can not commit the greater ids first
+	select {
+	case err := <-done:
+		t.Fatalf("the second writer has not waited: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	posts, err := db.GetNewsAfter(Filter{}, 0, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, posts)
+
+	assert.Nil(t, tx.Commit(ctx))
+	assert.Nil(t, <-done)
+	assert.Greater(t, fast[0].ID, slow[1].ID)
+
+	//a reader that has passed the first posts does not skip the second ones
+	posts, err = db.GetNewsAfter(Filter{}, slow[1].ID, 10)
 	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(posts)) {
+		assert.Equal(t, fast[0].ID, posts[0].ID)
+		assert.Equal(t, fast[1].ID, posts[1].ID)
+	}
 }
 
-func TestStore_GetLastNews(t *testing.T) {
+func TestStore_ListenNews_Concurrent(t *testing.T) {
 	db, cleanup := testPGDB(t)
 	defer cleanup()
 
-	posts := generateSomePosts(20)
-	err := db.WriteNews(posts)
+	listenCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ids := make(chan int, 100)
+	go db.ListenNews(listenCtx, func(id int) { ids <- id })
+
+	//the writers use their own connections, like the instances sharing the database
+	const writers, batches, size = 4, 5, 3
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for b := 0; b < batches; b++ {
+				posts := generateDatedPosts(size)
+				for _, post := range posts {
+					post.Link = fmt.Sprintf("%d %d %s", w, b, post.Link)
+				}
+				assert.Nil(t, db.WriteNews(posts))
+			}
+		}(w)
+	}
+
+	//the follower reads the posts after its cursor up to every notified id, as the live updates do
+	received := map[int]bool{}
+	cursor := 0
+	for len(received) < writers*batches*size {
+		select {
+		case id := <-ids:
+			for cursor < id {
+				posts, err := db.GetNewsAfter(Filter{}, cursor, 100)
+				if !assert.Nil(t, err) || !assert.NotEmpty(t, posts, "posts up to %d are not visible", id) {
+					return
+				}
+				for _, post := range posts {
+					received[post.ID] = true
+					cursor = post.ID
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d posts of %d", len(received), writers*batches*size)
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestStore_TryAdvisoryLock(t *testing.T) {
+	db, cleanup := testPGDB(t)
+	defer cleanup()
+
+	key := time.Now().UnixNano()
+
+	first, err := db.TryAdvisoryLock(ctx, key)
 	assert.Nil(t, err)
+	if !assert.NotNil(t, first) {
+		return
+	}
+	assert.Nil(t, first.Check(ctx))
 
-	n := 10
-	lastPosts, err := db.GetLastNews(n)
+	//another session can not take the held lock
+	second, err := db.TryAdvisoryLock(ctx, key)
 	assert.Nil(t, err)
+	assert.Nil(t, second)
 
-	assert.Equal(t, n, len(lastPosts))
+	first.Unlock()
+
+	second, err = db.TryAdvisoryLock(ctx, key)
+	assert.Nil(t, err)
+	if assert.NotNil(t, second) {
+		second.Unlock()
+	}
 }
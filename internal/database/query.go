@@ -0,0 +1,598 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//postColumns is the list of posts columns, used for inserts and, followed by the tags, in selects.
+const postColumns = `
+		id,
+		title,
+		content,
+		pubTime,
+		link,
+		feed,
+		guid,
+		author,
+		categories,
+		comments,
+		enclosureUrl,
+		enclosureType,
+		enclosureLength,
+		fetchedAt,
+		plainText`
+
+//tagCondition selects the posts, aliased as p, that have the tag.
+const tagCondition = `EXISTS (
+		SELECT 1
+		FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.post_id = p.id AND t.name = ?)`
+
+//mediaCondition selects the posts, aliased as p, that have media attachments matching the extra condition on m.
+const mediaCondition = `EXISTS (
+		SELECT 1
+		FROM media m
+		WHERE m.post_id = p.id%s)`
+
+//subscriptionCondition selects the posts, aliased as p, of the feeds the user is subscribed to.
+const subscriptionCondition = `p.feed IN (
+		SELECT f.url
+		FROM subscriptions s JOIN feeds f ON f.id = s.feed_id
+		WHERE s.user_id = ?)`
+
+//unreadCondition selects the posts, aliased as p, the user has not read. The state set for the post itself
+//wins over the "read up to" marks of its feed and of all feeds, which are stored as feed ''.
+const unreadCondition = `NOT COALESCE(
+		(SELECT r.isRead FROM post_reads r WHERE r.user_id = ? AND r.post_id = p.id),
+		p.pubTime <= (SELECT COALESCE(max(m.readBefore), 0) FROM read_marks m WHERE m.user_id = ? AND m.feed IN (p.feed, '')))`
+
+//upsertPostRead sets the read state of the post, if the post exists.
+const upsertPostRead = `
+	INSERT INTO post_reads (
+		user_id,
+		post_id,
+		isRead,
+		readAt)
+	SELECT ?, id, ?, ?
+	FROM posts
+	WHERE id = ?
+	ON CONFLICT (user_id, post_id) DO UPDATE SET
+		isRead = excluded.isRead,
+		readAt = excluded.readAt;`
+
+//upsertReadMark moves the "read up to" mark of the feed forward, it never goes back.
+const upsertReadMark = `
+	INSERT INTO read_marks (
+		user_id,
+		feed,
+		readBefore)
+	VALUES (?, ?, ?)
+	ON CONFLICT (user_id, feed) DO UPDATE SET
+		readBefore = CASE WHEN excluded.readBefore > read_marks.readBefore THEN excluded.readBefore ELSE read_marks.readBefore END;`
+
+//deleteCoveredReads removes the states of the posts covered by the new mark, so the posts marked unread become read.
+const deleteCoveredReads = `
+	DELETE FROM post_reads
+	WHERE user_id = ? AND post_id IN (
+		SELECT id
+		FROM posts
+		WHERE pubTime <= ? AND (? = '' OR feed = ?));`
+
+//selectUnreadCounts counts the unread posts of the user by feed.
+const selectUnreadCounts = `
+	SELECT p.feed, count(*)
+	FROM posts p
+	WHERE ` + unreadCondition + `
+	GROUP BY p.feed
+	ORDER BY p.feed;`
+
+//notSavedCondition selects the posts, aliased as p, nobody has starred.
+const notSavedCondition = `NOT EXISTS (SELECT 1 FROM saved_posts s WHERE s.post_id = p.id)`
+
+//upsertSavedPost stars the post, if the post exists. Starring it again changes only the note.
+const upsertSavedPost = `
+	INSERT INTO saved_posts (
+		user_id,
+		post_id,
+		note,
+		savedAt)
+	SELECT ?, id, ?, ?
+	FROM posts
+	WHERE id = ?
+	ON CONFLICT (user_id, post_id) DO UPDATE SET
+		note = excluded.note;`
+
+//insertSubscription subscribes the user to the feed, if the feed exists.
+const insertSubscription = `
+	INSERT INTO subscriptions (
+		user_id,
+		feed_id,
+		createdAt)
+	SELECT ?, id, ?
+	FROM feeds
+	WHERE id = ?
+	ON CONFLICT (user_id, feed_id) DO NOTHING;`
+
+//selectSubscriptions returns feedColumns of the feeds the user is subscribed to.
+const selectSubscriptions = `
+	SELECT ` + feedColumns + `
+	FROM feeds
+	WHERE id IN (SELECT feed_id FROM subscriptions WHERE user_id = ?)
+	ORDER BY id;`
+
+//insertMedia adds one media attachment of the post.
+const insertMedia = `
+	INSERT INTO media (
+		post_id,
+		position,
+		url,
+		type,
+		medium,
+		source,
+		length,
+		width,
+		height)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+//mediaObject is the JSON object of a media row m, it is decoded by mediaList.
+const mediaObject = `'Position', m.position, 'URL', m.url, 'Type', m.type, 'Medium', m.medium,
+			'Source', m.source, 'Length', m.length, 'Width', m.width, 'Height', m.height`
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+//feedColumns are the columns of the feeds table without the icon itself.
+const feedColumns = `
+	id,
+	url,
+	title,
+	link,
+	description,
+	language,
+	image,
+	lastBuildDate,
+	fetchedAt,
+	iconFetchedAt,
+	iconType <> ''`
+
+//upsertFeed saves the channel metadata of the feed, the icon is kept.
+const upsertFeed = `
+	INSERT INTO feeds (
+		url,
+		title,
+		link,
+		description,
+		language,
+		image,
+		lastBuildDate,
+		fetchedAt)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (url) DO UPDATE SET
+		title = excluded.title,
+		link = excluded.link,
+		description = excluded.description,
+		language = excluded.language,
+		image = excluded.image,
+		lastBuildDate = excluded.lastBuildDate,
+		fetchedAt = excluded.fetchedAt;`
+
+//updateFeedIcon saves the time of the icon download and, if it succeeded, the icon.
+const updateFeedIcon = `
+	UPDATE feeds SET
+		iconFetchedAt = ?,
+		iconType = CASE WHEN ? <> '' THEN ? ELSE iconType END,
+		icon = CASE WHEN ? <> '' THEN ? ELSE icon END
+	WHERE url = ?;`
+
+//insertUser adds the user, the first user becomes an admin. No rows are returned if the login is taken
+//or if the last argument is false and there are users already.
+const insertUser = `
+	INSERT INTO users (
+		login,
+		passwordHash,
+		admin,
+		createdAt)
+	SELECT ?, ?, NOT EXISTS (SELECT 1 FROM users), ?
+	WHERE ? OR NOT EXISTS (SELECT 1 FROM users)
+	ON CONFLICT (login) DO NOTHING
+	RETURNING id, admin;`
+
+//alertRuleColumns are the columns of alert_rules in the order of scanAlertRule.
+const alertRuleColumns = `id, user_id, name, keywords, regex, feeds, webhookUrl, secret, createdAt`
+
+const insertAlertRule = `
+	INSERT INTO alert_rules (
+		user_id,
+		name,
+		keywords,
+		regex,
+		feeds,
+		webhookUrl,
+		secret,
+		createdAt)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	RETURNING id;`
+
+//deliveryColumns are the columns of alert_deliveries in the order of scanDelivery.
+const deliveryColumns = `id, rule_id, post_id, payload, status, attempts, responseCode, error, createdAt, updatedAt, nextAttemptAt`
+
+const insertDelivery = `
+	INSERT INTO alert_deliveries (
+		rule_id,
+		post_id,
+		payload,
+		status,
+		attempts,
+		responseCode,
+		error,
+		createdAt,
+		updatedAt,
+		nextAttemptAt)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	RETURNING id;`
+
+const updateDelivery = `
+	UPDATE alert_deliveries SET
+		status = ?,
+		attempts = ?,
+		responseCode = ?,
+		error = ?,
+		updatedAt = ?,
+		nextAttemptAt = ?
+	WHERE id = ?;`
+
+//selectDueDeliveries returns the pending deliveries whose next attempt is due, the oldest first.
+const selectDueDeliveries = `
+	SELECT ` + deliveryColumns + `
+	FROM alert_deliveries
+	WHERE status = 'pending' AND nextAttemptAt <= ?
+	ORDER BY nextAttemptAt, id
+	LIMIT ?;`
+
+//deleteFinishedDeliveries removes the delivery log records older than the given time, the pending deliveries are kept.
+const deleteFinishedDeliveries = `
+	DELETE FROM alert_deliveries
+	WHERE status <> 'pending' AND updatedAt < ?;`
+
+//scanAlertRule scans alertRuleColumns.
+func scanAlertRule(row scanner) (*AlertRule, error) {
+	var (
+		rule     AlertRule
+		keywords jsonList
+		feeds    jsonList
+	)
+
+	err := row.Scan(&rule.ID, &rule.UserID, &rule.Name, &keywords, &rule.Regex, &feeds, &rule.WebhookURL, &rule.Secret, &rule.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rule.Keywords = keywords
+	rule.Feeds = feeds
+
+	return &rule, nil
+}
+
+func alertRuleValues(rule *AlertRule) []interface{} {
+	return []interface{}{
+		rule.UserID, rule.Name, jsonList(rule.Keywords), rule.Regex, jsonList(rule.Feeds),
+		rule.WebhookURL, rule.Secret, rule.CreatedAt,
+	}
+}
+
+//scanDelivery scans deliveryColumns.
+func scanDelivery(row scanner) (*AlertDelivery, error) {
+	var (
+		delivery AlertDelivery
+		payload  string
+	)
+
+	err := row.Scan(&delivery.ID, &delivery.RuleID, &delivery.PostID, &payload, &delivery.Status, &delivery.Attempts,
+		&delivery.ResponseCode, &delivery.Error, &delivery.CreatedAt, &delivery.UpdatedAt, &delivery.NextAttemptAt)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Payload = json.RawMessage(payload)
+
+	return &delivery, nil
+}
+
+func deliveryValues(delivery *AlertDelivery) []interface{} {
+	return []interface{}{
+		delivery.RuleID, delivery.PostID, string(delivery.Payload), delivery.Status, delivery.Attempts,
+		delivery.ResponseCode, delivery.Error, delivery.CreatedAt, delivery.UpdatedAt, delivery.NextAttemptAt,
+	}
+}
+
+//updateDeliveryValues returns the arguments of updateDelivery.
+func updateDeliveryValues(delivery *AlertDelivery) []interface{} {
+	return []interface{}{
+		delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error,
+		delivery.UpdatedAt, delivery.NextAttemptAt, delivery.ID,
+	}
+}
+
+//scanSavedPost scans the post columns followed by the note and the time it was saved.
+func scanSavedPost(row scanner) (*SavedPost, error) {
+	saved := &SavedPost{}
+
+	post, err := scanPost(extraScanner{row, []interface{}{&saved.Note, &saved.SavedAt}})
+	if err != nil {
+		return nil, err
+	}
+	saved.Post = post
+
+	return saved, nil
+}
+
+//extraScanner scans the columns following the ones requested by the caller into extra.
+type extraScanner struct {
+	scanner
+	extra []interface{}
+}
+
+func (s extraScanner) Scan(dest ...interface{}) error {
+	return s.scanner.Scan(append(dest, s.extra...)...)
+}
+
+//escapeLike escapes the LIKE wildcards so that the filter is matched literally.
+func escapeLike(filter string) string {
+	return likeEscaper.Replace(filter)
+}
+
+//scanner is implemented by the rows of both pgx and database/sql.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+//scanPost scans postColumns followed by the JSON arrays of the post tags and media.
+func scanPost(row scanner) (*Post, error) {
+	var (
+		post       Post
+		categories jsonList
+		enclosure  Enclosure
+		tags       jsonList
+		media      mediaList
+	)
+
+	err := row.Scan(
+		&post.ID, &post.Title, &post.Content, &post.PubTime, &post.Link, &post.Feed,
+		&post.GUID, &post.Author, &categories, &post.Comments,
+		&enclosure.URL, &enclosure.Type, &enclosure.Length, &post.FetchedAt, &post.PlainText,
+		&tags, &media,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	post.Categories = categories
+	post.Tags = tags
+	sort.Strings(post.Tags)
+	post.Media = media
+	if enclosure.URL != "" {
+		post.Enclosure = &enclosure
+	}
+
+	return &post, nil
+}
+
+//scanFeed scans feedColumns.
+func scanFeed(row scanner) (*Feed, error) {
+	var feed Feed
+
+	err := row.Scan(
+		&feed.ID, &feed.URL, &feed.Title, &feed.Link, &feed.Description, &feed.Language,
+		&feed.Image, &feed.LastBuildDate, &feed.FetchedAt, &feed.IconFetchedAt, &feed.HasIcon,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &feed, nil
+}
+
+//feedValues returns the values of the upsertFeed columns.
+func feedValues(feed *Feed) []interface{} {
+	return []interface{}{
+		feed.URL, feed.Title, feed.Link, feed.Description, feed.Language,
+		feed.Image, feed.LastBuildDate, feed.FetchedAt,
+	}
+}
+
+//feedIconValues returns the values of updateFeedIcon, the icon type is empty when there is no image.
+func feedIconValues(feedURL string, icon *FeedIcon) []interface{} {
+	iconType := icon.Type
+	if len(icon.Data) == 0 {
+		iconType = ""
+	}
+
+	return []interface{}{icon.FetchedAt, iconType, iconType, iconType, icon.Data, feedURL}
+}
+
+//postValues returns the values of the post columns after id, in the order of postColumns.
+func postValues(post *Post) []interface{} {
+	var enclosure Enclosure
+	if post.Enclosure != nil {
+		enclosure = *post.Enclosure
+	}
+
+	return []interface{}{
+		post.Title, post.Content, post.PubTime, post.Link, post.Feed,
+		post.key(), post.Author, jsonList(post.Categories), post.Comments,
+		enclosure.URL, enclosure.Type, enclosure.Length, post.FetchedAt, post.PlainText,
+	}
+}
+
+//mediaValues returns the values of the insertMedia columns.
+func mediaValues(postID int64, position int, media Media) []interface{} {
+	return []interface{}{
+		postID, position, media.URL, media.Type, media.Medium, media.Source,
+		media.Length, media.Width, media.Height,
+	}
+}
+
+//addUserConditions adds the conditions of the filter that depend on the user.
+func addUserConditions(cond *conditions, filter Filter) {
+	if filter.UserID == 0 {
+		return
+	}
+
+	if filter.Subscribed {
+		cond.add(subscriptionCondition, filter.UserID)
+	}
+	if filter.Unread {
+		cond.add(unreadCondition, filter.UserID, filter.UserID)
+	}
+}
+
+//addFeedConditions limits the posts, aliased as p, to the feeds of the filter.
+func addFeedConditions(cond *conditions, filter Filter) {
+	if len(filter.Feeds) == 0 {
+		return
+	}
+
+	args := make([]interface{}, len(filter.Feeds))
+	for i, feed := range filter.Feeds {
+		args[i] = feed
+	}
+
+	cond.add("p.feed IN (?"+strings.Repeat(", ?", len(args)-1)+")", args...)
+}
+
+//addMediaConditions adds the media conditions of the filter.
+func addMediaConditions(cond *conditions, filter Filter) {
+	if filter.MediaType != "" {
+		column, value := filter.mediaTypeColumn()
+		cond.add(fmt.Sprintf(mediaCondition, " AND m."+column+" = ?"), value)
+		return
+	}
+
+	if filter.HasMedia {
+		cond.add(fmt.Sprintf(mediaCondition, ""))
+	}
+}
+
+//jsonList is a list of strings stored as a JSON array.
+type jsonList []string
+
+//Value implements driver.Valuer.
+func (l jsonList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+
+	data, err := json.Marshal([]string(l))
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+//Scan implements sql.Scanner.
+func (l *jsonList) Scan(src interface{}) error {
+	var data []byte
+
+	switch v := src.(type) {
+	case nil:
+		*l = jsonList{}
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("cannot scan %T into jsonList", src)
+	}
+
+	list := []string{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	*l = list
+	return nil
+}
+
+//mediaList is the JSON array of the post media, each object also has the Position of the attachment.
+type mediaList []Media
+
+//Scan implements sql.Scanner.
+func (l *mediaList) Scan(src interface{}) error {
+	var data []byte
+
+	switch v := src.(type) {
+	case nil:
+		*l = mediaList{}
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("cannot scan %T into mediaList", src)
+	}
+
+	var list []struct {
+		Position int
+		Media
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Position < list[j].Position
+	})
+
+	media := make(mediaList, 0, len(list))
+	for _, m := range list {
+		media = append(media, m.Media)
+	}
+
+	*l = media
+	return nil
+}
+
+//conditions collects the WHERE conditions of a query, placeholders are written as "?".
+type conditions struct {
+	list []string
+	args []interface{}
+}
+
+func (c *conditions) add(cond string, args ...interface{}) {
+	c.list = append(c.list, cond)
+	c.args = append(c.args, args...)
+}
+
+//where returns the conditions joined with AND.
+func (c *conditions) where() string {
+	if len(c.list) == 0 {
+		return "1 = 1"
+	}
+
+	return strings.Join(c.list, " AND ")
+}
+
+//rebind replaces "?" placeholders with the numbered ones used by Postgres.
+func rebind(query string) string {
+	var b strings.Builder
+
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,1322 @@
+package database
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+
+	"modernc.org/sqlite"
+)
+
+//sqliteSchema is applied on every start, all statements are idempotent.
+//Search goes through the FTS5 index with the trigram tokenizer,
+//which gives the same case-insensitive substring semantics as ILIKE in Postgres.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS posts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT NOT NULL,
+	content TEXT NOT NULL,
+	pubTime INTEGER NOT NULL CHECK (pubTime > 0),
+	link TEXT NOT NULL,
+	feed TEXT NOT NULL DEFAULT '',
+	guid TEXT NOT NULL UNIQUE,
+	author TEXT NOT NULL DEFAULT '',
+	categories TEXT NOT NULL DEFAULT '[]',
+	comments TEXT NOT NULL DEFAULT '',
+	enclosureUrl TEXT NOT NULL DEFAULT '',
+	enclosureType TEXT NOT NULL DEFAULT '',
+	enclosureLength INTEGER NOT NULL DEFAULT 0,
+	fetchedAt INTEGER NOT NULL DEFAULT 0,
+	plainText TEXT NOT NULL DEFAULT ''
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS posts_link_idx ON posts (link);
+
+CREATE INDEX IF NOT EXISTS posts_pubTime_idx ON posts (pubTime);
+CREATE INDEX IF NOT EXISTS posts_feed_pubTime_idx ON posts (feed, pubTime DESC);
+
+CREATE TABLE IF NOT EXISTS posts_archive (
+	guid TEXT PRIMARY KEY,
+	link TEXT NOT NULL,
+	feed TEXT NOT NULL,
+	pubTime INTEGER NOT NULL,
+	prunedAt INTEGER NOT NULL,
+	data BLOB
+);
+
+CREATE TABLE IF NOT EXISTS tags (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS post_tags (
+	post_id INTEGER NOT NULL REFERENCES posts (id) ON DELETE CASCADE,
+	tag_id INTEGER NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+	source TEXT NOT NULL,
+	PRIMARY KEY (post_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS post_tags_tag_id_idx ON post_tags (tag_id);
+
+CREATE TABLE IF NOT EXISTS media (
+	post_id INTEGER NOT NULL REFERENCES posts (id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	url TEXT NOT NULL,
+	type TEXT NOT NULL DEFAULT '',
+	medium TEXT NOT NULL DEFAULT '',
+	source TEXT NOT NULL,
+	length INTEGER NOT NULL DEFAULT 0,
+	width INTEGER NOT NULL DEFAULT 0,
+	height INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (post_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS media_medium_idx ON media (medium);
+CREATE INDEX IF NOT EXISTS media_type_idx ON media (type);
+
+CREATE TABLE IF NOT EXISTS full_texts (
+	post_id INTEGER PRIMARY KEY REFERENCES posts (id) ON DELETE CASCADE,
+	content TEXT NOT NULL,
+	plainText TEXT NOT NULL,
+	fetchedAt INTEGER NOT NULL,
+	error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS feeds (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	url TEXT NOT NULL UNIQUE,
+	title TEXT NOT NULL DEFAULT '',
+	link TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	language TEXT NOT NULL DEFAULT '',
+	image TEXT NOT NULL DEFAULT '',
+	lastBuildDate INTEGER NOT NULL DEFAULT 0,
+	fetchedAt INTEGER NOT NULL DEFAULT 0,
+	iconFetchedAt INTEGER NOT NULL DEFAULT 0,
+	iconType TEXT NOT NULL DEFAULT '',
+	icon BLOB
+);
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	login TEXT NOT NULL UNIQUE,
+	passwordHash TEXT NOT NULL,
+	admin INTEGER NOT NULL DEFAULT 0,
+	createdAt INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	tokenHash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	createdAt INTEGER NOT NULL,
+	expiresAt INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_expiresAt_idx ON sessions (expiresAt);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	feed_id INTEGER NOT NULL REFERENCES feeds (id) ON DELETE CASCADE,
+	createdAt INTEGER NOT NULL,
+	PRIMARY KEY (user_id, feed_id)
+);
+
+CREATE TABLE IF NOT EXISTS post_reads (
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	post_id INTEGER NOT NULL REFERENCES posts (id) ON DELETE CASCADE,
+	isRead INTEGER NOT NULL,
+	readAt INTEGER NOT NULL,
+	PRIMARY KEY (user_id, post_id)
+);
+
+CREATE INDEX IF NOT EXISTS post_reads_post_id_idx ON post_reads (post_id);
+
+CREATE TABLE IF NOT EXISTS read_marks (
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	feed TEXT NOT NULL,
+	readBefore INTEGER NOT NULL,
+	PRIMARY KEY (user_id, feed)
+);
+
+CREATE TABLE IF NOT EXISTS saved_posts (
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	post_id INTEGER NOT NULL REFERENCES posts (id) ON DELETE CASCADE,
+	note TEXT NOT NULL DEFAULT '',
+	savedAt INTEGER NOT NULL,
+	PRIMARY KEY (user_id, post_id)
+);
+
+CREATE INDEX IF NOT EXISTS saved_posts_post_id_idx ON saved_posts (post_id);
+
+CREATE TABLE IF NOT EXISTS alert_rules (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name TEXT NOT NULL DEFAULT '',
+	keywords TEXT NOT NULL DEFAULT '[]',
+	regex TEXT NOT NULL DEFAULT '',
+	feeds TEXT NOT NULL DEFAULT '[]',
+	webhookUrl TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	createdAt INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS alert_rules_user_id_idx ON alert_rules (user_id);
+
+CREATE TABLE IF NOT EXISTS alert_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	rule_id INTEGER NOT NULL REFERENCES alert_rules (id) ON DELETE CASCADE,
+	post_id INTEGER NOT NULL,
+	payload TEXT NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	responseCode INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	createdAt INTEGER NOT NULL,
+	updatedAt INTEGER NOT NULL,
+	nextAttemptAt INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS alert_deliveries_rule_id_idx ON alert_deliveries (rule_id, id);
+CREATE INDEX IF NOT EXISTS alert_deliveries_status_idx ON alert_deliveries (status, nextAttemptAt);
+
+CREATE TABLE IF NOT EXISTS host_policies (
+	host TEXT PRIMARY KEY,
+	robots TEXT NOT NULL DEFAULT '',
+	robotsStatus INTEGER NOT NULL DEFAULT 0,
+	robotsFetchedAt INTEGER NOT NULL DEFAULT 0,
+	retryAfter INTEGER NOT NULL DEFAULT 0,
+	lastRequestAt INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5 (
+	title,
+	plainText,
+	content = 'posts',
+	content_rowid = 'id',
+	tokenize = 'trigram'
+);
+
+CREATE TRIGGER IF NOT EXISTS posts_fts_insert AFTER INSERT ON posts BEGIN
+	INSERT INTO posts_fts (rowid, title, plainText) VALUES (new.id, new.title, new.plainText);
+END;
+
+CREATE TRIGGER IF NOT EXISTS posts_fts_delete AFTER DELETE ON posts BEGIN
+	INSERT INTO posts_fts (posts_fts, rowid, title, plainText) VALUES ('delete', old.id, old.title, old.plainText);
+END;
+
+CREATE TRIGGER IF NOT EXISTS posts_fts_update AFTER UPDATE ON posts BEGIN
+	INSERT INTO posts_fts (posts_fts, rowid, title, plainText) VALUES ('delete', old.id, old.title, old.plainText);
+	INSERT INTO posts_fts (rowid, title, plainText) VALUES (new.id, new.title, new.plainText);
+END;`
+
+//minTrigramFilter is the shortest filter the trigram index can answer, shorter ones fall back to LIKE.
+const minTrigramFilter = 3
+
+//foldCondition compares the folded text with the folded LIKE pattern. LIKE and lower() of SQLite ignore
+//the case only of ASCII letters, so the SQL function fold lowers the text in Go.
+const foldCondition = `fold(%s) LIKE '%%' || ? || '%%' ESCAPE '\'`
+
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("fold", 1, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		switch v := args[0].(type) {
+		case string:
+			return strings.ToLower(v), nil
+		case []byte:
+			return strings.ToLower(string(v)), nil
+		default:
+			return v, nil
+		}
+	})
+}
+
+//sqlitePostSelect is postColumns of the posts table aliased as p, followed by the post tags and media.
+const sqlitePostSelect = postColumns + `,
+		(SELECT json_group_array(t.name)
+		FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+		WHERE pt.post_id = p.id) AS tags,
+		(SELECT json_group_array(json_object(` + mediaObject + `))
+		FROM media m
+		WHERE m.post_id = p.id) AS media`
+
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+//NewSQLiteDB creates a new instance SQLiteStore and prepares the database file.
+func NewSQLiteDB(cfg config.SQLite) (*SQLiteStore, error) {
+	dsn := "file:" + cfg.Path + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	//sqlite allows only one writer at a time, a single connection avoids "database is locked" errors
+	db.SetMaxOpenConns(1)
+
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err = db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{
+		db: db,
+	}, nil
+}
+
+//Close closes the database.
+func (s *SQLiteStore) Close() {
+	s.db.Close()
+}
+
+//WriteNews adds posts to the database, checking guids for uniqueness.
+//Posts that were already pruned by the retention policy are not added again.
+//The inserted posts get their ids, the skipped ones get zero ids.
+func (s *SQLiteStore) WriteNews(posts []*Post) error {
+	query := `
+	INSERT INTO posts (` + postColumns + `)
+	SELECT NULL, ?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14
+	WHERE NOT EXISTS (SELECT 1 FROM posts_archive WHERE guid = ?6)
+	ON CONFLICT DO NOTHING;`
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, post := range posts {
+		post.ID = 0
+
+		result, err := tx.ExecContext(ctx, query, postValues(post)...)
+		if err != nil {
+			return err
+		}
+
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		post.ID = int(id)
+
+		if err = s.addTags(tx, id, normalizeTags(post.Categories), tagSourceFeed); err != nil {
+			return err
+		}
+
+		for i, media := range post.Media {
+			if _, err = tx.ExecContext(ctx, insertMedia, mediaValues(id, i, media)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+//GetLastNews returns the latest n news, sorted by publication date.
+func (s *SQLiteStore) GetLastNews(n int) ([]*Post, error) {
+	query := `
+	SELECT ` + sqlitePostSelect + `
+	FROM posts p
+	ORDER BY pubTime DESC, id DESC
+	LIMIT ?;`
+
+	rows, err := s.db.QueryContext(ctx, query, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scanPosts(rows)
+}
+
+//NewsAmount returns the number of news by filter.
+func (s *SQLiteStore) NewsAmount(filter Filter) (int, error) {
+	cond := s.filterConditions(filter)
+
+	query := `
+	SELECT count(*)
+	FROM posts p
+	WHERE ` + cond.where() + `;`
+
+	var amount int
+
+	err := s.db.QueryRowContext(ctx, query, cond.args...).Scan(&amount)
+	if err != nil {
+		return 0, err
+	}
+
+	return amount, nil
+}
+
+//GetNewsPage returns the specified page with news by filter.
+func (s *SQLiteStore) GetNewsPage(filter Filter, page int, ipemsPerPage int) ([]*Post, error) {
+	if page < 1 {
+		return nil, nil
+	}
+
+	cond := s.filterConditions(filter)
+
+	query := `
+	SELECT ` + sqlitePostSelect + `
+	FROM posts p
+	WHERE ` + cond.where() + `
+	ORDER BY pubTime DESC, id DESC
+	LIMIT ?
+	OFFSET ?;`
+
+	offset := (page - 1) * ipemsPerPage
+
+	rows, err := s.db.QueryContext(ctx, query, append(cond.args, ipemsPerPage, offset)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scanPosts(rows)
+}
+
+//GetNewsAfter returns up to n news by filter with ids greater than id, in the order they were written.
+func (s *SQLiteStore) GetNewsAfter(filter Filter, id int, n int) ([]*Post, error) {
+	cond := s.filterConditions(filter)
+	cond.add("p.id > ?", id)
+
+	query := `
+	SELECT ` + sqlitePostSelect + `
+	FROM posts p
+	WHERE ` + cond.where() + `
+	ORDER BY id
+	LIMIT ?;`
+
+	rows, err := s.db.QueryContext(ctx, query, append(cond.args, n)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scanPosts(rows)
+}
+
+//LastNewsID returns the greatest id of the stored news, 0 if there are none.
+func (s *SQLiteStore) LastNewsID() (int, error) {
+	var id int
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(max(id), 0) FROM posts;`).Scan(&id)
+	return id, err
+}
+
+//GetNewsByID returns one post by its id.
+func (s *SQLiteStore) GetNewsByID(id int) (*Post, error) {
+	query := `
+	SELECT ` + sqlitePostSelect + `
+	FROM posts p
+	WHERE id = ?;`
+
+	post, err := scanPost(s.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	query = `
+	SELECT content
+	FROM full_texts
+	WHERE post_id = ? AND error = '';`
+
+	err = s.db.QueryRowContext(ctx, query, id).Scan(&post.FullText)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return post, nil
+}
+
+//PendingFullText returns the latest n posts of the feed, for which the full text was not fetched yet.
+func (s *SQLiteStore) PendingFullText(feed string, n int) ([]*Post, error) {
+	query := `
+	SELECT ` + sqlitePostSelect + `
+	FROM posts p
+	WHERE feed = ? AND NOT EXISTS (SELECT 1 FROM full_texts f WHERE f.post_id = p.id)
+	ORDER BY pubTime DESC, id DESC
+	LIMIT ?;`
+
+	rows, err := s.db.QueryContext(ctx, query, feed, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scanPosts(rows)
+}
+
+//WriteFullText saves the full text of the post, an existing one is replaced.
+func (s *SQLiteStore) WriteFullText(id int, text *FullText) error {
+	query := `
+	INSERT INTO full_texts (
+		post_id,
+		content,
+		plainText,
+		fetchedAt,
+		error)
+	SELECT id, ?2, ?3, ?4, ?5
+	FROM posts
+	WHERE id = ?1
+	ON CONFLICT (post_id) DO UPDATE SET
+		content = excluded.content,
+		plainText = excluded.plainText,
+		fetchedAt = excluded.fetchedAt,
+		error = excluded.error;`
+
+	result, err := s.db.ExecContext(ctx, query, id, text.Content, text.PlainText, text.FetchedAt, text.Error)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//AddTags attaches user tags to the post.
+func (s *SQLiteStore) AddTags(id int, tags []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM posts WHERE id = ?);`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	if err = s.addTags(tx, int64(id), normalizeTags(tags), tagSourceUser); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//RemoveTag detaches the tag from the post.
+func (s *SQLiteStore) RemoveTag(id int, tag string) error {
+	query := `
+	DELETE FROM post_tags
+	WHERE post_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?);`
+
+	result, err := s.db.ExecContext(ctx, query, id, NormalizeTag(tag))
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetTags returns all tags that have posts with the number of their posts, the most popular first.
+func (s *SQLiteStore) GetTags() ([]*Tag, error) {
+	query := `
+	SELECT t.name, count(*)
+	FROM tags t
+	JOIN post_tags pt ON pt.tag_id = t.id
+	GROUP BY t.name
+	ORDER BY count(*) DESC, t.name;`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []*Tag{}
+
+	for rows.Next() {
+		var tag Tag
+
+		if err = rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, &tag)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+//WriteFeed saves the channel metadata of the feed, the feed is created on first write.
+func (s *SQLiteStore) WriteFeed(feed *Feed) error {
+	_, err := s.db.ExecContext(ctx, upsertFeed, feedValues(feed)...)
+	return err
+}
+
+//GetFeed returns the feed by its link.
+func (s *SQLiteStore) GetFeed(url string) (*Feed, error) {
+	query := `
+	SELECT ` + feedColumns + `
+	FROM feeds
+	WHERE url = ?;`
+
+	feed, err := scanFeed(s.db.QueryRowContext(ctx, query, url))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return feed, nil
+}
+
+//GetFeeds returns all feeds in the order they were first fetched.
+func (s *SQLiteStore) GetFeeds() ([]*Feed, error) {
+	query := `
+	SELECT ` + feedColumns + `
+	FROM feeds
+	ORDER BY id;`
+
+	return s.queryFeeds(query)
+}
+
+//MarkRead sets the read state of the post for the user.
+//ErrNotFound is returned if the post does not exist.
+func (s *SQLiteStore) MarkRead(userID, postID int, read bool, at int64) error {
+	result, err := s.db.ExecContext(ctx, upsertPostRead, userID, read, at, postID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//MarkAllRead marks as read the posts of the feed published up to the unix time before, an empty feed means all feeds.
+func (s *SQLiteStore) MarkAllRead(userID int, feed string, before int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, upsertReadMark, userID, feed, before); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, deleteCoveredReads, userID, before, feed, feed); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//UnreadCounts returns the number of unread posts of the user for each feed that has them.
+func (s *SQLiteStore) UnreadCounts(userID int) ([]*UnreadCount, error) {
+	rows, err := s.db.QueryContext(ctx, selectUnreadCounts, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []*UnreadCount{}
+
+	for rows.Next() {
+		var count UnreadCount
+		if err = rows.Scan(&count.Feed, &count.Count); err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, &count)
+	}
+
+	return counts, rows.Err()
+}
+
+//SavePost stars the post for the user, starring it again replaces the note.
+//ErrNotFound is returned if the post does not exist.
+func (s *SQLiteStore) SavePost(userID, postID int, note string, at int64) error {
+	result, err := s.db.ExecContext(ctx, upsertSavedPost, userID, note, at, postID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//UnsavePost removes the star of the user from the post.
+//ErrNotFound is returned if the post is not starred.
+func (s *SQLiteStore) UnsavePost(userID, postID int) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM saved_posts WHERE user_id = ? AND post_id = ?;`, userID, postID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetSavedPosts returns the posts starred by the user, the last saved first.
+//A non-empty query is searched in the title, the text and the note.
+func (s *SQLiteStore) GetSavedPosts(userID int, query string) ([]*SavedPost, error) {
+	cond := &conditions{}
+	cond.add("s.user_id = ?", userID)
+	if query != "" {
+		query = escapeLike(strings.ToLower(query))
+		cond.add("("+fmt.Sprintf(foldCondition, "p.title")+" OR "+fmt.Sprintf(foldCondition, "p.plainText")+
+			" OR "+fmt.Sprintf(foldCondition, "s.note")+")", query, query, query)
+	}
+
+	q := `
+	SELECT ` + sqlitePostSelect + `, s.note, s.savedAt
+	FROM saved_posts s JOIN posts p ON p.id = s.post_id
+	WHERE ` + cond.where() + `
+	ORDER BY s.savedAt DESC, p.id DESC;`
+
+	rows, err := s.db.QueryContext(ctx, q, cond.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	saved := []*SavedPost{}
+
+	for rows.Next() {
+		post, err := scanSavedPost(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		saved = append(saved, post)
+	}
+
+	return saved, rows.Err()
+}
+
+//Subscribe subscribes the user to the feed, the repeated subscription is not an error.
+//ErrNotFound is returned if the feed does not exist.
+func (s *SQLiteStore) Subscribe(userID, feedID int, createdAt int64) error {
+	result, err := s.db.ExecContext(ctx, insertSubscription, userID, createdAt, feedID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM feeds WHERE id = ?);`, feedID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//Unsubscribe removes the subscription of the user to the feed.
+//ErrNotFound is returned if the user is not subscribed to the feed.
+func (s *SQLiteStore) Unsubscribe(userID, feedID int) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM subscriptions WHERE user_id = ? AND feed_id = ?;`, userID, feedID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetSubscriptions returns the feeds the user is subscribed to.
+func (s *SQLiteStore) GetSubscriptions(userID int) ([]*Feed, error) {
+	return s.queryFeeds(selectSubscriptions, userID)
+}
+
+//queryFeeds returns the feeds selected by the query of feedColumns.
+func (s *SQLiteStore) queryFeeds(query string, args ...interface{}) ([]*Feed, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := []*Feed{}
+
+	for rows.Next() {
+		feed, err := scanFeed(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
+}
+
+//WriteFeedIcon saves the result of the icon download, a failed download keeps the previous icon.
+func (s *SQLiteStore) WriteFeedIcon(feedURL string, icon *FeedIcon) error {
+	result, err := s.db.ExecContext(ctx, updateFeedIcon, feedIconValues(feedURL, icon)...)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetFeedIcon returns the icon of the feed site.
+func (s *SQLiteStore) GetFeedIcon(id int) (*FeedIcon, error) {
+	query := `
+	SELECT iconType, icon, iconFetchedAt
+	FROM feeds
+	WHERE id = ? AND iconType <> '';`
+
+	var icon FeedIcon
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&icon.Type, &icon.Data, &icon.FetchedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &icon, nil
+}
+
+//CreateUser adds the user and sets its ID, the first user becomes an admin.
+//ErrExists is returned if the login is taken. With closed registration only the first user is added,
+//ErrRegistrationClosed is returned if there are users already. The check and the insert are one statement,
+//so the concurrent registrations see the users added by each other.
+func (s *SQLiteStore) CreateUser(user *User, closed bool) error {
+	err := s.db.QueryRowContext(ctx, insertUser, user.Login, user.PasswordHash, user.CreatedAt, !closed).Scan(&user.ID, &user.Admin)
+	if errors.Is(err, sql.ErrNoRows) && closed {
+		return ErrRegistrationClosed
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrExists
+	}
+
+	return err
+}
+
+//GetUser returns the user by its id.
+func (s *SQLiteStore) GetUser(id int) (*User, error) {
+	return s.getUser("id = ?", id)
+}
+
+//GetUserByLogin returns the user by its login.
+func (s *SQLiteStore) GetUserByLogin(login string) (*User, error) {
+	return s.getUser("login = ?", login)
+}
+
+//UsersAmount returns the number of registered users.
+func (s *SQLiteStore) UsersAmount() (int, error) {
+	var amount int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM users;`).Scan(&amount)
+
+	return amount, err
+}
+
+//CreateSession saves the session of the user.
+func (s *SQLiteStore) CreateSession(session *Session) error {
+	query := `
+	INSERT INTO sessions (
+		tokenHash,
+		user_id,
+		createdAt,
+		expiresAt)
+	VALUES (?, ?, ?, ?);`
+
+	_, err := s.db.ExecContext(ctx, query, session.TokenHash, session.UserID, session.CreatedAt, session.ExpiresAt)
+	return err
+}
+
+//GetSession returns the session by the hash of its token, expired sessions are returned too.
+func (s *SQLiteStore) GetSession(tokenHash string) (*Session, error) {
+	query := `
+	SELECT tokenHash, user_id, createdAt, expiresAt
+	FROM sessions
+	WHERE tokenHash = ?;`
+
+	var session Session
+	err := s.db.QueryRowContext(ctx, query, tokenHash).Scan(&session.TokenHash, &session.UserID, &session.CreatedAt, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+//DeleteSession removes the session, a missing session is not an error.
+func (s *SQLiteStore) DeleteSession(tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE tokenHash = ?;`, tokenHash)
+	return err
+}
+
+//DeleteExpiredSessions removes the sessions that expired before the unix time.
+func (s *SQLiteStore) DeleteExpiredSessions(before int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE expiresAt < ?;`, before)
+	return err
+}
+
+//getUser returns the user matching the condition.
+func (s *SQLiteStore) getUser(condition string, arg interface{}) (*User, error) {
+	query := `
+	SELECT id, login, passwordHash, admin, createdAt
+	FROM users
+	WHERE ` + condition + `;`
+
+	var user User
+	err := s.db.QueryRowContext(ctx, query, arg).Scan(&user.ID, &user.Login, &user.PasswordHash, &user.Admin, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+//CreateAlertRule adds the alert rule and sets its id.
+func (s *SQLiteStore) CreateAlertRule(rule *AlertRule) error {
+	return s.db.QueryRowContext(ctx, insertAlertRule, alertRuleValues(rule)...).Scan(&rule.ID)
+}
+
+//GetAlertRule returns the alert rule by id.
+func (s *SQLiteStore) GetAlertRule(id int) (*AlertRule, error) {
+	query := `
+	SELECT ` + alertRuleColumns + `
+	FROM alert_rules
+	WHERE id = ?;`
+
+	rule, err := scanAlertRule(s.db.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return rule, err
+}
+
+//GetAlertRules returns the alert rules of the user in the order they were created, zero userID returns the rules of all users.
+func (s *SQLiteStore) GetAlertRules(userID int) ([]*AlertRule, error) {
+	query := `
+	SELECT ` + alertRuleColumns + `
+	FROM alert_rules
+	WHERE ? = 0 OR user_id = ?
+	ORDER BY id;`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*AlertRule{}
+
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+//DeleteAlertRule removes the alert rule of the user together with its deliveries.
+func (s *SQLiteStore) DeleteAlertRule(userID, id int) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM alert_rules WHERE id = ? AND user_id = ?;`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//CreateDeliveries adds the deliveries and sets their ids.
+func (s *SQLiteStore) CreateDeliveries(deliveries []*AlertDelivery) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, delivery := range deliveries {
+		if err = tx.QueryRowContext(ctx, insertDelivery, deliveryValues(delivery)...).Scan(&delivery.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//UpdateDelivery saves the result of the delivery attempt.
+func (s *SQLiteStore) UpdateDelivery(delivery *AlertDelivery) error {
+	result, err := s.db.ExecContext(ctx, updateDelivery, updateDeliveryValues(delivery)...)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//DueDeliveries returns up to n pending deliveries whose next attempt is due at the time now.
+func (s *SQLiteStore) DueDeliveries(now int64, n int) ([]*AlertDelivery, error) {
+	return s.queryDeliveries(selectDueDeliveries, now, n)
+}
+
+//GetDeliveries returns the latest n deliveries of the alert rule, the newest first.
+func (s *SQLiteStore) GetDeliveries(ruleID int, n int) ([]*AlertDelivery, error) {
+	query := `
+	SELECT ` + deliveryColumns + `
+	FROM alert_deliveries
+	WHERE rule_id = ?
+	ORDER BY id DESC
+	LIMIT ?;`
+
+	return s.queryDeliveries(query, ruleID, n)
+}
+
+//DeleteDeliveries removes the delivered and failed deliveries last attempted before the given time.
+func (s *SQLiteStore) DeleteDeliveries(before int64) error {
+	_, err := s.db.ExecContext(ctx, deleteFinishedDeliveries, before)
+	return err
+}
+
+func (s *SQLiteStore) queryDeliveries(query string, args ...interface{}) ([]*AlertDelivery, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*AlertDelivery{}
+
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+//GetHostPolicy returns the saved state of the host for the fetcher.
+func (s *SQLiteStore) GetHostPolicy(host string) (*HostPolicy, error) {
+	query := `
+	SELECT host, robots, robotsStatus, robotsFetchedAt, retryAfter, lastRequestAt
+	FROM host_policies
+	WHERE host = ?;`
+
+	var policy HostPolicy
+	err := s.db.QueryRowContext(ctx, query, host).Scan(
+		&policy.Host,
+		&policy.Robots,
+		&policy.RobotsStatus,
+		&policy.RobotsFetchedAt,
+		&policy.RetryAfter,
+		&policy.LastRequestAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+//WriteHostPolicy saves the state of the host, an existing one is replaced.
+func (s *SQLiteStore) WriteHostPolicy(policy *HostPolicy) error {
+	query := `
+	INSERT INTO host_policies (
+		host,
+		robots,
+		robotsStatus,
+		robotsFetchedAt,
+		retryAfter,
+		lastRequestAt)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (host) DO UPDATE SET
+		robots = excluded.robots,
+		robotsStatus = excluded.robotsStatus,
+		robotsFetchedAt = excluded.robotsFetchedAt,
+		retryAfter = excluded.retryAfter,
+		lastRequestAt = excluded.lastRequestAt;`
+
+	_, err := s.db.ExecContext(ctx, query, policy.Host, policy.Robots, policy.RobotsStatus,
+		policy.RobotsFetchedAt, policy.RetryAfter, policy.LastRequestAt)
+
+	return err
+}
+
+//ExpiredNews returns posts published before the "before" unix time
+//or not among the latest keepPerFeed posts of their feed, the oldest first.
+//Zero values disable the corresponding limit.
+func (s *SQLiteStore) ExpiredNews(before int64, keepPerFeed int) ([]*Post, error) {
+	query := `
+	SELECT ` + sqlitePostSelect + `
+	FROM (
+		SELECT *, row_number() OVER (PARTITION BY feed ORDER BY pubTime DESC, id DESC) AS rank
+		FROM posts
+	) p
+	WHERE ((?1 > 0 AND pubTime < ?1) OR (?2 > 0 AND rank > ?2)) AND ` + notSavedCondition + `
+	ORDER BY pubTime, id;`
+
+	rows, err := s.db.QueryContext(ctx, query, before, keepPerFeed)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.scanPosts(rows)
+}
+
+//PruneNews removes posts from the database and remembers their guids, so they are not fetched again.
+//If archive is true, the compressed posts are kept in the archive table.
+func (s *SQLiteStore) PruneNews(posts []*Post, archive bool) error {
+	query := `
+	INSERT INTO posts_archive (
+		guid,
+		link,
+		feed,
+		pubTime,
+		prunedAt,
+		data)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (guid) DO NOTHING;`
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	prunedAt := time.Now().Unix()
+
+	for _, post := range posts {
+		var data []byte
+		if archive {
+			if data, err = compressPost(post); err != nil {
+				return err
+			}
+		}
+
+		//the post starred after it was selected for pruning is kept
+		result, err := tx.ExecContext(ctx, `DELETE FROM posts AS p WHERE id = ? AND `+notSavedCondition+`;`, post.ID)
+		if err != nil {
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, query, post.key(), post.Link, post.Feed, post.PubTime, prunedAt, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//GetArchivedNews returns the archived post by its guid.
+func (s *SQLiteStore) GetArchivedNews(guid string) (*Post, error) {
+	query := `
+	SELECT data
+	FROM posts_archive
+	WHERE guid = ? AND data IS NOT NULL;`
+
+	var data []byte
+
+	err := s.db.QueryRowContext(ctx, query, guid).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return decompressPost(data)
+}
+
+func (s *SQLiteStore) addTags(tx *sql.Tx, id int64, tags []string, source string) error {
+	for _, tag := range tags {
+		_, err := tx.ExecContext(ctx, `INSERT INTO tags (name) VALUES (?) ON CONFLICT (name) DO NOTHING;`, tag)
+		if err != nil {
+			return err
+		}
+
+		query := `
+		INSERT INTO post_tags (
+			post_id,
+			tag_id,
+			source)
+		SELECT ?, id, ?
+		FROM tags
+		WHERE name = ?
+		ON CONFLICT DO NOTHING;`
+
+		if _, err = tx.ExecContext(ctx, query, id, source, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//filterConditions builds the WHERE conditions for the filter.
+func (s *SQLiteStore) filterConditions(filter Filter) *conditions {
+	cond := &conditions{}
+
+	if filter.Query != "" {
+		s.addSearch(cond, filter.Query)
+	}
+	if filter.From > 0 {
+		cond.add("pubTime >= ?", filter.From)
+	}
+	if filter.To > 0 {
+		cond.add("pubTime < ?", filter.To)
+	}
+	if filter.Tag != "" {
+		cond.add(tagCondition, NormalizeTag(filter.Tag))
+	}
+	addFeedConditions(cond, filter)
+	addMediaConditions(cond, filter)
+	addUserConditions(cond, filter)
+
+	return cond
+}
+
+//addSearch adds the search in the title and the plain text through the trigram index.
+func (s *SQLiteStore) addSearch(cond *conditions, query string) {
+	if len([]rune(query)) < minTrigramFilter {
+		query = escapeLike(strings.ToLower(query))
+		cond.add("("+fmt.Sprintf(foldCondition, "title")+" OR "+fmt.Sprintf(foldCondition, "plainText")+")", query, query)
+		return
+	}
+
+	phrase := `"` + strings.ReplaceAll(query, `"`, `""`) + `"`
+	cond.add("id IN (SELECT rowid FROM posts_fts WHERE posts_fts MATCH ?)", phrase)
+}
+
+func (s *SQLiteStore) scanPosts(rows *sql.Rows) ([]*Post, error) {
+	defer rows.Close()
+
+	var posts []*Post
+
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		posts = append(posts, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return posts, nil
+}
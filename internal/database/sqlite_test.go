@@ -0,0 +1,24 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSQLiteDB(t *testing.T) (*SQLiteStore, func()) {
+	db, err := NewSQLiteDB(config.SQLite{
+		Path: filepath.Join(t.TempDir(), "news.db"),
+	})
+	assert.Nil(t, err)
+
+	return db, db.Close
+}
+
+func TestSQLiteStore(t *testing.T) {
+	runStorageSuite(t, func(t *testing.T) (testStorage, func()) {
+		return testSQLiteDB(t)
+	})
+}
@@ -0,0 +1,1521 @@
+package database
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//testStorage is the set of methods every store must implement identically.
+type testStorage interface {
+	WriteNews(posts []*Post) error
+	GetLastNews(n int) ([]*Post, error)
+	NewsAmount(filter Filter) (int, error)
+	GetNewsPage(filter Filter, page int, ipemsPerPage int) ([]*Post, error)
+	GetNewsByID(id int) (*Post, error)
+	GetNewsAfter(filter Filter, id int, n int) ([]*Post, error)
+	LastNewsID() (int, error)
+	ExpiredNews(before int64, keepPerFeed int) ([]*Post, error)
+	PruneNews(posts []*Post, archive bool) error
+	GetArchivedNews(link string) (*Post, error)
+	AddTags(id int, tags []string) error
+	RemoveTag(id int, tag string) error
+	GetTags() ([]*Tag, error)
+	PendingFullText(feed string, n int) ([]*Post, error)
+	WriteFullText(id int, text *FullText) error
+	WriteFeed(feed *Feed) error
+	GetFeed(url string) (*Feed, error)
+	GetFeeds() ([]*Feed, error)
+	WriteFeedIcon(feedURL string, icon *FeedIcon) error
+	GetFeedIcon(id int) (*FeedIcon, error)
+	GetHostPolicy(host string) (*HostPolicy, error)
+	WriteHostPolicy(policy *HostPolicy) error
+	CreateUser(user *User, closed bool) error
+	GetUser(id int) (*User, error)
+	GetUserByLogin(login string) (*User, error)
+	UsersAmount() (int, error)
+	CreateSession(session *Session) error
+	GetSession(tokenHash string) (*Session, error)
+	DeleteSession(tokenHash string) error
+	DeleteExpiredSessions(before int64) error
+	Subscribe(userID, feedID int, createdAt int64) error
+	Unsubscribe(userID, feedID int) error
+	GetSubscriptions(userID int) ([]*Feed, error)
+	MarkRead(userID, postID int, read bool, at int64) error
+	MarkAllRead(userID int, feed string, before int64) error
+	UnreadCounts(userID int) ([]*UnreadCount, error)
+	SavePost(userID, postID int, note string, at int64) error
+	UnsavePost(userID, postID int) error
+	GetSavedPosts(userID int, query string) ([]*SavedPost, error)
+	CreateAlertRule(rule *AlertRule) error
+	GetAlertRule(id int) (*AlertRule, error)
+	GetAlertRules(userID int) ([]*AlertRule, error)
+	DeleteAlertRule(userID, id int) error
+	CreateDeliveries(deliveries []*AlertDelivery) error
+	UpdateDelivery(delivery *AlertDelivery) error
+	DueDeliveries(now int64, n int) ([]*AlertDelivery, error)
+	GetDeliveries(ruleID int, n int) ([]*AlertDelivery, error)
+	DeleteDeliveries(before int64) error
+}
+
+//storageFactory returns a new empty store and a function that releases it.
+type storageFactory func(t *testing.T) (testStorage, func())
+
+func generateSomePosts(n int) []*Post {
+	var posts []*Post
+	for i := 0; i < n; i++ {
+		post := Post{
+			Title:   "Title " + strconv.Itoa(i),
+			Content: "Content " + strconv.Itoa(i),
+			PubTime: time.Now().Unix(),
+			Link:    "Link " + strconv.Itoa(i),
+		}
+		posts = append(posts, &post)
+	}
+
+	return posts
+}
+
+//generateDatedPosts returns n posts published one minute apart, the last one is the newest.
+func generateDatedPosts(n int) []*Post {
+	posts := generateSomePosts(n)
+
+	start := time.Now().Add(-time.Duration(n) * time.Minute).Unix()
+	for i, post := range posts {
+		post.PubTime = start + int64(i*60)
+	}
+
+	return posts
+}
+
+//runStorageSuite runs the conformance tests against the store created by newDB.
+func runStorageSuite(t *testing.T, newDB storageFactory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db testStorage)
+	}{
+		{"WriteNews", testWriteNews},
+		{"WriteNews_Deduplication", testWriteNewsDeduplication},
+		{"WriteNews_GUID", testWriteNewsGUID},
+		{"WriteNews_AllFields", testWriteNewsAllFields},
+		{"WriteNews_Concurrent", testWriteNewsConcurrent},
+		{"GetLastNews", testGetLastNews},
+		{"GetLastNews_Ordering", testGetLastNewsOrdering},
+		{"GetLastNews_Empty", testGetLastNewsEmpty},
+		{"NewsAmount_Filter", testNewsAmountFilter},
+		{"GetNewsPage", testGetNewsPage},
+		{"GetNewsPage_Boundaries", testGetNewsPageBoundaries},
+		{"GetNewsPage_Filter", testGetNewsPageFilter},
+		{"GetNewsPage_StableOrder", testGetNewsPageStableOrder},
+		{"GetNewsPage_Period", testGetNewsPagePeriod},
+		{"GetNewsByID", testGetNewsByID},
+		{"GetNewsByID_NotFound", testGetNewsByIDNotFound},
+		{"GetNewsAfter", testGetNewsAfter},
+		{"ExpiredNews", testExpiredNews},
+		{"PruneNews_Delete", testPruneNewsDelete},
+		{"PruneNews_Archive", testPruneNewsArchive},
+		{"Tags_FromCategories", testTagsFromCategories},
+		{"Tags_AddRemove", testTagsAddRemove},
+		{"Tags_Filter", testTagsFilter},
+		{"Media_Filter", testMediaFilter},
+		{"FullText", testFullText},
+		{"Feeds", testFeeds},
+		{"FeedIcon", testFeedIcon},
+		{"HostPolicy", testHostPolicy},
+		{"Users", testUsers},
+		{"FirstUsersAtOnce", testFirstUsersAtOnce},
+		{"ClosedRegistrationAtOnce", testClosedRegistrationAtOnce},
+		{"Sessions", testSessions},
+		{"Subscriptions", testSubscriptions},
+		{"ReadState", testReadState},
+		{"SavedPosts", testSavedPosts},
+		{"SavedPosts_Retention", testSavedPostsRetention},
+		{"AlertRules", testAlertRules},
+		{"AlertDeliveries", testAlertDeliveries},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			db, cleanup := newDB(t)
+			defer cleanup()
+
+			tt.test(t, db)
+		})
+	}
+}
+
+func testWriteNews(t *testing.T, db testStorage) {
+	var n = 10
+	posts := generateSomePosts(n)
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	amount, err := db.NewsAmount(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, n, amount)
+
+	err = db.WriteNews(nil)
+	assert.Nil(t, err)
+}
+
+func testWriteNewsDeduplication(t *testing.T, db testStorage) {
+	posts := generateSomePosts(5)
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	//the same links in a later batch and twice within one batch
+	again := generateSomePosts(8)
+	again = append(again, &Post{Title: "Copy", Content: "Copy", PubTime: time.Now().Unix(), Link: "Link 7"})
+
+	err = db.WriteNews(again)
+	assert.Nil(t, err)
+
+	amount, err := db.NewsAmount(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 8, amount)
+
+	//only the inserted posts get ids
+	for i, post := range again {
+		inserted := i >= 5 && i < 8
+		assert.Equal(t, inserted, post.ID != 0, post.Title)
+	}
+
+	post, err := db.GetNewsByID(again[5].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "Title 5", post.Title)
+
+	//the first stored version wins
+	last, err := db.GetNewsPage(Filter{Query: "Title 0"}, 1, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(last)) {
+		assert.Equal(t, "Content 0", last[0].Content)
+	}
+}
+
+func testWriteNewsGUID(t *testing.T, db testStorage) {
+	posts := []*Post{
+		{Title: "First", Content: "Content", PubTime: 1650000000, Link: "https://example.com/1", GUID: "post-1"},
+		//the link has changed, but it is the same post
+		{Title: "First moved", Content: "Content", PubTime: 1650000000, Link: "https://example.com/first", GUID: "post-1"},
+		//the guid has changed, but the link is the same
+		{Title: "Second", Content: "Content", PubTime: 1650000001, Link: "https://example.com/2", GUID: "post-2"},
+		{Title: "Second again", Content: "Content", PubTime: 1650000002, Link: "https://example.com/2", GUID: "post-3"},
+		//no guid, deduplicated by link
+		{Title: "Fourth", Content: "Content", PubTime: 1650000003, Link: "https://example.com/4"},
+		{Title: "Fourth again", Content: "Content", PubTime: 1650000003, Link: "https://example.com/4"},
+	}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	lastPosts, err := db.GetLastNews(10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(lastPosts)) {
+		assert.Equal(t, "Fourth", lastPosts[0].Title)
+		assert.Equal(t, "https://example.com/4", lastPosts[0].GUID)
+		assert.Equal(t, "post-2", lastPosts[1].GUID)
+		assert.Equal(t, "First", lastPosts[2].Title)
+	}
+
+	assert.Equal(t, 0, posts[3].ID)
+}
+
+func testWriteNewsAllFields(t *testing.T, db testStorage) {
+	posts := []*Post{
+		{
+			Title:      "Title",
+			Content:    "<p>Content</p>",
+			PlainText:  "Content",
+			PubTime:    1650000000,
+			Link:       "https://example.com/post",
+			Feed:       "https://example.com/rss",
+			GUID:       "https://example.com/?p=1",
+			Author:     "Author",
+			Categories: []string{"go", "postgres"},
+			Comments:   "https://example.com/post#comments",
+			Enclosure: &Enclosure{
+				URL:    "https://example.com/podcast.mp3",
+				Type:   "audio/mpeg",
+				Length: 1024,
+			},
+			FetchedAt: 1650000100,
+			Media: []Media{
+				{URL: "https://example.com/podcast.mp3", Type: "audio/mpeg", Medium: "audio", Source: MediaSourceEnclosure, Length: 1024},
+				{URL: "https://example.com/cover.jpg", Type: "image/jpeg", Medium: "image", Source: MediaSourceContent, Width: 640, Height: 480},
+				{URL: "https://example.com/thumb.jpg", Medium: "image", Source: MediaSourceThumbnail, Width: 64, Height: 48},
+			},
+		},
+		{
+			Title:   "Minimal",
+			Content: "Content",
+			PubTime: 1650000001,
+			Link:    "https://example.com/minimal",
+		},
+	}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	lastPosts, err := db.GetLastNews(2)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 2, len(lastPosts)) {
+		return
+	}
+
+	minimal := lastPosts[0]
+	assert.Equal(t, posts[1].Link, minimal.GUID)
+	assert.Empty(t, minimal.Categories)
+	assert.Nil(t, minimal.Enclosure)
+	assert.Empty(t, minimal.Media)
+
+	post, err := db.GetNewsByID(lastPosts[1].ID)
+	assert.Nil(t, err)
+
+	expected := *posts[0]
+	expected.ID = post.ID
+	expected.Tags = []string{"go", "postgres"}
+	assert.Equal(t, expected, *post)
+}
+
+func testWriteNewsConcurrent(t *testing.T, db testStorage) {
+	writers := 8
+	posts := generateSomePosts(20)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			//every writer shares half of its batch with the others
+			batch := append([]*Post{}, posts[:10]...)
+			batch = append(batch, &Post{
+				Title:   "Writer " + strconv.Itoa(i),
+				Content: "Content",
+				PubTime: time.Now().Unix(),
+				Link:    "Writer link " + strconv.Itoa(i),
+			})
+
+			errs <- db.WriteNews(batch)
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	amount, err := db.NewsAmount(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 10+writers, amount)
+}
+
+func testGetLastNews(t *testing.T, db testStorage) {
+	posts := generateSomePosts(20)
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	n := 10
+	lastPosts, err := db.GetLastNews(n)
+	assert.Nil(t, err)
+	assert.Equal(t, n, len(lastPosts))
+
+	lastPosts, err = db.GetLastNews(100)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(lastPosts))
+}
+
+func testGetLastNewsOrdering(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(10)
+
+	//insert in shuffled order, the result must not depend on it
+	shuffled := []*Post{posts[3], posts[9], posts[0], posts[5], posts[1], posts[8], posts[2], posts[7], posts[4], posts[6]}
+	err := db.WriteNews(shuffled)
+	assert.Nil(t, err)
+
+	lastPosts, err := db.GetLastNews(3)
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(lastPosts)) {
+		assert.Equal(t, posts[9].Link, lastPosts[0].Link)
+		assert.Equal(t, posts[8].Link, lastPosts[1].Link)
+		assert.Equal(t, posts[7].Link, lastPosts[2].Link)
+	}
+}
+
+func testGetLastNewsEmpty(t *testing.T, db testStorage) {
+	lastPosts, err := db.GetLastNews(10)
+	assert.Nil(t, err)
+	assert.Empty(t, lastPosts)
+}
+
+func testNewsAmountFilter(t *testing.T, db testStorage) {
+	posts := generateSomePosts(12)
+	posts = append(posts,
+		&Post{Title: "Новости Go", Content: "Content", PubTime: time.Now().Unix(), Link: "Link ru"},
+		&Post{Title: "100% coverage", Content: "Content", PubTime: time.Now().Unix(), Link: "Link percent"},
+		&Post{Title: "It's a quote", Content: "Content", PubTime: time.Now().Unix(), Link: "Link quote"},
+		&Post{Title: "Plain", Content: "<p>Текст о PostgreSQL</p>", PlainText: "Текст о PostgreSQL", PubTime: time.Now().Unix(), Link: "Link text"},
+	)
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		filter string
+		amount int
+	}{
+		{"", 16},
+		{"title 1", 3}, // Title 1, Title 10, Title 11
+		{"TITLE 11", 1},
+		{"новости", 1},
+		{"go", 1},
+		{"%", 1},
+		{"_", 0},
+		{"'", 1},
+		{"' OR '1'='1", 0},
+		{"missing", 0},
+		{"postgresql", 1},
+		{"ТЕКСТ", 1},
+		{"о", 2},
+		{"НО", 1},
+		{"ТЕ", 1},
+		{"<p>", 0},
+	}
+
+	for _, tt := range tests {
+		amount, err := db.NewsAmount(Filter{Query: tt.filter})
+		assert.Nil(t, err, tt.filter)
+		assert.Equal(t, tt.amount, amount, tt.filter)
+	}
+}
+
+func testGetNewsPage(t *testing.T, db testStorage) {
+	posts := generateSomePosts(25)
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	page, err := db.GetNewsPage(Filter{}, 1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(page))
+
+	page, err = db.GetNewsPage(Filter{}, 3, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(page))
+}
+
+func testGetNewsPageBoundaries(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(20)
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		page   int
+		amount int
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 10},
+		{2, 10},
+		{3, 0},
+	}
+
+	for _, tt := range tests {
+		page, err := db.GetNewsPage(Filter{}, tt.page, 10)
+		assert.Nil(t, err, tt.page)
+		assert.Equal(t, tt.amount, len(page), tt.page)
+	}
+
+	page, err := db.GetNewsPage(Filter{}, 2, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 10, len(page)) {
+		assert.Equal(t, posts[9].Link, page[0].Link)
+		assert.Equal(t, posts[0].Link, page[9].Link)
+	}
+}
+
+func testGetNewsPageFilter(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(30)
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	//Title 2, Title 20 ... Title 29
+	page, err := db.GetNewsPage(Filter{Query: "title 2"}, 1, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 10, len(page)) {
+		assert.Equal(t, posts[29].Link, page[0].Link)
+	}
+
+	page, err = db.GetNewsPage(Filter{Query: "title 2"}, 2, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(page)) {
+		assert.Equal(t, posts[2].Link, page[0].Link)
+	}
+}
+
+func testGetNewsPageStableOrder(t *testing.T, db testStorage) {
+	//all posts have the same publication time
+	posts := generateSomePosts(9)
+	for _, post := range posts {
+		post.PubTime = 1650000000
+	}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	seen := make(map[string]bool)
+	for p := 1; p <= 3; p++ {
+		page, err := db.GetNewsPage(Filter{}, p, 3)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(page))
+
+		for _, post := range page {
+			assert.False(t, seen[post.Link], post.Link)
+			seen[post.Link] = true
+		}
+	}
+
+	assert.Equal(t, 9, len(seen))
+}
+
+func testGetNewsPagePeriod(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(10)
+
+	//a post from the last year goes to a different partition
+	posts[0].PubTime = time.Now().AddDate(-1, 0, 0).Unix()
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	filter := Filter{From: posts[2].PubTime, To: posts[5].PubTime}
+
+	amount, err := db.NewsAmount(filter)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, amount)
+
+	page, err := db.GetNewsPage(filter, 1, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(page)) {
+		assert.Equal(t, posts[4].Link, page[0].Link)
+		assert.Equal(t, posts[2].Link, page[2].Link)
+	}
+
+	amount, err = db.NewsAmount(Filter{To: posts[1].PubTime})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, amount)
+
+	amount, err = db.NewsAmount(Filter{Query: "title 1", From: posts[1].PubTime})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, amount)
+
+	old, err := db.GetNewsPage(Filter{To: posts[1].PubTime}, 1, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(old)) {
+		post, err := db.GetNewsByID(old[0].ID)
+		assert.Nil(t, err)
+		assert.Equal(t, posts[0].Link, post.Link)
+	}
+}
+
+func testGetNewsByID(t *testing.T, db testStorage) {
+	posts := generateSomePosts(1)
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	lastPosts, err := db.GetLastNews(1)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 1, len(lastPosts)) {
+		return
+	}
+
+	post, err := db.GetNewsByID(lastPosts[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, *lastPosts[0], *post)
+	assert.Equal(t, posts[0].Title, post.Title)
+	assert.Equal(t, posts[0].Content, post.Content)
+	assert.Equal(t, posts[0].PubTime, post.PubTime)
+	assert.Equal(t, posts[0].Link, post.Link)
+}
+
+func testGetNewsByIDNotFound(t *testing.T, db testStorage) {
+	post, err := db.GetNewsByID(1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Nil(t, post)
+
+	err = db.WriteNews(generateSomePosts(1))
+	assert.Nil(t, err)
+
+	post, err = db.GetNewsByID(-1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Nil(t, post)
+}
+
+func testGetNewsAfter(t *testing.T, db testStorage) {
+	id, err := db.LastNewsID()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, id)
+
+	//the newest written post is published first, the order is by ids
+	posts := generateDatedPosts(5)
+	for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+		posts[i], posts[j] = posts[j], posts[i]
+	}
+	posts[3].Categories = []string{"Go"}
+	posts[2].Feed = "Feed 1"
+	posts[4].Feed = "Feed 2"
+	assert.Nil(t, db.WriteNews(posts))
+
+	id, err = db.LastNewsID()
+	assert.Nil(t, err)
+	assert.Equal(t, posts[4].ID, id)
+
+	after, err := db.GetNewsAfter(Filter{}, posts[1].ID, 2)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(after)) {
+		assert.Equal(t, posts[2].ID, after[0].ID)
+		assert.Equal(t, posts[3].ID, after[1].ID)
+		assert.Equal(t, []string{"go"}, after[1].Tags)
+	}
+
+	after, err = db.GetNewsAfter(Filter{Tag: "go"}, 0, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(after)) {
+		assert.Equal(t, posts[3].ID, after[0].ID)
+	}
+
+	after, err = db.GetNewsAfter(Filter{Feeds: []string{"Feed 1", "Feed 2"}}, 0, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(after)) {
+		assert.Equal(t, posts[2].ID, after[0].ID)
+		assert.Equal(t, posts[4].ID, after[1].ID)
+	}
+
+	after, err = db.GetNewsAfter(Filter{}, id, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, after)
+}
+
+func testExpiredNews(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(10)
+	for i, post := range posts {
+		post.Feed = "Feed " + strconv.Itoa(i%2)
+	}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	expired, err := db.ExpiredNews(0, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, expired)
+
+	//older than the fourth post
+	expired, err = db.ExpiredNews(posts[3].PubTime, 0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(expired)) {
+		assert.Equal(t, posts[0].Link, expired[0].Link)
+		assert.Equal(t, posts[2].Link, expired[2].Link)
+		assert.Equal(t, posts[0].Feed, expired[0].Feed)
+	}
+
+	//the latest 3 posts of every feed are kept
+	expired, err = db.ExpiredNews(0, 3)
+	assert.Nil(t, err)
+	if assert.Equal(t, 4, len(expired)) {
+		assert.Equal(t, posts[0].Link, expired[0].Link)
+		assert.Equal(t, posts[3].Link, expired[3].Link)
+	}
+
+	expired, err = db.ExpiredNews(posts[3].PubTime, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(expired))
+}
+
+func testPruneNewsDelete(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(5)
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	expired, err := db.ExpiredNews(posts[2].PubTime, 0)
+	assert.Nil(t, err)
+
+	err = db.PruneNews(expired, false)
+	assert.Nil(t, err)
+
+	amount, err := db.NewsAmount(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, amount)
+
+	_, err = db.GetNewsByID(expired[0].ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = db.GetArchivedNews(posts[0].Link)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	//pruned posts are not added again by the next poll
+	err = db.WriteNews(generateDatedPosts(5))
+	assert.Nil(t, err)
+
+	amount, err = db.NewsAmount(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, amount)
+}
+
+func testPruneNewsArchive(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(5)
+	posts[0].Feed = "Feed"
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	expired, err := db.ExpiredNews(posts[2].PubTime, 0)
+	assert.Nil(t, err)
+
+	err = db.PruneNews(expired, true)
+	assert.Nil(t, err)
+
+	amount, err := db.NewsAmount(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, amount)
+
+	archived, err := db.GetArchivedNews(posts[0].Link)
+	assert.Nil(t, err)
+	assert.Equal(t, *expired[0], *archived)
+
+	err = db.WriteNews(generateDatedPosts(5))
+	assert.Nil(t, err)
+
+	amount, err = db.NewsAmount(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, amount)
+}
+
+func testTagsFromCategories(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(3)
+	posts[0].Categories = []string{"Go", " #go ", "Data  Bases"}
+	posts[1].Categories = []string{"go"}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	lastPosts, err := db.GetLastNews(3)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 3, len(lastPosts)) {
+		return
+	}
+
+	//the original categories are kept as they are
+	assert.Equal(t, []string{"Go", " #go ", "Data  Bases"}, lastPosts[2].Categories)
+	assert.Equal(t, []string{"data bases", "go"}, lastPosts[2].Tags)
+	assert.Equal(t, []string{"go"}, lastPosts[1].Tags)
+	assert.Empty(t, lastPosts[0].Tags)
+
+	tags, err := db.GetTags()
+	assert.Nil(t, err)
+	assert.Equal(t, []*Tag{{Name: "go", Count: 2}, {Name: "data bases", Count: 1}}, tags)
+}
+
+func testTagsAddRemove(t *testing.T, db testStorage) {
+	posts := generateSomePosts(1)
+	posts[0].Categories = []string{"feed"}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	lastPosts, err := db.GetLastNews(1)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 1, len(lastPosts)) {
+		return
+	}
+	id := lastPosts[0].ID
+
+	err = db.AddTags(id, []string{"Read Later", "feed", ""})
+	assert.Nil(t, err)
+
+	post, err := db.GetNewsByID(id)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"feed", "read later"}, post.Tags)
+
+	err = db.RemoveTag(id, "FEED")
+	assert.Nil(t, err)
+
+	post, err = db.GetNewsByID(id)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"read later"}, post.Tags)
+
+	//tags without posts are not listed
+	tags, err := db.GetTags()
+	assert.Nil(t, err)
+	assert.Equal(t, []*Tag{{Name: "read later", Count: 1}}, tags)
+
+	err = db.RemoveTag(id, "feed")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	err = db.AddTags(id+1, []string{"missing"})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testTagsFilter(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(5)
+	for i := 0; i < 3; i++ {
+		posts[i].Categories = []string{"Golang"}
+	}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	filter := Filter{Tag: "#golang"}
+
+	amount, err := db.NewsAmount(filter)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, amount)
+
+	page, err := db.GetNewsPage(filter, 1, 2)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(page)) {
+		assert.Equal(t, "Title 2", page[0].Title)
+		assert.Equal(t, "Title 1", page[1].Title)
+	}
+
+	amount, err = db.NewsAmount(Filter{Tag: "golang", Query: "Title 0"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, amount)
+
+	amount, err = db.NewsAmount(Filter{Tag: "unknown"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, amount)
+}
+
+func testMediaFilter(t *testing.T, db testStorage) {
+	posts := generateDatedPosts(4)
+	posts[0].Media = []Media{{URL: "https://example.com/1.mp3", Type: "audio/mpeg", Medium: "audio", Source: MediaSourceEnclosure}}
+	posts[1].Media = []Media{{URL: "https://example.com/2.jpg", Type: "image/jpeg", Medium: "image", Source: MediaSourceContent}}
+	posts[2].Media = []Media{
+		{URL: "https://example.com/3.png", Type: "image/png", Medium: "image", Source: MediaSourceContent},
+		{URL: "https://example.com/3.mp4", Type: "video/mp4", Medium: "video", Source: MediaSourceContent},
+	}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		filter Filter
+		titles []string
+	}{
+		{Filter{HasMedia: true}, []string{"Title 2", "Title 1", "Title 0"}},
+		{Filter{MediaType: "image"}, []string{"Title 2", "Title 1"}},
+		{Filter{MediaType: "Image/PNG"}, []string{"Title 2"}},
+		{Filter{MediaType: "audio", Query: "Title 1"}, nil},
+		{Filter{MediaType: "document"}, nil},
+	}
+
+	for _, tt := range tests {
+		amount, err := db.NewsAmount(tt.filter)
+		assert.Nil(t, err)
+		assert.Equal(t, len(tt.titles), amount, tt.filter)
+
+		page, err := db.GetNewsPage(tt.filter, 1, 10)
+		assert.Nil(t, err)
+
+		var titles []string
+		for _, post := range page {
+			titles = append(titles, post.Title)
+		}
+		assert.Equal(t, tt.titles, titles, tt.filter)
+	}
+}
+
+func testFullText(t *testing.T, db testStorage) {
+	feed := "https://example.com/rss"
+
+	posts := generateDatedPosts(4)
+	for _, post := range posts[:3] {
+		post.Feed = feed
+	}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	pending, err := db.PendingFullText(feed, 2)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 2, len(pending)) {
+		return
+	}
+	assert.Equal(t, "Title 2", pending[0].Title)
+	assert.Equal(t, "Title 1", pending[1].Title)
+
+	fetched, failed := pending[0].ID, pending[1].ID
+
+	err = db.WriteFullText(fetched, &FullText{Content: "<p>Full</p>", PlainText: "Full", FetchedAt: 1650000000})
+	assert.Nil(t, err)
+	err = db.WriteFullText(failed, &FullText{FetchedAt: 1650000000, Error: "404 Not Found"})
+	assert.Nil(t, err)
+
+	pending, err = db.PendingFullText(feed, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(pending)) {
+		assert.Equal(t, "Title 0", pending[0].Title)
+	}
+
+	post, err := db.GetNewsByID(fetched)
+	assert.Nil(t, err)
+	assert.Equal(t, "<p>Full</p>", post.FullText)
+
+	post, err = db.GetNewsByID(failed)
+	assert.Nil(t, err)
+	assert.Equal(t, "", post.FullText)
+
+	last, err := db.GetLastNews(4)
+	assert.Nil(t, err)
+	for _, post := range last {
+		//the full text is returned only for a single post
+		assert.Equal(t, "", post.FullText)
+	}
+
+	err = db.WriteFullText(-1, &FullText{Content: "Missing"})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testFeeds(t *testing.T, db testStorage) {
+	feeds, err := db.GetFeeds()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(feeds))
+
+	_, err = db.GetFeed("https://example.com/rss")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	feed := &Feed{
+		URL:           "https://example.com/rss",
+		Title:         "Example",
+		Link:          "https://example.com/",
+		Description:   "Example news",
+		Language:      "en",
+		Image:         "https://example.com/logo.png",
+		LastBuildDate: 1650000000,
+		FetchedAt:     1650000100,
+	}
+	assert.Nil(t, db.WriteFeed(feed))
+	assert.Nil(t, db.WriteFeed(&Feed{URL: "https://example.org/rss", Title: "Other", FetchedAt: 1650000100}))
+
+	got, err := db.GetFeed(feed.URL)
+	if assert.Nil(t, err) {
+		assert.NotZero(t, got.ID)
+		feed.ID = got.ID
+		assert.Equal(t, feed, got)
+	}
+
+	//the next poll updates the metadata of the same feed
+	feed.Title = "Example news"
+	feed.FetchedAt = 1650000200
+	assert.Nil(t, db.WriteFeed(feed))
+
+	feeds, err = db.GetFeeds()
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(feeds)) {
+		assert.Equal(t, feed, feeds[0])
+		assert.Equal(t, "Other", feeds[1].Title)
+	}
+}
+
+func testFeedIcon(t *testing.T, db testStorage) {
+	feedURL := "https://example.com/rss"
+
+	err := db.WriteFeedIcon(feedURL, &FeedIcon{FetchedAt: 1650000000})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.Nil(t, db.WriteFeed(&Feed{URL: feedURL, Title: "Example"}))
+	feed, err := db.GetFeed(feedURL)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	_, err = db.GetFeedIcon(feed.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	//a failed download is remembered without an icon
+	assert.Nil(t, db.WriteFeedIcon(feedURL, &FeedIcon{FetchedAt: 1650000000}))
+	feed, err = db.GetFeed(feedURL)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1650000000), feed.IconFetchedAt)
+	assert.False(t, feed.HasIcon)
+
+	png := []byte("\x89PNG\r\n\x1a\nicon")
+	assert.Nil(t, db.WriteFeedIcon(feedURL, &FeedIcon{Type: "image/png", Data: png, FetchedAt: 1650000100}))
+
+	//a later failure keeps the icon, the metadata update too
+	assert.Nil(t, db.WriteFeedIcon(feedURL, &FeedIcon{FetchedAt: 1650000200}))
+	assert.Nil(t, db.WriteFeed(&Feed{URL: feedURL, Title: "Example news"}))
+
+	feed, err = db.GetFeed(feedURL)
+	assert.Nil(t, err)
+	assert.True(t, feed.HasIcon)
+	assert.Equal(t, int64(1650000200), feed.IconFetchedAt)
+
+	icon, err := db.GetFeedIcon(feed.ID)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "image/png", icon.Type)
+		assert.Equal(t, png, icon.Data)
+	}
+
+	_, err = db.GetFeedIcon(feed.ID + 100)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testHostPolicy(t *testing.T, db testStorage) {
+	_, err := db.GetHostPolicy("example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	policy := &HostPolicy{
+		Host:            "example.com",
+		Robots:          "User-agent: *\nDisallow: /private",
+		RobotsStatus:    200,
+		RobotsFetchedAt: 1650000000,
+		LastRequestAt:   1650000010,
+	}
+	err = db.WriteHostPolicy(policy)
+	assert.Nil(t, err)
+
+	got, err := db.GetHostPolicy("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, policy, got)
+
+	//the second write replaces the whole state
+	policy.RetryAfter = 1650000600
+	policy.LastRequestAt = 1650000020
+	err = db.WriteHostPolicy(policy)
+	assert.Nil(t, err)
+
+	got, err = db.GetHostPolicy("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, policy, got)
+
+	_, err = db.GetHostPolicy("example.com:8080")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testUsers(t *testing.T, db testStorage) {
+	amount, err := db.UsersAmount()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, amount)
+
+	//the first user becomes an admin
+	admin := &User{Login: "admin", PasswordHash: "hash1", CreatedAt: 1650000000}
+	assert.Nil(t, db.CreateUser(admin, false))
+	assert.NotZero(t, admin.ID)
+	assert.True(t, admin.Admin)
+
+	user := &User{Login: "reader", PasswordHash: "hash2", Admin: true, CreatedAt: 1650000100}
+	assert.Nil(t, db.CreateUser(user, false))
+	assert.NotEqual(t, admin.ID, user.ID)
+	assert.False(t, user.Admin)
+
+	err = db.CreateUser(&User{Login: "reader", PasswordHash: "hash3", CreatedAt: 1650000200}, false)
+	assert.ErrorIs(t, err, ErrExists)
+
+	//with closed registration only the first user is added
+	err = db.CreateUser(&User{Login: "guest", PasswordHash: "hash4", CreatedAt: 1650000300}, true)
+	assert.ErrorIs(t, err, ErrRegistrationClosed)
+
+	amount, err = db.UsersAmount()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, amount)
+
+	got, err := db.GetUser(user.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, user, got)
+
+	got, err = db.GetUserByLogin("admin")
+	assert.Nil(t, err)
+	assert.Equal(t, admin, got)
+
+	_, err = db.GetUser(user.ID + 100)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = db.GetUserByLogin("nobody")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+//testClosedRegistrationAtOnce registers the first users concurrently with closed registration,
+//only one of them is added.
+func testClosedRegistrationAtOnce(t *testing.T, db testStorage) {
+	users := make([]*User, 8)
+	errs := make([]error, len(users))
+
+	var wg sync.WaitGroup
+	for i := range users {
+		users[i] = &User{Login: "user" + strconv.Itoa(i), PasswordHash: "hash", CreatedAt: 1650000000}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.CreateUser(users[i], true)
+		}(i)
+	}
+	wg.Wait()
+
+	added := 0
+	for i, err := range errs {
+		if err == nil {
+			added++
+			assert.True(t, users[i].Admin)
+			continue
+		}
+		assert.ErrorIs(t, err, ErrRegistrationClosed)
+	}
+	assert.Equal(t, 1, added)
+
+	amount, err := db.UsersAmount()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, amount)
+}
+
+//testFirstUsersAtOnce registers the first users concurrently, only one of them becomes an admin.
+func testFirstUsersAtOnce(t *testing.T, db testStorage) {
+	users := make([]*User, 8)
+
+	var wg sync.WaitGroup
+	for i := range users {
+		users[i] = &User{Login: "user" + strconv.Itoa(i), PasswordHash: "hash", CreatedAt: 1650000000}
+
+		wg.Add(1)
+		go func(user *User) {
+			defer wg.Done()
+			assert.Nil(t, db.CreateUser(user, false))
+		}(users[i])
+	}
+	wg.Wait()
+
+	admins := 0
+	for _, user := range users {
+		if user.Admin {
+			admins++
+		}
+	}
+	assert.Equal(t, 1, admins)
+}
+
+func testSessions(t *testing.T, db testStorage) {
+	user := &User{Login: "reader", PasswordHash: "hash", CreatedAt: 1650000000}
+	if !assert.Nil(t, db.CreateUser(user, false)) {
+		return
+	}
+
+	_, err := db.GetSession("token1")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	expired := &Session{TokenHash: "token1", UserID: user.ID, CreatedAt: 1650000000, ExpiresAt: 1650000100}
+	active := &Session{TokenHash: "token2", UserID: user.ID, CreatedAt: 1650000000, ExpiresAt: 1650009999}
+	assert.Nil(t, db.CreateSession(expired))
+	assert.Nil(t, db.CreateSession(active))
+
+	got, err := db.GetSession("token1")
+	assert.Nil(t, err)
+	assert.Equal(t, expired, got)
+
+	assert.Nil(t, db.DeleteExpiredSessions(1650000500))
+
+	_, err = db.GetSession("token1")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	got, err = db.GetSession("token2")
+	assert.Nil(t, err)
+	assert.Equal(t, active, got)
+
+	assert.Nil(t, db.DeleteSession("token2"))
+	assert.Nil(t, db.DeleteSession("token2"))
+
+	_, err = db.GetSession("token2")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testSubscriptions(t *testing.T, db testStorage) {
+	reader := &User{Login: "reader", PasswordHash: "hash", CreatedAt: 1650000000}
+	other := &User{Login: "other", PasswordHash: "hash", CreatedAt: 1650000000}
+	if !assert.Nil(t, db.CreateUser(reader, false)) || !assert.Nil(t, db.CreateUser(other, false)) {
+		return
+	}
+
+	posts := generateDatedPosts(6)
+	for i, post := range posts {
+		post.Feed = "https://example.com/rss" + strconv.Itoa(i%3)
+	}
+	posts[0].Categories = []string{"Go"}
+	assert.Nil(t, db.WriteNews(posts))
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.WriteFeed(&Feed{URL: "https://example.com/rss" + strconv.Itoa(i)}))
+	}
+	feeds, err := db.GetFeeds()
+	if !assert.Nil(t, err) || !assert.Equal(t, 3, len(feeds)) {
+		return
+	}
+
+	subscriptions, err := db.GetSubscriptions(reader.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, subscriptions)
+
+	//no subscriptions, no news
+	amount, err := db.NewsAmount(Filter{UserID: reader.ID, Subscribed: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, amount)
+
+	assert.Nil(t, db.Subscribe(reader.ID, feeds[2].ID, 1650000000))
+	assert.Nil(t, db.Subscribe(reader.ID, feeds[0].ID, 1650000000))
+	assert.Nil(t, db.Subscribe(reader.ID, feeds[0].ID, 1650000100))
+	assert.Nil(t, db.Subscribe(other.ID, feeds[1].ID, 1650000000))
+	assert.ErrorIs(t, db.Subscribe(reader.ID, feeds[2].ID+100, 1650000000), ErrNotFound)
+
+	subscriptions, err = db.GetSubscriptions(reader.ID)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(subscriptions)) {
+		assert.Equal(t, feeds[0].URL, subscriptions[0].URL)
+		assert.Equal(t, feeds[2].URL, subscriptions[1].URL)
+	}
+
+	amount, err = db.NewsAmount(Filter{UserID: reader.ID, Subscribed: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, amount)
+
+	//the other filters still apply
+	page, err := db.GetNewsPage(Filter{UserID: reader.ID, Subscribed: true, Tag: "go"}, 1, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(page)) {
+		assert.Equal(t, posts[0].Link, page[0].Link)
+	}
+
+	page, err = db.GetNewsPage(Filter{UserID: reader.ID, Subscribed: true}, 1, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 4, len(page)) {
+		assert.Equal(t, posts[5].Link, page[0].Link)
+		assert.Equal(t, posts[0].Link, page[3].Link)
+	}
+
+	assert.Nil(t, db.Unsubscribe(reader.ID, feeds[0].ID))
+	assert.ErrorIs(t, db.Unsubscribe(reader.ID, feeds[0].ID), ErrNotFound)
+
+	amount, err = db.NewsAmount(Filter{UserID: reader.ID, Subscribed: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, amount)
+
+	amount, err = db.NewsAmount(Filter{UserID: other.ID, Subscribed: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, amount)
+}
+
+func testReadState(t *testing.T, db testStorage) {
+	reader := &User{Login: "reader", PasswordHash: "hash", CreatedAt: 1650000000}
+	other := &User{Login: "other", PasswordHash: "hash", CreatedAt: 1650000000}
+	if !assert.Nil(t, db.CreateUser(reader, false)) || !assert.Nil(t, db.CreateUser(other, false)) {
+		return
+	}
+
+	//posts 0, 2, 4 are in feed a, 1, 3, 5 in feed b, the last one is the newest
+	posts := generateDatedPosts(6)
+	for i, post := range posts {
+		post.Feed = []string{"https://a.example.com/rss", "https://b.example.com/rss"}[i%2]
+	}
+	assert.Nil(t, db.WriteNews(posts))
+
+	page, err := db.GetNewsPage(Filter{}, 1, 10)
+	if !assert.Nil(t, err) || !assert.Equal(t, 6, len(page)) {
+		return
+	}
+	ids := make(map[string]int)
+	for _, post := range page {
+		ids[post.Link] = post.ID
+	}
+	unread := func(user *User) int {
+		amount, err := db.NewsAmount(Filter{UserID: user.ID, Unread: true})
+		assert.Nil(t, err)
+		return amount
+	}
+
+	assert.Equal(t, 6, unread(reader))
+
+	assert.Nil(t, db.MarkRead(reader.ID, ids[posts[5].Link], true, 1650000000))
+	assert.Nil(t, db.MarkRead(reader.ID, ids[posts[5].Link], true, 1650000100))
+	assert.ErrorIs(t, db.MarkRead(reader.ID, ids[posts[5].Link]+100, true, 1650000000), ErrNotFound)
+	assert.Equal(t, 5, unread(reader))
+	assert.Equal(t, 6, unread(other))
+
+	page, err = db.GetNewsPage(Filter{UserID: reader.ID, Unread: true}, 1, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 5, len(page)) {
+		assert.Equal(t, posts[4].Link, page[0].Link)
+	}
+
+	//feed a up to post 2: posts 0 and 2
+	assert.Nil(t, db.MarkAllRead(reader.ID, "https://a.example.com/rss", posts[2].PubTime))
+	assert.Equal(t, 3, unread(reader))
+
+	//a single post is marked unread below the mark
+	assert.Nil(t, db.MarkRead(reader.ID, ids[posts[0].Link], false, 1650000200))
+	assert.Equal(t, 4, unread(reader))
+
+	counts, err := db.UnreadCounts(reader.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []*UnreadCount{
+		{Feed: "https://a.example.com/rss", Count: 2},
+		{Feed: "https://b.example.com/rss", Count: 2},
+	}, counts)
+
+	//the earlier mark does not unread anything
+	assert.Nil(t, db.MarkAllRead(reader.ID, "https://a.example.com/rss", posts[0].PubTime-60))
+	assert.Equal(t, 4, unread(reader))
+
+	//all feeds up to post 3, the explicit unread state is overridden
+	assert.Nil(t, db.MarkAllRead(reader.ID, "", posts[3].PubTime))
+	assert.Equal(t, 1, unread(reader))
+
+	counts, err = db.UnreadCounts(reader.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []*UnreadCount{{Feed: "https://a.example.com/rss", Count: 1}}, counts)
+
+	counts, err = db.UnreadCounts(other.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []*UnreadCount{
+		{Feed: "https://a.example.com/rss", Count: 3},
+		{Feed: "https://b.example.com/rss", Count: 3},
+	}, counts)
+}
+
+func testSavedPosts(t *testing.T, db testStorage) {
+	reader := &User{Login: "reader", PasswordHash: "hash", CreatedAt: 1650000000}
+	other := &User{Login: "other", PasswordHash: "hash", CreatedAt: 1650000000}
+	if !assert.Nil(t, db.CreateUser(reader, false)) || !assert.Nil(t, db.CreateUser(other, false)) {
+		return
+	}
+
+	posts := generateDatedPosts(3)
+	posts[1].Categories = []string{"Go"}
+	assert.Nil(t, db.WriteNews(posts))
+
+	page, err := db.GetNewsPage(Filter{}, 1, 10)
+	if !assert.Nil(t, err) || !assert.Equal(t, 3, len(page)) {
+		return
+	}
+	newest, middle, oldest := page[0], page[1], page[2]
+
+	saved, err := db.GetSavedPosts(reader.ID, "")
+	assert.Nil(t, err)
+	assert.Empty(t, saved)
+
+	assert.Nil(t, db.SavePost(reader.ID, oldest.ID, "read later", 1650000000))
+	assert.Nil(t, db.SavePost(reader.ID, middle.ID, "", 1650000100))
+	assert.Nil(t, db.SavePost(other.ID, newest.ID, "", 1650000100))
+	assert.ErrorIs(t, db.SavePost(reader.ID, newest.ID+100, "", 1650000000), ErrNotFound)
+
+	//saving again changes only the note
+	assert.Nil(t, db.SavePost(reader.ID, middle.ID, "About Go", 1650000200))
+
+	saved, err = db.GetSavedPosts(reader.ID, "")
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(saved)) {
+		assert.Equal(t, middle.Link, saved[0].Link)
+		assert.Equal(t, "About Go", saved[0].Note)
+		assert.Equal(t, int64(1650000100), saved[0].SavedAt)
+		assert.Equal(t, []string{"go"}, saved[0].Tags)
+		assert.Equal(t, oldest.Link, saved[1].Link)
+		assert.Equal(t, "read later", saved[1].Note)
+	}
+
+	//the search goes through the notes and the posts
+	saved, err = db.GetSavedPosts(reader.ID, "LATER")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(saved)) {
+		assert.Equal(t, oldest.Link, saved[0].Link)
+	}
+
+	saved, err = db.GetSavedPosts(reader.ID, oldest.Title)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(saved))
+
+	saved, err = db.GetSavedPosts(reader.ID, "50%")
+	assert.Nil(t, err)
+	assert.Empty(t, saved)
+
+	assert.Nil(t, db.UnsavePost(reader.ID, oldest.ID))
+	assert.ErrorIs(t, db.UnsavePost(reader.ID, oldest.ID), ErrNotFound)
+
+	saved, err = db.GetSavedPosts(reader.ID, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(saved))
+}
+
+func testSavedPostsRetention(t *testing.T, db testStorage) {
+	user := &User{Login: "reader", PasswordHash: "hash", CreatedAt: 1650000000}
+	if !assert.Nil(t, db.CreateUser(user, false)) {
+		return
+	}
+
+	posts := generateDatedPosts(5)
+	assert.Nil(t, db.WriteNews(posts))
+
+	expired, err := db.ExpiredNews(posts[2].PubTime, 0)
+	if !assert.Nil(t, err) || !assert.Equal(t, 2, len(expired)) {
+		return
+	}
+
+	//the oldest post is starred after it was selected for pruning
+	assert.Nil(t, db.SavePost(user.ID, expired[0].ID, "", 1650000000))
+
+	again, err := db.ExpiredNews(posts[2].PubTime, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(again))
+
+	assert.Nil(t, db.PruneNews(expired, true))
+
+	amount, err := db.NewsAmount(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, amount)
+
+	_, err = db.GetNewsByID(expired[0].ID)
+	assert.Nil(t, err)
+
+	_, err = db.GetArchivedNews(expired[0].Link)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = db.GetArchivedNews(expired[1].Link)
+	assert.Nil(t, err)
+
+	saved, err := db.GetSavedPosts(user.ID, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(saved))
+}
+
+func testAlertRules(t *testing.T, db testStorage) {
+	reader := &User{Login: "reader", PasswordHash: "hash", CreatedAt: 1650000000}
+	other := &User{Login: "other", PasswordHash: "hash", CreatedAt: 1650000000}
+	if !assert.Nil(t, db.CreateUser(reader, false)) || !assert.Nil(t, db.CreateUser(other, false)) {
+		return
+	}
+
+	rule := &AlertRule{
+		UserID:     reader.ID,
+		Name:       "Go releases",
+		Keywords:   []string{"go", "golang"},
+		Regex:      `go1\.\d+`,
+		Feeds:      []string{"https://go.dev/blog/feed.atom"},
+		WebhookURL: "https://hooks.example.com/news",
+		Secret:     "secret",
+		CreatedAt:  1650000000,
+	}
+	assert.Nil(t, db.CreateAlertRule(rule))
+	assert.NotZero(t, rule.ID)
+
+	assert.Nil(t, db.CreateAlertRule(&AlertRule{UserID: other.ID, Keywords: []string{"rust"}, WebhookURL: "https://example.com", Secret: "s"}))
+
+	stored, err := db.GetAlertRule(rule.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, rule, stored)
+
+	_, err = db.GetAlertRule(rule.ID + 100)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	rules, err := db.GetAlertRules(reader.ID)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(rules)) {
+		assert.Equal(t, rule, rules[0])
+	}
+
+	//zero user returns all the rules, the empty lists are not nil
+	rules, err = db.GetAlertRules(0)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(rules)) {
+		assert.Equal(t, []string{}, rules[1].Feeds)
+	}
+
+	//the rule can be deleted only by its owner
+	assert.ErrorIs(t, db.DeleteAlertRule(other.ID, rule.ID), ErrNotFound)
+	assert.Nil(t, db.DeleteAlertRule(reader.ID, rule.ID))
+	assert.ErrorIs(t, db.DeleteAlertRule(reader.ID, rule.ID), ErrNotFound)
+
+	rules, err = db.GetAlertRules(reader.ID)
+	assert.Nil(t, err)
+	assert.Empty(t, rules)
+}
+
+func testAlertDeliveries(t *testing.T, db testStorage) {
+	user := &User{Login: "reader", PasswordHash: "hash", CreatedAt: 1650000000}
+	if !assert.Nil(t, db.CreateUser(user, false)) {
+		return
+	}
+
+	rule := &AlertRule{UserID: user.ID, Keywords: []string{"go"}, WebhookURL: "https://example.com", Secret: "s"}
+	if !assert.Nil(t, db.CreateAlertRule(rule)) {
+		return
+	}
+
+	deliveries := []*AlertDelivery{
+		{RuleID: rule.ID, PostID: 1, Payload: []byte(`{"Post":1}`), Status: DeliveryPending, CreatedAt: 100, UpdatedAt: 100, NextAttemptAt: 100},
+		{RuleID: rule.ID, PostID: 2, Payload: []byte(`{"Post":2}`), Status: DeliveryPending, CreatedAt: 100, UpdatedAt: 100, NextAttemptAt: 50},
+		{RuleID: rule.ID, PostID: 3, Payload: []byte(`{"Post":3}`), Status: DeliveryPending, CreatedAt: 100, UpdatedAt: 100, NextAttemptAt: 300},
+	}
+	assert.Nil(t, db.CreateDeliveries(deliveries))
+	for _, delivery := range deliveries {
+		assert.NotZero(t, delivery.ID)
+	}
+
+	//the due deliveries, the longest waiting first
+	due, err := db.DueDeliveries(200, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(due)) {
+		assert.Equal(t, deliveries[1], due[0])
+		assert.Equal(t, deliveries[0], due[1])
+	}
+
+	due, err = db.DueDeliveries(200, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(due))
+
+	delivered := *deliveries[1]
+	delivered.Status = DeliveryDelivered
+	delivered.Attempts = 1
+	delivered.ResponseCode = 200
+	delivered.UpdatedAt = 200
+	assert.Nil(t, db.UpdateDelivery(&delivered))
+
+	failed := *deliveries[0]
+	failed.Status = DeliveryFailed
+	failed.Attempts = 5
+	failed.ResponseCode = 500
+	failed.Error = "unexpected status 500"
+	failed.UpdatedAt = 400
+	assert.Nil(t, db.UpdateDelivery(&failed))
+
+	assert.ErrorIs(t, db.UpdateDelivery(&AlertDelivery{ID: deliveries[2].ID + 100}), ErrNotFound)
+
+	due, err = db.DueDeliveries(1000, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(due)) {
+		assert.Equal(t, deliveries[2].ID, due[0].ID)
+	}
+
+	//the log, the newest first
+	log, err := db.GetDeliveries(rule.ID, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 3, len(log)) {
+		assert.Equal(t, deliveries[2].ID, log[0].ID)
+		assert.Equal(t, &delivered, log[1])
+		assert.Equal(t, &failed, log[2])
+	}
+
+	//only the finished deliveries are removed from the log
+	assert.Nil(t, db.DeleteDeliveries(1000))
+	log, err = db.GetDeliveries(rule.ID, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(log)) {
+		assert.Equal(t, DeliveryPending, log[0].Status)
+	}
+
+	//the deliveries are removed with the rule
+	assert.Nil(t, db.DeleteAlertRule(user.ID, rule.ID))
+	due, err = db.DueDeliveries(1000, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, due)
+}
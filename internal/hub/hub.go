@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"sync"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+)
+
+//Hub tells the live update subscribers that new posts were written.
+//It passes only the greatest id of the new posts, the subscribers read the posts themselves
+//from the storage after the last one they have sent. So a slow subscriber never blocks the publisher:
+//the notifications it has not taken yet are merged into one. Nothing is lost only while the storage
+//makes the posts visible in the order of their ids, the storages serialise WriteNews for that.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+	last int
+}
+
+//Subscription receives the ids of the newest posts until it is closed.
+type Subscription struct {
+	hub *Hub
+	c   chan int
+}
+
+//New creates a new instance Hub.
+func New() *Hub {
+	return &Hub{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+//Publish notifies the subscribers about the posts written by the parser, the posts without ids are skipped.
+func (h *Hub) Publish(posts []*database.Post) {
+	id := 0
+	for _, post := range posts {
+		if post.ID > id {
+			id = post.ID
+		}
+	}
+
+	if id > 0 {
+		h.Notify(id)
+	}
+}
+
+//Notify tells the subscribers that the posts up to the id were written.
+func (h *Hub) Notify(id int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if id > h.last {
+		h.last = id
+	}
+
+	for sub := range h.subs {
+		latest := id
+
+		//only Notify writes to the channel and it holds the lock, so after the pending id is taken the send does not block
+		select {
+		case pending := <-sub.c:
+			if pending > latest {
+				latest = pending
+			}
+		default:
+		}
+
+		sub.c <- latest
+	}
+}
+
+//Last returns the greatest id passed to the hub, 0 if there was none.
+func (h *Hub) Last() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.last
+}
+
+//Subscribe adds a subscriber, it must be closed when it is not needed.
+func (h *Hub) Subscribe() *Subscription {
+	sub := &Subscription{
+		hub: h,
+		c:   make(chan int, 1),
+	}
+
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+//C returns the channel of the newest post ids.
+func (s *Subscription) C() <-chan int {
+	return s.c
+}
+
+//Close removes the subscriber from the hub.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	delete(s.hub.subs, s)
+	s.hub.mu.Unlock()
+}
@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+)
+
+func TestHub(t *testing.T) {
+	h := New()
+	first := h.Subscribe()
+	second := h.Subscribe()
+
+	h.Publish([]*database.Post{{ID: 3}, {ID: 0}, {ID: 5}})
+	assert.Equal(t, 5, <-first.C())
+
+	//the subscriber that has not read yet gets the merged notification
+	h.Publish([]*database.Post{{ID: 7}})
+	h.Publish([]*database.Post{{ID: 0}})
+	h.Notify(6)
+	assert.Equal(t, 7, <-first.C())
+	assert.Equal(t, 7, <-second.C())
+	assert.Equal(t, 7, h.Last())
+
+	second.Close()
+	h.Notify(8)
+	assert.Equal(t, 8, <-first.C())
+
+	select {
+	case id := <-second.C():
+		t.Fatalf("closed subscription got %d", id)
+	default:
+	}
+
+	first.Close()
+	h.Notify(9)
+	assert.Equal(t, 9, h.Last())
+}
+
+//fakeNotifier sends the next id on every call and fails, the last call waits for the end of the context.
+type fakeNotifier struct {
+	ids   []int
+	calls int
+}
+
+func (n *fakeNotifier) ListenNews(ctx context.Context, notify func(id int)) error {
+	notify(n.ids[n.calls])
+	n.calls++
+
+	if n.calls < len(n.ids) {
+		return errors.New("connection lost")
+	}
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestListener(t *testing.T) {
+	h := New()
+	sub := h.Subscribe()
+	defer sub.Close()
+
+	db := &fakeNotifier{ids: []int{4, 6}}
+	l := NewListener(h, db)
+	l.retry = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- l.Start(ctx)
+	}()
+
+	//the listener comes back after the failure, the notifications may be merged
+	id := <-sub.C()
+	if id == 4 {
+		id = <-sub.C()
+	}
+	assert.Equal(t, 6, id)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Equal(t, 2, db.calls)
+}
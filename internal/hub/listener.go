@@ -0,0 +1,49 @@
+package hub
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//listenRetry is the pause before listening again after the connection to the database was lost.
+const listenRetry = 5 * time.Second
+
+type notifier interface {
+	ListenNews(ctx context.Context, notify func(id int)) error
+}
+
+//Listener passes to the hub the ids of the posts written by any instance that shares the database,
+//so the live update clients get the news no matter which instance they are connected to.
+type Listener struct {
+	hub   *Hub
+	db    notifier
+	retry time.Duration
+}
+
+//NewListener creates a new instance Listener.
+func NewListener(h *Hub, db notifier) *Listener {
+	return &Listener{
+		hub:   h,
+		db:    db,
+		retry: listenRetry,
+	}
+}
+
+//Start starts a process that listens to the notifications of the database and listens again after a failure.
+func (l *Listener) Start(ctx context.Context) error {
+	for {
+		err := l.db.ListenNews(ctx, l.hub.Notify)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.WithError(err).Error("fail to listen for news notifications")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.retry):
+		}
+	}
+}
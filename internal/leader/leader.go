@@ -0,0 +1,144 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//errProcessStopped is returned by lead when a process stops while the instance is the leader.
+var errProcessStopped = errors.New("leader process stopped")
+
+type storage interface {
+	TryAdvisoryLock(ctx context.Context, key int64) (*database.AdvisoryLock, error)
+}
+
+type lock interface {
+	Check(ctx context.Context) error
+	Unlock()
+}
+
+type process struct {
+	name  string
+	start func(ctx context.Context) error
+}
+
+//Elector runs the processes that must run on one instance at a time, such as polling the feeds,
+//only on the instance that holds the advisory lock, the leader. The other instances wait to take the lock.
+type Elector struct {
+	tryLock   func(ctx context.Context) (lock, error)
+	period    time.Duration
+	processes []process
+}
+
+//New creates a new instance Elector.
+func New(cfg config.Postgres, db storage) *Elector {
+	period := cfg.LeaderPeriod
+	if period <= 0 {
+		period = time.Second
+	}
+
+	return &Elector{
+		tryLock: func(ctx context.Context) (lock, error) {
+			l, err := db.TryAdvisoryLock(ctx, cfg.LeaderLockKey)
+			if l == nil {
+				return nil, err
+			}
+			return l, nil
+		},
+		period: period,
+	}
+}
+
+//Add adds a process that runs while the instance is the leader, it must stop when its context is done.
+func (e *Elector) Add(name string, start func(ctx context.Context) error) {
+	e.processes = append(e.processes, process{name: name, start: start})
+}
+
+//Start starts a process that every "period" tries to take the lock. The leader runs the added processes
+//and every "period" checks that it still holds the lock. When the lock is lost, the processes are stopped
+//and the instance waits for the lock like the others, so when the leader dies another instance takes over.
+//When one of the processes stops by itself, the leader stops the others and gives up the lock the same way,
+//so the processes are started again by the next leader, which may be this instance.
+func (e *Elector) Start(ctx context.Context) error {
+	for {
+		l, err := e.tryLock(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Error("fail to take the leader lock")
+		}
+
+		if l != nil {
+			log.Info("this instance is the leader")
+			err = e.lead(ctx, l)
+			l.Unlock()
+
+			if ctx.Err() == nil {
+				log.WithError(err).Warn("this instance is no longer the leader")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.period):
+		}
+	}
+}
+
+//lead runs the processes until ctx is done, the lock is lost or one of the processes stops,
+//and waits for them to stop.
+func (e *Elector) lead(ctx context.Context, l lock) error {
+	processCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan error, len(e.processes))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	for _, p := range e.processes {
+		wg.Add(1)
+		go func(p process) {
+			defer wg.Done()
+
+			err := p.start(processCtx)
+			if processCtx.Err() != nil {
+				return
+			}
+			if err == nil {
+				err = errors.New("returned without an error")
+			}
+			stopped <- fmt.Errorf("%w: %s: %v", errProcessStopped, p.name, err)
+		}(p)
+	}
+
+	ticker := time.NewTicker(e.period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-stopped:
+			return err
+		case <-ticker.C:
+			if err := e.check(ctx, l); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//check checks the lock, a connection that does not answer within the period counts as lost.
+func (e *Elector) check(ctx context.Context, l lock) error {
+	checkCtx, cancel := context.WithTimeout(ctx, e.period)
+	defer cancel()
+
+	return l.Check(checkCtx)
+}
@@ -0,0 +1,194 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeLock is a lock whose connection can be lost.
+type fakeLock struct {
+	mu       sync.Mutex
+	lost     bool
+	unlocked bool
+}
+
+func (l *fakeLock) Check(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lost {
+		return errors.New("connection lost")
+	}
+	return nil
+}
+
+func (l *fakeLock) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.unlocked = true
+}
+
+func (l *fakeLock) isUnlocked() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.unlocked
+}
+
+//fakeLocker gives the lock when it is free, like pg_try_advisory_lock.
+type fakeLocker struct {
+	mu      sync.Mutex
+	free    bool
+	current *fakeLock
+}
+
+func (f *fakeLocker) tryLock(ctx context.Context) (lock, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.free {
+		return nil, nil
+	}
+
+	f.free = false
+	f.current = &fakeLock{}
+	return f.current, nil
+}
+
+func (f *fakeLocker) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.free = true
+}
+
+func (f *fakeLocker) lock() *fakeLock {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.current
+}
+
+func TestElector(t *testing.T) {
+	locker := &fakeLocker{}
+	e := &Elector{tryLock: locker.tryLock, period: 10 * time.Millisecond}
+
+	running := make(chan bool, 10)
+	e.Add("rss", func(ctx context.Context) error {
+		running <- true
+		<-ctx.Done()
+		running <- false
+		return ctx.Err()
+	})
+
+	next := func() bool {
+		select {
+		case r := <-running:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("the process did not change its state")
+			return false
+		}
+	}
+
+	noChange := func() {
+		select {
+		case r := <-running:
+			t.Fatalf("unexpected process state %v", r)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- e.Start(ctx)
+	}()
+
+	//another instance is the leader
+	noChange()
+
+	//the leader dies, its lock is released
+	locker.release()
+	assert.True(t, next())
+
+	//the connection holding the lock is lost, the process stops until the lock is taken again
+	first := locker.lock()
+	first.mu.Lock()
+	first.lost = true
+	first.mu.Unlock()
+
+	assert.False(t, next())
+	assert.Eventually(t, first.isUnlocked, 5*time.Second, 10*time.Millisecond)
+	noChange()
+
+	locker.release()
+	assert.True(t, next())
+
+	cancel()
+	assert.False(t, next())
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.True(t, locker.lock().isUnlocked())
+}
+
+func TestElector_ProcessStopped(t *testing.T) {
+	locker := &fakeLocker{free: true}
+	e := &Elector{tryLock: locker.tryLock, period: 10 * time.Millisecond}
+
+	started := make(chan string, 10)
+	var alertsRuns int32
+
+	e.Add("rss", func(ctx context.Context) error {
+		started <- "rss"
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	e.Add("alerts", func(ctx context.Context) error {
+		started <- "alerts"
+		if atomic.AddInt32(&alertsRuns, 1) == 1 {
+			return errors.New("broken")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	next := func() []string {
+		var names []string
+		for len(names) < 2 {
+			select {
+			case name := <-started:
+				names = append(names, name)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the processes were not started")
+			}
+		}
+		return names
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- e.Start(ctx)
+	}()
+
+	assert.ElementsMatch(t, []string{"rss", "alerts"}, next())
+
+	//the failed process makes the leader give up the lock, so the polling is not left stopped
+	first := locker.lock()
+	assert.Eventually(t, first.isUnlocked, 5*time.Second, 10*time.Millisecond)
+
+	//the next leader starts all processes again
+	locker.release()
+	assert.ElementsMatch(t, []string{"rss", "alerts"}, next())
+	assert.NotSame(t, first, locker.lock())
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
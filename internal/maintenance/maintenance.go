@@ -0,0 +1,51 @@
+package maintenance
+
+import (
+	"context"
+	"time"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type storage interface {
+	CreatePartitions(from time.Time, monthsAhead int) error
+}
+
+//Maintainer keeps the partitions of the posts table created in advance.
+type Maintainer struct {
+	db              storage
+	partitionsAhead int
+	period          time.Duration
+}
+
+//New creates a new instance Maintainer.
+func New(cfg config.Postgres, db storage) *Maintainer {
+	return &Maintainer{
+		db:              db,
+		partitionsAhead: cfg.PartitionsAhead,
+		period:          cfg.MaintenancePeriod,
+	}
+}
+
+//Start starts a process that every "period" creates the partitions for the upcoming months.
+func (m *Maintainer) Start(ctx context.Context) error {
+	for {
+		if err := m.Run(); err != nil {
+			log.WithError(err).Error("fail to create partitions")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.period):
+		}
+	}
+}
+
+//Run creates the partitions for the current month and the next "partitionsAhead" months,
+//and for the earlier months whose posts are still in the default partition.
+func (m *Maintainer) Run() error {
+	return m.db.CreatePartitions(time.Now(), m.partitionsAhead)
+}
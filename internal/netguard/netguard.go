@@ -0,0 +1,67 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+//ErrPrivateAddress is returned for the links and the connections to loopback, private, link-local
+//and unspecified addresses, which the links supplied by the users must not reach.
+var ErrPrivateAddress = errors.New("private, loopback and link-local addresses are not allowed")
+
+//sharedAddressSpace is 100.64.0.0/10 of the carrier-grade NAT, some clouds serve their metadata from it.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+//Public reports whether the server may connect to the address on behalf of a user.
+func Public(ip net.IP) bool {
+	return !ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsUnspecified() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+//Control is the net.Dialer.Control hook that refuses the connections to the addresses that are not Public.
+//It runs after DNS resolution for every address the dialer tries, so the host names resolving
+//to internal addresses and the redirects to them are refused as well.
+func Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !Public(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+
+	return nil
+}
+
+//CheckHost resolves the host and returns ErrPrivateAddress if any of its addresses is not Public.
+//A host that does not resolve passes: DNS may change before the connection anyway, Control checks it then.
+func CheckHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !Public(ip) {
+			return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		if !Public(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrPrivateAddress, host, addr.IP)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package netguard
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublic(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.public, Public(net.ParseIP(tt.ip)), tt.ip)
+	}
+}
+
+func TestControl(t *testing.T) {
+	assert.Nil(t, Control("tcp4", "93.184.216.34:443", nil))
+	assert.ErrorIs(t, Control("tcp4", "169.254.169.254:80", nil), ErrPrivateAddress)
+	assert.ErrorIs(t, Control("tcp6", "[::1]:80", nil), ErrPrivateAddress)
+
+	//the hook is called by the dialer after the host name is resolved
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	dialer := &net.Dialer{Control: Control}
+	_, err = dialer.Dial("tcp", listener.Addr().String())
+	assert.ErrorIs(t, err, ErrPrivateAddress)
+}
+
+func TestCheckHost(t *testing.T) {
+	ctx := context.Background()
+
+	assert.Nil(t, CheckHost(ctx, "93.184.216.34"))
+	assert.ErrorIs(t, CheckHost(ctx, "10.0.0.1"), ErrPrivateAddress)
+	assert.ErrorIs(t, CheckHost(ctx, "localhost"), ErrPrivateAddress)
+	assert.Nil(t, CheckHost(ctx, "missing.invalid"))
+}
@@ -0,0 +1,24 @@
+package retention
+
+type Report struct {
+	Mode   string       // delete или archive
+	DryRun bool         // посты только попадают в отчет, но не удаляются
+	Total  int          // общее количество постов к удалению
+	Feeds  []FeedReport // количество постов к удалению по каждой ленте
+	Posts  []PostReport // посты к удалению, начиная с самых старых
+}
+
+type FeedReport struct {
+	Feed   string // ссылка на RSS ленту
+	Amount int    // количество постов к удалению
+	Oldest int64  // время публикации самого старого поста
+	Newest int64  // время публикации самого нового поста
+}
+
+type PostReport struct {
+	ID      int    // номер записи
+	Title   string // заголовок публикации
+	PubTime int64  // время публикации
+	Link    string // ссылка на источник
+	Feed    string // ссылка на RSS ленту
+}
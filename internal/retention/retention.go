@@ -0,0 +1,156 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ModeDelete  = "delete"
+	ModeArchive = "archive"
+)
+
+type storage interface {
+	ExpiredNews(before int64, keepPerFeed int) ([]*database.Post, error)
+	PruneNews(posts []*database.Post, archive bool) error
+}
+
+type Pruner struct {
+	db              storage
+	maxAge          time.Duration
+	maxPostsPerFeed int
+	mode            string
+	dryRun          bool
+	period          time.Duration
+}
+
+//New creates a new instance Pruner.
+func New(cfg config.Retention, db storage) (*Pruner, error) {
+	if cfg.Mode != ModeDelete && cfg.Mode != ModeArchive {
+		return nil, fmt.Errorf("unknown retention mode %q", cfg.Mode)
+	}
+
+	return &Pruner{
+		db:              db,
+		maxAge:          cfg.MaxAge,
+		maxPostsPerFeed: cfg.MaxPostsPerFeed,
+		mode:            cfg.Mode,
+		dryRun:          cfg.DryRun,
+		period:          cfg.Period,
+	}, nil
+}
+
+//Start starts a process that every "period" prunes the posts that fall outside the retention policy.
+func (p *Pruner) Start(ctx context.Context) error {
+	for {
+		if err := p.Prune(); err != nil {
+			log.WithError(err).Error("fail to prune news")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.period):
+		}
+	}
+}
+
+//Prune removes or archives expired posts, in the dry-run mode it only logs them.
+func (p *Pruner) Prune() error {
+	if !p.enabled() {
+		return nil
+	}
+
+	posts, err := p.expired()
+	if err != nil {
+		return err
+	}
+
+	if len(posts) == 0 {
+		return nil
+	}
+
+	fields := log.Fields{
+		"amount": len(posts),
+		"mode":   p.mode,
+	}
+
+	if p.dryRun {
+		log.WithFields(fields).Info("dry run, news are not pruned")
+		return nil
+	}
+
+	if err = p.db.PruneNews(posts, p.mode == ModeArchive); err != nil {
+		return err
+	}
+
+	log.WithFields(fields).Info("news pruned")
+	return nil
+}
+
+//Report returns the posts that would be pruned by the current policy.
+func (p *Pruner) Report() (*Report, error) {
+	report := &Report{
+		Mode:   p.mode,
+		DryRun: p.dryRun,
+		Feeds:  []FeedReport{},
+		Posts:  []PostReport{},
+	}
+
+	if !p.enabled() {
+		return report, nil
+	}
+
+	posts, err := p.expired()
+	if err != nil {
+		return nil, err
+	}
+
+	feeds := make(map[string]int)
+
+	for _, post := range posts {
+		report.Posts = append(report.Posts, PostReport{
+			ID:      post.ID,
+			Title:   post.Title,
+			PubTime: post.PubTime,
+			Link:    post.Link,
+			Feed:    post.Feed,
+		})
+
+		i, ok := feeds[post.Feed]
+		if !ok {
+			i = len(report.Feeds)
+			feeds[post.Feed] = i
+			report.Feeds = append(report.Feeds, FeedReport{
+				Feed:   post.Feed,
+				Oldest: post.PubTime,
+			})
+		}
+
+		//posts are sorted from the oldest
+		report.Feeds[i].Amount++
+		report.Feeds[i].Newest = post.PubTime
+	}
+
+	report.Total = len(posts)
+	return report, nil
+}
+
+func (p *Pruner) enabled() bool {
+	return p.maxAge > 0 || p.maxPostsPerFeed > 0
+}
+
+func (p *Pruner) expired() ([]*database.Post, error) {
+	var before int64
+	if p.maxAge > 0 {
+		before = time.Now().Add(-p.maxAge).Unix()
+	}
+
+	return p.db.ExpiredNews(before, p.maxPostsPerFeed)
+}
@@ -0,0 +1,93 @@
+package retention
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDB(t *testing.T) *database.Memdb {
+	db := database.NewMemoryDB()
+
+	var posts []*database.Post
+	for i := 0; i < 10; i++ {
+		feed := "feed a"
+		if i%2 == 1 {
+			feed = "feed b"
+		}
+
+		posts = append(posts, &database.Post{
+			Title:   "Title " + strconv.Itoa(i),
+			Content: "Content " + strconv.Itoa(i),
+			PubTime: time.Now().Add(-time.Duration(10-i) * 24 * time.Hour).Unix(),
+			Link:    "Link " + strconv.Itoa(i),
+			Feed:    feed,
+		})
+	}
+
+	err := db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	return db
+}
+
+func TestNew_UnknownMode(t *testing.T) {
+	_, err := New(config.Retention{Mode: "truncate"}, database.NewMemoryDB())
+	assert.NotNil(t, err)
+}
+
+func TestPruner_Report(t *testing.T) {
+	db := testDB(t)
+
+	p, err := New(config.Retention{
+		MaxAge:          7*24*time.Hour + time.Hour,
+		MaxPostsPerFeed: 3,
+		Mode:            ModeDelete,
+	}, db)
+	assert.Nil(t, err)
+
+	report, err := p.Report()
+	assert.Nil(t, err)
+
+	//posts 0, 1 and 2 are older than a week, post 3 is the fourth in its feed
+	assert.Equal(t, 4, report.Total)
+	assert.Equal(t, "Link 0", report.Posts[0].Link)
+	assert.Equal(t, 2, len(report.Feeds))
+	assert.Equal(t, 2, report.Feeds[0].Amount)
+	assert.Equal(t, 2, report.Feeds[1].Amount)
+}
+
+func TestPruner_Prune(t *testing.T) {
+	db := testDB(t)
+
+	p, err := New(config.Retention{
+		MaxPostsPerFeed: 2,
+		Mode:            ModeArchive,
+		DryRun:          true,
+	}, db)
+	assert.Nil(t, err)
+
+	err = p.Prune()
+	assert.Nil(t, err)
+
+	amount, err := db.NewsAmount(database.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, amount)
+
+	p.dryRun = false
+
+	err = p.Prune()
+	assert.Nil(t, err)
+
+	amount, err = db.NewsAmount(database.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, amount)
+
+	archived, err := db.GetArchivedNews("Link 0")
+	assert.Nil(t, err)
+	assert.Equal(t, "Content 0", archived.Content)
+}
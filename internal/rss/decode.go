@@ -0,0 +1,59 @@
+package rss
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/transform"
+)
+
+//decodeRSS parses the feed in any encoding known to the WHATWG Encoding Standard.
+//The charset from the HTTP Content-Type takes precedence over the encoding in the XML prolog,
+//like RFC 7303 requires, without both the document is UTF-8.
+func decodeRSS(r io.Reader, contentType string) (*RSS, error) {
+	label := httpCharset(contentType)
+	if label != "" {
+		encoding, name := charset.Lookup(label)
+		if encoding == nil {
+			return nil, fmt.Errorf("unsupported charset %q", label)
+		}
+
+		if name != "utf-8" {
+			r = transform.NewReader(r, encoding.NewDecoder())
+		}
+	}
+
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = func(prolog string, input io.Reader) (io.Reader, error) {
+		if label != "" {
+			//the input is already decoded with the charset from the HTTP header
+			return input, nil
+		}
+
+		return charset.NewReaderLabel(prolog, input)
+	}
+
+	var rss RSS
+	if err := decoder.Decode(&rss); err != nil {
+		return nil, err
+	}
+
+	return &rss, nil
+}
+
+//httpCharset returns the charset parameter of the Content-Type header.
+func httpCharset(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	return params["charset"]
+}
@@ -0,0 +1,66 @@
+package rss
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeRSS(t *testing.T) {
+	tests := []struct {
+		file        string
+		contentType string
+		title       string
+		description string
+	}{
+		{"rss.xml", "application/rss+xml", "Permalink guid", "<p>First post</p>"},
+		{"rss-windows-1251.xml", "", "Привет, мир! Ёлки и ёжики", "Текст новости в кодировке windows-1251"},
+		{"rss-koi8-r.xml", "text/xml", "Привет, мир! Ёлки и ёжики", "Текст новости в кодировке koi8-r"},
+		{"rss-iso-8859-1.xml", "application/xml", "Café crème à la française", "Texte de l'actualité en ISO-8859-1"},
+		//the same charset in the header and in the prolog is decoded once
+		{"rss-windows-1251.xml", "application/rss+xml; charset=windows-1251", "Привет, мир! Ёлки и ёжики", "Текст новости в кодировке windows-1251"},
+		//the header charset is used when the prolog has none
+		{"rss-windows-1251-noprolog.xml", "text/xml; charset=cp1251", "Привет, мир! Ёлки и ёжики", "Текст новости в кодировке windows-1251"},
+	}
+
+	for _, tt := range tests {
+		f, err := os.Open("testdata/" + tt.file)
+		if !assert.Nil(t, err, tt.file) {
+			continue
+		}
+
+		rss, err := decodeRSS(f, tt.contentType)
+		f.Close()
+
+		if !assert.Nil(t, err, tt.file) || !assert.NotEmpty(t, rss.Channel.Items, tt.file) {
+			continue
+		}
+		assert.Equal(t, tt.title, rss.Channel.Items[0].Title, tt.file)
+		assert.Equal(t, tt.description, rss.Channel.Items[0].Content, tt.file)
+	}
+}
+
+func TestDecodeRSS_HeaderOverridesProlog(t *testing.T) {
+	f, err := os.Open("testdata/rss-koi8-r.xml")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer f.Close()
+
+	//the header wins, so a wrong header gives wrong text instead of an error
+	rss, err := decodeRSS(f, "text/xml; charset=windows-1251")
+	assert.Nil(t, err)
+	if assert.NotEmpty(t, rss.Channel.Items) {
+		assert.NotEqual(t, "Привет, мир! Ёлки и ёжики", rss.Channel.Items[0].Title)
+	}
+}
+
+func TestDecodeRSS_UnsupportedCharset(t *testing.T) {
+	_, err := decodeRSS(strings.NewReader(`<rss/>`), "text/xml; charset=x-unknown")
+	assert.NotNil(t, err)
+
+	_, err = decodeRSS(strings.NewReader(`<?xml version="1.0" encoding="x-unknown"?><rss/>`), "")
+	assert.NotNil(t, err)
+}
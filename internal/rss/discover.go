@@ -0,0 +1,204 @@
+package rss
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+//ErrInvalidLink is returned when the link to discover or preview is not an absolute http(s) URL.
+var ErrInvalidLink = errors.New("invalid link, expected an http or https URL")
+
+//maxCandidates limits the number of advertised feeds validated for one page.
+const maxCandidates = 10
+
+//feedTypes are the types of <link rel="alternate"> that point to feeds.
+var feedTypes = []string{"application/rss+xml", "application/atom+xml"}
+
+//commonFeedPaths are tried in addition to the advertised feeds.
+var commonFeedPaths = []string{"/feed", "/rss", "/rss.xml", "/feed.xml", "/atom.xml", "/index.xml"}
+
+//Candidate is a feed found by Discover.
+type Candidate struct {
+	URL    string // ссылка на ленту
+	Title  string // название канала, если его нет, то атрибут title тега link
+	Type   string // MIME тип из тега link
+	Format string // формат документа: rss, atom, rdf, json, html или unknown
+	Items  int    // количество записей в ленте
+	Error  string // почему ленту не удалось разобрать, пусто для рабочей ленты
+}
+
+//Discover finds the feeds of the site: the feeds advertised with <link rel="alternate"> on the page
+//and the feeds at the common paths.
+//Every candidate is downloaded and parsed, advertised feeds that fail are returned with Error,
+//failed common paths are skipped unless they hold an Atom or RDF feed. The parser reads only RSS,
+//so such feeds are returned with ErrUnsupportedFormat. A link to a feed itself is returned as the only candidate.
+//The candidates are validated at once, the fetcher still keeps the slots and the delay of their hosts.
+//When ctx is done the found candidates are returned, the advertised ones that were not validated with the error.
+//The link comes from the user, so it is fetched only from public addresses, see Fetcher.Guarded.
+func (p *NewsParser) Discover(ctx context.Context, link string) ([]*Candidate, error) {
+	site, err := parseLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.linkFetcher.Fetch(ctx, site.String(), acceptArticle)
+	if err != nil {
+		return nil, err
+	}
+
+	if rss, err := decodeRSS(bytes.NewReader(resp.Body), resp.ContentType); err == nil {
+		return []*Candidate{{
+			URL:    resp.URL.String(),
+			Title:  strings.TrimSpace(rss.Channel.Title),
+			Format: FormatRSS,
+			Items:  len(rss.Channel.Items),
+		}}, nil
+	}
+
+	body, err := charset.NewReader(bytes.NewReader(resp.Body), resp.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := html.Parse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	advertised := []*Candidate{}
+	seen := make(map[string]bool)
+
+	for _, c := range feedLinks(doc, resp.URL) {
+		if seen[c.URL] || len(advertised) == maxCandidates {
+			continue
+		}
+		seen[c.URL] = true
+		advertised = append(advertised, c)
+	}
+
+	var common []*Candidate
+	for _, path := range commonFeedPaths {
+		c := &Candidate{URL: resp.URL.ResolveReference(&url.URL{Path: path}).String()}
+		if seen[c.URL] {
+			continue
+		}
+		seen[c.URL] = true
+		common = append(common, c)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range append(append([]*Candidate{}, advertised...), common...) {
+		wg.Add(1)
+		go func(c *Candidate) {
+			defer wg.Done()
+			p.validate(ctx, c)
+		}(c)
+	}
+	wg.Wait()
+
+	candidates := advertised
+	for _, c := range common {
+		if c.Error == "" || c.Format == FormatAtom || c.Format == FormatRDF {
+			candidates = append(candidates, c)
+		}
+	}
+
+	return candidates, nil
+}
+
+//validate downloads and parses the candidate, filling its title and number of items or the error.
+func (p *NewsParser) validate(ctx context.Context, c *Candidate) {
+	resp, err := p.linkFetcher.Fetch(ctx, c.URL, acceptFeed)
+	if err == nil {
+		c.Format, _ = detectFormat(resp.Body)
+		if c.Format != FormatRSS {
+			err = formatError(c.Format)
+		}
+	}
+	if err == nil {
+		var rss *RSS
+		if rss, err = decodeRSS(bytes.NewReader(resp.Body), resp.ContentType); err == nil {
+			if title := strings.TrimSpace(rss.Channel.Title); title != "" {
+				c.Title = title
+			}
+			c.Items = len(rss.Channel.Items)
+			return
+		}
+	}
+
+	c.Error = err.Error()
+}
+
+//feedLinks returns the feeds advertised in the head of the page, relative links are resolved
+//against <base href> or the page URL.
+func feedLinks(doc *html.Node, page *url.URL) []*Candidate {
+	base := page
+	var candidates []*Candidate
+
+	walk(doc, func(node *html.Node) {
+		switch node.Data {
+		case "base":
+			if href := resolveLink(page, attr(node, "href")); href != nil {
+				base = href
+			}
+
+		case "link":
+			rel := strings.Fields(strings.ToLower(attr(node, "rel")))
+			feedType := strings.ToLower(strings.TrimSpace(attr(node, "type")))
+			if !containsString(rel, "alternate") || !containsString(feedTypes, feedType) {
+				return
+			}
+
+			link := resolveLink(base, attr(node, "href"))
+			if link == nil || (link.Scheme != "http" && link.Scheme != "https") {
+				return
+			}
+
+			candidates = append(candidates, &Candidate{
+				URL:   link.String(),
+				Title: strings.TrimSpace(attr(node, "title")),
+				Type:  feedType,
+			})
+		}
+	})
+
+	return candidates
+}
+
+//resolveLink resolves the href against the base, it returns nil for an empty or invalid href.
+func resolveLink(base *url.URL, href string) *url.URL {
+	href = strings.TrimSpace(href)
+	if href == "" {
+		return nil
+	}
+
+	u, err := url.Parse(href)
+	if err != nil {
+		return nil
+	}
+
+	return base.ResolveReference(u)
+}
+
+//parseLink checks that the link is an absolute http(s) URL, a link without a scheme is taken as https.
+func parseLink(link string) (*url.URL, error) {
+	link = strings.TrimSpace(link)
+	if u, err := url.Parse(link); err == nil && u.Scheme == "" && link != "" {
+		link = "https://" + link
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidLink, link)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,185 @@
+package rss
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/netguard"
+)
+
+const discoverFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <title>Example blog</title>
+    <item><title>First</title><link>https://example.com/1</link></item>
+    <item><title>Second</title><link>https://example.com/2</link></item>
+  </channel>
+</rss>`
+
+func TestNewsParser_Discover(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(`<html><head>
+				<base href="/blog/">
+				<link rel="stylesheet" href="style.css">
+				<link rel="alternate" type="application/rss+xml" title="Blog RSS" href="feed.xml">
+				<link rel="alternate" type="application/rss+xml" title="Duplicate" href="/blog/feed.xml">
+				<link rel="Alternate" type="application/rss+xml" title="Comments" href="/comments.xml">
+				<link rel="alternate" type="application/atom+xml" title="Blog Atom" href="/atom">
+				<link rel="alternate" type="text/html" hreflang="en" href="/en/">
+			</head><body><p>Blog</p></body></html>`))
+
+		case "/blog/feed.xml", "/rss":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			_, _ = w.Write([]byte(discoverFeed))
+
+		case "/atom", "/atom.xml", "/comments.xml":
+			w.Header().Set("Content-Type", "application/atom+xml")
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><feed xmlns="http://www.w3.org/2005/Atom"><title>Atom</title></feed>`))
+
+		case "/plain":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<html><body><p>No feeds here</p></body></html>`))
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	p := NewNewsParser(config.RSS{Fetcher: config.Fetcher{AllowPrivate: true}}, database.NewMemoryDB())
+	ctx := context.Background()
+
+	//the advertised feeds, the Atom ones with the format error, and the feeds at the common paths
+	candidates, err := p.Discover(ctx, server.URL)
+	assert.Nil(t, err)
+	if assert.Equal(t, 5, len(candidates)) {
+		assert.Equal(t, &Candidate{
+			URL:    server.URL + "/blog/feed.xml",
+			Title:  "Example blog",
+			Type:   "application/rss+xml",
+			Format: FormatRSS,
+			Items:  2,
+		}, candidates[0])
+
+		assert.Equal(t, server.URL+"/comments.xml", candidates[1].URL)
+		assert.Equal(t, "Comments", candidates[1].Title)
+		assert.Equal(t, FormatAtom, candidates[1].Format)
+		assert.Equal(t, formatError(FormatAtom).Error(), candidates[1].Error)
+
+		assert.Equal(t, &Candidate{
+			URL:    server.URL + "/atom",
+			Title:  "Blog Atom",
+			Type:   "application/atom+xml",
+			Format: FormatAtom,
+			Error:  "unsupported format atom, only RSS feeds can be added",
+		}, candidates[2])
+
+		assert.Equal(t, server.URL+"/rss", candidates[3].URL)
+		assert.Equal(t, "", candidates[3].Error)
+
+		//an Atom feed at a common path is not skipped
+		assert.Equal(t, server.URL+"/atom.xml", candidates[4].URL)
+		assert.Equal(t, FormatAtom, candidates[4].Format)
+		assert.NotEmpty(t, candidates[4].Error)
+	}
+
+	//a page without feeds falls back to the common paths
+	candidates, err = p.Discover(ctx, server.URL+"/plain")
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(candidates)) {
+		assert.Equal(t, server.URL+"/rss", candidates[0].URL)
+		assert.Equal(t, "Example blog", candidates[0].Title)
+		assert.Equal(t, "", candidates[0].Error)
+	}
+
+	//a link to the feed itself
+	candidates, err = p.Discover(ctx, server.URL+"/blog/feed.xml")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(candidates)) {
+		assert.Equal(t, server.URL+"/blog/feed.xml", candidates[0].URL)
+		assert.Equal(t, 2, candidates[0].Items)
+	}
+
+	_, err = p.Discover(ctx, "ftp://example.com")
+	assert.ErrorIs(t, err, ErrInvalidLink)
+
+	_, err = p.Discover(ctx, server.URL+"/missing")
+	assert.NotNil(t, err)
+
+	//by default the links of the users do not reach the internal addresses
+	p = NewNewsParser(config.RSS{}, database.NewMemoryDB())
+	_, err = p.Discover(ctx, server.URL)
+	assert.ErrorIs(t, err, netguard.ErrPrivateAddress)
+}
+
+func TestNewsParser_Discover_Deadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(`<html><head>
+				<link rel="alternate" type="application/rss+xml" href="/first.xml">
+				<link rel="alternate" type="application/rss+xml" href="/second.xml">
+				<link rel="alternate" type="application/rss+xml" href="/third.xml">
+				<link rel="alternate" type="application/rss+xml" href="/hanging.xml">
+			</head></html>`))
+
+		case "/first.xml", "/second.xml", "/third.xml":
+			time.Sleep(200 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/rss+xml")
+			_, _ = w.Write([]byte(discoverFeed))
+
+		case "/hanging.xml":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	p := NewNewsParser(config.RSS{Fetcher: config.Fetcher{AllowPrivate: true, MaxPerHost: 8}}, database.NewMemoryDB())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	//the candidates are validated at once and the hanging one does not hold the answer past the deadline
+	start := time.Now()
+	candidates, err := p.Discover(ctx, server.URL)
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	if assert.Equal(t, 4, len(candidates)) {
+		for _, c := range candidates[:3] {
+			assert.Equal(t, "", c.Error, c.URL)
+			assert.Equal(t, 2, c.Items, c.URL)
+		}
+		assert.Equal(t, server.URL+"/hanging.xml", candidates[3].URL)
+		assert.Contains(t, candidates[3].Error, context.DeadlineExceeded.Error())
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	u, err := parseLink(" example.com/blog ")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "https://example.com/blog", u.String())
+	}
+
+	for _, link := range []string{"", "ftp://example.com", "http://", "mailto:user@example.com"} {
+		_, err = parseLink(link)
+		assert.ErrorIs(t, err, ErrInvalidLink, link)
+	}
+}
@@ -0,0 +1,618 @@
+package rss
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	log "github.com/sirupsen/logrus"
+	"github.com/temoto/robotstxt"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/netguard"
+)
+
+//ErrBodyTooLarge is returned when the response is larger than the configured limit.
+var ErrBodyTooLarge = errors.New("response body is too large")
+
+//ErrDisallowed is returned without a request when robots.txt of the host forbids the link.
+var ErrDisallowed = errors.New("disallowed by robots.txt")
+
+const (
+	//defaultRobotsTTL is used when the robots.txt lifetime is not configured.
+	defaultRobotsTTL = 24 * time.Hour
+	//robotsErrorTTL is the lifetime of a 5xx answer to robots.txt, the host is not visited until it expires.
+	robotsErrorTTL = time.Hour
+	//maxRetryAfter caps Retry-After, so a broken header does not block the host forever.
+	maxRetryAfter = 24 * time.Hour
+	//defaultMaxRedirects is used when the number of redirects is not limited, like in net/http.
+	defaultMaxRedirects = 10
+	acceptRobots        = "text/plain"
+)
+
+//hostStore keeps the fetcher decisions about the hosts between restarts.
+type hostStore interface {
+	GetHostPolicy(host string) (*database.HostPolicy, error)
+	WriteHostPolicy(policy *database.HostPolicy) error
+}
+
+//StatusError is returned for responses with a non-2xx status code.
+type StatusError struct {
+	Code       int
+	Status     string
+	RetryAfter time.Time // время из заголовка Retry-After для ответов 429 и 503
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected status " + e.Status
+}
+
+//Temporary reports whether the request may succeed later: server errors and rate limiting.
+func (e *StatusError) Temporary() bool {
+	return e.Code >= http.StatusInternalServerError || e.Code == http.StatusTooManyRequests
+}
+
+//RetryAfterError is returned without a request while the host asked to wait with Retry-After.
+type RetryAfterError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("host %s asked to retry after %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+//Temporary always reports true, the host will be requested again after Until.
+func (e *RetryAfterError) Temporary() bool {
+	return true
+}
+
+//Response is a fully read and decompressed response.
+type Response struct {
+	URL         *url.URL // адрес после перенаправлений
+	ContentType string   // заголовок Content-Type
+	Body        []byte   // тело ответа
+
+	redirect *url.URL // адрес из Location, пока Fetch идет по перенаправлениям
+}
+
+//Fetcher downloads feeds and articles with timeouts, a body size limit
+//and at most MaxPerHost simultaneous requests to one host.
+//It honours robots.txt and Retry-After and keeps HostDelay between requests to one host.
+//robots.txt and Retry-After are saved to the store when they change, so a restart does not reset them.
+type Fetcher struct {
+	client       *http.Client
+	robotsClient *http.Client
+	store        hostStore
+	userAgent    string
+	robotsAgent  string
+	maxBodySize  int64
+	maxRedirects int
+	maxPerHost   int
+	hostDelay    time.Duration
+	robots       bool
+	robotsTTL    time.Duration
+	persist      bool
+	hosts        *hostTable
+}
+
+//hostTable is the state of the hosts, shared by the fetchers of one parser.
+type hostTable struct {
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+//hostState is the fetcher state of one host.
+type hostState struct {
+	slots chan struct{}
+
+	//load serialises reading the saved policy and downloading robots.txt
+	load   sync.Mutex
+	loaded bool
+
+	mu            sync.Mutex
+	policy        database.HostPolicy
+	rules         *robotstxt.RobotsData
+	crawlDelay    time.Duration
+	robotsExpires time.Time
+	next          time.Time
+}
+
+//NewFetcher creates a new instance Fetcher, store may be nil, then the decisions are kept only in memory.
+func NewFetcher(cfg config.Fetcher, store hostStore) *Fetcher {
+	return newFetcher(cfg, store, false)
+}
+
+//Guarded returns a fetcher for the links supplied by the users. Unless cfg.AllowPrivate is set,
+//it connects only to public addresses, see netguard.Control, and ignores the proxy settings,
+//since the proxy would connect to the internal addresses instead of it.
+//It shares the state of the hosts with f, so the requests of both count against one budget of a host.
+//The saved policies are read, but not written: the users may send any number of hosts.
+func (f *Fetcher) Guarded(cfg config.Fetcher) *Fetcher {
+	g := newFetcher(cfg, f.store, !cfg.AllowPrivate)
+	g.hosts = f.hosts
+	g.persist = false
+
+	return g
+}
+
+func newFetcher(cfg config.Fetcher, store hostStore, guarded bool) *Fetcher {
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if guarded {
+		dialer.Control = netguard.Control
+		proxy = nil
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		//compression is handled by the fetcher, the transport knows only gzip
+		DisableCompression: true,
+	}
+
+	maxRedirects := cfg.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+
+	f := &Fetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.ConnectTimeout + cfg.ReadTimeout,
+			//the redirects are followed by Fetch, every host on the way is checked by its own state
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		//robots.txt is requested under the state of its host, so its redirects are followed by the client
+		robotsClient: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.ConnectTimeout + cfg.ReadTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				return nil
+			},
+		},
+		store:        store,
+		userAgent:    cfg.UserAgent,
+		robotsAgent:  robotsAgent(cfg.UserAgent),
+		maxBodySize:  cfg.MaxBodySize,
+		maxRedirects: maxRedirects,
+		maxPerHost:   cfg.MaxPerHost,
+		hostDelay:    cfg.HostDelay,
+		robots:       cfg.Robots,
+		robotsTTL:    cfg.RobotsTTL,
+		persist:      true,
+		hosts:        &hostTable{hosts: make(map[string]*hostState)},
+	}
+
+	if f.robotsTTL <= 0 {
+		f.robotsTTL = defaultRobotsTTL
+	}
+
+	return f
+}
+
+//Fetch downloads the link, accept is the value of the Accept header.
+//The redirects are followed one by one, every host on the way gets its own robots.txt check,
+//Retry-After, delay and slot.
+//Non-2xx responses are returned as *StatusError, links forbidden by robots.txt as ErrDisallowed
+//and links of a host that asked to wait as *RetryAfterError.
+func (f *Fetcher) Fetch(ctx context.Context, link string, accept string) (*Response, error) {
+	for redirects := 0; ; redirects++ {
+		req, err := f.newRequest(ctx, link, accept)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := f.fetchHost(ctx, req)
+		if err != nil || resp.redirect == nil {
+			return resp, err
+		}
+
+		if redirects == f.maxRedirects {
+			return nil, fmt.Errorf("stopped after %d redirects", f.maxRedirects)
+		}
+		link = resp.redirect.String()
+	}
+}
+
+//fetchHost sends one request of Fetch, once its host allows it. A redirect is returned in Response.redirect.
+func (f *Fetcher) fetchHost(ctx context.Context, req *http.Request) (*Response, error) {
+	release, err := f.acquire(ctx, req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	h := f.host(req.URL.Host)
+
+	if err = f.loadPolicy(ctx, h, req.URL); err != nil {
+		return nil, err
+	}
+
+	if f.robots && !h.allowed(req.URL, f.robotsAgent) {
+		return nil, ErrDisallowed
+	}
+
+	return f.do(ctx, h, f.client, req)
+}
+
+//newRequest creates a GET request with the headers of the fetcher.
+func (f *Fetcher) newRequest(ctx context.Context, link string, accept string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+
+	return req, nil
+}
+
+//do waits for the host delay and sends the request with the client.
+//429 and 503 responses with Retry-After block the host until the time from the header.
+func (f *Fetcher) do(ctx context.Context, h *hostState, client *http.Client, req *http.Request) (*Response, error) {
+	if err := f.wait(ctx, h); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if location, err := resp.Location(); err == nil && isRedirect(resp.StatusCode) {
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		return &Response{URL: resp.Request.URL, redirect: location}, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		//the rest of a small body is read, so the connection can be reused
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+		statusErr := &StatusError{Code: resp.StatusCode, Status: resp.Status}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if until, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				statusErr.RetryAfter = until
+				f.update(h, func(policy *database.HostPolicy) { policy.RetryAfter = until.Unix() })
+			}
+		}
+
+		return nil, statusErr
+	}
+
+	body, err := f.readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{
+		URL:         resp.Request.URL,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        body,
+	}, nil
+}
+
+//readBody decompresses the body and reads it up to the size limit, the limit applies to the decompressed data.
+func (f *Fetcher) readBody(resp *http.Response) ([]byte, error) {
+	var body io.Reader
+
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		body = resp.Body
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	case "br":
+		body = brotli.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	if f.maxBodySize <= 0 {
+		return ioutil.ReadAll(body)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, f.maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > f.maxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+
+	return data, nil
+}
+
+//host returns the state of the host, creating it on first use.
+func (f *Fetcher) host(host string) *hostState {
+	f.hosts.mu.Lock()
+	defer f.hosts.mu.Unlock()
+
+	h, ok := f.hosts.hosts[host]
+	if !ok {
+		h = &hostState{policy: database.HostPolicy{Host: host}}
+		if f.maxPerHost > 0 {
+			h.slots = make(chan struct{}, f.maxPerHost)
+		}
+		f.hosts.hosts[host] = h
+	}
+
+	return h
+}
+
+//acquire waits for a free slot of the host and returns the function that frees it.
+func (f *Fetcher) acquire(ctx context.Context, host string) (func(), error) {
+	slots := f.host(host).slots
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//loadPolicy reads the saved state of the host on first use and downloads robots.txt when it is missing or expired.
+//A host that asked to wait with Retry-After is reported as *RetryAfterError.
+func (f *Fetcher) loadPolicy(ctx context.Context, h *hostState, link *url.URL) error {
+	h.load.Lock()
+	defer h.load.Unlock()
+
+	if !h.loaded {
+		if f.store != nil {
+			policy, err := f.store.GetHostPolicy(h.policy.Host)
+			if err != nil && !errors.Is(err, database.ErrNotFound) {
+				return err
+			}
+			if err == nil {
+				h.mu.Lock()
+				f.restore(h, policy)
+				h.mu.Unlock()
+			}
+		}
+		h.loaded = true
+	}
+
+	if err := h.retryAfter(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	expired := time.Now().After(h.robotsExpires)
+	h.mu.Unlock()
+
+	if !f.robots || !expired {
+		return nil
+	}
+
+	robots := &url.URL{Scheme: link.Scheme, Host: link.Host, Path: "/robots.txt"}
+	req, err := f.newRequest(ctx, robots.String(), acceptRobots)
+	if err != nil {
+		return err
+	}
+
+	var body string
+	resp, err := f.do(ctx, h, f.robotsClient, req)
+
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		body = string(resp.Body)
+	case errors.As(err, &statusErr):
+	default:
+		//the host is unreachable, robots.txt is requested again with the next link
+		return err
+	}
+
+	status := http.StatusOK
+	if statusErr != nil {
+		status = statusErr.Code
+	}
+
+	f.update(h, func(policy *database.HostPolicy) {
+		policy.Robots = body
+		policy.RobotsStatus = status
+		policy.RobotsFetchedAt = time.Now().Unix()
+		f.setRobots(h)
+	})
+
+	//robots.txt itself may have been answered with Retry-After
+	return h.retryAfter()
+}
+
+//wait reserves the next request time of the host and sleeps until it comes.
+func (f *Fetcher) wait(ctx context.Context, h *hostState) error {
+	h.mu.Lock()
+	now := time.Now()
+	at := h.next
+	if at.Before(now) {
+		at = now
+	}
+	h.next = at.Add(f.delay(h))
+	//the time is saved with the next change of the policy, a row per request would be too many writes
+	h.policy.LastRequestAt = at.Unix()
+	h.mu.Unlock()
+
+	if d := at.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+//update changes the policy of the host and saves it, a failed save does not stop the download.
+func (f *Fetcher) update(h *hostState, change func(policy *database.HostPolicy)) {
+	h.mu.Lock()
+	change(&h.policy)
+	policy := h.policy
+	h.mu.Unlock()
+
+	if f.store == nil || !f.persist {
+		return
+	}
+
+	if err := f.store.WriteHostPolicy(&policy); err != nil {
+		log.WithError(err).WithField("host", policy.Host).Warn("failed to save host policy")
+	}
+}
+
+//restore applies the saved policy, the caller must hold h.mu. The last request time is kept in seconds,
+//so it is rounded up to never make the delay shorter after a restart.
+func (f *Fetcher) restore(h *hostState, policy *database.HostPolicy) {
+	h.policy = *policy
+	if policy.RobotsFetchedAt > 0 {
+		f.setRobots(h)
+	}
+	if policy.LastRequestAt > 0 {
+		h.next = time.Unix(policy.LastRequestAt+1, 0).Add(f.delay(h))
+	}
+}
+
+//setRobots parses robots.txt from the policy of the host, the caller must hold h.mu.
+//As RFC 9309 says, 4xx means no restrictions and 5xx forbids the whole host,
+//429 is treated as a server error and a file that can not be parsed as a missing one.
+func (f *Fetcher) setRobots(h *hostState) {
+	status := h.policy.RobotsStatus
+	if status == http.StatusTooManyRequests {
+		status = http.StatusServiceUnavailable
+	}
+
+	rules, err := robotstxt.FromStatusAndString(status, h.policy.Robots)
+	if err != nil {
+		rules, _ = robotstxt.FromStatusAndString(http.StatusNotFound, "")
+	}
+
+	ttl := f.robotsTTL
+	if status >= http.StatusInternalServerError && robotsErrorTTL < ttl {
+		ttl = robotsErrorTTL
+	}
+
+	h.rules = rules
+	h.crawlDelay = rules.FindGroup(f.robotsAgent).CrawlDelay
+	h.robotsExpires = time.Unix(h.policy.RobotsFetchedAt, 0).Add(ttl)
+}
+
+//delay returns the interval between requests to the host: the larger of HostDelay
+//and Crawl-delay from robots.txt, the caller must hold h.mu.
+func (f *Fetcher) delay(h *hostState) time.Duration {
+	if f.robots && h.crawlDelay > f.hostDelay {
+		return h.crawlDelay
+	}
+
+	return f.hostDelay
+}
+
+//retryAfter returns *RetryAfterError while the host asked to wait.
+func (h *hostState) retryAfter() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	until := time.Unix(h.policy.RetryAfter, 0)
+	if time.Now().Before(until) {
+		return &RetryAfterError{Host: h.policy.Host, Until: until}
+	}
+
+	return nil
+}
+
+//allowed reports whether robots.txt of the host allows the link for the agent.
+func (h *hostState) allowed(link *url.URL, agent string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.rules == nil {
+		return true
+	}
+
+	return h.rules.TestAgent(link.RequestURI(), agent)
+}
+
+//isRedirect reports whether the status is a redirect that net/http would follow.
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+//robotsAgent returns the product token of the User-Agent, robots.txt groups are matched by it.
+func robotsAgent(userAgent string) string {
+	agent := strings.TrimSpace(userAgent)
+	if i := strings.IndexAny(agent, "/ "); i >= 0 {
+		agent = agent[:i]
+	}
+
+	return agent
+}
+
+//parseRetryAfter parses the Retry-After header: a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	var until time.Time
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return time.Time{}, false
+		}
+		until = now.Add(time.Duration(seconds) * time.Second)
+	} else if date, err := http.ParseTime(value); err == nil {
+		until = date
+	} else {
+		return time.Time{}, false
+	}
+
+	if until.Sub(now) > maxRetryAfter {
+		until = now.Add(maxRetryAfter)
+	}
+
+	return until, true
+}
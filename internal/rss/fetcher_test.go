@@ -0,0 +1,488 @@
+package rss
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/netguard"
+)
+
+func testFetcherConfig() config.Fetcher {
+	return config.Fetcher{
+		ConnectTimeout: time.Second,
+		ReadTimeout:    time.Second,
+		MaxBodySize:    1024,
+		MaxRedirects:   2,
+		MaxPerHost:     2,
+		UserAgent:      "news_reader/test",
+	}
+}
+
+func TestFetcher_Fetch(t *testing.T) {
+	body := strings.Repeat("feed ", 100)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+
+		switch r.URL.Path {
+		case "/plain":
+			_, _ = w.Write([]byte(body))
+
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			_, _ = zw.Write([]byte(body))
+			_ = zw.Close()
+
+		case "/brotli":
+			w.Header().Set("Content-Encoding", "br")
+			bw := brotli.NewWriter(w)
+			_, _ = bw.Write([]byte(body))
+			_ = bw.Close()
+
+		case "/user-agent":
+			_, _ = w.Write([]byte(r.UserAgent() + "|" + r.Header.Get("Accept-Encoding")))
+
+		case "/large":
+			_, _ = w.Write(bytes.Repeat([]byte("x"), 2048))
+
+		case "/large-gzip":
+			//small on the wire, but too large after decompression
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			_, _ = zw.Write(bytes.Repeat([]byte("x"), 2048))
+			_ = zw.Close()
+
+		case "/redirect/1":
+			http.Redirect(w, r, "/plain", http.StatusFound)
+		case "/redirect/3":
+			http.Redirect(w, r, "/redirect/2", http.StatusFound)
+		case "/redirect/2":
+			http.Redirect(w, r, "/redirect/1", http.StatusFound)
+
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(3 * time.Second):
+			}
+
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	f := NewFetcher(testFetcherConfig(), nil)
+	ctx := context.Background()
+
+	for _, path := range []string{"/plain", "/gzip", "/brotli", "/redirect/1"} {
+		resp, err := f.Fetch(ctx, server.URL+path, acceptFeed)
+		if !assert.Nil(t, err, path) {
+			continue
+		}
+		assert.Equal(t, body, string(resp.Body), path)
+		assert.Equal(t, "application/rss+xml; charset=utf-8", resp.ContentType, path)
+	}
+
+	resp, err := f.Fetch(ctx, server.URL+"/redirect/1", acceptFeed)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "/plain", resp.URL.Path)
+	}
+
+	resp, err = f.Fetch(ctx, server.URL+"/user-agent", acceptFeed)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "news_reader/test|gzip, br", string(resp.Body))
+	}
+
+	_, err = f.Fetch(ctx, server.URL+"/large", acceptFeed)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	_, err = f.Fetch(ctx, server.URL+"/large-gzip", acceptFeed)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	_, err = f.Fetch(ctx, server.URL+"/redirect/3", acceptFeed)
+	assert.ErrorContains(t, err, "stopped after 2 redirects")
+
+	_, err = f.Fetch(ctx, server.URL+"/slow", acceptFeed)
+	assert.NotNil(t, err)
+
+	var statusErr *StatusError
+
+	_, err = f.Fetch(ctx, server.URL+"/missing", acceptFeed)
+	if assert.True(t, errors.As(err, &statusErr)) {
+		assert.Equal(t, http.StatusNotFound, statusErr.Code)
+		assert.False(t, statusErr.Temporary())
+	}
+
+	_, err = f.Fetch(ctx, server.URL+"/unavailable", acceptFeed)
+	if assert.True(t, errors.As(err, &statusErr)) {
+		assert.Equal(t, http.StatusServiceUnavailable, statusErr.Code)
+		assert.True(t, statusErr.Temporary())
+	}
+}
+
+func TestFetcher_MaxPerHost(t *testing.T) {
+	var active, maxActive int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	f := NewFetcher(testFetcherConfig(), nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := f.Fetch(context.Background(), server.URL, acceptFeed)
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxActive))
+
+	//a cancelled request does not wait for a slot
+	release, err := f.acquire(context.Background(), "example.com")
+	assert.Nil(t, err)
+	defer release()
+	release2, err := f.acquire(context.Background(), "example.com")
+	assert.Nil(t, err)
+	defer release2()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = f.acquire(ctx, "example.com")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFetcher_Robots(t *testing.T) {
+	var robots, requests int32
+	var mu sync.Mutex
+	var times []time.Time
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt32(&robots, 1)
+			_, _ = w.Write([]byte("User-agent: news_reader\nDisallow: /private\nCrawl-delay: 0.2\n\nUser-agent: *\nDisallow: /\n"))
+			return
+		}
+
+		atomic.AddInt32(&requests, 1)
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	cfg := testFetcherConfig()
+	cfg.Robots = true
+	db := database.NewMemoryDB()
+	ctx := context.Background()
+
+	f := NewFetcher(cfg, db)
+
+	_, err := f.Fetch(ctx, server.URL+"/feed", acceptFeed)
+	assert.Nil(t, err)
+	_, err = f.Fetch(ctx, server.URL+"/feed?page=2", acceptFeed)
+	assert.Nil(t, err)
+
+	_, err = f.Fetch(ctx, server.URL+"/private/feed", acceptFeed)
+	assert.ErrorIs(t, err, ErrDisallowed)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&robots))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	if assert.Equal(t, 2, len(times)) {
+		//Crawl-delay of the matching group is longer than HostDelay
+		assert.GreaterOrEqual(t, times[1].Sub(times[0]), 190*time.Millisecond)
+	}
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	policy, err := db.GetHostPolicy(host)
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusOK, policy.RobotsStatus)
+		assert.Contains(t, policy.Robots, "Disallow: /private")
+	}
+
+	//after a restart robots.txt is taken from the store
+	f = NewFetcher(cfg, db)
+	_, err = f.Fetch(ctx, server.URL+"/private", acceptFeed)
+	assert.ErrorIs(t, err, ErrDisallowed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&robots))
+
+	//another agent falls into the "*" group
+	cfg.UserAgent = "other_bot/2.0"
+	f = NewFetcher(cfg, database.NewMemoryDB())
+	_, err = f.Fetch(ctx, server.URL+"/feed", acceptFeed)
+	assert.ErrorIs(t, err, ErrDisallowed)
+}
+
+func TestFetcher_RobotsStatus(t *testing.T) {
+	status := int32(http.StatusNotFound)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			return
+		}
+	}))
+	defer server.Close()
+
+	cfg := testFetcherConfig()
+	cfg.Robots = true
+	ctx := context.Background()
+
+	//a missing robots.txt allows everything
+	_, err := NewFetcher(cfg, nil).Fetch(ctx, server.URL+"/feed", acceptFeed)
+	assert.Nil(t, err)
+
+	//a server error forbids the whole host
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	_, err = NewFetcher(cfg, nil).Fetch(ctx, server.URL+"/feed", acceptFeed)
+	assert.ErrorIs(t, err, ErrDisallowed)
+}
+
+func TestFetcher_RetryAfter(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	db := database.NewMemoryDB()
+	ctx := context.Background()
+	start := time.Now()
+
+	f := NewFetcher(testFetcherConfig(), db)
+
+	var statusErr *StatusError
+	_, err := f.Fetch(ctx, server.URL+"/feed", acceptFeed)
+	if assert.True(t, errors.As(err, &statusErr)) {
+		assert.Equal(t, http.StatusTooManyRequests, statusErr.Code)
+		assert.WithinDuration(t, start.Add(120*time.Second), statusErr.RetryAfter, 2*time.Second)
+	}
+
+	//the host is not requested until Retry-After, also after a restart
+	var retryErr *RetryAfterError
+	for _, f := range []*Fetcher{f, NewFetcher(testFetcherConfig(), db)} {
+		_, err = f.Fetch(ctx, server.URL+"/other", acceptFeed)
+		if assert.True(t, errors.As(err, &retryErr)) {
+			assert.WithinDuration(t, start.Add(120*time.Second), retryErr.Until, 2*time.Second)
+			assert.True(t, retryErr.Temporary())
+		}
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestFetcher_HostDelay(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	cfg := testFetcherConfig()
+	cfg.HostDelay = 100 * time.Millisecond
+	db := database.NewMemoryDB()
+
+	f := NewFetcher(cfg, db)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := f.Fetch(context.Background(), server.URL, acceptFeed)
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	if assert.Equal(t, 3, len(times)) {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		assert.GreaterOrEqual(t, times[1].Sub(times[0]), 90*time.Millisecond)
+		assert.GreaterOrEqual(t, times[2].Sub(times[1]), 90*time.Millisecond)
+	}
+
+	//the requests alone do not write the policy of the host
+	host := strings.TrimPrefix(server.URL, "http://")
+	_, err := db.GetHostPolicy(host)
+	assert.ErrorIs(t, err, database.ErrNotFound)
+
+	//a restarted fetcher does not send the next request earlier than the saved time allows
+	last := time.Now()
+	assert.Nil(t, db.WriteHostPolicy(&database.HostPolicy{Host: host, LastRequestAt: last.Unix()}))
+
+	f = NewFetcher(cfg, db)
+	h := f.host(host)
+	assert.Nil(t, f.loadPolicy(context.Background(), h, &url.URL{Scheme: "http", Host: host}))
+	assert.True(t, h.next.After(last.Add(cfg.HostDelay)))
+}
+
+func TestFetcher_RedirectHosts(t *testing.T) {
+	var mu sync.Mutex
+	var robots int
+	var times []time.Time
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			mu.Lock()
+			robots++
+			mu.Unlock()
+			_, _ = w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+			return
+		}
+
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}))
+	defer target.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer origin.Close()
+
+	cfg := testFetcherConfig()
+	cfg.Robots = true
+	cfg.HostDelay = 100 * time.Millisecond
+	ctx := context.Background()
+
+	f := NewFetcher(cfg, nil)
+
+	//robots.txt of the target host is checked for the redirected link
+	_, err := f.Fetch(ctx, origin.URL+"/private", acceptFeed)
+	assert.ErrorIs(t, err, ErrDisallowed)
+	assert.Equal(t, 1, robots)
+	assert.Empty(t, times)
+
+	//the delay of the target host applies to the redirected requests
+	_, err = f.Fetch(ctx, target.URL+"/feed", acceptFeed)
+	assert.Nil(t, err)
+	resp, err := f.Fetch(ctx, origin.URL+"/feed", acceptFeed)
+	if assert.Nil(t, err) {
+		assert.Equal(t, target.URL+"/feed", resp.URL.String())
+	}
+
+	if assert.Equal(t, 2, len(times)) {
+		assert.GreaterOrEqual(t, times[1].Sub(times[0]), 90*time.Millisecond)
+	}
+}
+
+func TestFetcher_Guarded(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	cfg := testFetcherConfig()
+	cfg.HostDelay = 100 * time.Millisecond
+	db := database.NewMemoryDB()
+	ctx := context.Background()
+
+	f := NewFetcher(cfg, db)
+
+	//by default the guarded fetcher does not connect to the internal addresses
+	_, err := f.Guarded(cfg).Fetch(ctx, server.URL, acceptFeed)
+	assert.ErrorIs(t, err, netguard.ErrPrivateAddress)
+
+	//both fetchers keep one delay for the host
+	cfg.AllowPrivate = true
+	g := f.Guarded(cfg)
+
+	_, err = f.Fetch(ctx, server.URL, acceptFeed)
+	assert.Nil(t, err)
+	_, err = g.Fetch(ctx, server.URL, acceptFeed)
+	assert.Nil(t, err)
+
+	if assert.Equal(t, 2, len(times)) {
+		assert.GreaterOrEqual(t, times[1].Sub(times[0]), 90*time.Millisecond)
+	}
+
+	//Retry-After got by the guarded fetcher stops both, but is not saved
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+
+	var statusErr *StatusError
+	_, err = g.Fetch(ctx, limited.URL, acceptFeed)
+	assert.True(t, errors.As(err, &statusErr))
+
+	var retryErr *RetryAfterError
+	_, err = f.Fetch(ctx, limited.URL, acceptFeed)
+	assert.True(t, errors.As(err, &retryErr))
+
+	_, err = db.GetHostPolicy(strings.TrimPrefix(limited.URL, "http://"))
+	assert.ErrorIs(t, err, database.ErrNotFound)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		until time.Time
+		ok    bool
+	}{
+		{"30", now.Add(30 * time.Second), true},
+		{" 0 ", now, true},
+		{"Sun, 01 May 2022 12:10:00 GMT", now.Add(10 * time.Minute), true},
+		{"999999999", now.Add(maxRetryAfter), true},
+		{"", time.Time{}, false},
+		{"-5", time.Time{}, false},
+		{"soon", time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		until, ok := parseRetryAfter(tt.value, now)
+		assert.Equal(t, tt.ok, ok, tt.value)
+		assert.True(t, tt.until.Equal(until), tt.value)
+	}
+}
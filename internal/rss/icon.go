@@ -0,0 +1,131 @@
+package rss
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+)
+
+//iconTTL is how often the site icon is downloaded again, failed downloads are retried with the same period.
+const iconTTL = 7 * 24 * time.Hour
+
+//maxIconSize is the largest icon that is cached.
+const maxIconSize = 256 << 10
+
+const acceptIcon = "image/png, image/x-icon, image/*;q=0.8, */*;q=0.5"
+
+//updateIcon downloads the icon of the feed site, if it was not downloaded during the last iconTTL.
+func (p *NewsParser) updateIcon(ctx context.Context, feed *database.Feed) {
+	stored, err := p.db.GetFeed(feed.URL)
+	if err != nil {
+		log.WithError(err).WithField("feed", feed.URL).Error("failed to get feed")
+		return
+	}
+
+	if time.Since(time.Unix(stored.IconFetchedAt, 0)) < iconTTL {
+		return
+	}
+
+	icon := p.fetchIcon(ctx, siteURL(feed))
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err = p.db.WriteFeedIcon(feed.URL, icon); err != nil {
+		log.WithError(err).WithField("feed", feed.URL).Error("failed to write feed icon")
+	}
+}
+
+//fetchIcon downloads the icons declared on the site page and /favicon.ico and returns the first valid image.
+//Only raster images recognised by their content are accepted, so the icon can be served as is.
+func (p *NewsParser) fetchIcon(ctx context.Context, site *url.URL) *database.FeedIcon {
+	icon := &database.FeedIcon{FetchedAt: time.Now().Unix()}
+	if site == nil {
+		return icon
+	}
+
+	var links []string
+	if resp, err := p.fetcher.Fetch(ctx, site.String(), acceptArticle); err == nil {
+		if body, err := charset.NewReader(bytes.NewReader(resp.Body), resp.ContentType); err == nil {
+			if doc, err := html.Parse(body); err == nil {
+				links = iconLinks(doc, resp.URL)
+			}
+		}
+	}
+	links = append(links, site.ResolveReference(&url.URL{Path: "/favicon.ico"}).String())
+
+	seen := make(map[string]bool)
+	for _, link := range links {
+		if seen[link] || ctx.Err() != nil {
+			continue
+		}
+		seen[link] = true
+
+		resp, err := p.fetcher.Fetch(ctx, link, acceptIcon)
+		if err != nil || len(resp.Body) == 0 || len(resp.Body) > maxIconSize {
+			continue
+		}
+
+		if imageType := http.DetectContentType(resp.Body); strings.HasPrefix(imageType, "image/") {
+			icon.Type = imageType
+			icon.Data = resp.Body
+			return icon
+		}
+	}
+
+	return icon
+}
+
+//iconLinks returns the icons declared with <link rel="icon"> on the page, apple-touch-icon goes last.
+func iconLinks(doc *html.Node, page *url.URL) []string {
+	base := page
+	var icons, touchIcons []string
+
+	walk(doc, func(node *html.Node) {
+		switch node.Data {
+		case "base":
+			if href := resolveLink(page, attr(node, "href")); href != nil {
+				base = href
+			}
+
+		case "link":
+			link := resolveLink(base, attr(node, "href"))
+			if link == nil || (link.Scheme != "http" && link.Scheme != "https") {
+				return
+			}
+
+			rel := strings.Fields(strings.ToLower(attr(node, "rel")))
+			switch {
+			case containsString(rel, "icon"):
+				icons = append(icons, link.String())
+			case containsString(rel, "apple-touch-icon"):
+				touchIcons = append(touchIcons, link.String())
+			}
+		}
+	})
+
+	return append(icons, touchIcons...)
+}
+
+//siteURL returns the site link of the channel or, if it has none, the root of the feed host.
+func siteURL(feed *database.Feed) *url.URL {
+	if link, err := url.Parse(feed.Link); err == nil && (link.Scheme == "http" || link.Scheme == "https") && link.Host != "" {
+		return link
+	}
+
+	link, err := url.Parse(feed.URL)
+	if err != nil || link.Host == "" {
+		return nil
+	}
+
+	return &url.URL{Scheme: link.Scheme, Host: link.Host, Path: "/"}
+}
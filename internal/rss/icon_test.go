@@ -0,0 +1,119 @@
+package rss
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x10\x00\x00\x00\x10")
+
+func TestNewsParser_processFeed_Channel(t *testing.T) {
+	var icons int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rss":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			_, _ = w.Write([]byte(`<rss version="2.0"><channel>
+				<title>Example news</title>
+				<link>http://` + r.Host + `/blog/</link>
+				<description>News of the example</description>
+				<language>ru</language>
+				<image><url>http://` + r.Host + `/logo.png</url></image>
+				<lastBuildDate>Mon, 18 Apr 2022 12:00:00 GMT</lastBuildDate>
+				<item><title>Post</title><link>https://example.com/post</link><pubDate>Mon, 18 Apr 2022 10:00:00 GMT</pubDate></item>
+			</channel></rss>`))
+
+		case "/blog/":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<html><head>
+				<link rel="apple-touch-icon" href="/touch.png">
+				<link rel="shortcut icon" href="/static/missing.ico">
+				<link rel="icon" type="image/svg+xml" href="/static/icon.svg">
+				<link rel="icon" href="/static/icon.png">
+			</head></html>`))
+
+		case "/static/icon.svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			_, _ = w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`))
+
+		case "/static/icon.png":
+			atomic.AddInt32(&icons, 1)
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(testPNG)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	db := database.NewMemoryDB()
+	p := NewNewsParser(config.RSS{}, db)
+	feed := config.Feed{URL: server.URL + "/rss"}
+
+	p.processFeed(context.Background(), feed)
+
+	stored, err := db.GetFeed(feed.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "Example news", stored.Title)
+	assert.Equal(t, server.URL+"/blog/", stored.Link)
+	assert.Equal(t, "News of the example", stored.Description)
+	assert.Equal(t, "ru", stored.Language)
+	assert.Equal(t, server.URL+"/logo.png", stored.Image)
+	assert.Equal(t, int64(1650283200), stored.LastBuildDate)
+	assert.NotZero(t, stored.FetchedAt)
+	assert.True(t, stored.HasIcon)
+
+	//the svg is skipped, the first raster icon is taken
+	icon, err := db.GetFeedIcon(stored.ID)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "image/png", icon.Type)
+		assert.Equal(t, testPNG, icon.Data)
+	}
+
+	//the icon is not downloaded again on the next poll
+	p.processFeed(context.Background(), feed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&icons))
+}
+
+func TestNewsParser_fetchIcon_Favicon(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			_, _ = w.Write([]byte(`<html><head><title>No icons</title></head></html>`))
+		case "/favicon.ico":
+			_, _ = w.Write([]byte("\x00\x00\x01\x00\x01\x00\x10\x10"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	p := NewNewsParser(config.RSS{}, database.NewMemoryDB())
+
+	//the feed has no site link, the root of its host is used
+	icon := p.fetchIcon(context.Background(), siteURL(&database.Feed{URL: server.URL + "/feeds/rss.xml"}))
+	assert.Equal(t, "image/x-icon", icon.Type)
+	assert.NotZero(t, icon.FetchedAt)
+
+	//a page instead of an image is not an icon
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<html><body>Not found</body></html>`))
+	}))
+	defer empty.Close()
+
+	icon = p.fetchIcon(context.Background(), siteURL(&database.Feed{URL: empty.URL + "/rss"}))
+	assert.Empty(t, icon.Data)
+	assert.Equal(t, "", icon.Type)
+}
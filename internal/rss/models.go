@@ -1,16 +1,91 @@
 package rss
 
+import (
+	"encoding/xml"
+	"strings"
+)
+
 type RSS struct {
-	Channel Channel `xml:"channel"`
+	XMLName xml.Name `xml:"rss"` // документы с другим корневым элементом не разбираются
+	Channel Channel  `xml:"channel"`
 }
 
 type Channel struct {
-	Items []Item `xml:"item"`
+	Title         string   `xml:"title"`
+	Links         []string `xml:"link"` // atom:link тоже попадает сюда, поэтому ссылка на сайт - первая непустая
+	Description   string   `xml:"description"`
+	Language      string   `xml:"language"`
+	Image         Image    `xml:"image"`
+	LastBuildDate string   `xml:"lastBuildDate"`
+	Items         []Item   `xml:"item"`
+}
+
+//Image is the image element of the channel, usually the logo of the site.
+type Image struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+//Link returns the link to the site of the channel.
+func (c *Channel) Link() string {
+	for _, link := range c.Links {
+		if link = strings.TrimSpace(link); link != "" {
+			return link
+		}
+	}
+
+	return ""
 }
 
 type Item struct {
-	Title   string `xml:"title"`
-	Content string `xml:"description"`
-	PubTime string `xml:"pubDate"`
-	Link    string `xml:"link"`
+	Title      string      `xml:"title"`
+	Content    string      `xml:"description"`
+	PubTime    string      `xml:"pubDate"`
+	Link       string      `xml:"link"`
+	GUID       GUID        `xml:"guid"`
+	Author     string      `xml:"author"`
+	Creator    string      `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Categories []string    `xml:"category"`
+	Comments   string      `xml:"comments"`
+	Enclosures []Enclosure `xml:"enclosure"`
+
+	MediaContents   []MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	MediaThumbnails []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	MediaGroups     []MediaGroup     `xml:"http://search.yahoo.com/mrss/ group"`
+}
+
+type GUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink string `xml:"isPermaLink,attr"`
+}
+
+type Enclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length string `xml:"length,attr"`
+}
+
+//MediaContent is the media:content element of Media RSS.
+type MediaContent struct {
+	URL        string           `xml:"url,attr"`
+	Type       string           `xml:"type,attr"`
+	Medium     string           `xml:"medium,attr"`
+	FileSize   string           `xml:"fileSize,attr"`
+	Width      string           `xml:"width,attr"`
+	Height     string           `xml:"height,attr"`
+	Thumbnails []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+}
+
+//MediaThumbnail is the media:thumbnail element of Media RSS.
+type MediaThumbnail struct {
+	URL    string `xml:"url,attr"`
+	Width  string `xml:"width,attr"`
+	Height string `xml:"height,attr"`
+}
+
+//MediaGroup is the media:group element of Media RSS, it holds the versions of one media object.
+type MediaGroup struct {
+	Contents   []MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	Thumbnails []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
 }
@@ -0,0 +1,314 @@
+package rss
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+
+	"github.com/MarySmirnova/news_reader/internal/database"
+)
+
+//Document formats recognised by the preview, only FormatRSS is parsed.
+const (
+	FormatRSS     = "rss"
+	FormatAtom    = "atom"
+	FormatRDF     = "rdf"
+	FormatJSON    = "json"
+	FormatHTML    = "html"
+	FormatUnknown = "unknown"
+)
+
+//ErrUnsupportedFormat is the error of a document in any format but FormatRSS.
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+//Preview is what NewsParser makes of the feed, nothing of it is stored.
+type Preview struct {
+	URL         string         // адрес ленты после перенаправлений
+	Format      string         // формат документа: rss, atom, rdf, json, html или unknown
+	Version     string         // версия из атрибута version корневого элемента
+	ContentType string         // заголовок Content-Type ответа
+	Encoding    string         // кодировка, в которой разобрана лента
+	Channel     *ChannelInfo   // данные канала
+	Items       []*PreviewItem // записи в том виде, в котором они будут сохранены
+	Warnings    []string       // предупреждения о ленте в целом
+	Error       string         // почему ленту не удалось разобрать, такая лента не будет загружена
+}
+
+//ChannelInfo is the metadata of the channel.
+type ChannelInfo struct {
+	Title         string // название канала
+	Link          string // ссылка на сайт
+	Description   string // описание канала
+	Language      string // язык канала
+	Image         string // ссылка на логотип
+	LastBuildDate int64  // время последнего изменения ленты, 0 если оно не указано или не разобрано
+}
+
+type PreviewItem struct {
+	Post     *database.Post // запись, PubTime равно 0, если дату не удалось разобрать
+	Warnings []string       // проблемы записи
+}
+
+//Preview downloads and parses the feed the same way as the poller does, without storing anything.
+//Problems of the feed are returned in Preview, the error is returned only when the feed can not be downloaded.
+//The link comes from the user, so it is fetched only from public addresses, see Fetcher.Guarded.
+func (p *NewsParser) Preview(ctx context.Context, link string) (*Preview, error) {
+	feed, err := parseLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.linkFetcher.Fetch(ctx, feed.String(), acceptFeed)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &Preview{
+		URL:         resp.URL.String(),
+		ContentType: resp.ContentType,
+		Items:       []*PreviewItem{},
+		Warnings:    []string{},
+	}
+	preview.Format, preview.Version = detectFormat(resp.Body)
+	preview.Encoding = feedEncoding(resp.Body, resp.ContentType, &preview.Warnings)
+
+	if preview.Format != FormatRSS {
+		preview.Error = formatError(preview.Format).Error()
+		return preview, nil
+	}
+
+	rss, err := decodeRSS(bytes.NewReader(resp.Body), resp.ContentType)
+	if err != nil {
+		preview.Error = err.Error()
+		return preview, nil
+	}
+
+	channel, warnings := channelInfo(rss.Channel)
+	preview.Channel = channel
+	preview.Warnings = append(preview.Warnings, warnings...)
+	if len(rss.Channel.Items) == 0 {
+		preview.Warnings = append(preview.Warnings, "the feed has no items")
+	}
+
+	fetchedAt := time.Now().Unix()
+	rejected := false
+
+	for _, item := range rss.Channel.Items {
+		post, err := p.convertItem(feed.String(), item, fetchedAt)
+		warnings := itemWarnings(item, post, err)
+		rejected = rejected || err != nil
+
+		preview.Items = append(preview.Items, &PreviewItem{Post: post, Warnings: warnings})
+	}
+
+	if rejected {
+		preview.Warnings = append(preview.Warnings, "some items have no valid pubDate, the poller rejects the whole feed")
+	}
+
+	return preview, nil
+}
+
+//formatError returns ErrUnsupportedFormat for the format.
+func formatError(format string) error {
+	return fmt.Errorf("%w %s, only RSS feeds can be added", ErrUnsupportedFormat, format)
+}
+
+//detectFormat returns the format of the document by its root element and the version attribute.
+func detectFormat(body []byte) (string, string) {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return FormatJSON, ""
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(trimmed))
+	decoder.Strict = false
+	decoder.CharsetReader = charset.NewReaderLabel
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		var version string
+		for _, a := range start.Attr {
+			if a.Name.Local == "version" {
+				version = a.Value
+			}
+		}
+
+		switch strings.ToLower(start.Name.Local) {
+		case "rss":
+			return FormatRSS, version
+		case "feed":
+			return FormatAtom, version
+		case "rdf":
+			return FormatRDF, version
+		case "html":
+			return FormatHTML, version
+		default:
+			return FormatUnknown, version
+		}
+	}
+
+	if bytes.Contains(bytes.ToLower(trimmed), []byte("<html")) {
+		return FormatHTML, ""
+	}
+
+	return FormatUnknown, ""
+}
+
+//feedEncoding returns the name of the encoding decodeRSS uses for the body
+//and warns when the Content-Type header and the XML prolog disagree.
+func feedEncoding(body []byte, contentType string, warnings *[]string) string {
+	header := httpCharset(contentType)
+	prolog := prologEncoding(body)
+
+	var headerName, prologName string
+	if header != "" {
+		if _, headerName = charset.Lookup(header); headerName == "" {
+			headerName = header
+		}
+	}
+	if prolog != "" {
+		if _, prologName = charset.Lookup(prolog); prologName == "" {
+			prologName = prolog
+		}
+	}
+
+	if headerName != "" && prologName != "" && headerName != prologName {
+		*warnings = append(*warnings, fmt.Sprintf("charset %s from Content-Type overrides encoding %s from the XML prolog", headerName, prologName))
+	}
+
+	switch {
+	case headerName != "":
+		return headerName
+	case prologName != "":
+		return prologName
+	default:
+		return "utf-8"
+	}
+}
+
+//prologEncoding returns the encoding declared in the XML prolog.
+func prologEncoding(body []byte) string {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(body, []byte("<?xml")) {
+		return ""
+	}
+
+	end := bytes.Index(body, []byte("?>"))
+	if end < 0 {
+		return ""
+	}
+
+	for _, field := range strings.Fields(string(body[len("<?xml"):end])) {
+		if strings.HasPrefix(field, "encoding=") {
+			return strings.Trim(strings.TrimPrefix(field, "encoding="), `"'`)
+		}
+	}
+
+	return ""
+}
+
+//channelInfo returns the metadata of the channel and its problems.
+func channelInfo(channel Channel) (*ChannelInfo, []string) {
+	var warnings []string
+
+	info := &ChannelInfo{
+		Title:       strings.TrimSpace(channel.Title),
+		Link:        channel.Link(),
+		Description: strings.TrimSpace(channel.Description),
+		Language:    strings.TrimSpace(channel.Language),
+		Image:       strings.TrimSpace(channel.Image.URL),
+	}
+
+	if info.Title == "" {
+		warnings = append(warnings, "the channel has no title")
+	}
+
+	if date := strings.TrimSpace(channel.LastBuildDate); date != "" {
+		lastBuildDate, err := parsePubTime(date)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("unparseable lastBuildDate %q", date))
+		}
+		info.LastBuildDate = lastBuildDate
+	}
+
+	return info, warnings
+}
+
+//itemWarnings lists the problems of the item, dateErr is the error of convertItem.
+func itemWarnings(item Item, post *database.Post, dateErr error) []string {
+	warnings := []string{}
+
+	if strings.TrimSpace(item.Title) == "" {
+		warnings = append(warnings, "missing title")
+	}
+
+	link := strings.TrimSpace(item.Link)
+	if link == "" {
+		warnings = append(warnings, "missing link")
+	} else if u, err := url.Parse(link); err != nil || !u.IsAbs() {
+		warnings = append(warnings, fmt.Sprintf("link %q is not an absolute URL", link))
+	}
+
+	if post.GUID == "" && link == "" {
+		warnings = append(warnings, "no guid and no link, the item can not be deduplicated")
+	}
+
+	switch {
+	case strings.TrimSpace(item.PubTime) == "":
+		warnings = append(warnings, "missing pubDate")
+	case dateErr != nil:
+		warnings = append(warnings, fmt.Sprintf("unparseable pubDate %q", item.PubTime))
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"title", item.Title},
+		{"description", item.Content},
+		{"author", post.Author},
+	} {
+		if problem := encodingProblem(field.value); problem != "" {
+			warnings = append(warnings, fmt.Sprintf("%s %s, the encoding is probably wrong", field.name, problem))
+		}
+	}
+
+	return warnings
+}
+
+//encodingProblem detects the text decoded with a wrong charset: replacement characters
+//or UTF-8 bytes read as a single-byte encoding, like "ÐŸÑ€Ð¸Ð²ÐµÑ‚" instead of "Привет".
+func encodingProblem(text string) string {
+	if strings.ContainsRune(text, utf8.RuneError) {
+		return "contains replacement characters"
+	}
+
+	runes := []rune(text)
+	for i := 0; i+1 < len(runes); i++ {
+		switch runes[i] {
+		case 'Ã', 'Â', 'Ð', 'Ñ':
+			if next := runes[i+1]; (next >= 0x80 && next <= 0xbf) || strings.ContainsRune("€‚ƒ„…†‡ˆ‰Š‹ŒŽ‘’“”•–—˜™š›œžŸ", next) {
+				return "looks like UTF-8 read as a single-byte encoding"
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,160 @@
+package rss
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/MarySmirnova/news_reader/internal/config"
+	"github.com/MarySmirnova/news_reader/internal/database"
+	"github.com/MarySmirnova/news_reader/internal/netguard"
+)
+
+const previewFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom">
+  <channel>
+    <title>Example news</title>
+    <atom:link href="https://example.com/rss" rel="self" type="application/rss+xml"/>
+    <link>https://example.com/</link>
+    <description>News of the example</description>
+    <language>en</language>
+    <image><url>https://example.com/logo.png</url><title>Example</title><link>https://example.com/</link></image>
+    <lastBuildDate>Mon, 18 Apr 2022 12:00:00 GMT</lastBuildDate>
+    <item>
+      <title>Good post</title>
+      <description>&lt;p&gt;Text&lt;/p&gt;</description>
+      <pubDate>Mon, 18 Apr 2022 10:00:00 GMT</pubDate>
+      <link>https://example.com/good</link>
+    </item>
+    <item>
+      <title></title>
+      <description>No link and a bad date</description>
+      <pubDate>18.04.2022</pubDate>
+    </item>
+    <item>
+      <title>ÐŸÑ€Ð¸Ð²ÐµÑ‚</title>
+      <pubDate>Mon, 18 Apr 2022 11:00:00 GMT</pubDate>
+      <link>/relative</link>
+    </item>
+  </channel>
+</rss>`
+
+func TestNewsParser_Preview(t *testing.T) {
+	koi8, err := os.ReadFile("testdata/rss-koi8-r.xml")
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rss":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			_, _ = w.Write([]byte(previewFeed))
+		case "/koi8":
+			w.Header().Set("Content-Type", "text/xml; charset=koi8-r")
+			_, _ = w.Write(koi8)
+		case "/atom":
+			w.Header().Set("Content-Type", "application/atom+xml")
+			_, _ = w.Write([]byte(`<?xml version="1.0"?><feed xmlns="http://www.w3.org/2005/Atom"><title>Atom</title></feed>`))
+		case "/page":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<!DOCTYPE html><html><head><title>Page</title></head><body><p>Text<br></p></body></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	db := database.NewMemoryDB()
+	p := NewNewsParser(config.RSS{Fetcher: config.Fetcher{AllowPrivate: true}}, db)
+	ctx := context.Background()
+
+	preview, err := p.Preview(ctx, server.URL+"/rss")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, FormatRSS, preview.Format)
+	assert.Equal(t, "2.0", preview.Version)
+	assert.Equal(t, "utf-8", preview.Encoding)
+	assert.Equal(t, "", preview.Error)
+	assert.Equal(t, &ChannelInfo{
+		Title:         "Example news",
+		Link:          "https://example.com/",
+		Description:   "News of the example",
+		Language:      "en",
+		Image:         "https://example.com/logo.png",
+		LastBuildDate: 1650283200,
+	}, preview.Channel)
+	assert.Equal(t, []string{"some items have no valid pubDate, the poller rejects the whole feed"}, preview.Warnings)
+
+	if assert.Equal(t, 3, len(preview.Items)) {
+		assert.Equal(t, "Good post", preview.Items[0].Post.Title)
+		assert.Equal(t, "<p>Text</p>", preview.Items[0].Post.Content)
+		assert.Equal(t, int64(1650276000), preview.Items[0].Post.PubTime)
+		assert.Empty(t, preview.Items[0].Warnings)
+
+		assert.Equal(t, int64(0), preview.Items[1].Post.PubTime)
+		assert.Equal(t, []string{
+			"missing title",
+			"missing link",
+			"no guid and no link, the item can not be deduplicated",
+			`unparseable pubDate "18.04.2022"`,
+		}, preview.Items[1].Warnings)
+
+		assert.Equal(t, []string{
+			`link "/relative" is not an absolute URL`,
+			"title looks like UTF-8 read as a single-byte encoding, the encoding is probably wrong",
+		}, preview.Items[2].Warnings)
+	}
+
+	//nothing is stored
+	amount, err := db.NewsAmount(database.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, amount)
+
+	preview, err = p.Preview(ctx, server.URL+"/koi8")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "koi8-r", preview.Encoding)
+		assert.Equal(t, "", preview.Error)
+		if assert.NotEmpty(t, preview.Items) {
+			assert.Equal(t, "Привет, мир! Ёлки и ёжики", preview.Items[0].Post.Title)
+		}
+	}
+
+	preview, err = p.Preview(ctx, server.URL+"/atom")
+	if assert.Nil(t, err) {
+		assert.Equal(t, FormatAtom, preview.Format)
+		assert.Equal(t, "unsupported format atom, only RSS feeds can be added", preview.Error)
+		assert.Empty(t, preview.Items)
+	}
+
+	preview, err = p.Preview(ctx, server.URL+"/page")
+	if assert.Nil(t, err) {
+		assert.Equal(t, FormatHTML, preview.Format)
+		assert.NotEmpty(t, preview.Error)
+	}
+
+	_, err = p.Preview(ctx, server.URL+"/missing")
+	assert.NotNil(t, err)
+
+	_, err = p.Preview(ctx, "file:///etc/passwd")
+	assert.ErrorIs(t, err, ErrInvalidLink)
+
+	//by default the links of the users do not reach the internal addresses
+	p = NewNewsParser(config.RSS{}, db)
+	_, err = p.Preview(ctx, server.URL+"/rss")
+	assert.ErrorIs(t, err, netguard.ErrPrivateAddress)
+}
+
+func TestFeedEncoding(t *testing.T) {
+	var warnings []string
+
+	assert.Equal(t, "utf-8", feedEncoding([]byte(`<rss/>`), "", &warnings))
+	assert.Equal(t, "windows-1251", feedEncoding([]byte(`<?xml version="1.0" encoding="cp1251"?><rss/>`), "text/xml", &warnings))
+	assert.Empty(t, warnings)
+
+	assert.Equal(t, "koi8-r", feedEncoding([]byte(`<?xml version="1.0" encoding="windows-1251"?><rss/>`), "text/xml; charset=koi8-r", &warnings))
+	assert.Equal(t, []string{"charset koi8-r from Content-Type overrides encoding windows-1251 from the XML prolog"}, warnings)
+}
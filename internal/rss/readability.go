@@ -0,0 +1,278 @@
+package rss
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+//ErrNoArticle is returned when the page has no block of text that looks like an article.
+var ErrNoArticle = errors.New("article content not found")
+
+var (
+	unlikelyCandidates = regexp.MustCompile(`(?i)banner|breadcrumb|combx|comment|community|disqus|extra|foot|header|menu|modal|related|remark|rss|share|shoutbox|sidebar|skyscraper|social|sponsor|ad-break|agegate|pagination|pager|popup|subscribe|tags`)
+	maybeCandidate     = regexp.MustCompile(`(?i)and|article|body|column|main|shadow|content`)
+	positiveWeight     = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|post|text|blog|story`)
+	negativeWeight     = regexp.MustCompile(`(?i)hidden|banner|combx|comment|com-|contact|foot|footer|footnote|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget`)
+)
+
+//noiseTags never hold the article text.
+var noiseTags = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Nav:      true,
+	atom.Header:   true,
+	atom.Footer:   true,
+	atom.Aside:    true,
+	atom.Form:     true,
+	atom.Iframe:   true,
+	atom.Button:   true,
+	atom.Select:   true,
+	atom.Svg:      true,
+}
+
+//minParagraphLength is the shortest paragraph that adds to the score of its ancestors.
+const minParagraphLength = 25
+
+//extractArticle finds the main content of the page with a readability-style scoring:
+//paragraphs give points to their parent and grandparent depending on the amount of text and commas,
+//class names and link density adjust the points, the best element with its related siblings is the article.
+//The result is not sanitized.
+func extractArticle(r io.Reader) (string, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", err
+	}
+
+	removeNoise(doc)
+
+	scores := make(map[*html.Node]float64)
+	var candidates []*html.Node
+
+	addScore := func(node *html.Node, score float64) {
+		if node == nil || node.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[node]; !ok {
+			scores[node] = initialScore(node)
+			candidates = append(candidates, node)
+		}
+		scores[node] += score
+	}
+
+	walk(doc, func(node *html.Node) {
+		switch node.DataAtom {
+		case atom.P, atom.Pre, atom.Td, atom.Blockquote:
+		default:
+			return
+		}
+
+		text := textContent(node)
+		if len([]rune(text)) < minParagraphLength {
+			return
+		}
+
+		score := 1 + float64(strings.Count(text, ",")+strings.Count(text, "，"))
+		score += minFloat(float64(len([]rune(text)))/100, 3)
+
+		addScore(node.Parent, score)
+		if node.Parent != nil {
+			addScore(node.Parent.Parent, score/2)
+		}
+	})
+
+	var top *html.Node
+	for _, candidate := range candidates {
+		scores[candidate] *= 1 - linkDensity(candidate)
+		if top == nil || scores[candidate] > scores[top] {
+			top = candidate
+		}
+	}
+
+	if top == nil {
+		return "", ErrNoArticle
+	}
+
+	var buf bytes.Buffer
+	for _, node := range articleNodes(top, scores) {
+		if err = html.Render(&buf, node); err != nil {
+			return "", err
+		}
+	}
+
+	return buf.String(), nil
+}
+
+//articleNodes returns the top candidate and those of its siblings that look like a part of the article.
+func articleNodes(top *html.Node, scores map[*html.Node]float64) []*html.Node {
+	if top.Parent == nil {
+		return []*html.Node{top}
+	}
+
+	threshold := maxFloat(10, scores[top]*0.2)
+
+	var nodes []*html.Node
+	for sibling := top.Parent.FirstChild; sibling != nil; sibling = sibling.NextSibling {
+		if sibling.Type != html.ElementNode {
+			continue
+		}
+
+		if sibling == top {
+			nodes = append(nodes, sibling)
+			continue
+		}
+
+		if score, ok := scores[sibling]; ok && score >= threshold {
+			nodes = append(nodes, sibling)
+			continue
+		}
+
+		if sibling.DataAtom == atom.P {
+			text := textContent(sibling)
+			density := linkDensity(sibling)
+
+			if (len([]rune(text)) > 80 && density < 0.25) || (density == 0 && strings.Contains(text, ". ")) {
+				nodes = append(nodes, sibling)
+			}
+		}
+	}
+
+	return nodes
+}
+
+//removeNoise removes the elements that cannot be a part of the article.
+func removeNoise(node *html.Node) {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+
+		if child.Type == html.CommentNode || (child.Type == html.ElementNode && isNoise(child)) {
+			node.RemoveChild(child)
+		} else {
+			removeNoise(child)
+		}
+
+		child = next
+	}
+}
+
+func isNoise(node *html.Node) bool {
+	if noiseTags[node.DataAtom] {
+		return true
+	}
+
+	if node.DataAtom == atom.Body || node.DataAtom == atom.Article || node.DataAtom == atom.Main {
+		return false
+	}
+
+	match := attr(node, "class") + " " + attr(node, "id")
+	return unlikelyCandidates.MatchString(match) && !maybeCandidate.MatchString(match)
+}
+
+//initialScore gives points by the element kind and its class and id.
+func initialScore(node *html.Node) float64 {
+	var score float64
+
+	switch node.DataAtom {
+	case atom.Article:
+		score = 10
+	case atom.Div:
+		score = 5
+	case atom.Pre, atom.Td, atom.Blockquote:
+		score = 3
+	case atom.Address, atom.Ol, atom.Ul, atom.Dl, atom.Dd, atom.Dt, atom.Li, atom.Form:
+		score = -3
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Th:
+		score = -5
+	}
+
+	for _, value := range []string{attr(node, "class"), attr(node, "id")} {
+		if value == "" {
+			continue
+		}
+		if negativeWeight.MatchString(value) {
+			score -= 25
+		}
+		if positiveWeight.MatchString(value) {
+			score += 25
+		}
+	}
+
+	return score
+}
+
+//linkDensity is the share of the element text inside links.
+func linkDensity(node *html.Node) float64 {
+	length := len([]rune(textContent(node)))
+	if length == 0 {
+		return 0
+	}
+
+	var links int
+	walk(node, func(n *html.Node) {
+		if n.DataAtom == atom.A {
+			links += len([]rune(textContent(n)))
+		}
+	})
+
+	return float64(links) / float64(length)
+}
+
+//walk calls fn for the element nodes of the tree in document order.
+func walk(node *html.Node, fn func(*html.Node)) {
+	if node.Type == html.ElementNode {
+		fn(node)
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		walk(child, fn)
+	}
+}
+
+//textContent returns the text of the node with collapsed whitespace.
+func textContent(node *html.Node) string {
+	var b strings.Builder
+
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			b.WriteString(" ")
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			collect(child)
+		}
+	}
+	collect(node)
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func attr(node *html.Node, key string) string {
+	for _, a := range node.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+
+	return ""
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
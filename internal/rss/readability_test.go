@@ -0,0 +1,38 @@
+package rss
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractArticle(t *testing.T) {
+	f, err := os.Open("testdata/article.html")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer f.Close()
+
+	article, err := extractArticle(f)
+	assert.Nil(t, err)
+
+	base, _ := url.Parse("https://example.com/posts/1")
+	content, text := sanitizeHTML(article, base)
+
+	assert.Contains(t, text, "Goroutines are lightweight threads")
+	assert.Contains(t, text, "The scheduler multiplexes goroutines")
+	assert.Contains(t, content, `<img src="https://example.com/images/scheduler.png" alt="Scheduler"/>`)
+	assert.Contains(t, content, `href="https://example.com/posts/scheduler"`)
+
+	for _, noise := range []string{"window.analytics", "Popular", "Ten things", "Great article", "Copyright", "Hubs"} {
+		assert.NotContains(t, text, noise)
+	}
+}
+
+func TestExtractArticle_NoArticle(t *testing.T) {
+	_, err := extractArticle(strings.NewReader(`<html><body><nav><a href="/">Home</a></nav><p>Short</p></body></html>`))
+	assert.ErrorIs(t, err, ErrNoArticle)
+}
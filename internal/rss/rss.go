@@ -1,135 +1,503 @@
 package rss
 
 import (
+	"bytes"
 	"context"
-	"encoding/xml"
-	"io/ioutil"
-	"net/http"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/MarySmirnova/news_reader/internal/config"
 	"github.com/MarySmirnova/news_reader/internal/database"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html/charset"
 )
 
 type storage interface {
 	WriteNews([]*database.Post) error
+	PendingFullText(feed string, n int) ([]*database.Post, error)
+	WriteFullText(id int, text *database.FullText) error
+	WriteFeed(feed *database.Feed) error
+	GetFeed(url string) (*database.Feed, error)
+	WriteFeedIcon(feedURL string, icon *database.FeedIcon) error
+	hostStore
 }
 
+//fullTextBatch is the maximum number of articles of one feed downloaded per poll.
+const fullTextBatch = 20
+
+//Accept headers of the feed and article requests.
+const (
+	acceptFeed    = "application/rss+xml, application/xml;q=0.9, text/xml;q=0.8, */*;q=0.5"
+	acceptArticle = "text/html, application/xhtml+xml;q=0.9, */*;q=0.5"
+)
+
+//defaultWorkers is the number of feeds polled at once when it is not configured.
+const defaultWorkers = 4
+
 type NewsParser struct {
 	db            storage
-	rssLinks      []string
+	fetcher       *Fetcher
+	linkFetcher   *Fetcher
+	feeds         []config.Feed
 	requestPeriod time.Duration
-
-	errorChan chan error
-	postChan  chan []*database.Post
+	workers       int
+	handlers      []func(posts []*database.Post)
 }
 
 //NewNewsParser creates a new instance NewsParser.
 func NewNewsParser(cfg config.RSS, db storage) *NewsParser {
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+
+	fetcher := NewFetcher(cfg.Fetcher, db)
+
 	return &NewsParser{
 		db:            db,
-		rssLinks:      cfg.Links,
+		fetcher:       fetcher,
+		linkFetcher:   fetcher.Guarded(cfg.Fetcher),
+		feeds:         cfg.Feeds,
 		requestPeriod: time.Duration(cfg.RequestPeriod) * time.Minute,
-		errorChan:     make(chan error),
-		postChan:      make(chan []*database.Post),
+		workers:       workers,
 	}
 }
 
+//OnNewPosts registers the handler called with the posts inserted by the poll right after they are written.
+//The handlers are called by the poll workers and must not block for long.
+func (p *NewsParser) OnNewPosts(handler func(posts []*database.Post)) {
+	p.handlers = append(p.handlers, handler)
+}
+
 //Start starts a process that every "requestPeriod" minutes polls all links specified in the configuration.
+//On cancellation of ctx the requests in flight are aborted and Start returns after all workers have stopped.
 func (p *NewsParser) Start(ctx context.Context) error {
 	for {
-		posts := p.readAllRSS()
-		err := p.db.WriteNews(posts)
-		if err != nil {
-			log.WithError(err).Error("fail to write data to database")
-		}
+		p.readAllRSS(ctx)
+
+		timer := time.NewTimer(p.requestPeriod)
 
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			return ctx.Err()
-		case <-time.After(p.requestPeriod):
+		case <-timer.C:
 		}
 	}
 }
 
-func (p *NewsParser) readAllRSS() []*database.Post {
-	rssCount := len(p.rssLinks)
+//notify passes the inserted posts, the ones that got ids, to the handlers.
+func (p *NewsParser) notify(posts []*database.Post) {
+	inserted := make([]*database.Post, 0, len(posts))
+	for _, post := range posts {
+		if post.ID != 0 {
+			inserted = append(inserted, post)
+		}
+	}
 
-	for _, link := range p.rssLinks {
-		go p.readRSS(link)
+	if len(inserted) == 0 {
+		return
 	}
 
-	var posts []*database.Post
+	for _, handler := range p.handlers {
+		handler(inserted)
+	}
+}
 
-	for rssCount > 0 {
-		select {
-		case err := <-p.errorChan:
-			log.WithError(err).Error("failed to read rss")
+//readAllRSS polls all feeds with a pool of workers, every feed is written to the storage as soon as it is read.
+//It returns when all feeds are processed or ctx is cancelled and the workers have stopped.
+func (p *NewsParser) readAllRSS(ctx context.Context) {
+	feeds := make(chan config.Feed)
 
-		case post := <-p.postChan:
-			posts = append(posts, post...)
-		}
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-		rssCount--
+			for feed := range feeds {
+				p.processFeed(ctx, feed)
+			}
+		}()
 	}
 
-	return posts
+send:
+	for _, feed := range p.feeds {
+		select {
+		case feeds <- feed:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(feeds)
+
+	wg.Wait()
 }
 
-func (p *NewsParser) readRSS(link string) {
+//processFeed reads the feed, writes its posts and channel metadata,
+//refreshes the site icon and downloads the full texts, if the feed needs them.
+func (p *NewsParser) processFeed(ctx context.Context, feed config.Feed) {
+	if ctx.Err() != nil {
+		return
+	}
 
-	req, err := http.NewRequest(http.MethodGet, link, nil)
+	posts, channel, err := p.readRSS(ctx, feed.URL)
 	if err != nil {
-		p.errorChan <- err
+		if ctx.Err() == nil {
+			log.WithError(err).WithField("feed", feed.URL).Error("failed to read rss")
+		}
 		return
 	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		p.errorChan <- err
+	if err = p.db.WriteNews(posts); err != nil {
+		log.WithError(err).WithField("feed", feed.URL).Error("fail to write data to database")
 		return
 	}
-	defer resp.Body.Close()
 
-	text, _ := ioutil.ReadAll(resp.Body)
+	p.notify(posts)
+
+	if err = p.db.WriteFeed(channel); err != nil {
+		log.WithError(err).WithField("feed", feed.URL).Error("failed to write feed metadata")
+	} else {
+		p.updateIcon(ctx, channel)
+	}
 
-	var rss RSS
+	if feed.FullText {
+		p.fetchFullTexts(ctx, feed)
+	}
+}
 
-	err = xml.Unmarshal(text, &rss)
+//readRSS downloads the feed and returns its posts and the channel metadata.
+func (p *NewsParser) readRSS(ctx context.Context, link string) ([]*database.Post, *database.Feed, error) {
+	resp, err := p.fetcher.Fetch(ctx, link, acceptFeed)
 	if err != nil {
-		p.errorChan <- err
-		return
+		return nil, nil, err
 	}
 
-	posts, err := p.convertDataModel(rss.Channel.Items)
+	rss, err := decodeRSS(bytes.NewReader(resp.Body), resp.ContentType)
 	if err != nil {
-		p.errorChan <- err
-		return
+		return nil, nil, err
 	}
 
-	p.postChan <- posts
+	posts, err := p.convertDataModel(link, rss.Channel.Items)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, _ := channelInfo(rss.Channel)
+
+	return posts, &database.Feed{
+		URL:           link,
+		Title:         info.Title,
+		Link:          info.Link,
+		Description:   info.Description,
+		Language:      info.Language,
+		Image:         info.Image,
+		LastBuildDate: info.LastBuildDate,
+		FetchedAt:     time.Now().Unix(),
+	}, nil
 }
 
-func (p *NewsParser) convertDataModel(items []Item) ([]*database.Post, error) {
+func (p *NewsParser) convertDataModel(link string, items []Item) ([]*database.Post, error) {
 	posts := make([]*database.Post, 0, len(items))
+	fetchedAt := time.Now().Unix()
 
 	for _, item := range items {
-		var post database.Post
-
-		post.Title = item.Title
-		post.Content = item.Content
-		post.Link = item.Link
-
-		dateLayout := "Mon, 2 Jan 2006 15:04:05 MST"
-		pubTime, err := time.Parse(dateLayout, item.PubTime)
+		post, err := p.convertItem(link, item, fetchedAt)
 		if err != nil {
 			return nil, err
 		}
-		post.PubTime = pubTime.Unix()
 
-		posts = append(posts, &post)
+		posts = append(posts, post)
 	}
 	return posts, nil
 }
+
+//convertItem converts the feed item to a post. If the publication date can not be parsed,
+//the post is returned with zero PubTime together with the error.
+func (p *NewsParser) convertItem(link string, item Item, fetchedAt int64) (*database.Post, error) {
+	var post database.Post
+
+	post.Title = item.Title
+	post.Content, post.PlainText = sanitizeHTML(item.Content, p.baseURL(link, item))
+	post.Link = item.Link
+	post.Feed = link
+	post.GUID = p.guid(item)
+	post.Author = p.author(item)
+	post.Categories = p.categories(item)
+	post.Comments = strings.TrimSpace(item.Comments)
+	post.Enclosure = p.enclosure(item)
+	post.Media = p.media(item)
+	post.FetchedAt = fetchedAt
+
+	pubTime, err := parsePubTime(item.PubTime)
+	if err != nil {
+		return &post, err
+	}
+	post.PubTime = pubTime
+
+	return &post, nil
+}
+
+//fetchFullTexts downloads the articles of the new posts of the feed.
+func (p *NewsParser) fetchFullTexts(ctx context.Context, feed config.Feed) {
+	posts, err := p.db.PendingFullText(feed.URL, fullTextBatch)
+	if err != nil {
+		log.WithError(err).WithField("feed", feed.URL).Error("failed to get posts without full text")
+		return
+	}
+
+	for _, post := range posts {
+		if ctx.Err() != nil {
+			return
+		}
+
+		text, err := p.fullText(ctx, post.Link)
+		if err != nil {
+			//temporary errors are not saved, the article is downloaded again on the next poll
+			if ctx.Err() == nil {
+				log.WithError(err).WithField("link", post.Link).Warn("failed to download article")
+			}
+			continue
+		}
+
+		if err = p.db.WriteFullText(post.ID, text); err != nil {
+			log.WithError(err).WithField("link", post.Link).Error("failed to write full text")
+		}
+	}
+}
+
+//fullText downloads the article and extracts its main content.
+//Errors that will not go away on retry, like 404 or a page without an article, are returned in FullText.Error.
+func (p *NewsParser) fullText(ctx context.Context, link string) (*database.FullText, error) {
+	text := &database.FullText{
+		FetchedAt: time.Now().Unix(),
+	}
+
+	base, err := url.Parse(link)
+	if err != nil || !base.IsAbs() {
+		text.Error = fmt.Sprintf("invalid article link %q", link)
+		return text, nil
+	}
+
+	resp, err := p.fetcher.Fetch(ctx, link, acceptArticle)
+	if err != nil {
+		var statusErr *StatusError
+		if (errors.As(err, &statusErr) && !statusErr.Temporary()) || errors.Is(err, ErrBodyTooLarge) || errors.Is(err, ErrDisallowed) {
+			text.Error = err.Error()
+			return text, nil
+		}
+		return nil, err
+	}
+
+	//the page encoding is taken from the header, a BOM or the meta tags
+	body, err := charset.NewReader(bytes.NewReader(resp.Body), resp.ContentType)
+	if err != nil {
+		text.Error = err.Error()
+		return text, nil
+	}
+
+	article, err := extractArticle(body)
+	if err != nil {
+		text.Error = err.Error()
+		return text, nil
+	}
+
+	text.Content, text.PlainText = sanitizeHTML(article, resp.URL)
+
+	return text, nil
+}
+
+//guid returns the item guid if it can identify the item across polls.
+//A permalink guid is the item URL, any other non-empty guid must be unique and permanent by the RSS spec.
+//An empty result makes the storage deduplicate the post by its link.
+func (p *NewsParser) guid(item Item) string {
+	guid := strings.TrimSpace(item.GUID.Value)
+	if guid == "" {
+		return ""
+	}
+
+	if strings.EqualFold(item.GUID.IsPermaLink, "false") {
+		return guid
+	}
+
+	//a permalink guid must be an absolute URL, otherwise the feed generates it and it may change
+	if u, err := url.Parse(guid); err != nil || !u.IsAbs() {
+		return ""
+	}
+
+	return guid
+}
+
+//baseURL returns the item link resolved against the feed link, relative URLs of the content are resolved against it.
+func (p *NewsParser) baseURL(link string, item Item) *url.URL {
+	base, err := url.Parse(link)
+	if err != nil {
+		base = nil
+	}
+
+	itemLink, err := url.Parse(strings.TrimSpace(item.Link))
+	if err != nil || itemLink.String() == "" {
+		return base
+	}
+
+	if base == nil {
+		return itemLink
+	}
+
+	return base.ResolveReference(itemLink)
+}
+
+func (p *NewsParser) author(item Item) string {
+	if author := strings.TrimSpace(item.Author); author != "" {
+		return author
+	}
+
+	return strings.TrimSpace(item.Creator)
+}
+
+func (p *NewsParser) categories(item Item) []string {
+	categories := make([]string, 0, len(item.Categories))
+
+	for _, category := range item.Categories {
+		if category = strings.TrimSpace(category); category != "" {
+			categories = append(categories, category)
+		}
+	}
+
+	return categories
+}
+
+//enclosure returns the first enclosure of the item.
+func (p *NewsParser) enclosure(item Item) *database.Enclosure {
+	for _, enclosure := range item.Enclosures {
+		if enclosure.URL == "" {
+			continue
+		}
+
+		return &database.Enclosure{
+			URL:    enclosure.URL,
+			Type:   enclosure.Type,
+			Length: parseInt64(enclosure.Length),
+		}
+	}
+
+	return nil
+}
+
+//media collects the attachments of the item: enclosures, media:content and media:thumbnail,
+//also inside media:group. An URL met twice is kept only the first time.
+func (p *NewsParser) media(item Item) []database.Media {
+	var media []database.Media
+	seen := make(map[string]struct{})
+
+	add := func(m database.Media) {
+		m.URL = strings.TrimSpace(m.URL)
+		if m.URL == "" {
+			return
+		}
+		if _, ok := seen[m.URL]; ok {
+			return
+		}
+		seen[m.URL] = struct{}{}
+
+		m.Type = mediaType(m.Type)
+		m.Medium = medium(m.Medium, m.Type)
+		media = append(media, m)
+	}
+
+	var thumbnails []MediaThumbnail
+
+	addContents := func(contents []MediaContent) {
+		for _, c := range contents {
+			add(database.Media{
+				URL:    c.URL,
+				Type:   c.Type,
+				Medium: c.Medium,
+				Source: database.MediaSourceContent,
+				Length: parseInt64(c.FileSize),
+				Width:  int(parseInt64(c.Width)),
+				Height: int(parseInt64(c.Height)),
+			})
+			thumbnails = append(thumbnails, c.Thumbnails...)
+		}
+	}
+
+	for _, enclosure := range item.Enclosures {
+		add(database.Media{
+			URL:    enclosure.URL,
+			Type:   enclosure.Type,
+			Source: database.MediaSourceEnclosure,
+			Length: parseInt64(enclosure.Length),
+		})
+	}
+
+	addContents(item.MediaContents)
+	for _, group := range item.MediaGroups {
+		addContents(group.Contents)
+		thumbnails = append(thumbnails, group.Thumbnails...)
+	}
+	thumbnails = append(thumbnails, item.MediaThumbnails...)
+
+	//thumbnails go last, the attachments themselves are more important
+	for _, t := range thumbnails {
+		add(database.Media{
+			URL:    t.URL,
+			Medium: "image",
+			Source: database.MediaSourceThumbnail,
+			Width:  int(parseInt64(t.Width)),
+			Height: int(parseInt64(t.Height)),
+		})
+	}
+
+	return media
+}
+
+//parsePubTime parses the RFC 1123 date of the feed to unix time.
+func parsePubTime(value string) (int64, error) {
+	dateLayout := "Mon, 2 Jan 2006 15:04:05 MST"
+	pubTime, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return pubTime.Unix(), nil
+}
+
+//mediaType returns the MIME type without parameters in lower case.
+func mediaType(value string) string {
+	if t, _, err := mime.ParseMediaType(value); err == nil {
+		return t
+	}
+
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+//medium returns the medium attribute of media:content or guesses it from the MIME type.
+func medium(value string, mimeType string) string {
+	if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+		return value
+	}
+
+	switch kind := strings.SplitN(mimeType, "/", 2)[0]; kind {
+	case "image", "audio", "video":
+		return kind
+	case "":
+		return ""
+	default:
+		return "document"
+	}
+}
+
+//parseInt64 parses optional numeric attributes, they are often missing or zero and are informational only.
+func parseInt64(value string) int64 {
+	n, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return n
+}
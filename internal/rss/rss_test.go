@@ -1,7 +1,15 @@
 package rss
 
 import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/MarySmirnova/news_reader/internal/config"
 	"github.com/MarySmirnova/news_reader/internal/database"
@@ -10,14 +18,246 @@ import (
 
 func TestNewsParser_readAllRSS(t *testing.T) {
 	db := database.NewMemoryDB()
-	links := []string{"https://habr.com/ru/rss/hub/go/all/?fl=ru", "https://habr.com/ru/rss/best/daily/?fl=ru"}
+	feeds := []config.Feed{{URL: "https://habr.com/ru/rss/hub/go/all/?fl=ru"}, {URL: "https://habr.com/ru/rss/best/daily/?fl=ru"}}
 
 	p := NewNewsParser(config.RSS{
-		Links:         links,
+		Feeds:         feeds,
 		RequestPeriod: 1,
 	}, db)
 
-	posts := p.readAllRSS()
+	p.readAllRSS(context.Background())
 
-	assert.True(t, len(posts) > 0)
+	amount, err := db.NewsAmount(database.Filter{})
+	assert.Nil(t, err)
+	assert.True(t, amount > 0)
+}
+
+func TestNewsParser_convertDataModel(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/rss.xml")
+	assert.Nil(t, err)
+
+	var rss RSS
+	err = xml.Unmarshal(data, &rss)
+	assert.Nil(t, err)
+
+	p := NewNewsParser(config.RSS{}, database.NewMemoryDB())
+
+	feed := "https://example.com/rss"
+	posts, err := p.convertDataModel(feed, rss.Channel.Items)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 3, len(posts)) {
+		return
+	}
+
+	first := posts[0]
+	assert.Equal(t, "Permalink guid", first.Title)
+	assert.Equal(t, "<p>First post</p>", first.Content)
+	assert.Equal(t, "First post", first.PlainText)
+	assert.Equal(t, int64(1650276000), first.PubTime)
+	assert.Equal(t, feed, first.Feed)
+	assert.Equal(t, "https://example.com/posts/1", first.GUID)
+	assert.Equal(t, "gopher", first.Author)
+	assert.Equal(t, []string{"Go", "Postgres"}, first.Categories)
+	assert.Equal(t, "https://example.com/posts/1#comments", first.Comments)
+	assert.Equal(t, &database.Enclosure{URL: "https://example.com/podcast/1.mp3", Type: "audio/mpeg", Length: 12345}, first.Enclosure)
+	assert.Equal(t, []database.Media{
+		{URL: "https://example.com/podcast/1.mp3", Type: "audio/mpeg", Medium: "audio", Source: database.MediaSourceEnclosure, Length: 12345},
+	}, first.Media)
+	assert.True(t, first.FetchedAt > 0)
+
+	second := posts[1]
+	assert.Equal(t, "post-2", second.GUID)
+	assert.Equal(t, "editor@example.com (Editor)", second.Author)
+	assert.Empty(t, second.Categories)
+	assert.Equal(t, int64(0), second.Enclosure.Length)
+	assert.Equal(t, []database.Media{
+		//the media:content with the same URL is skipped
+		{URL: "https://example.com/images/2.jpg", Type: "image/jpeg", Medium: "image", Source: database.MediaSourceEnclosure},
+		{URL: "https://example.com/video/2.mp4", Type: "video/mp4", Medium: "video", Source: database.MediaSourceContent, Length: 2048, Width: 1920, Height: 1080},
+		{URL: "https://example.com/docs/2.pdf", Type: "application/pdf", Medium: "document", Source: database.MediaSourceContent},
+		{URL: "https://example.com/video/2.jpg", Medium: "image", Source: database.MediaSourceThumbnail, Width: 320, Height: 180},
+	}, second.Media)
+
+	//not an absolute URL, deduplicated by link
+	assert.Equal(t, "", posts[2].GUID)
+	assert.Nil(t, posts[2].Enclosure)
+	assert.Empty(t, posts[2].Media)
+}
+
+func TestNewsParser_fetchFullTexts(t *testing.T) {
+	article, err := ioutil.ReadFile("testdata/article.html")
+	assert.Nil(t, err)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		switch r.URL.Path {
+		case "/article":
+			_, _ = w.Write(article)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	db := database.NewMemoryDB()
+	feed := server.URL + "/rss"
+
+	posts := []*database.Post{
+		{Title: "Article", PubTime: time.Now().Unix() - 2, Link: server.URL + "/article", Feed: feed},
+		{Title: "Missing", PubTime: time.Now().Unix() - 1, Link: server.URL + "/missing", Feed: feed},
+		{Title: "Unavailable", PubTime: time.Now().Unix(), Link: server.URL + "/unavailable", Feed: feed},
+	}
+	err = db.WriteNews(posts)
+	assert.Nil(t, err)
+
+	p := NewNewsParser(config.RSS{}, db)
+
+	p.fetchFullTexts(context.Background(), config.Feed{URL: feed, FullText: true})
+	assert.Equal(t, 3, requests)
+
+	stored, err := db.GetLastNews(3)
+	assert.Nil(t, err)
+
+	post, err := db.GetNewsByID(stored[2].ID)
+	assert.Nil(t, err)
+	assert.Contains(t, post.FullText, "Goroutines are lightweight threads")
+	assert.NotContains(t, post.FullText, "Copyright")
+	//the feed summary is kept
+	assert.Equal(t, "", post.Content)
+
+	//the 404 is not requested again, the temporary error is retried
+	pending, err := db.PendingFullText(feed, 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(pending)) {
+		assert.Equal(t, "Unavailable", pending[0].Title)
+	}
+
+	p.fetchFullTexts(context.Background(), config.Feed{URL: feed, FullText: true})
+	assert.Equal(t, 4, requests)
+}
+
+//testFeed returns a feed with one item, unique for the path.
+func testFeed(path string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <item>
+      <title>Post %[1]s</title>
+      <description>Content</description>
+      <pubDate>Mon, 18 Apr 2022 10:00:00 GMT</pubDate>
+      <link>https://example.com%[1]s</link>
+      <guid isPermaLink="false">%[1]s</guid>
+    </item>
+  </channel>
+</rss>`, path)
+}
+
+func TestNewsParser_readAllRSS_Pool(t *testing.T) {
+	var active, maxActive int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+				break
+			}
+		}
+
+		if r.URL.Path == "/broken" {
+			http.NotFound(w, r)
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte(testFeed(r.URL.Path)))
+	}))
+	defer server.Close()
+
+	var feeds []config.Feed
+	for i := 0; i < 8; i++ {
+		feeds = append(feeds, config.Feed{URL: fmt.Sprintf("%s/feed/%d", server.URL, i)})
+	}
+	feeds = append(feeds, config.Feed{URL: server.URL + "/broken"})
+
+	db := database.NewMemoryDB()
+	p := NewNewsParser(config.RSS{Feeds: feeds, Workers: 3}, db)
+
+	p.readAllRSS(context.Background())
+
+	//a broken feed does not stop the others
+	amount, err := db.NewsAmount(database.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 8, amount)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&maxActive))
+}
+
+func TestNewsParser_readAllRSS_Cancel(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		//hangs until the client goes away
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	var feeds []config.Feed
+	for i := 0; i < 10; i++ {
+		feeds = append(feeds, config.Feed{URL: fmt.Sprintf("%s/feed/%d", server.URL, i)})
+	}
+
+	p := NewNewsParser(config.RSS{Feeds: feeds, Workers: 2, RequestPeriod: 1}, database.NewMemoryDB())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.Start(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("parser did not stop")
+	}
+
+	//only the feeds taken by the workers were requested
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestNewsParser_OnNewPosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testFeed(r.URL.Path)))
+	}))
+	defer server.Close()
+
+	db := database.NewMemoryDB()
+	p := NewNewsParser(config.RSS{Feeds: []config.Feed{{URL: server.URL + "/feed"}}}, db)
+
+	var notified [][]*database.Post
+	p.OnNewPosts(func(posts []*database.Post) {
+		notified = append(notified, posts)
+	})
+
+	p.readAllRSS(context.Background())
+
+	if assert.Equal(t, 1, len(notified)) && assert.Equal(t, 1, len(notified[0])) {
+		assert.NotZero(t, notified[0][0].ID)
+		assert.Equal(t, "/feed", notified[0][0].GUID)
+	}
+
+	//the handlers are not called when the poll adds nothing
+	p.readAllRSS(context.Background())
+	assert.Equal(t, 1, len(notified))
 }
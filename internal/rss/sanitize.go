@@ -0,0 +1,339 @@
+package rss
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+//allowedTags is the allow-list of elements with their allowed attributes.
+//Elements not in the list are replaced with their content.
+var allowedTags = map[atom.Atom][]string{
+	atom.A:          {"href", "title"},
+	atom.Abbr:       {"title"},
+	atom.B:          nil,
+	atom.Blockquote: {"cite"},
+	atom.Br:         nil,
+	atom.Caption:    nil,
+	atom.Code:       nil,
+	atom.Dd:         nil,
+	atom.Del:        nil,
+	atom.Div:        nil,
+	atom.Dl:         nil,
+	atom.Dt:         nil,
+	atom.Em:         nil,
+	atom.Figcaption: nil,
+	atom.Figure:     nil,
+	atom.H1:         nil,
+	atom.H2:         nil,
+	atom.H3:         nil,
+	atom.H4:         nil,
+	atom.H5:         nil,
+	atom.H6:         nil,
+	atom.Hr:         nil,
+	atom.I:          nil,
+	atom.Img:        {"src", "alt", "title", "width", "height"},
+	atom.Ins:        nil,
+	atom.Li:         nil,
+	atom.Ol:         nil,
+	atom.P:          nil,
+	atom.Pre:        nil,
+	atom.Q:          {"cite"},
+	atom.S:          nil,
+	atom.Small:      nil,
+	atom.Span:       nil,
+	atom.Strong:     nil,
+	atom.Sub:        nil,
+	atom.Sup:        nil,
+	atom.Table:      nil,
+	atom.Tbody:      nil,
+	atom.Td:         {"colspan", "rowspan"},
+	atom.Tfoot:      nil,
+	atom.Th:         {"colspan", "rowspan"},
+	atom.Thead:      nil,
+	atom.Tr:         nil,
+	atom.U:          nil,
+	atom.Ul:         nil,
+}
+
+//droppedTags are removed together with their content.
+var droppedTags = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Form:     true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Math:     true,
+	atom.Head:     true,
+	atom.Title:    true,
+}
+
+//blockTags separate the lines of the plain-text rendition.
+var blockTags = map[atom.Atom]bool{
+	atom.Blockquote: true,
+	atom.Br:         true,
+	atom.Dd:         true,
+	atom.Div:        true,
+	atom.Dt:         true,
+	atom.Figcaption: true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.Hr:         true,
+	atom.Li:         true,
+	atom.P:          true,
+	atom.Pre:        true,
+	atom.Tr:         true,
+}
+
+//urlAttrs hold URLs, they are resolved against the item link and must have a safe scheme.
+var urlAttrs = map[string]bool{
+	"href": true,
+	"src":  true,
+	"cite": true,
+}
+
+//trackerHosts are the hosts of the well-known tracking pixels and feed counters.
+var trackerHosts = []string{
+	"feeds.feedburner.com",
+	"feedproxy.google.com",
+	"pixel.wp.com",
+	"stats.wordpress.com",
+	"www.google-analytics.com",
+	"pixel.quantserve.com",
+	"counter.yadro.ru",
+	"mc.yandex.ru",
+}
+
+//sanitizeHTML cleans the item content with the allow-list policy,
+//resolves relative URLs against base and removes tracking pixels.
+//It returns the safe HTML and its plain-text rendition.
+func sanitizeHTML(content string, base *url.URL) (string, string) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+
+	nodes, err := html.ParseFragment(strings.NewReader(content), body)
+	if err != nil {
+		//the parser reads from memory and never fails, but do not pass through unparsed markup
+		return "", ""
+	}
+
+	for _, node := range nodes {
+		body.AppendChild(node)
+	}
+	sanitizeNode(body, base)
+
+	var safe bytes.Buffer
+	var text strings.Builder
+	for node := body.FirstChild; node != nil; node = node.NextSibling {
+		_ = html.Render(&safe, node)
+		writeText(&text, node)
+	}
+
+	return strings.TrimSpace(safe.String()), collapseText(text.String())
+}
+
+//sanitizeNode cleans the children of the node in place and then the node itself.
+func sanitizeNode(node *html.Node, base *url.URL) {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+
+		switch {
+		case child.Type == html.CommentNode, child.Type == html.DoctypeNode:
+			node.RemoveChild(child)
+
+		case child.Type != html.ElementNode:
+
+		case droppedTags[child.DataAtom], isTrackingPixel(child, base):
+			node.RemoveChild(child)
+
+		default:
+			sanitizeNode(child, base)
+
+			if _, ok := allowedTags[child.DataAtom]; !ok {
+				unwrap(child)
+			}
+		}
+
+		child = next
+	}
+
+	if node.Type == html.ElementNode {
+		node.Attr = sanitizeAttrs(node, base)
+	}
+}
+
+//unwrap replaces the node with its children.
+func unwrap(node *html.Node) {
+	parent := node.Parent
+
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		node.RemoveChild(child)
+		parent.InsertBefore(child, node)
+		child = next
+	}
+
+	parent.RemoveChild(node)
+}
+
+func sanitizeAttrs(node *html.Node, base *url.URL) []html.Attribute {
+	allowed := allowedTags[node.DataAtom]
+
+	var attrs []html.Attribute
+	for _, attr := range node.Attr {
+		if attr.Namespace != "" || !containsString(allowed, attr.Key) {
+			continue
+		}
+
+		if urlAttrs[attr.Key] {
+			u, ok := resolveURL(attr.Val, base)
+			if !ok {
+				continue
+			}
+			attr.Val = u
+		}
+
+		attrs = append(attrs, attr)
+	}
+
+	if node.DataAtom == atom.A {
+		attrs = append(attrs, html.Attribute{Key: "rel", Val: "nofollow noopener noreferrer"})
+	}
+
+	return attrs
+}
+
+//resolveURL returns the absolute URL, only http, https and mailto links are allowed.
+func resolveURL(value string, base *url.URL) (string, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", false
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", false
+	}
+
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return u.String(), true
+	case "":
+		//there is no base to resolve against, a relative link is harmless
+		return u.String(), !strings.HasPrefix(u.String(), "//")
+	default:
+		return "", false
+	}
+}
+
+//isTrackingPixel reports whether the node is an image of at most 1x1 pixels or from a known tracker.
+func isTrackingPixel(node *html.Node, base *url.URL) bool {
+	if node.DataAtom != atom.Img {
+		return false
+	}
+
+	var width, height, src string
+	for _, attr := range node.Attr {
+		switch attr.Key {
+		case "width":
+			width = attr.Val
+		case "height":
+			height = attr.Val
+		case "src":
+			src = attr.Val
+		}
+	}
+
+	if isTinySize(width) && isTinySize(height) {
+		return true
+	}
+
+	u, ok := resolveURL(src, base)
+	if !ok {
+		//the image source is not allowed, so the image is not shown anyway
+		return true
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return true
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	for _, tracker := range trackerHosts {
+		if host == tracker {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isTinySize(value string) bool {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), "px"))
+	return err == nil && n <= 1
+}
+
+//writeText writes the text of the sanitized node, block elements start new lines.
+func writeText(b *strings.Builder, node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		b.WriteString(node.Data)
+		return
+	case html.ElementNode:
+		if node.DataAtom == atom.Img {
+			return
+		}
+	}
+
+	block := blockTags[node.DataAtom]
+	if block {
+		b.WriteString("\n")
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		writeText(b, child)
+	}
+
+	if block {
+		b.WriteString("\n")
+	}
+}
+
+//collapseText collapses the whitespace inside the lines and removes empty lines.
+func collapseText(text string) string {
+	var lines []string
+
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
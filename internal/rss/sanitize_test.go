@@ -0,0 +1,93 @@
+package rss
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	base, err := url.Parse("https://example.com/posts/1")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name    string
+		content string
+		html    string
+		text    string
+	}{
+		{
+			name:    "allowed markup",
+			content: `<p>Hello, <b>world</b>!</p>`,
+			html:    `<p>Hello, <b>world</b>!</p>`,
+			text:    "Hello, world!",
+		},
+		{
+			name:    "plain text",
+			content: `Just text &amp; entities`,
+			html:    `Just text &amp; entities`,
+			text:    "Just text & entities",
+		},
+		{
+			name:    "script and style",
+			content: `<p>Safe</p><script>alert(1)</script><style>p{}</style>`,
+			html:    `<p>Safe</p>`,
+			text:    "Safe",
+		},
+		{
+			name:    "event handlers and styles",
+			content: `<p onclick="alert(1)" style="color:red" class="x">Text</p>`,
+			html:    `<p>Text</p>`,
+			text:    "Text",
+		},
+		{
+			name:    "unknown elements are unwrapped",
+			content: `<section><font color="red">Text</font></section>`,
+			html:    `Text`,
+			text:    "Text",
+		},
+		{
+			name:    "relative links",
+			content: `<a href="../about">About</a> <img src="/images/1.png" alt="Image">`,
+			html:    `<a href="https://example.com/about" rel="nofollow noopener noreferrer">About</a> <img src="https://example.com/images/1.png" alt="Image"/>`,
+			text:    "About",
+		},
+		{
+			name:    "javascript links",
+			content: `<a href="javascript:alert(1)">Click</a>`,
+			html:    `<a rel="nofollow noopener noreferrer">Click</a>`,
+			text:    "Click",
+		},
+		{
+			name:    "tracking pixels",
+			content: `<p>Text<img src="https://example.com/pixel.gif" width="1" height="1"><img src="https://feeds.feedburner.com/~r/example/~4/abc"></p>`,
+			html:    `<p>Text</p>`,
+			text:    "Text",
+		},
+		{
+			name:    "data images",
+			content: `<img src="data:image/png;base64,AAAA">`,
+			html:    ``,
+			text:    "",
+		},
+		{
+			name:    "block elements in text",
+			content: `<h1>Title</h1><ul><li>One</li><li>Two</li></ul>Line<br>break`,
+			html:    `<h1>Title</h1><ul><li>One</li><li>Two</li></ul>Line<br/>break`,
+			text:    "Title\nOne\nTwo\nLine\nbreak",
+		},
+		{
+			name:    "comments",
+			content: `<!-- hidden --><p>Visible</p>`,
+			html:    `<p>Visible</p>`,
+			text:    "Visible",
+		},
+	}
+
+	for _, tt := range tests {
+		html, text := sanitizeHTML(tt.content, base)
+		assert.Equal(t, tt.html, html, tt.name)
+		assert.Equal(t, tt.text, text, tt.name)
+	}
+}
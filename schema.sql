@@ -1,9 +1,289 @@
 CREATE SCHEMA IF NOT EXISTS news;
 
-CREATE TABLE IF NOT EXISTS news.posts (
+-- upgrade of the versions with the flat news.posts table: the table is renamed, its indexes are renamed
+-- to free their names, and its posts are copied to the partitioned table at the end of the file
+DO $$
+DECLARE
+    idx TEXT;
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_class WHERE oid = to_regclass('news.posts') AND relkind = 'r') THEN
+        ALTER TABLE news.posts RENAME TO posts_flat;
+
+        FOR idx IN SELECT indexname FROM pg_indexes WHERE schemaname = 'news' AND tablename = 'posts_flat' LOOP
+            EXECUTE format('ALTER INDEX news.%I RENAME TO %I', idx, idx || '_flat');
+        END LOOP;
+    END IF;
+END $$;
+
+-- ids, guids and links of all posts, keeps guids and links unique across the partitions of news.posts
+CREATE TABLE IF NOT EXISTS news.post_keys (
     id SERIAL PRIMARY KEY,
+    guid TEXT NOT NULL UNIQUE,
+    link TEXT NOT NULL UNIQUE,
+    pubTime BIGINT NOT NULL
+);
+
+-- monthly partitions are created by the application, see Store.CreatePartitions
+CREATE TABLE IF NOT EXISTS news.posts (
+    id INTEGER NOT NULL REFERENCES news.post_keys (id) ON DELETE CASCADE,
     title TEXT NOT NULL,
     content TEXT NOT NULL,
     pubTime BIGINT NOT NULL CHECK (pubTime > 0),
-    link TEXT NOT NULL UNIQUE
-);
\ No newline at end of file
+    link TEXT NOT NULL,
+    feed TEXT NOT NULL DEFAULT '',
+    guid TEXT NOT NULL,
+    author TEXT NOT NULL DEFAULT '',
+    categories JSONB NOT NULL DEFAULT '[]',
+    comments TEXT NOT NULL DEFAULT '',
+    enclosureUrl TEXT NOT NULL DEFAULT '',
+    enclosureType TEXT NOT NULL DEFAULT '',
+    enclosureLength BIGINT NOT NULL DEFAULT 0,
+    fetchedAt BIGINT NOT NULL DEFAULT 0,
+    plainText TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (id, pubTime)
+) PARTITION BY RANGE (pubTime);
+
+-- posts outside of the created partitions, e.g. published before the first start
+CREATE TABLE IF NOT EXISTS news.posts_default PARTITION OF news.posts DEFAULT;
+
+CREATE INDEX IF NOT EXISTS posts_pubTime_idx ON news.posts (pubTime DESC, id DESC);
+CREATE INDEX IF NOT EXISTS posts_feed_pubTime_idx ON news.posts (feed, pubTime DESC);
+
+CREATE TABLE IF NOT EXISTS news.tags (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+-- source is "feed" for the feed categories and "user" for the tags added through the API
+CREATE TABLE IF NOT EXISTS news.post_tags (
+    post_id INTEGER NOT NULL REFERENCES news.post_keys (id) ON DELETE CASCADE,
+    tag_id INTEGER NOT NULL REFERENCES news.tags (id) ON DELETE CASCADE,
+    source TEXT NOT NULL,
+    PRIMARY KEY (post_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS post_tags_tag_id_idx ON news.post_tags (tag_id);
+
+-- media attachments of the posts in the order of the feed
+CREATE TABLE IF NOT EXISTS news.media (
+    post_id INTEGER NOT NULL REFERENCES news.post_keys (id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    type TEXT NOT NULL DEFAULT '',
+    medium TEXT NOT NULL DEFAULT '',
+    source TEXT NOT NULL,
+    length BIGINT NOT NULL DEFAULT 0,
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (post_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS media_medium_idx ON news.media (medium);
+CREATE INDEX IF NOT EXISTS media_type_idx ON news.media (type);
+
+-- full texts of the articles of the feeds with the full_text option, kept apart from the feed summary
+CREATE TABLE IF NOT EXISTS news.full_texts (
+    post_id INTEGER PRIMARY KEY REFERENCES news.post_keys (id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    plainText TEXT NOT NULL,
+    fetchedAt BIGINT NOT NULL,
+    error TEXT NOT NULL DEFAULT ''
+);
+
+-- channel metadata of the polled feeds and the cached favicon of their sites
+CREATE TABLE IF NOT EXISTS news.feeds (
+    id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL UNIQUE,
+    title TEXT NOT NULL DEFAULT '',
+    link TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    language TEXT NOT NULL DEFAULT '',
+    image TEXT NOT NULL DEFAULT '',
+    lastBuildDate BIGINT NOT NULL DEFAULT 0,
+    fetchedAt BIGINT NOT NULL DEFAULT 0,
+    iconFetchedAt BIGINT NOT NULL DEFAULT 0,
+    iconType TEXT NOT NULL DEFAULT '',
+    icon BYTEA
+);
+
+-- API users, passwordHash is a bcrypt hash, the first registered user is an admin
+CREATE TABLE IF NOT EXISTS news.users (
+    id SERIAL PRIMARY KEY,
+    login TEXT NOT NULL UNIQUE,
+    passwordHash TEXT NOT NULL,
+    admin BOOLEAN NOT NULL DEFAULT false,
+    createdAt BIGINT NOT NULL
+);
+
+-- login sessions, only the sha256 of the token is stored
+CREATE TABLE IF NOT EXISTS news.sessions (
+    tokenHash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES news.users (id) ON DELETE CASCADE,
+    createdAt BIGINT NOT NULL,
+    expiresAt BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_expiresAt_idx ON news.sessions (expiresAt);
+
+-- feeds the user reads in GET /me/news, the posts themselves are shared
+CREATE TABLE IF NOT EXISTS news.subscriptions (
+    user_id INTEGER NOT NULL REFERENCES news.users (id) ON DELETE CASCADE,
+    feed_id INTEGER NOT NULL REFERENCES news.feeds (id) ON DELETE CASCADE,
+    createdAt BIGINT NOT NULL,
+    PRIMARY KEY (user_id, feed_id)
+);
+
+-- read state set for single posts, it overrides the read_marks
+CREATE TABLE IF NOT EXISTS news.post_reads (
+    user_id INTEGER NOT NULL REFERENCES news.users (id) ON DELETE CASCADE,
+    post_id INTEGER NOT NULL REFERENCES news.post_keys (id) ON DELETE CASCADE,
+    isRead BOOLEAN NOT NULL,
+    readAt BIGINT NOT NULL,
+    PRIMARY KEY (user_id, post_id)
+);
+
+CREATE INDEX IF NOT EXISTS post_reads_post_id_idx ON news.post_reads (post_id);
+
+-- "read up to" marks: posts of the feed published up to readBefore are read, feed '' means all feeds
+CREATE TABLE IF NOT EXISTS news.read_marks (
+    user_id INTEGER NOT NULL REFERENCES news.users (id) ON DELETE CASCADE,
+    feed TEXT NOT NULL,
+    readBefore BIGINT NOT NULL,
+    PRIMARY KEY (user_id, feed)
+);
+
+-- posts starred by the users, the retention policy never prunes them
+CREATE TABLE IF NOT EXISTS news.saved_posts (
+    user_id INTEGER NOT NULL REFERENCES news.users (id) ON DELETE CASCADE,
+    post_id INTEGER NOT NULL REFERENCES news.post_keys (id) ON DELETE CASCADE,
+    note TEXT NOT NULL DEFAULT '',
+    savedAt BIGINT NOT NULL,
+    PRIMARY KEY (user_id, post_id)
+);
+
+CREATE INDEX IF NOT EXISTS saved_posts_post_id_idx ON news.saved_posts (post_id);
+
+-- alert rules of the users, the new posts matching the keywords or the regex are sent to the webhook
+CREATE TABLE IF NOT EXISTS news.alert_rules (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES news.users (id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    keywords JSONB NOT NULL DEFAULT '[]',
+    regex TEXT NOT NULL DEFAULT '',
+    feeds JSONB NOT NULL DEFAULT '[]',
+    webhookUrl TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    createdAt BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS alert_rules_user_id_idx ON news.alert_rules (user_id);
+
+-- webhook requests of the alert rules: the queue of the pending ones and the delivery log
+CREATE TABLE IF NOT EXISTS news.alert_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    rule_id INTEGER NOT NULL REFERENCES news.alert_rules (id) ON DELETE CASCADE,
+    post_id INTEGER NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    responseCode INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    createdAt BIGINT NOT NULL,
+    updatedAt BIGINT NOT NULL,
+    nextAttemptAt BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS alert_deliveries_rule_id_idx ON news.alert_deliveries (rule_id, id);
+CREATE INDEX IF NOT EXISTS alert_deliveries_status_idx ON news.alert_deliveries (status, nextAttemptAt);
+
+-- robots.txt, Retry-After and the time of the last request of every host the fetcher has visited
+CREATE TABLE IF NOT EXISTS news.host_policies (
+    host TEXT PRIMARY KEY,
+    robots TEXT NOT NULL DEFAULT '',
+    robotsStatus INTEGER NOT NULL DEFAULT 0,
+    robotsFetchedAt BIGINT NOT NULL DEFAULT 0,
+    retryAfter BIGINT NOT NULL DEFAULT 0,
+    lastRequestAt BIGINT NOT NULL DEFAULT 0
+);
+
+-- posts removed by the retention policy, data holds the gzipped post or NULL if it was deleted
+CREATE TABLE IF NOT EXISTS news.posts_archive (
+    guid TEXT PRIMARY KEY,
+    link TEXT NOT NULL,
+    feed TEXT NOT NULL,
+    pubTime BIGINT NOT NULL,
+    prunedAt BIGINT NOT NULL,
+    data BYTEA
+);
+
+-- upgrade of the earlier versions: the columns added since are added to the existing tables
+DO $$
+BEGIN
+    -- post_keys kept the links before the guids, the posts without a guid use the link as their guid
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'news' AND table_name = 'post_keys' AND column_name = 'guid') THEN
+        ALTER TABLE news.post_keys RENAME COLUMN link TO guid;
+    END IF;
+
+    -- the versions that kept only the guids could store the same link more than once, the first post is kept
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'news' AND table_name = 'post_keys' AND column_name = 'link') THEN
+        ALTER TABLE news.post_keys ADD COLUMN link TEXT;
+        UPDATE news.post_keys k SET link = p.link FROM news.posts p WHERE p.id = k.id;
+        DELETE FROM news.post_keys k
+        WHERE k.link IS NULL OR EXISTS (SELECT 1 FROM news.post_keys d WHERE d.link = k.link AND d.id < k.id);
+        ALTER TABLE news.post_keys ALTER COLUMN link SET NOT NULL;
+        ALTER TABLE news.post_keys ADD CONSTRAINT post_keys_link_key UNIQUE (link);
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'news' AND table_name = 'posts' AND column_name = 'guid') THEN
+        ALTER TABLE news.posts ADD COLUMN guid TEXT;
+        UPDATE news.posts SET guid = link;
+        ALTER TABLE news.posts ALTER COLUMN guid SET NOT NULL;
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'news' AND table_name = 'posts_archive' AND column_name = 'guid') THEN
+        ALTER TABLE news.posts_archive ADD COLUMN guid TEXT;
+        UPDATE news.posts_archive SET guid = link;
+        ALTER TABLE news.posts_archive ALTER COLUMN guid SET NOT NULL;
+        CREATE UNIQUE INDEX posts_archive_guid_idx ON news.posts_archive (guid);
+    END IF;
+END $$;
+
+ALTER TABLE news.posts ADD COLUMN IF NOT EXISTS author TEXT NOT NULL DEFAULT '';
+ALTER TABLE news.posts ADD COLUMN IF NOT EXISTS categories JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE news.posts ADD COLUMN IF NOT EXISTS comments TEXT NOT NULL DEFAULT '';
+ALTER TABLE news.posts ADD COLUMN IF NOT EXISTS enclosureUrl TEXT NOT NULL DEFAULT '';
+ALTER TABLE news.posts ADD COLUMN IF NOT EXISTS enclosureType TEXT NOT NULL DEFAULT '';
+ALTER TABLE news.posts ADD COLUMN IF NOT EXISTS enclosureLength BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE news.posts ADD COLUMN IF NOT EXISTS fetchedAt BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE news.posts ADD COLUMN IF NOT EXISTS plainText TEXT NOT NULL DEFAULT '';
+
+-- the posts of the flat table keep their ids, the link is their guid, the plain text is the content
+-- without the tags; they go to news.posts_default until the application creates their partitions,
+-- Store.CreatePartitions does it for every month found there
+DO $$
+DECLARE
+    feed TEXT := quote_literal('');
+BEGIN
+    IF to_regclass('news.posts_flat') IS NOT NULL THEN
+        IF EXISTS (SELECT 1 FROM information_schema.columns
+            WHERE table_schema = 'news' AND table_name = 'posts_flat' AND column_name = 'feed') THEN
+            feed := 'feed';
+        END IF;
+
+        INSERT INTO news.post_keys (id, guid, link, pubTime)
+        SELECT id, link, link, pubTime FROM news.posts_flat;
+
+        EXECUTE format('
+            INSERT INTO news.posts (id, title, content, pubTime, link, feed, guid, plainText)
+            SELECT id, title, content, pubTime, link, %s, link, btrim(regexp_replace(content, %L, %L, %L))
+            FROM news.posts_flat', feed, '<[^>]*>', ' ', 'g');
+
+        PERFORM setval(pg_get_serial_sequence('news.post_keys', 'id'), max(id)) FROM news.post_keys;
+
+        DROP TABLE news.posts_flat;
+    END IF;
+END $$;